@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kishaningithub/rdapp/pkg"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+var auditAnchor string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with audit files written via --audit-file",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify FILE...",
+	Short: "Verify that no record of an audit file has been altered, removed or reordered",
+	Long: `Verify that no record of an audit file has been altered, removed or reordered.
+
+Pass the rotated audit files oldest first followed by the audit file. The chain has to start with the first
+record ever written unless --anchor names the record it continues from, e.g. the head printed by a previous
+verification before older files were rotated away.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runAuditVerifyCommand,
+}
+
+func init() {
+	auditVerifyCmd.Flags().StringVar(&auditAnchor, "anchor", "", "sequence:hash of the record the files continue from")
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func runAuditVerifyCommand(cmd *cobra.Command, args []string) error {
+	var anchor rdapp.AuditAnchor
+	var err error
+	if auditAnchor != "" {
+		anchor, err = rdapp.ParseAuditAnchor(auditAnchor)
+		if err != nil {
+			return err
+		}
+	}
+	var readers []io.Reader
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error while opening audit file: %w", err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+	head, count, err := rdapp.VerifyAuditLog(anchor, readers...)
+	if err != nil {
+		return err
+	}
+	expectedHead, found, err := rdapp.ReadAuditHead(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	if found && expectedHead != head {
+		return fmt.Errorf("audit records after %d are missing, the last record written is %d", head.Sequence, expectedHead.Sequence)
+	}
+	_, err = fmt.Fprintf(cmd.OutOrStdout(), "%d records verified, head %s\n", count, head)
+	return err
+}
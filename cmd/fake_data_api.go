@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/kishaningithub/rdapp/fakedataapi"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"time"
+)
+
+var fakeDataApiListenAddress string
+var fakeDataApiFixtures string
+var fakeDataApiPageSize int
+var fakeDataApiLatency time.Duration
+
+var fakeDataApiCmd = &cobra.Command{
+	Use:   "fake-data-api",
+	Short: "Serve a fake redshift data api answering statements from a fixture file, for use with --data-api-endpoint",
+	Args:  cobra.NoArgs,
+	RunE:  runFakeDataApiCommand,
+}
+
+func init() {
+	fakeDataApiCmd.Flags().StringVar(&fakeDataApiListenAddress, "listen", ":25480", "address the fake data api is served on")
+	fakeDataApiCmd.Flags().StringVar(&fakeDataApiFixtures, "fixtures", "", "yaml file with the fixtures answering statements")
+	fakeDataApiCmd.Flags().IntVar(&fakeDataApiPageSize, "page-size", 0, "records per page of a result, 0 returns results in a single page")
+	fakeDataApiCmd.Flags().DurationVar(&fakeDataApiLatency, "latency", 0, "time every data api call takes")
+	_ = fakeDataApiCmd.MarkFlagRequired("fixtures")
+	rootCmd.AddCommand(fakeDataApiCmd)
+}
+
+func runFakeDataApiCommand(_ *cobra.Command, _ []string) error {
+	logger := constructLogger()
+	defer func() {
+		_ = logger.Sync()
+	}()
+	fixtures, err := fakedataapi.LoadFixtures(fakeDataApiFixtures)
+	if err != nil {
+		return err
+	}
+	engine, err := fakedataapi.NewFixtureEngine(fixtures)
+	if err != nil {
+		return err
+	}
+	logger.Info("serving fake redshift data api", zap.String("listenAddress", fakeDataApiListenAddress))
+	err = http.ListenAndServe(fakeDataApiListenAddress, fakedataapi.NewServer(engine, fakeDataApiPageSize, fakeDataApiLatency, logger))
+	if err != nil {
+		return fmt.Errorf("error while serving fake data api: %w", err)
+	}
+	return nil
+}
+
+// withReplay serves the fixtures of the replay file on a loopback address and points the data api at it
+func withReplay(cfg aws.Config, logger *zap.Logger) (aws.Config, error) {
+	fixtures, err := fakedataapi.LoadFixtures(replayFile)
+	if err != nil {
+		return cfg, err
+	}
+	engine, err := fakedataapi.NewFixtureEngine(fixtures)
+	if err != nil {
+		return cfg, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return cfg, fmt.Errorf("error while serving replay file: %w", err)
+	}
+	go func() {
+		_ = http.Serve(listener, fakedataapi.NewServer(engine, 0, 0, logger))
+	}()
+	logger.Info("replaying fixtures", zap.String("replayFile", replayFile), zap.Int("noOfFixtures", len(fixtures)))
+	dataApiEndpoint = "http://" + listener.Addr().String()
+	cfg.Credentials = aws.AnonymousCredentials{}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return withDataApiEndpoint(cfg), nil
+}
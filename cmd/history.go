@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/kishaningithub/rdapp/pkg"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var historyStatus string
+var historyTarget string
+var historySince string
+var historyUntil string
+var historyContains string
+var historyLimit int
+var historyPrint string
+var historyRerun string
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Search, print or re-run statements previously run via rdapp",
+	Args:  cobra.NoArgs,
+	RunE:  runHistoryCommand,
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historyStatus, "status", "", "only statements with this status, success or error")
+	historyCmd.Flags().StringVar(&historyTarget, "target", "", "only statements whose target contains this, e.g. workgroup/rdapp")
+	historyCmd.Flags().StringVar(&historySince, "since", "", "only statements since this time, either RFC3339, a date or a duration like 24h")
+	historyCmd.Flags().StringVar(&historyUntil, "until", "", "only statements until this time, either RFC3339, a date or a duration like 1h")
+	historyCmd.Flags().StringVar(&historyContains, "search", "", "only statements containing this text")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 50, "number of latest statements to list, 0 lists all")
+	historyCmd.Flags().StringVar(&historyPrint, "print", "", "print the statement with this id")
+	historyCmd.Flags().StringVar(&historyRerun, "rerun", "", "run the statement with this id again against its target")
+	rootCmd.AddCommand(historyCmd)
+}
+
+func runHistoryCommand(cmd *cobra.Command, _ []string) error {
+	if historyFile == "" {
+		return fmt.Errorf("history is disabled, pass --history-file")
+	}
+	historyStore := rdapp.NewJsonlHistoryStore(historyFile)
+	switch {
+	case historyPrint != "":
+		entry, err := historyStore.Get(historyPrint)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), entry.Statement)
+		return err
+	case historyRerun != "":
+		entry, err := historyStore.Get(historyRerun)
+		if err != nil {
+			return err
+		}
+		return rerunHistoryEntry(cmd.Context(), entry, cmd)
+	}
+	filter := rdapp.HistoryFilter{
+		Status:   historyStatus,
+		Target:   historyTarget,
+		Contains: historyContains,
+		Limit:    historyLimit,
+	}
+	var err error
+	filter.Since, err = parseHistoryTime(historySince)
+	if err != nil {
+		return err
+	}
+	filter.Until, err = parseHistoryTime(historyUntil)
+	if err != nil {
+		return err
+	}
+	entries, err := historyStore.Search(filter)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "ID\tTIME\tSTATUS\tDURATION\tROWS\tTARGET\tUSER\tSTATEMENT")
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			entry.ShortId(),
+			entry.Time.Local().Format(time.RFC3339),
+			entry.Status,
+			entry.Duration.Round(time.Millisecond),
+			entry.Rows,
+			entry.Target,
+			entry.User,
+			abbreviateStatement(entry.Statement, 80))
+	}
+	return writer.Flush()
+}
+
+// parseHistoryTime parses RFC3339 timestamps, dates and durations relative to now
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339, a date or a duration", value)
+	}
+	return parsed, nil
+}
+
+func abbreviateStatement(statement string, length int) string {
+	statement = strings.Join(strings.Fields(statement), " ")
+	if len(statement) > length {
+		return statement[:length-3] + "..."
+	}
+	return statement
+}
+
+func rerunHistoryEntry(ctx context.Context, entry rdapp.HistoryEntry, cmd *cobra.Command) error {
+	logger := constructLogger()
+	defer func() {
+		_ = logger.Sync()
+	}()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("error while loading aws config: %w", err)
+	}
+	cfg = withDataApiEndpoint(cfg)
+	redshiftDataAPIService := rdapp.NewRedshiftDataAPIService(redshiftdata.NewFromConfig(cfg), entry.Target.RedshiftDataAPIConfig(), rdapp.NewMetrics())
+	// entries recorded before the data api query was kept are translated again
+	query := entry.Query
+	if query == "" {
+		query = rdapp.NewPgRedshiftTranslator().TranslateToRedshiftQuery(entry.Statement, nil)
+	}
+	rdappCtx := rdapp.NewRdappContext(ctx, logger).WithForwardedStatements(entry.SessionStatements)
+	result, err := redshiftDataAPIService.ExecuteQuery(rdappCtx, query, entry.SqlParameters())
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	if result.HasResultSet {
+		var names []string
+		for _, column := range result.ColumnMetadata {
+			names = append(names, aws.ToString(column.Name))
+		}
+		_, _ = fmt.Fprintln(writer, strings.Join(names, "\t"))
+		for _, record := range result.Records {
+			var values []string
+			for _, field := range record {
+				values = append(values, formatField(field))
+			}
+			_, _ = fmt.Fprintln(writer, strings.Join(values, "\t"))
+		}
+	}
+	_, _ = fmt.Fprintf(writer, "(%d rows)\n", result.ResultRows)
+	return writer.Flush()
+}
+
+func formatField(field types.Field) string {
+	switch value := field.(type) {
+	case *types.FieldMemberIsNull:
+		return "NULL"
+	case *types.FieldMemberBlobValue:
+		return fmt.Sprintf("\\x%x", value.Value)
+	case *types.FieldMemberBooleanValue:
+		return strconv.FormatBool(value.Value)
+	case *types.FieldMemberDoubleValue:
+		return strconv.FormatFloat(value.Value, 'g', -1, 64)
+	case *types.FieldMemberLongValue:
+		return strconv.FormatInt(value.Value, 10)
+	case *types.FieldMemberStringValue:
+		return value.Value
+	}
+	return fmt.Sprintf("%v", field)
+}
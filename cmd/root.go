@@ -3,26 +3,85 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/redshift"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftserverless"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/kishaningithub/rdapp/pkg"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var Version string
 
 var listenAddress string
+var unixSocket string
+var unixSocketMode string
 var dbUser string
 var clusterIdentifier string
 var database string
 var secretArn string
 var workgroupName string
 var verboseLogging bool
+var metricsListenAddress string
+var traceExporter string
+var otlpEndpoint string
+var historyFile string
+var dataApiEndpoint string
+var auditFile string
+var auditMaxSizeMegabytes int
+var auditMaxBackups int
+var auditWebhook string
+var auditRedactParameters bool
+var readOnly bool
+var readOnlyUsers []string
+var readWriteUsers []string
+var readOnlyTargets []string
+var passwordsFile string
+var tlsCertFile string
+var tlsKeyFile string
+var policyFile string
+var maxRows int64
+var maxRowsUsers map[string]int64
+var injectLimit bool
+var maskingFile string
+var resultCacheTtl time.Duration
+var resultCacheMaxMegabytes int64
+var resultCacheDirectory string
+var resultCacheMaxDiskMegabytes int64
+var maxConcurrentStatements int
+var maxConcurrentStatementsPerUser int
+var maxConcurrentStatementsUsers map[string]int
+var queueTimeout time.Duration
+var activeStatementsRetryTimeout time.Duration
+var postgresUrl string
+var recordFile string
+var recordScrub string
+var replayFile string
+var shutdownTimeout time.Duration
+var adminListenAddress string
+var adminToken string
+var listenersFile string
+
+// singleListenerFlags configure the listener of rdapp without a listeners file, the listeners of a listeners
+// file have their own settings
+var singleListenerFlags = []string{"listen", "unix-socket", "unix-socket-mode", "cluster-identifier", "database", "db-user",
+	"secret-arn", "workgroup-name", "read-only", "read-only-users", "read-write-users", "read-only-targets", "passwords-file",
+	"tls-cert-file", "tls-key-file"}
 
 var rootCmd = &cobra.Command{
 	Use:     "rdapp",
@@ -34,19 +93,76 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.Flags().StringVar(&listenAddress, "listen", ":25432", "")
+	rootCmd.Flags().StringVar(&unixSocket, "unix-socket", "", "also listen on this unix socket, or on .s.PGSQL.<port> in this directory like /tmp")
+	rootCmd.Flags().StringVar(&unixSocketMode, "unix-socket-mode", "0700", "octal file mode of the unix socket")
+	rootCmd.Flags().StringVar(&listenersFile, "listeners-file", "", "yaml file with listeners each serving its own target, replaces --listen and the target flags")
 	rootCmd.Flags().StringVar(&clusterIdentifier, "cluster-identifier", "", "")
 	rootCmd.Flags().StringVar(&database, "database", "", "")
 	rootCmd.Flags().StringVar(&dbUser, "db-user", "", "")
 	rootCmd.Flags().StringVar(&secretArn, "secret-arn", "", "")
 	rootCmd.Flags().StringVar(&workgroupName, "workgroup-name", "", "")
 	rootCmd.Flags().BoolVar(&verboseLogging, "verbose", false, "verbose output")
+	rootCmd.Flags().StringVar(&metricsListenAddress, "metrics-listen", "", "serve prometheus metrics on /metrics of this address")
+	rootCmd.Flags().StringVar(&adminListenAddress, "admin-listen", "", "serve health, readiness and admin endpoints on this address")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", os.Getenv("RDAPP_ADMIN_TOKEN"), "bearer token of the admin endpoints other than /healthz and /readyz, required unless --admin-listen is a loopback address, defaults to $RDAPP_ADMIN_TOKEN")
+	rootCmd.Flags().StringVar(&traceExporter, "trace-exporter", "", "export opentelemetry traces to stdout or otlp")
+	rootCmd.PersistentFlags().StringVar(&historyFile, "history-file", "", "file statements are recorded to, e.g. ~/.config/rdapp/history.jsonl, statements are not recorded by default")
+	rootCmd.PersistentFlags().StringVar(&dataApiEndpoint, "data-api-endpoint", "", "url of the redshift data api, e.g. of rdapp fake-data-api")
+	rootCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "http://localhost:4318", "otlp/http collector traces are exported to")
+	rootCmd.Flags().StringVar(&auditFile, "audit-file", "", "write a tamper evident audit record per connection and statement to this file")
+	rootCmd.Flags().IntVar(&auditMaxSizeMegabytes, "audit-max-size-mb", 100, "size in megabytes at which the audit file is rotated")
+	rootCmd.Flags().IntVar(&auditMaxBackups, "audit-max-backups", 10, "number of rotated audit files to keep, 0 keeps all")
+	rootCmd.Flags().StringVar(&auditWebhook, "audit-webhook", "", "post every audit record as json to this url")
+	rootCmd.Flags().BoolVar(&auditRedactParameters, "audit-redact-parameters", false, "leave query parameter values out of audit records")
+	rootCmd.Flags().BoolVar(&readOnly, "read-only", false, "reject statements which modify data or schema")
+	rootCmd.Flags().StringSliceVar(&readOnlyUsers, "read-only-users", nil, "postgres users who are read only even without --read-only")
+	rootCmd.Flags().StringSliceVar(&readWriteUsers, "read-write-users", nil, "postgres users who may modify data despite --read-only")
+	rootCmd.Flags().StringSliceVar(&readOnlyTargets, "read-only-targets", nil, "targets which are read only even without --read-only, glob patterns like workgroup/prod/*")
+	rootCmd.Flags().StringVar(&passwordsFile, "passwords-file", "", "yaml file mapping the postgres users who may connect to their passwords, needed by --read-only-users and --read-write-users")
+	rootCmd.Flags().StringVar(&tlsCertFile, "tls-cert-file", "", "pem encoded certificate served to clients connecting via tls, needed by --passwords-file unless only --unix-socket is served")
+	rootCmd.Flags().StringVar(&tlsKeyFile, "tls-key-file", "", "pem encoded private key of --tls-cert-file")
+	rootCmd.Flags().StringVar(&policyFile, "policy-file", "", "yaml file with rules allowing or denying statements")
+	rootCmd.Flags().Int64Var(&maxRows, "max-rows", 0, "stop fetching results after this many rows, 0 does not cap")
+	rootCmd.Flags().StringToInt64Var(&maxRowsUsers, "max-rows-users", nil, "max rows per postgres user like analyst=1000,etl=0")
+	rootCmd.Flags().BoolVar(&injectLimit, "inject-limit", false, "add a LIMIT to top level selects without one when rows are capped")
+	rootCmd.Flags().StringVar(&maskingFile, "masking-file", "", "yaml file with rules masking sensitive columns in results")
+	rootCmd.Flags().DurationVar(&resultCacheTtl, "result-cache-ttl", 0, "serve repeated read only queries from a cache for this long, 0 disables the cache")
+	rootCmd.Flags().Int64Var(&resultCacheMaxMegabytes, "result-cache-max-mb", 64, "megabytes of memory the result cache may use")
+	rootCmd.Flags().StringVar(&resultCacheDirectory, "result-cache-dir", "", "directory the result cache also keeps results in")
+	rootCmd.Flags().Int64Var(&resultCacheMaxDiskMegabytes, "result-cache-max-disk-mb", 1024, "megabytes the result cache may use in --result-cache-dir")
+	rootCmd.Flags().IntVar(&maxConcurrentStatements, "max-concurrent-statements", 0, "statements of all users running at once, further ones are queued, 0 does not cap")
+	rootCmd.Flags().IntVar(&maxConcurrentStatementsPerUser, "max-concurrent-statements-per-user", 0, "statements of a postgres user running at once, further ones are queued, 0 does not cap")
+	rootCmd.Flags().StringToIntVar(&maxConcurrentStatementsUsers, "max-concurrent-statements-users", nil, "concurrent statements per postgres user like etl=8,analyst=2")
+	rootCmd.Flags().DurationVar(&queueTimeout, "queue-timeout", time.Minute, "how long statements are queued until concurrent statements finish, 0 waits forever")
+	rootCmd.Flags().DurationVar(&activeStatementsRetryTimeout, "active-statements-retry-timeout", time.Minute, "how long statements are retried while the data api has too many active statements, 0 retries forever")
+	rootCmd.Flags().StringVar(&recordFile, "record-file", "", "record the statements run via the data api and their results as fixtures to this file")
+	rootCmd.Flags().StringVar(&recordScrub, "record-scrub", string(rdapp.RecordScrubSecrets), "what is scrubbed from recordings, one of none, secrets or values")
+	rootCmd.Flags().StringVar(&replayFile, "replay-file", "", "answer statements from the fixtures of this file, e.g. one recorded with --record-file")
+	rootCmd.Flags().StringVar(&postgresUrl, "postgres-url", "", "run statements against this postgres instead of redshift, for local development")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "how long running statements may finish on SIGINT or SIGTERM before they are cancelled")
 }
 
 func main() {
-	_ = rootCmd.Execute()
+	err := rootCmd.Execute()
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
-func runRootCommand(_ *cobra.Command, _ []string) error {
+func runRootCommand(command *cobra.Command, _ []string) error {
+	if listenersFile != "" {
+		for _, name := range singleListenerFlags {
+			if command.Flags().Changed(name) {
+				return fmt.Errorf("--%s cannot be combined with --listeners-file, configure it per listener in the listeners file", name)
+			}
+		}
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return fmt.Errorf("--tls-cert-file and --tls-key-file are needed together")
+	}
+	if passwordsFile != "" && listenAddress != "" && tlsCertFile == "" {
+		return fmt.Errorf("--passwords-file needs --tls-cert-file and --tls-key-file, clients would send their passwords in clear text otherwise")
+	}
 	logger := constructLogger()
 	defer func(logger *zap.Logger) {
 		_ = logger.Sync()
@@ -56,6 +172,13 @@ func runRootCommand(_ *cobra.Command, _ []string) error {
 	if err != nil {
 		return fmt.Errorf("error while loading aws config: %w", err)
 	}
+	cfg = withDataApiEndpoint(cfg)
+	if replayFile != "" {
+		cfg, err = withReplay(cfg, logger)
+		if err != nil {
+			return err
+		}
+	}
 	redshiftDataApiConfig := rdapp.RedshiftDataAPIConfig{
 		Database:          getFlagValue(database),
 		ClusterIdentifier: getFlagValue(clusterIdentifier),
@@ -63,7 +186,23 @@ func runRootCommand(_ *cobra.Command, _ []string) error {
 		SecretArn:         getFlagValue(secretArn),
 		WorkgroupName:     getFlagValue(workgroupName),
 	}
-	if redshiftDataApiConfig.Database == nil {
+	if replayFile != "" && redshiftDataApiConfig.Database == nil {
+		redshiftDataApiConfig.Database = aws.String("dev")
+	}
+	if replayFile != "" && redshiftDataApiConfig.ClusterIdentifier == nil && redshiftDataApiConfig.WorkgroupName == nil {
+		redshiftDataApiConfig.WorkgroupName = aws.String("replay")
+	}
+	var postgresConfig *pgx.ConnConfig
+	if postgresUrl != "" {
+		postgresConfig, err = pgx.ParseConfig(postgresUrl)
+		if err != nil {
+			return fmt.Errorf("error while parsing postgres url: %w", err)
+		}
+		if redshiftDataApiConfig.Database == nil {
+			redshiftDataApiConfig.Database = aws.String(postgresConfig.Database)
+		}
+	}
+	if listenersFile == "" && redshiftDataApiConfig.Database == nil {
 		fmt.Println("Loading interactive config setup view...")
 		redshiftClient := redshift.NewFromConfig(cfg)
 		redshiftServerlessClient := redshiftserverless.NewFromConfig(cfg)
@@ -77,14 +216,286 @@ func runRootCommand(_ *cobra.Command, _ []string) error {
 		}
 		logger.Info("using config", zap.Any("config", redshiftDataApiConfig))
 	}
-	proxy := rdapp.ConstructProxy(cfg, redshiftDataApiConfig, logger, listenAddress)
-	err = proxy.Run()
+	if traceExporter != "" {
+		tracerProvider, err := rdapp.NewTracerProvider(traceExporter, otlpEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tracerProvider.Shutdown(rootContext)
+		}()
+		otel.SetTracerProvider(tracerProvider)
+	}
+	metrics := rdapp.NewMetrics()
+	if metricsListenAddress != "" {
+		metricsListener, err := net.Listen("tcp", metricsListenAddress)
+		if err != nil {
+			return fmt.Errorf("error while listening for metrics on %s: %w", metricsListenAddress, err)
+		}
+		metricsServer := rdapp.NewMetricsServer(metricsListenAddress, metrics, logger)
+		go func() {
+			// serving errors are logged by the metrics server
+			_ = metricsServer.Serve(metricsListener)
+		}()
+	}
+	var recorder *rdapp.Recorder
+	if recordFile != "" {
+		recorder, err = rdapp.NewRecorder(recordFile, rdapp.RecordScrub(recordScrub), logger)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := recorder.Close()
+			if err != nil {
+				logger.Error("error while recording data api interactions", zap.Error(err))
+			}
+		}()
+	}
+	redshiftDataApiClient := redshiftdata.NewFromConfig(cfg)
+	proxyOptions := []rdapp.ProxyOption{
+		rdapp.WithDataAPIClient(redshiftDataApiClient),
+		rdapp.WithRecorder(recorder),
+		rdapp.WithMetrics(metrics),
+	}
+	readinessCheck := rdapp.NewDataApiReadinessCheck(cfg.Credentials, redshiftDataApiClient, redshiftDataApiConfig)
+	if postgresConfig != nil {
+		db := stdlib.OpenDB(*postgresConfig)
+		defer func() {
+			_ = db.Close()
+		}()
+		logger.Info("running statements against postgres", zap.String("host", postgresConfig.Host), zap.String("database", postgresConfig.Database))
+		proxyOptions = append(proxyOptions, rdapp.WithDataAPIService(rdapp.NewPostgresRedshiftDataAPIService(db, metrics, logger)))
+		readinessCheck = db.PingContext
+	}
+	var historyStore rdapp.HistoryStore
+	if historyFile != "" {
+		historyStore = rdapp.NewJsonlHistoryStore(historyFile)
+	}
+	auditLog, err := constructAuditLog(rootContext, sts.NewFromConfig(cfg), redshiftDataApiConfig, logger)
 	if err != nil {
-		return fmt.Errorf("error while creating postgres redshift proxy: %w", err)
+		return err
+	}
+	if auditLog != nil {
+		defer func() {
+			_ = auditLog.Close()
+		}()
+	}
+	var policy *rdapp.Policy
+	if policyFile != "" {
+		policy, err = rdapp.LoadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+	}
+	var masking *rdapp.Masking
+	if maskingFile != "" {
+		masking, err = rdapp.LoadMasking(maskingFile)
+		if err != nil {
+			return err
+		}
+	}
+	var resultCache rdapp.ResultCache
+	if resultCacheTtl > 0 {
+		resultCache, err = rdapp.NewResultCache(resultCacheTtl, resultCacheMaxMegabytes<<20, resultCacheDirectory, resultCacheMaxDiskMegabytes<<20, metrics, logger)
+		if err != nil {
+			return err
+		}
+	}
+	proxyOptions = append(proxyOptions,
+		rdapp.WithHistoryStore(historyStore),
+		rdapp.WithPolicy(policy),
+		rdapp.WithRowLimitPolicy(rdapp.RowLimitPolicy{MaxRows: maxRows, Users: maxRowsUsers, InjectLimit: injectLimit}),
+		rdapp.WithMasking(masking),
+		rdapp.WithResultCache(resultCache),
+		// the listeners of a listeners file share the limits
+		rdapp.WithConcurrencyLimiter(rdapp.NewConcurrencyLimiter(constructConcurrencyLimits(), metrics)))
+	var proxy rdapp.PostgresRedshiftProxy
+	if listenersFile != "" {
+		var listenersReadinessCheck rdapp.ReadinessCheck
+		proxy, listenersReadinessCheck, err = constructProxyGroup(rootContext, cfg, redshiftDataApiClient, proxyOptions, auditLog, logger)
+		if err != nil {
+			return err
+		}
+		if postgresConfig == nil {
+			readinessCheck = listenersReadinessCheck
+		}
+	} else {
+		proxyOptions = append(proxyOptions,
+			rdapp.WithListenAddress(listenAddress),
+			rdapp.WithRedshiftDataAPIConfig(redshiftDataApiConfig),
+			rdapp.WithAuditLog(auditLog),
+			rdapp.WithReadOnlyPolicy(constructReadOnlyPolicy()),
+			rdapp.WithLogger(logger))
+		if passwordsFile != "" {
+			passwords, err := rdapp.LoadPasswords(passwordsFile)
+			if err != nil {
+				return err
+			}
+			proxyOptions = append(proxyOptions, rdapp.WithAuth(rdapp.PasswordAuthenticator(passwords)))
+		}
+		if tlsCertFile != "" {
+			tlsConfig, err := rdapp.LoadTLSConfig(tlsCertFile, tlsKeyFile)
+			if err != nil {
+				return err
+			}
+			proxyOptions = append(proxyOptions, rdapp.WithTLS(tlsConfig))
+		}
+		if unixSocket != "" {
+			mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+			if err != nil {
+				return fmt.Errorf("error while parsing unix socket mode %s: %w", unixSocketMode, err)
+			}
+			proxyOptions = append(proxyOptions, rdapp.WithUnixSocket(unixSocket, os.FileMode(mode)))
+		}
+		proxy, err = rdapp.NewProxy(proxyOptions...)
+		if err != nil {
+			return fmt.Errorf("error while creating postgres redshift proxy: %w", err)
+		}
+	}
+	if adminListenAddress != "" {
+		adminServer, err := rdapp.NewAdminServer(adminListenAddress, adminToken, proxy, readinessCheck, logger)
+		if err != nil {
+			return err
+		}
+		adminListener, err := net.Listen("tcp", adminListenAddress)
+		if err != nil {
+			return fmt.Errorf("error while listening for admin endpoints on %s: %w", adminListenAddress, err)
+		}
+		go func() {
+			// serving errors are logged by the admin server
+			_ = adminServer.Serve(adminListener)
+		}()
+	}
+	return runUntilSignalled(proxy, logger)
+}
+
+// runUntilSignalled runs the proxy until SIGINT or SIGTERM and then shuts it down, running statements
+// may finish until the shutdown timeout or a second signal
+func runUntilSignalled(proxy rdapp.PostgresRedshiftProxy, logger *zap.Logger) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Run()
+	}()
+	select {
+	case err := <-served:
+		if err != nil {
+			return fmt.Errorf("error while creating postgres redshift proxy: %w", err)
+		}
+		return nil
+	case received := <-signals:
+		logger.Info("received signal, shutting down", zap.Stringer("signal", received), zap.Duration("shutdownTimeout", shutdownTimeout))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			logger.Info("received second signal, cancelling running statements")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := proxy.Shutdown(ctx)
+	<-served
+	if err != nil {
+		logger.Error("error while shutting down", zap.Error(err))
+		return fmt.Errorf("error while shutting down: %w", err)
 	}
 	return nil
 }
 
+// constructProxyGroup constructs a proxy per listener of the listeners file. They share the data api client,
+// history, caches and limits of the shared options and the hash chain of the audit log.
+func constructProxyGroup(ctx context.Context, cfg aws.Config, redshiftDataApiClient *redshiftdata.Client, sharedOptions []rdapp.ProxyOption, auditLog rdapp.AuditLog, logger *zap.Logger) (rdapp.PostgresRedshiftProxy, rdapp.ReadinessCheck, error) {
+	listenerConfigs, err := rdapp.LoadListenerConfigs(listenersFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the listeners hand out the backend pids of their connections from one counter
+	backendPids := rdapp.NewBackendPids()
+	var proxies []rdapp.PostgresRedshiftProxy
+	var readinessChecks []rdapp.ReadinessCheck
+	for _, listenerConfig := range listenerConfigs {
+		listenerOptions, err := listenerConfig.ProxyOptions()
+		if err != nil {
+			return nil, nil, err
+		}
+		redshiftDataApiConfig := listenerConfig.RedshiftDataAPIConfig()
+		options := append(append([]rdapp.ProxyOption{}, sharedOptions...), listenerOptions...)
+		options = append(options, rdapp.WithBackendPids(backendPids), rdapp.WithLogger(logger.With(zap.String("listener", listenerConfig.Name))))
+		if auditLog != nil {
+			identity, err := rdapp.NewAuditIdentity(ctx, sts.NewFromConfig(cfg), redshiftDataApiConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			target := rdapp.NewHistoryTarget(redshiftDataApiConfig).String()
+			options = append(options, rdapp.WithAuditLog(rdapp.NewListenerAuditLog(auditLog, identity, target)))
+		}
+		proxy, err := rdapp.NewProxy(options...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while creating postgres redshift proxy of listener %s: %w", listenerConfig.Name, err)
+		}
+		if len(listenerConfig.Passwords) == 0 {
+			logger.Warn("listener accepts any user as it has no passwords", zap.String("listener", listenerConfig.Name))
+		}
+		proxies = append(proxies, proxy)
+		readinessChecks = append(readinessChecks, rdapp.NewDataApiReadinessCheck(cfg.Credentials, redshiftDataApiClient, redshiftDataApiConfig))
+		logger.Info("configured listener", zap.String("listener", listenerConfig.Name), zap.String("listenAddress", listenerConfig.Listen),
+			zap.String("unixSocket", listenerConfig.UnixSocket), zap.Any("config", redshiftDataApiConfig))
+	}
+	readinessCheck := func(ctx context.Context) error {
+		for i, readinessCheck := range readinessChecks {
+			err := readinessCheck(ctx)
+			if err != nil {
+				return fmt.Errorf("listener %s is not ready: %w", listenerConfigs[i].Name, err)
+			}
+		}
+		return nil
+	}
+	return rdapp.NewProxyGroup(proxies...), readinessCheck, nil
+}
+
+// constructAuditLog returns nil when neither an audit file nor an audit webhook is configured
+func constructAuditLog(ctx context.Context, stsClient rdapp.StsClient, redshiftDataApiConfig rdapp.RedshiftDataAPIConfig, logger *zap.Logger) (rdapp.AuditLog, error) {
+	var sinks []rdapp.AuditSink
+	if auditFile != "" {
+		sinks = append(sinks, rdapp.NewFileAuditSink(auditFile, auditMaxSizeMegabytes, auditMaxBackups))
+	}
+	if auditWebhook != "" {
+		sinks = append(sinks, rdapp.NewWebhookAuditSink(auditWebhook, logger))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	identity, err := rdapp.NewAuditIdentity(ctx, stsClient, redshiftDataApiConfig)
+	if err != nil {
+		return nil, err
+	}
+	target := rdapp.NewHistoryTarget(redshiftDataApiConfig).String()
+	return rdapp.NewAuditLog(identity, target, auditRedactParameters, logger, sinks...)
+}
+
+func constructReadOnlyPolicy() rdapp.ReadOnlyPolicy {
+	policy := rdapp.ReadOnlyPolicy{
+		Default: readOnly,
+		Targets: map[string]bool{},
+		Users:   map[string]bool{},
+	}
+	for _, target := range readOnlyTargets {
+		policy.Targets[target] = true
+	}
+	for _, user := range readOnlyUsers {
+		policy.Users[user] = true
+	}
+	for _, user := range readWriteUsers {
+		policy.Users[user] = false
+	}
+	return policy
+}
+
 func getFlagValue(value string) *string {
 	if value == "" {
 		return nil
@@ -109,3 +520,27 @@ func logLevel() zapcore.Level {
 	}
 	return zap.InfoLevel
 }
+
+func constructConcurrencyLimits() rdapp.ConcurrencyLimits {
+	return rdapp.ConcurrencyLimits{
+		MaxStatements:        maxConcurrentStatements,
+		MaxStatementsPerUser: maxConcurrentStatementsPerUser,
+		Users:                maxConcurrentStatementsUsers,
+		QueueTimeout:         queueTimeout,
+		RetryTimeout:         activeStatementsRetryTimeout,
+	}
+}
+
+// withDataApiEndpoint points the data api client at --data-api-endpoint, other services keep their endpoints
+func withDataApiEndpoint(cfg aws.Config) aws.Config {
+	if dataApiEndpoint == "" {
+		return cfg
+	}
+	cfg.EndpointResolverWithOptions = aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if service == redshiftdata.ServiceID {
+			return aws.Endpoint{URL: dataApiEndpoint, SigningRegion: region}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+	return cfg
+}
@@ -0,0 +1,434 @@
+package componenttest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/kishaningithub/rdapp/fakedataapi"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const largeResultRows = 10000
+
+// compatibilityConn hides the api differences of the driver paths, values of rows are scanned into any
+type compatibilityConn interface {
+	ping(ctx context.Context) error
+	query(ctx context.Context, sql string, args ...any) ([][]any, error)
+	// queryPrepared prepares the statement explicitly before running it
+	queryPrepared(ctx context.Context, sql string, args ...any) ([][]any, error)
+	close() error
+}
+
+type driverPath struct {
+	name string
+	open func(ctx context.Context, address string) (compatibilityConn, error)
+}
+
+type compatibilityScenario struct {
+	name string
+	// required scenarios fail the suite, the others are only reported
+	required bool
+	run      func(ctx context.Context, conn compatibilityConn) error
+}
+
+var driverPaths = []driverPath{
+	{name: "pgx", open: openPgx},
+	{name: "database/sql pgx", open: openDatabaseSql("pgx")},
+	{name: "database/sql lib/pq", open: openDatabaseSql("postgres")},
+}
+
+var compatibilityScenarios = []compatibilityScenario{
+	{name: "connect", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		return conn.ping(ctx)
+	}},
+	{name: "simple query", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		rows, err := conn.query(ctx, "select id, name, flag from compat_simple")
+		if err != nil {
+			return err
+		}
+		return expectRows(rows, [][]any{{int64(1), "name", true}})
+	}},
+	{name: "prepared query", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		rows, err := conn.queryPrepared(ctx, "select id from compat_person where id > $1", 1)
+		if err != nil {
+			return err
+		}
+		return expectRows(rows, [][]any{{int64(2)}, {int64(3)}})
+	}},
+	{name: "nulls", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		rows, err := conn.query(ctx, "select name, id from compat_nulls")
+		if err != nil {
+			return err
+		}
+		return expectRows(rows, [][]any{{nil, nil}, {"name", nil}})
+	}},
+	{name: "every mapped type", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		rows, err := conn.query(ctx, "select * from compat_types")
+		if err != nil {
+			return err
+		}
+		if len(rows) != 2 {
+			return fmt.Errorf("expected 2 rows, got %d", len(rows))
+		}
+		for i, value := range rows[0] {
+			if value == nil {
+				return fmt.Errorf("value of column %s is null", compatibilityTypeColumns[i].Name)
+			}
+		}
+		for i, value := range rows[1] {
+			if value != nil {
+				return fmt.Errorf("null of column %s is read as %v", compatibilityTypeColumns[i].Name, value)
+			}
+		}
+		return nil
+	}},
+	{name: "errors", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		_, err := conn.query(ctx, "select * from compat_missing")
+		if err == nil || !strings.Contains(err.Error(), `relation "compat_missing" does not exist`) {
+			return fmt.Errorf("expected the error of the statement, got %v", err)
+		}
+		rows, err := conn.query(ctx, "select id, name, flag from compat_simple")
+		if err != nil {
+			return fmt.Errorf("connection is not usable after an error: %w", err)
+		}
+		return expectRows(rows, [][]any{{int64(1), "name", true}})
+	}},
+	{name: "cancellation", required: false, run: func(ctx context.Context, conn compatibilityConn) error {
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		startedAt := time.Now()
+		_, err := conn.query(ctx, "select id from compat_slow")
+		if err == nil {
+			return errors.New("statement completed despite being cancelled")
+		}
+		if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+			return fmt.Errorf("statement returned %s after being cancelled", elapsed)
+		}
+		return nil
+	}},
+	{name: "large result", required: true, run: func(ctx context.Context, conn compatibilityConn) error {
+		rows, err := conn.query(ctx, "select id, name from compat_large")
+		if err != nil {
+			return err
+		}
+		if len(rows) != largeResultRows {
+			return fmt.Errorf("expected %d rows, got %d", largeResultRows, len(rows))
+		}
+		return expectRows(rows[len(rows)-1:], [][]any{{int64(largeResultRows), fmt.Sprintf("name %d", largeResultRows)}})
+	}},
+}
+
+// compatibilityTypeColumns has a column of every redshift type rdapp maps to a postgres type
+var compatibilityTypeColumns = []fakedataapi.FixtureColumn{
+	{Name: "super_value", TypeName: "super"},
+	{Name: "bool_value", TypeName: "bool"},
+	{Name: "char_value", TypeName: "char"},
+	{Name: "varchar_value", TypeName: "varchar"},
+	{Name: "bpchar_value", TypeName: "bpchar"},
+	{Name: "text_value", TypeName: "_text"},
+	{Name: "timestamp_value", TypeName: "timestamp"},
+	{Name: "timestamptz_value", TypeName: "timestamptz"},
+	{Name: "date_value", TypeName: "date"},
+	{Name: "time_value", TypeName: "time"},
+	{Name: "timetz_value", TypeName: "timetz"},
+	{Name: "varbyte_value", TypeName: "varbyte"},
+	{Name: "float4_value", TypeName: "float4"},
+	{Name: "float8_value", TypeName: "float8"},
+	{Name: "int2_value", TypeName: "int2"},
+	{Name: "int4_value", TypeName: "int4"},
+	{Name: "int8_value", TypeName: "int8"},
+	{Name: "numeric_value", TypeName: "numeric", Precision: 10, Scale: 2},
+	{Name: "name_value", TypeName: "name"},
+	{Name: "oid_value", TypeName: "oid"},
+	{Name: "aclitem_value", TypeName: "_aclitem"},
+}
+
+func compatibilityFixtures() []fakedataapi.Fixture {
+	typeValues := []any{`{"a":1}`, true, "c", "varchar", "bpchar    ", "text", "2023-01-02 03:04:05.123456",
+		"2023-01-02 03:04:05.123456+00", "2023-01-02", "03:04:05", "03:04:05+00", "cafe", 1.5, 2.25, 2, 4, 8, "12.50",
+		"name", 26, "rdsdb=arwdRxtDPA/rdsdb"}
+	largeRows := make([][]any, 0, largeResultRows)
+	for id := 1; id <= largeResultRows; id++ {
+		largeRows = append(largeRows, []any{id, fmt.Sprintf("name %d", id)})
+	}
+	return []fakedataapi.Fixture{
+		{
+			Pattern: `from compat_simple`,
+			Columns: []fakedataapi.FixtureColumn{{Name: "id", TypeName: "int4"}, {Name: "name", TypeName: "varchar"}, {Name: "flag", TypeName: "bool"}},
+			Rows:    [][]any{{1, "name", true}},
+		},
+		{
+			Pattern:    `from compat_person where id > :1`,
+			Parameters: map[string]string{"1": "1"},
+			Columns:    []fakedataapi.FixtureColumn{{Name: "id", TypeName: "int4"}},
+			Rows:       [][]any{{2}, {3}},
+		},
+		{
+			Pattern: `from compat_nulls`,
+			Columns: []fakedataapi.FixtureColumn{{Name: "name", TypeName: "varchar"}, {Name: "id", TypeName: "int4"}},
+			Rows:    [][]any{{nil, nil}, {"name", nil}},
+		},
+		{
+			Pattern: `from compat_types`,
+			Columns: compatibilityTypeColumns,
+			Rows:    [][]any{typeValues, make([]any, len(compatibilityTypeColumns))},
+		},
+		{
+			Pattern: `from compat_missing`,
+			Error:   `ERROR: relation "compat_missing" does not exist`,
+		},
+		{
+			Pattern:  `from compat_slow`,
+			Columns:  []fakedataapi.FixtureColumn{{Name: "id", TypeName: "int4"}},
+			Rows:     [][]any{{1}},
+			Duration: 5 * time.Second,
+		},
+		{
+			Pattern: `from compat_large`,
+			Columns: []fakedataapi.FixtureColumn{{Name: "id", TypeName: "int4"}, {Name: "name", TypeName: "varchar"}},
+			Rows:    largeRows,
+		},
+	}
+}
+
+// TestDriverCompatibility runs the scenarios through every driver path against a proxy backed by a
+// fake data api. The report of RDAPP_COMPATIBILITY_REPORT lists the outcome of every scenario and the
+// protocol features the driver used for it.
+func TestDriverCompatibility(t *testing.T) {
+	cfg, redshiftDataAPIConfig := fakeDataApiConfig(t, 1000, compatibilityFixtures())
+	proxyAddress := startProxy(t, cfg, redshiftDataAPIConfig)
+	relay := startProtocolRelay(t, proxyAddress)
+	report := &compatibilityReport{outcomes: map[string]string{}}
+	t.Cleanup(func() {
+		markdown := report.markdown(relay)
+		t.Log("\n" + markdown)
+		if path := os.Getenv("RDAPP_COMPATIBILITY_REPORT"); path != "" {
+			require.NoError(t, os.WriteFile(path, []byte(markdown), 0o644))
+		}
+	})
+
+	for _, driver := range driverPaths {
+		for _, scenario := range compatibilityScenarios {
+			driver, scenario := driver, scenario
+			t.Run(driver.name+"/"+scenario.name, func(t *testing.T) {
+				key := driver.name + "/" + scenario.name
+				relay.observeAs(key)
+				err := runScenario(driver, scenario, relay.address())
+				report.outcomes[key] = outcome(scenario, err)
+				if scenario.required {
+					require.NoError(t, err)
+				} else if err != nil {
+					t.Logf("%s is not supported: %v", scenario.name, err)
+				}
+			})
+		}
+	}
+}
+
+func runScenario(driver driverPath, scenario compatibilityScenario, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := driver.open(ctx, address)
+	if err != nil {
+		return fmt.Errorf("error while connecting: %w", err)
+	}
+	defer conn.close()
+	return scenario.run(ctx, conn)
+}
+
+func outcome(scenario compatibilityScenario, err error) string {
+	switch {
+	case err == nil:
+		return "pass"
+	case scenario.required:
+		return "fail"
+	}
+	return "unsupported"
+}
+
+type compatibilityReport struct {
+	outcomes map[string]string
+}
+
+// markdown renders a table of the outcomes and one of the protocol features per scenario and driver
+func (report *compatibilityReport) markdown(relay *protocolRelay) string {
+	var markdown strings.Builder
+	header := "| scenario |"
+	separator := "| --- |"
+	for _, driver := range driverPaths {
+		header += " " + driver.name + " |"
+		separator += " --- |"
+	}
+	for _, table := range []string{"outcome", "protocol features"} {
+		markdown.WriteString(header + "\n" + separator + "\n")
+		for _, scenario := range compatibilityScenarios {
+			markdown.WriteString("| " + scenario.name + " |")
+			for _, driver := range driverPaths {
+				key := driver.name + "/" + scenario.name
+				cell := report.outcomes[key]
+				if table == "protocol features" {
+					cell = strings.Join(relay.featuresOf(key), ", ")
+				}
+				markdown.WriteString(" " + cell + " |")
+			}
+			markdown.WriteString("\n")
+		}
+		markdown.WriteString("\n")
+	}
+	return markdown.String()
+}
+
+// expectRows compares rows with integers, floats and text normalised across drivers
+func expectRows(rows [][]any, want [][]any) error {
+	var normalised [][]any
+	for _, row := range rows {
+		var values []any
+		for _, value := range row {
+			values = append(values, normalise(value))
+		}
+		normalised = append(normalised, values)
+	}
+	if fmt.Sprint(normalised) != fmt.Sprint(want) {
+		return fmt.Errorf("expected rows %v, got %v", want, normalised)
+	}
+	return nil
+}
+
+func normalise(value any) any {
+	switch value := value.(type) {
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case float32:
+		return float64(value)
+	case []byte:
+		return string(value)
+	}
+	return value
+}
+
+func databaseUrlFor(address string) string {
+	return fmt.Sprintf("postgres://postgres:mypassword@%s/postgres?sslmode=disable", address)
+}
+
+type pgxConn struct {
+	conn *pgx.Conn
+}
+
+func openPgx(ctx context.Context, address string) (compatibilityConn, error) {
+	conn, err := pgx.Connect(ctx, databaseUrlFor(address))
+	if err != nil {
+		return nil, err
+	}
+	return &pgxConn{conn: conn}, nil
+}
+
+func (conn *pgxConn) ping(ctx context.Context) error {
+	return conn.conn.Ping(ctx)
+}
+
+func (conn *pgxConn) query(ctx context.Context, sql string, args ...any) ([][]any, error) {
+	rows, err := conn.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values [][]any
+	for rows.Next() {
+		row, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+func (conn *pgxConn) queryPrepared(ctx context.Context, sql string, args ...any) ([][]any, error) {
+	statement, err := conn.conn.Prepare(ctx, "compat", sql)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.conn.Deallocate(ctx, statement.Name)
+	return conn.query(ctx, statement.Name, args...)
+}
+
+func (conn *pgxConn) close() error {
+	return conn.conn.Close(context.Background())
+}
+
+type databaseSqlConn struct {
+	db *sql.DB
+}
+
+func openDatabaseSql(driverName string) func(ctx context.Context, address string) (compatibilityConn, error) {
+	return func(ctx context.Context, address string) (compatibilityConn, error) {
+		db, err := sql.Open(driverName, databaseUrlFor(address))
+		if err != nil {
+			return nil, err
+		}
+		// a single connection shows if it is still usable after errors
+		db.SetMaxOpenConns(1)
+		return &databaseSqlConn{db: db}, nil
+	}
+}
+
+func (conn *databaseSqlConn) ping(ctx context.Context) error {
+	return conn.db.PingContext(ctx)
+}
+
+func (conn *databaseSqlConn) query(ctx context.Context, sql string, args ...any) ([][]any, error) {
+	rows, err := conn.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(rows)
+}
+
+func (conn *databaseSqlConn) queryPrepared(ctx context.Context, sql string, args ...any) ([][]any, error) {
+	statement, err := conn.db.PrepareContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer statement.Close()
+	rows, err := statement.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(rows)
+}
+
+func scanRows(rows *sql.Rows) ([][]any, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var values [][]any
+	for rows.Next() {
+		row := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+func (conn *databaseSqlConn) close() error {
+	return conn.db.Close()
+}
@@ -0,0 +1,92 @@
+package componenttest
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kishaningithub/rdapp/fakedataapi"
+	"github.com/lib/pq/oid"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExtendedProtocol(t *testing.T) {
+	cfg, redshiftDataAPIConfig := fakeDataApiConfig(t, 1000, []fakedataapi.Fixture{
+		{
+			Pattern:    `^select id from typed_params where name is not distinct from NULL and id = :2::int4$`,
+			Parameters: map[string]string{"2": "42"},
+			Columns:    []fakedataapi.FixtureColumn{{Name: "id", TypeName: "int4"}},
+			Rows:       [][]any{{42}},
+		},
+		{
+			Pattern: `from binary_results`,
+			Columns: []fakedataapi.FixtureColumn{
+				{Name: "int4_value", TypeName: "int4"},
+				{Name: "int8_value", TypeName: "int8"},
+				{Name: "float8_value", TypeName: "float8"},
+				{Name: "bool_value", TypeName: "bool"},
+				{Name: "numeric_value", TypeName: "numeric", Precision: 10, Scale: 4},
+				{Name: "timestamp_value", TypeName: "timestamp"},
+				{Name: "timestamptz_value", TypeName: "timestamptz"},
+				{Name: "date_value", TypeName: "date"},
+				{Name: "varbyte_value", TypeName: "varbyte"},
+				{Name: "varchar_value", TypeName: "varchar"},
+			},
+			Rows: [][]any{{42, 1 << 40, 1.5, true, "12345.6789", "2023-05-04 10:11:12.123456", "2023-05-04 10:11:12+05:30",
+				"2023-05-04", "cafe", "john doe"}},
+		},
+	})
+	proxyAddress := startProxy(t, cfg, redshiftDataAPIConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := pgconn.Connect(ctx, databaseUrlFor(proxyAddress))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close(context.Background())
+	})
+
+	t.Run("binary parameters", func(t *testing.T) {
+		result := conn.ExecParams(ctx, "select id from typed_params where name is not distinct from $1 and id = $2",
+			[][]byte{nil, {0, 0, 0, 42}},
+			[]uint32{uint32(oid.T_text), uint32(oid.T_int4)},
+			[]int16{pgx.BinaryFormatCode, pgx.BinaryFormatCode},
+			nil).Read()
+		require.NoError(t, result.Err)
+		require.Equal(t, [][][]byte{{[]byte("42")}}, result.Rows)
+	})
+
+	t.Run("binary results", func(t *testing.T) {
+		pgxConn, err := pgx.Connect(ctx, databaseUrlFor(proxyAddress))
+		require.NoError(t, err)
+		defer pgxConn.Close(context.Background())
+		rows, err := pgxConn.Query(ctx, "select * from binary_results", pgx.QueryExecModeExec, pgx.QueryResultFormats{pgx.BinaryFormatCode})
+		require.NoError(t, err)
+		defer rows.Close()
+		require.True(t, rows.Next())
+		for _, field := range rows.FieldDescriptions() {
+			require.Equal(t, int16(pgx.BinaryFormatCode), field.Format, "column %s", field.Name)
+		}
+		var int4Value int32
+		var int8Value int64
+		var float8Value, numericValue float64
+		var boolValue bool
+		var timestampValue, timestamptzValue, dateValue time.Time
+		var varbyteValue []byte
+		var varcharValue string
+		require.NoError(t, rows.Scan(&int4Value, &int8Value, &float8Value, &boolValue, &numericValue, &timestampValue,
+			&timestamptzValue, &dateValue, &varbyteValue, &varcharValue))
+		require.Equal(t, int32(42), int4Value)
+		require.Equal(t, int64(1<<40), int8Value)
+		require.Equal(t, 1.5, float8Value)
+		require.True(t, boolValue)
+		require.Equal(t, 12345.6789, numericValue)
+		require.Equal(t, time.Date(2023, 5, 4, 10, 11, 12, 123456000, time.UTC), timestampValue)
+		require.Equal(t, time.Date(2023, 5, 4, 4, 41, 12, 0, time.UTC), timestamptzValue.UTC())
+		require.Equal(t, time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), dateValue)
+		require.Equal(t, []byte{0xca, 0xfe}, varbyteValue)
+		require.Equal(t, "john doe", varcharValue)
+		require.False(t, rows.Next())
+		require.NoError(t, rows.Err())
+	})
+}
@@ -0,0 +1,266 @@
+package componenttest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const (
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// protocolRelay forwards connections to the proxy and notes the protocol features the frontend
+// messages of the clients use, attributed to the scenario running when the connection was opened
+type protocolRelay struct {
+	listener net.Listener
+	target   string
+	mutex    sync.Mutex
+	scenario string
+	features map[string]map[string]bool
+}
+
+func startProtocolRelay(t *testing.T, target string) *protocolRelay {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	relay := &protocolRelay{
+		listener: listener,
+		target:   target,
+		features: map[string]map[string]bool{},
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go relay.accept()
+	return relay
+}
+
+func (relay *protocolRelay) address() string {
+	return relay.listener.Addr().String()
+}
+
+// observeAs attributes the connections opened from now on to the scenario
+func (relay *protocolRelay) observeAs(scenario string) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	relay.scenario = scenario
+}
+
+// featuresOf returns the sorted features the clients used during the scenario
+func (relay *protocolRelay) featuresOf(scenario string) []string {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	var features []string
+	for feature := range relay.features[scenario] {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func (relay *protocolRelay) currentScenario() string {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return relay.scenario
+}
+
+func (relay *protocolRelay) observe(scenario string, feature string) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if relay.features[scenario] == nil {
+		relay.features[scenario] = map[string]bool{}
+	}
+	relay.features[scenario][feature] = true
+}
+
+func (relay *protocolRelay) accept() {
+	for {
+		client, err := relay.listener.Accept()
+		if err != nil {
+			return
+		}
+		go relay.forward(client, relay.currentScenario())
+	}
+}
+
+func (relay *protocolRelay) forward(client net.Conn, scenario string) {
+	defer client.Close()
+	backend, err := net.Dial("tcp", relay.target)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	go func() {
+		_, _ = io.Copy(client, backend)
+		_ = client.Close()
+	}()
+	_ = relay.readFrontend(bufio.NewReader(client), backend, scenario)
+}
+
+// readFrontend passes the messages of the client to the backend, the startup phase consists of
+// untyped packets which are followed by typed messages
+func (relay *protocolRelay) readFrontend(reader *bufio.Reader, backend io.Writer, scenario string) error {
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return err
+		}
+		body := make([]byte, int(binary.BigEndian.Uint32(header[:4]))-len(header))
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return err
+		}
+		_, err = backend.Write(append(header, body...))
+		if err != nil {
+			return err
+		}
+		code := binary.BigEndian.Uint32(header[4:])
+		switch code {
+		case sslRequestCode:
+			relay.observe(scenario, "ssl request")
+			continue
+		case gssEncRequestCode:
+			relay.observe(scenario, "gss encryption request")
+			continue
+		case cancelRequestCode:
+			relay.observe(scenario, "cancel request")
+			return nil
+		}
+		relay.observe(scenario, "startup")
+		break
+	}
+	for {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return err
+		}
+		body := make([]byte, int(binary.BigEndian.Uint32(header[1:]))-4)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return err
+		}
+		_, err = backend.Write(append(header, body...))
+		if err != nil {
+			return err
+		}
+		for _, feature := range messageFeatures(header[0], body) {
+			relay.observe(scenario, feature)
+		}
+	}
+}
+
+// messageFeatures names the protocol features a frontend message uses
+func messageFeatures(messageType byte, body []byte) []string {
+	switch messageType {
+	case 'Q':
+		return []string{"simple query"}
+	case 'P':
+		if name, _ := cString(body); name != "" {
+			return []string{"parse named statement"}
+		}
+		return []string{"parse unnamed statement"}
+	case 'B':
+		return bindFeatures(body)
+	case 'D':
+		if len(body) > 0 && body[0] == 'S' {
+			return []string{"describe statement"}
+		}
+		return []string{"describe portal"}
+	case 'E':
+		if _, rest := cString(body); len(rest) >= 4 && binary.BigEndian.Uint32(rest) > 0 {
+			return []string{"execute with row limit"}
+		}
+		return []string{"execute"}
+	case 'S':
+		return []string{"sync"}
+	case 'H':
+		return []string{"flush"}
+	case 'C':
+		return []string{"close"}
+	case 'X':
+		return []string{"terminate"}
+	case 'p':
+		return []string{"password"}
+	case 'F':
+		return []string{"function call"}
+	case 'd', 'c', 'f':
+		return []string{"copy"}
+	}
+	return []string{"message " + string(messageType)}
+}
+
+// bindFeatures tells if a bind message uses binary parameters or requests binary results
+func bindFeatures(body []byte) []string {
+	features := []string{"bind"}
+	_, rest := cString(body)
+	_, rest = cString(rest)
+	formats, rest, ok := formatCodes(rest)
+	if !ok {
+		return features
+	}
+	if anyBinary(formats) {
+		features = append(features, "binary parameters")
+	}
+	if len(rest) < 2 {
+		return features
+	}
+	parameters := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	for i := 0; i < parameters; i++ {
+		if len(rest) < 4 {
+			return features
+		}
+		length := int32(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if length > 0 {
+			if int(length) > len(rest) {
+				return features
+			}
+			rest = rest[length:]
+		}
+	}
+	formats, _, ok = formatCodes(rest)
+	if ok && anyBinary(formats) {
+		features = append(features, "binary results")
+	}
+	return features
+}
+
+// formatCodes reads a count prefixed list of int16 format codes
+func formatCodes(body []byte) (formats []byte, rest []byte, ok bool) {
+	if len(body) < 2 {
+		return nil, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+2*count {
+		return nil, nil, false
+	}
+	return body[2 : 2+2*count], body[2+2*count:], true
+}
+
+func anyBinary(formats []byte) bool {
+	for i := 0; i+1 < len(formats); i += 2 {
+		if binary.BigEndian.Uint16(formats[i:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func cString(body []byte) (string, []byte) {
+	end := bytes.IndexByte(body, 0)
+	if end < 0 {
+		return string(body), nil
+	}
+	return string(body[:end]), body[end+1:]
+}
@@ -0,0 +1,254 @@
+package fakedataapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Fixtures is the content of a fixture file
+type Fixtures struct {
+	Fixtures []Fixture `yaml:"fixtures"`
+}
+
+// Fixture scripts the outcome of the statements it matches, the first matching fixture is used
+type Fixture struct {
+	// Pattern is a regular expression the sql has to match, empty matches every statement
+	Pattern string `yaml:"pattern"`
+	// Parameters the statement has to be called with by name
+	Parameters map[string]string `yaml:"parameters,omitempty"`
+	// Columns of the result set, statements without columns have no result set
+	Columns []FixtureColumn `yaml:"columns,omitempty"`
+	// Rows hold null, booleans, integers, floats, strings or []byte
+	Rows         [][]any `yaml:"rows,omitempty"`
+	RowsAffected int64   `yaml:"rowsAffected,omitempty"`
+	// Error fails the statement with this message
+	Error string `yaml:"error,omitempty"`
+	// Fault fails the api call submitting the statement with this error code like ThrottlingException
+	Fault string `yaml:"fault,omitempty"`
+	// FaultTimes is how often the fault is injected before the statement succeeds, 0 injects it every time
+	FaultTimes int `yaml:"faultTimes,omitempty"`
+	// Times is how often the fixture answers before it is passed over for later fixtures, 0 answers every time
+	Times int `yaml:"times,omitempty"`
+	// Statuses are reported before the statement completes like [SUBMITTED, PICKED, STARTED]
+	Statuses []types.StatusString `yaml:"statuses,omitempty"`
+	// Duration the statement is reported as STARTED
+	Duration time.Duration `yaml:"duration,omitempty"`
+	pattern  *regexp.Regexp
+	faults   int
+	answers  int
+}
+
+type FixtureColumn struct {
+	Name            string `yaml:"name"`
+	Label           string `yaml:"label,omitempty"`
+	TypeName        string `yaml:"typeName"`
+	SchemaName      string `yaml:"schemaName,omitempty"`
+	TableName       string `yaml:"tableName,omitempty"`
+	ColumnDefault   string `yaml:"columnDefault,omitempty"`
+	Length          int32  `yaml:"length,omitempty"`
+	Precision       int32  `yaml:"precision,omitempty"`
+	Scale           int32  `yaml:"scale,omitempty"`
+	IsCaseSensitive bool   `yaml:"isCaseSensitive,omitempty"`
+	IsCurrency      bool   `yaml:"isCurrency,omitempty"`
+	IsSigned        bool   `yaml:"isSigned,omitempty"`
+	// Nullable is 0 for columns without nulls, 1 for nullable columns and 2 if unknown, it defaults to 1
+	Nullable *int32 `yaml:"nullable,omitempty"`
+}
+
+type fixtureEngine struct {
+	mutex    sync.Mutex
+	fixtures []Fixture
+}
+
+// LoadFixtures reads the fixtures from a yaml file
+func LoadFixtures(path string) ([]Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening fixture file: %w", err)
+	}
+	defer file.Close()
+	return ParseFixtures(file)
+}
+
+// WriteFixtures replaces the yaml file with the fixtures
+func WriteFixtures(path string, fixtures []Fixture) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error while creating fixture file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	encoder := yaml.NewEncoder(file)
+	encoder.SetIndent(2)
+	err = encoder.Encode(Fixtures{Fixtures: fixtures})
+	if err == nil {
+		err = encoder.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error while writing fixture file: %w", err)
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("error while writing fixture file: %w", err)
+	}
+	return nil
+}
+
+func ParseFixtures(reader io.Reader) ([]Fixture, error) {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	var fixtures Fixtures
+	err := decoder.Decode(&fixtures)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error while parsing fixtures: %w", err)
+	}
+	return fixtures.Fixtures, nil
+}
+
+// NewFixtureEngine constructs an engine answering statements with the fixtures, statements
+// matching no fixture fail
+func NewFixtureEngine(fixtures []Fixture) (Engine, error) {
+	engine := &fixtureEngine{}
+	for i, fixture := range fixtures {
+		pattern, err := regexp.Compile(fixture.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error while compiling pattern of fixture %d: %w", i+1, err)
+		}
+		fixture.pattern = pattern
+		engine.fixtures = append(engine.fixtures, fixture)
+	}
+	return engine, nil
+}
+
+func (engine *fixtureEngine) Execute(_ context.Context, sql string, parameters []types.SqlParameter) (*Result, error) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	for i := range engine.fixtures {
+		fixture := &engine.fixtures[i]
+		if !fixture.matches(sql, parameters) || (fixture.Times > 0 && fixture.answers >= fixture.Times) {
+			continue
+		}
+		fixture.answers++
+		if fixture.Fault != "" && (fixture.FaultTimes == 0 || fixture.faults < fixture.FaultTimes) {
+			fixture.faults++
+			return nil, &APIError{Code: fixture.Fault, Message: "injected by fixture"}
+		}
+		if fixture.Error != "" {
+			return nil, errors.New(fixture.Error)
+		}
+		return fixture.result()
+	}
+	return nil, fmt.Errorf("ERROR: no fixture matches the statement: %s", sql)
+}
+
+func (fixture *Fixture) matches(sql string, parameters []types.SqlParameter) bool {
+	if !fixture.pattern.MatchString(sql) {
+		return false
+	}
+	for name, value := range fixture.Parameters {
+		found := false
+		for _, parameter := range parameters {
+			found = found || (aws.ToString(parameter.Name) == name && aws.ToString(parameter.Value) == value)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (fixture *Fixture) result() (*Result, error) {
+	result := &Result{
+		RowsAffected: fixture.RowsAffected,
+		Statuses:     fixture.Statuses,
+		Duration:     fixture.Duration,
+	}
+	if len(fixture.Columns) == 0 {
+		return result, nil
+	}
+	result.ColumnMetadata = []types.ColumnMetadata{}
+	for _, column := range fixture.Columns {
+		label := column.Label
+		if label == "" {
+			label = column.Name
+		}
+		nullable := int32(1)
+		if column.Nullable != nil {
+			nullable = *column.Nullable
+		}
+		result.ColumnMetadata = append(result.ColumnMetadata, types.ColumnMetadata{
+			Name:            aws.String(column.Name),
+			Label:           aws.String(label),
+			TypeName:        aws.String(column.TypeName),
+			SchemaName:      aws.String(column.SchemaName),
+			TableName:       aws.String(column.TableName),
+			ColumnDefault:   aws.String(column.ColumnDefault),
+			Length:          column.Length,
+			Precision:       column.Precision,
+			Scale:           column.Scale,
+			IsCaseSensitive: column.IsCaseSensitive,
+			IsCurrency:      column.IsCurrency,
+			IsSigned:        column.IsSigned,
+			Nullable:        nullable,
+		})
+	}
+	for _, row := range fixture.Rows {
+		var record []types.Field
+		for i, value := range row {
+			// yaml reads floats without a fraction like 1.0 as integers
+			if integer, ok := value.(int); ok && i < len(fixture.Columns) && isFloatType(fixture.Columns[i].TypeName) {
+				value = float64(integer)
+			}
+			field, err := fieldOf(value)
+			if err != nil {
+				return nil, err
+			}
+			record = append(record, field)
+		}
+		result.Records = append(result.Records, record)
+	}
+	return result, nil
+}
+
+func isFloatType(typeName string) bool {
+	switch typeName {
+	case "float4", "float8", "float", "real", "double precision":
+		return true
+	}
+	return false
+}
+
+// fieldOf converts a fixture value into the data api field holding it
+func fieldOf(value any) (types.Field, error) {
+	switch value := value.(type) {
+	case nil:
+		return &types.FieldMemberIsNull{Value: true}, nil
+	case bool:
+		return &types.FieldMemberBooleanValue{Value: value}, nil
+	case int:
+		return &types.FieldMemberLongValue{Value: int64(value)}, nil
+	case int64:
+		return &types.FieldMemberLongValue{Value: value}, nil
+	case float64:
+		return &types.FieldMemberDoubleValue{Value: value}, nil
+	case string:
+		return &types.FieldMemberStringValue{Value: value}, nil
+	case []byte:
+		return &types.FieldMemberBlobValue{Value: value}, nil
+	case time.Time:
+		return &types.FieldMemberStringValue{Value: value.Format("2006-01-02 15:04:05.999999")}, nil
+	}
+	return nil, fmt.Errorf("fixture value %v of type %T is not supported", value, value)
+}
@@ -0,0 +1,231 @@
+package fakedataapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"time"
+)
+
+// the request and response documents of the awsJson1_1 protocol spoken by the data api
+
+type executeStatementInput struct {
+	Sql               string         `json:"Sql"`
+	Sqls              []string       `json:"Sqls"`
+	ClusterIdentifier string         `json:"ClusterIdentifier"`
+	WorkgroupName     string         `json:"WorkgroupName"`
+	Database          string         `json:"Database"`
+	DbUser            string         `json:"DbUser"`
+	SecretArn         string         `json:"SecretArn"`
+	StatementName     string         `json:"StatementName"`
+	WithEvent         bool           `json:"WithEvent"`
+	Parameters        []sqlParameter `json:"Parameters"`
+}
+
+type sqlParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (input executeStatementInput) validate() error {
+	switch {
+	case input.Database == "":
+		return &APIError{Code: ErrorCodeValidation, Message: "Database must be specified"}
+	case (input.ClusterIdentifier == "") == (input.WorkgroupName == ""):
+		return &APIError{Code: ErrorCodeValidation, Message: "Either ClusterIdentifier or WorkgroupName must be specified"}
+	case input.WorkgroupName != "" && input.DbUser != "":
+		return &APIError{Code: ErrorCodeValidation, Message: "DbUser is not supported for serverless workgroups"}
+	}
+	return nil
+}
+
+func (input executeStatementInput) parameters() []types.SqlParameter {
+	var parameters []types.SqlParameter
+	for _, parameter := range input.Parameters {
+		parameters = append(parameters, types.SqlParameter{Name: aws.String(parameter.Name), Value: aws.String(parameter.Value)})
+	}
+	return parameters
+}
+
+func (input executeStatementInput) output(statement *statement) *executeStatementOutput {
+	return &executeStatementOutput{
+		Id:                statement.id,
+		CreatedAt:         epochSeconds(statement.createdAt),
+		ClusterIdentifier: input.ClusterIdentifier,
+		WorkgroupName:     input.WorkgroupName,
+		Database:          input.Database,
+		DbUser:            input.DbUser,
+		SecretArn:         input.SecretArn,
+	}
+}
+
+type executeStatementOutput struct {
+	Id                string  `json:"Id"`
+	CreatedAt         float64 `json:"CreatedAt"`
+	ClusterIdentifier string  `json:"ClusterIdentifier,omitempty"`
+	WorkgroupName     string  `json:"WorkgroupName,omitempty"`
+	Database          string  `json:"Database"`
+	DbUser            string  `json:"DbUser,omitempty"`
+	SecretArn         string  `json:"SecretArn,omitempty"`
+}
+
+type statementInput struct {
+	Id        string `json:"Id"`
+	NextToken string `json:"NextToken"`
+}
+
+// statementData holds the members describe statement shares with its sub statements
+type statementData struct {
+	Id              string  `json:"Id"`
+	Status          string  `json:"Status"`
+	Error           string  `json:"Error,omitempty"`
+	QueryString     string  `json:"QueryString"`
+	HasResultSet    bool    `json:"HasResultSet"`
+	ResultRows      int64   `json:"ResultRows"`
+	ResultSize      int64   `json:"ResultSize"`
+	RedshiftQueryId int64   `json:"RedshiftQueryId"`
+	Duration        int64   `json:"Duration"`
+	CreatedAt       float64 `json:"CreatedAt"`
+	UpdatedAt       float64 `json:"UpdatedAt"`
+}
+
+func (statement *statement) data() statementData {
+	data := statementData{
+		Id:              statement.id,
+		Status:          string(statement.status),
+		QueryString:     statement.sql,
+		ResultRows:      -1,
+		RedshiftQueryId: statement.redshiftQueryId,
+		Duration:        -1,
+		CreatedAt:       epochSeconds(statement.createdAt),
+		UpdatedAt:       epochSeconds(statement.updatedAt),
+	}
+	switch statement.status {
+	case types.StatusStringFinished:
+		data.Duration = statement.updatedAt.Sub(statement.createdAt).Nanoseconds()
+		for _, subStatement := range statement.subStatements {
+			data.HasResultSet = data.HasResultSet || (subStatement.result != nil && subStatement.result.ColumnMetadata != nil)
+		}
+		if result := statement.result; result != nil {
+			data.HasResultSet = result.ColumnMetadata != nil
+			data.ResultRows = result.RowsAffected
+			if data.HasResultSet {
+				data.ResultRows = int64(len(result.Records))
+			}
+			for _, record := range result.Records {
+				for _, field := range record {
+					data.ResultSize += fieldSize(field)
+				}
+			}
+		}
+	case types.StatusStringFailed, types.StatusStringAborted:
+		data.Error = statement.failure
+	}
+	return data
+}
+
+type describeStatementOutput struct {
+	statementData
+	RedshiftPid   int64           `json:"RedshiftPid"`
+	SubStatements []statementData `json:"SubStatements,omitempty"`
+}
+
+type getStatementResultOutput struct {
+	ColumnMetadata []columnMetadata   `json:"ColumnMetadata"`
+	Records        [][]map[string]any `json:"Records"`
+	TotalNumRows   int64              `json:"TotalNumRows"`
+	NextToken      string             `json:"NextToken,omitempty"`
+}
+
+type cancelStatementOutput struct {
+	Status bool `json:"Status"`
+}
+
+type listDatabasesOutput struct {
+	Databases []string `json:"Databases"`
+}
+
+type columnMetadata struct {
+	Name            string `json:"name"`
+	Label           string `json:"label"`
+	TypeName        string `json:"typeName"`
+	SchemaName      string `json:"schemaName"`
+	TableName       string `json:"tableName"`
+	ColumnDefault   string `json:"columnDefault,omitempty"`
+	IsCaseSensitive bool   `json:"isCaseSensitive"`
+	IsCurrency      bool   `json:"isCurrency"`
+	IsSigned        bool   `json:"isSigned"`
+	Length          int32  `json:"length"`
+	Nullable        int32  `json:"nullable"`
+	Precision       int32  `json:"precision"`
+	Scale           int32  `json:"scale"`
+}
+
+func encodeColumnMetadata(columns []types.ColumnMetadata) []columnMetadata {
+	encoded := []columnMetadata{}
+	for _, column := range columns {
+		label := aws.ToString(column.Label)
+		if label == "" {
+			label = aws.ToString(column.Name)
+		}
+		encoded = append(encoded, columnMetadata{
+			Name:            aws.ToString(column.Name),
+			Label:           label,
+			TypeName:        aws.ToString(column.TypeName),
+			SchemaName:      aws.ToString(column.SchemaName),
+			TableName:       aws.ToString(column.TableName),
+			ColumnDefault:   aws.ToString(column.ColumnDefault),
+			IsCaseSensitive: column.IsCaseSensitive,
+			IsCurrency:      column.IsCurrency,
+			IsSigned:        column.IsSigned,
+			Length:          column.Length,
+			Nullable:        column.Nullable,
+			Precision:       column.Precision,
+			Scale:           column.Scale,
+		})
+	}
+	return encoded
+}
+
+// encodeRecords encodes every field as a union with a single member like {"longValue": 1}
+func encodeRecords(records [][]types.Field) [][]map[string]any {
+	encoded := [][]map[string]any{}
+	for _, record := range records {
+		var fields []map[string]any
+		for _, field := range record {
+			switch value := field.(type) {
+			case *types.FieldMemberBlobValue:
+				fields = append(fields, map[string]any{"blobValue": value.Value})
+			case *types.FieldMemberBooleanValue:
+				fields = append(fields, map[string]any{"booleanValue": value.Value})
+			case *types.FieldMemberDoubleValue:
+				fields = append(fields, map[string]any{"doubleValue": value.Value})
+			case *types.FieldMemberLongValue:
+				fields = append(fields, map[string]any{"longValue": value.Value})
+			case *types.FieldMemberStringValue:
+				fields = append(fields, map[string]any{"stringValue": value.Value})
+			default:
+				fields = append(fields, map[string]any{"isNull": true})
+			}
+		}
+		encoded = append(encoded, fields)
+	}
+	return encoded
+}
+
+func fieldSize(field types.Field) int64 {
+	switch value := field.(type) {
+	case *types.FieldMemberBlobValue:
+		return int64(len(value.Value))
+	case *types.FieldMemberStringValue:
+		return int64(len(value.Value))
+	case *types.FieldMemberLongValue, *types.FieldMemberDoubleValue:
+		return 8
+	case *types.FieldMemberBooleanValue:
+		return 1
+	}
+	return 0
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
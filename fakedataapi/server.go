@@ -0,0 +1,396 @@
+// Package fakedataapi serves the redshift data api over http for tests and local development. The
+// aws sdk is pointed at it via an endpoint override, statements are run by an Engine.
+package fakedataapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorCodeActiveStatementsExceeded = "ActiveStatementsExceededException"
+	ErrorCodeThrottling               = "ThrottlingException"
+	ErrorCodeValidation               = "ValidationException"
+	ErrorCodeResourceNotFound         = "ResourceNotFoundException"
+	ErrorCodeInternalServer           = "InternalServerException"
+)
+
+const targetPrefix = "RedshiftData."
+
+// Engine runs the statements submitted to the fake
+type Engine interface {
+	// Execute returns the result of the statement. An *APIError fails the api call submitting the
+	// statement, any other error fails the statement with the message of the error.
+	Execute(ctx context.Context, sql string, parameters []types.SqlParameter) (*Result, error)
+}
+
+// Result is the outcome of a statement and how the data api reports its progress
+type Result struct {
+	// ColumnMetadata is nil for statements without a result set
+	ColumnMetadata []types.ColumnMetadata
+	Records        [][]types.Field
+	// RowsAffected is reported as result rows of statements without a result set
+	RowsAffected int64
+	// Statuses are reported by DescribeStatement one after the other before the statement completes
+	Statuses []types.StatusString
+	// Duration is how long the statement runs, it is reported as STARTED until then
+	Duration time.Duration
+}
+
+// APIError is returned by the api instead of a response, like throttling or too many active statements
+type APIError struct {
+	Code    string
+	Message string
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+type server struct {
+	engine   Engine
+	pageSize int
+	latency  time.Duration
+	mutex    sync.Mutex
+	// statements by id, sub statements of batches are looked up via their batch
+	statements      map[string]*statement
+	redshiftQueryId int64
+	logger          *zap.Logger
+}
+
+type statement struct {
+	id              string
+	sql             string
+	redshiftQueryId int64
+	createdAt       time.Time
+	updatedAt       time.Time
+	result          *Result
+	// failure is the error of a failed statement
+	failure  string
+	statuses []types.StatusString
+	finishAt time.Time
+	status   types.StatusString
+	// subStatements are the statements of a batch
+	subStatements []*statement
+}
+
+// NewServer constructs a fake data api running statements with the engine. Results are returned in
+// pages of pageSize records, 0 returns them in a single page, and every call takes latency.
+func NewServer(engine Engine, pageSize int, latency time.Duration, logger *zap.Logger) http.Handler {
+	return &server{
+		engine:     engine,
+		pageSize:   pageSize,
+		latency:    latency,
+		statements: map[string]*statement{},
+		logger:     logger,
+	}
+}
+
+func (server *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	operation := strings.TrimPrefix(request.Header.Get("X-Amz-Target"), targetPrefix)
+	loggerWithContext := server.logger.With(zap.String("operation", operation))
+	if server.latency > 0 {
+		select {
+		case <-time.After(server.latency):
+		case <-request.Context().Done():
+			return
+		}
+	}
+	var response any
+	var err error
+	switch operation {
+	case "ExecuteStatement":
+		var input executeStatementInput
+		if err = decode(request, &input); err == nil {
+			response, err = server.executeStatement(request.Context(), input)
+		}
+	case "BatchExecuteStatement":
+		var input executeStatementInput
+		if err = decode(request, &input); err == nil {
+			response, err = server.batchExecuteStatement(request.Context(), input)
+		}
+	case "DescribeStatement":
+		var input statementInput
+		if err = decode(request, &input); err == nil {
+			response, err = server.describeStatement(input)
+		}
+	case "GetStatementResult":
+		var input statementInput
+		if err = decode(request, &input); err == nil {
+			response, err = server.getStatementResult(input)
+		}
+	case "CancelStatement":
+		var input statementInput
+		if err = decode(request, &input); err == nil {
+			response, err = server.cancelStatement(input)
+		}
+	case "ListDatabases":
+		var input executeStatementInput
+		if err = decode(request, &input); err == nil {
+			response, err = listDatabases(input)
+		}
+	default:
+		err = &APIError{Code: "UnknownOperationException", Message: fmt.Sprintf("operation %q is not supported by the fake", operation)}
+	}
+	writer.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if err != nil {
+		var apiError *APIError
+		if !errors.As(err, &apiError) {
+			apiError = &APIError{Code: ErrorCodeInternalServer, Message: err.Error()}
+		}
+		loggerWithContext.Info("failing data api call", zap.Error(apiError))
+		status := http.StatusBadRequest
+		if apiError.Code == ErrorCodeInternalServer {
+			status = http.StatusInternalServerError
+		}
+		writer.Header().Set("X-Amzn-ErrorType", apiError.Code)
+		writer.WriteHeader(status)
+		_ = json.NewEncoder(writer).Encode(map[string]string{"__type": apiError.Code, "message": apiError.Message})
+		return
+	}
+	_ = json.NewEncoder(writer).Encode(response)
+}
+
+func decode(request *http.Request, input any) error {
+	err := json.NewDecoder(request.Body).Decode(input)
+	if err != nil {
+		return &APIError{Code: "SerializationException", Message: err.Error()}
+	}
+	return nil
+}
+
+func (server *server) executeStatement(ctx context.Context, input executeStatementInput) (*executeStatementOutput, error) {
+	err := input.validate()
+	if err != nil {
+		return nil, err
+	}
+	if input.Sql == "" {
+		return nil, &APIError{Code: ErrorCodeValidation, Message: "Sql must not be empty"}
+	}
+	statement, err := server.run(ctx, input.Sql, input.parameters())
+	if err != nil {
+		return nil, err
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.statements[statement.id] = statement
+	return input.output(statement), nil
+}
+
+func (server *server) batchExecuteStatement(ctx context.Context, input executeStatementInput) (*executeStatementOutput, error) {
+	err := input.validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(input.Sqls) == 0 {
+		return nil, &APIError{Code: ErrorCodeValidation, Message: "Sqls must contain at least one statement"}
+	}
+	batch := server.newStatement(strings.Join(input.Sqls, "; "))
+	failed := false
+	for i, sql := range input.Sqls {
+		var subStatement *statement
+		if failed {
+			// statements after a failed one of the transaction are not run
+			subStatement = server.newStatement(sql)
+			subStatement.status = types.StatusStringAborted
+		} else {
+			subStatement, err = server.run(ctx, sql, nil)
+			if err != nil {
+				return nil, err
+			}
+			failed = subStatement.failure != ""
+		}
+		subStatement.id = fmt.Sprintf("%s:%d", batch.id, i+1)
+		batch.subStatements = append(batch.subStatements, subStatement)
+		if i == 0 {
+			batch.statuses = subStatement.statuses
+		}
+		if subStatement.finishAt.After(batch.finishAt) {
+			batch.finishAt = subStatement.finishAt
+		}
+		if failed && batch.failure == "" {
+			batch.failure = subStatement.failure
+		}
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.statements[batch.id] = batch
+	return input.output(batch), nil
+}
+
+// run executes the sql with the engine, api errors of the engine fail the call
+func (server *server) run(ctx context.Context, sql string, parameters []types.SqlParameter) (*statement, error) {
+	statement := server.newStatement(sql)
+	result, err := server.engine.Execute(ctx, sql, parameters)
+	var apiError *APIError
+	switch {
+	case errors.As(err, &apiError):
+		return nil, apiError
+	case err != nil:
+		statement.failure = err.Error()
+	default:
+		statement.result = result
+		statement.statuses = result.Statuses
+		statement.finishAt = statement.createdAt.Add(result.Duration)
+	}
+	return statement, nil
+}
+
+func (server *server) newStatement(sql string) *statement {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.redshiftQueryId++
+	now := time.Now()
+	return &statement{
+		id:              uuid.NewString(),
+		sql:             sql,
+		redshiftQueryId: server.redshiftQueryId,
+		createdAt:       now,
+		updatedAt:       now,
+	}
+}
+
+// lookup finds the statement or the sub statement of a batch with the id
+func (server *server) lookup(id string) (*statement, error) {
+	batchId, position, isSubStatement := strings.Cut(id, ":")
+	statement, ok := server.statements[batchId]
+	if ok && isSubStatement {
+		index, err := strconv.Atoi(position)
+		ok = err == nil && index >= 1 && index <= len(statement.subStatements)
+		if ok {
+			statement = statement.subStatements[index-1]
+		}
+	}
+	if !ok {
+		return nil, &APIError{Code: ErrorCodeResourceNotFound, Message: fmt.Sprintf("Query does not exist: %s", id)}
+	}
+	return statement, nil
+}
+
+func (server *server) describeStatement(input statementInput) (*describeStatementOutput, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	statement, err := server.lookup(input.Id)
+	if err != nil {
+		return nil, err
+	}
+	statement.advance(time.Now())
+	output := &describeStatementOutput{
+		statementData: statement.data(),
+		RedshiftPid:   1073741824 + statement.redshiftQueryId,
+	}
+	for _, subStatement := range statement.subStatements {
+		// sub statements follow the batch, once it completed they report their own outcome
+		switch {
+		case isFinal(subStatement.status):
+		case subStatement.failure != "" && isFinal(statement.status):
+			subStatement.status = types.StatusStringFailed
+		case isFinal(statement.status):
+			subStatement.status = types.StatusStringFinished
+		default:
+			subStatement.status = statement.status
+		}
+		output.SubStatements = append(output.SubStatements, subStatement.data())
+	}
+	return output, nil
+}
+
+func (server *server) getStatementResult(input statementInput) (*getStatementResultOutput, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	statement, err := server.lookup(input.Id)
+	if err != nil {
+		return nil, err
+	}
+	if statement.status != types.StatusStringFinished {
+		return nil, &APIError{Code: ErrorCodeValidation, Message: fmt.Sprintf("Query has not finished. Current status is %s.", statement.status)}
+	}
+	if statement.result == nil || statement.result.ColumnMetadata == nil {
+		return nil, &APIError{Code: ErrorCodeResourceNotFound, Message: "Query does not have result. Please check query status with DescribeStatement."}
+	}
+	records := statement.result.Records
+	offset := 0
+	if input.NextToken != "" {
+		offset, err = strconv.Atoi(input.NextToken)
+		if err != nil || offset < 0 || offset > len(records) {
+			return nil, &APIError{Code: ErrorCodeValidation, Message: "Invalid NextToken"}
+		}
+	}
+	end := len(records)
+	if server.pageSize > 0 && offset+server.pageSize < end {
+		end = offset + server.pageSize
+	}
+	output := &getStatementResultOutput{
+		ColumnMetadata: encodeColumnMetadata(statement.result.ColumnMetadata),
+		Records:        encodeRecords(records[offset:end]),
+		TotalNumRows:   int64(len(records)),
+	}
+	if end < len(records) {
+		output.NextToken = strconv.Itoa(end)
+	}
+	return output, nil
+}
+
+func (server *server) cancelStatement(input statementInput) (*cancelStatementOutput, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	statement, err := server.lookup(input.Id)
+	if err != nil {
+		return nil, err
+	}
+	statement.advance(time.Now())
+	if isFinal(statement.status) {
+		return nil, &APIError{Code: ErrorCodeValidation, Message: fmt.Sprintf("Could not cancel a query that is already in %s state with ID: %s", statement.status, input.Id)}
+	}
+	statement.status = types.StatusStringAborted
+	statement.failure = "Query cancelled on user's request"
+	for _, subStatement := range statement.subStatements {
+		subStatement.status = types.StatusStringAborted
+	}
+	return &cancelStatementOutput{Status: true}, nil
+}
+
+// listDatabases answers with the database of the request as the fake has no catalog
+func listDatabases(input executeStatementInput) (*listDatabasesOutput, error) {
+	err := input.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &listDatabasesOutput{Databases: []string{input.Database}}, nil
+}
+
+// advance moves the statement to the status DescribeStatement reports next
+func (statement *statement) advance(now time.Time) {
+	switch {
+	case isFinal(statement.status):
+		return
+	case len(statement.statuses) > 0:
+		statement.status = statement.statuses[0]
+		statement.statuses = statement.statuses[1:]
+	case now.Before(statement.finishAt):
+		statement.status = types.StatusStringStarted
+	case statement.failure != "":
+		statement.status = types.StatusStringFailed
+	default:
+		statement.status = types.StatusStringFinished
+	}
+	statement.updatedAt = now
+}
+
+func isFinal(status types.StatusString) bool {
+	switch status {
+	case types.StatusStringFinished, types.StatusStringFailed, types.StatusStringAborted:
+		return true
+	}
+	return false
+}
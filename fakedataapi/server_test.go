@@ -0,0 +1,110 @@
+package fakedataapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_server(t *testing.T) {
+	fixtures, err := ParseFixtures(strings.NewReader(`
+fixtures:
+  - pattern: (?i)^select id from person
+    parameters: {"1": "1"}
+    columns: [{name: id, typeName: int4}]
+    rows: [[2], [3], [null]]
+    statuses: [SUBMITTED, STARTED]
+  - pattern: (?i)^insert
+    rowsAffected: 1
+    fault: ActiveStatementsExceededException
+    faultTimes: 1
+  - pattern: (?i)^drop
+    error: 'ERROR: permission denied for relation person'
+`))
+	require.NoError(t, err)
+	engine, err := NewFixtureEngine(fixtures)
+	require.NoError(t, err)
+	server := httptest.NewServer(NewServer(engine, 2, 0, zap.NewNop()))
+	t.Cleanup(server.Close)
+	call := func(operation string, input map[string]any) (int, map[string]any) {
+		body, err := json.Marshal(input)
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("X-Amz-Target", targetPrefix+operation)
+		request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		var output map[string]any
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&output))
+		return response.StatusCode, output
+	}
+	statement := func(sql string, parameters ...map[string]any) map[string]any {
+		return map[string]any{"Sql": sql, "Database": "dev", "WorkgroupName": "rdapp", "Parameters": parameters}
+	}
+
+	t.Run("select reports statuses and pages the result", func(t *testing.T) {
+		status, output := call("ExecuteStatement", statement("select id from person where id > :1", map[string]any{"name": "1", "value": "1"}))
+		require.Equal(t, http.StatusOK, status)
+		id := output["Id"]
+		var statuses []any
+		for i := 0; i < 3; i++ {
+			_, output = call("DescribeStatement", map[string]any{"Id": id})
+			statuses = append(statuses, output["Status"])
+		}
+		require.Equal(t, []any{"SUBMITTED", "STARTED", "FINISHED"}, statuses)
+		require.Equal(t, true, output["HasResultSet"])
+		require.Equal(t, float64(3), output["ResultRows"])
+
+		_, output = call("GetStatementResult", map[string]any{"Id": id})
+		require.Equal(t, "2", output["NextToken"])
+		require.Equal(t, []any{[]any{map[string]any{"longValue": float64(2)}}, []any{map[string]any{"longValue": float64(3)}}}, output["Records"])
+		require.Equal(t, "id", output["ColumnMetadata"].([]any)[0].(map[string]any)["name"])
+		_, output = call("GetStatementResult", map[string]any{"Id": id, "NextToken": "2"})
+		require.Nil(t, output["NextToken"])
+		require.Equal(t, []any{[]any{map[string]any{"isNull": true}}}, output["Records"])
+	})
+
+	t.Run("fault is injected", func(t *testing.T) {
+		status, output := call("ExecuteStatement", statement("insert into person values (1)"))
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Equal(t, ErrorCodeActiveStatementsExceeded, output["__type"])
+		status, _ = call("ExecuteStatement", statement("insert into person values (1)"))
+		require.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("batch fails at the failing statement", func(t *testing.T) {
+		_, output := call("BatchExecuteStatement", map[string]any{"Sqls": []string{"insert into person values (1)", "drop table person", "insert into person values (2)"}, "Database": "dev", "WorkgroupName": "rdapp"})
+		_, output = call("DescribeStatement", map[string]any{"Id": output["Id"]})
+		require.Equal(t, "FAILED", output["Status"])
+		require.Equal(t, "ERROR: permission denied for relation person", output["Error"])
+		var statuses []any
+		for _, subStatement := range output["SubStatements"].([]any) {
+			statuses = append(statuses, subStatement.(map[string]any)["Status"])
+		}
+		require.Equal(t, []any{"FINISHED", "FAILED", "ABORTED"}, statuses)
+	})
+
+	t.Run("statement matching no fixture fails", func(t *testing.T) {
+		_, output := call("ExecuteStatement", statement("select 1"))
+		_, output = call("CancelStatement", map[string]any{"Id": output["Id"]})
+		require.Equal(t, ErrorCodeValidation, output["__type"], "already failed")
+	})
+
+	t.Run("list databases", func(t *testing.T) {
+		_, output := call("ListDatabases", map[string]any{"Database": "dev", "WorkgroupName": "rdapp"})
+		require.Equal(t, []any{"dev"}, output["Databases"])
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		status, output := call("ExecuteStatement", map[string]any{"Sql": "select 1", "Database": "dev"})
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Equal(t, ErrorCodeValidation, output["__type"])
+	})
+}
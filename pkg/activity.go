@@ -0,0 +1,613 @@
+package rdapp
+
+import (
+	"errors"
+	"fmt"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// firstBackendPid is the pseudo backend pid of the first connection, the pids of further connections
+// are counted up from it
+const firstBackendPid = 10001
+
+type backendCommandKind int
+
+const (
+	backendCommandPid backendCommandKind = iota
+	backendCommandCancel
+	backendCommandTerminate
+	backendCommandStatActivity
+)
+
+// backendCommand is a call of pg_backend_pid, pg_cancel_backend or pg_terminate_backend or a select of
+// pg_stat_activity. rdapp answers them from its own connections as redshift knows nothing of them.
+type backendCommand struct {
+	kind backendCommandKind
+	// column is the result column name of function calls
+	column string
+	// argument is the pid argument of pg_cancel_backend and pg_terminate_backend
+	argument []sqlToken
+	// activity is the select of pg_stat_activity
+	activity activityQuery
+}
+
+var backendFunctions = map[string]backendCommandKind{
+	"pg_backend_pid":       backendCommandPid,
+	"pg_cancel_backend":    backendCommandCancel,
+	"pg_terminate_backend": backendCommandTerminate,
+}
+
+// activityColumns are the columns of pg_stat_activity
+var activityColumns = []wire.Column{
+	{Name: "datid", Oid: oid.T_oid},
+	{Name: "datname", Oid: oid.T_name},
+	{Name: "pid", Oid: oid.T_int4},
+	{Name: "leader_pid", Oid: oid.T_int4},
+	{Name: "usesysid", Oid: oid.T_oid},
+	{Name: "usename", Oid: oid.T_name},
+	{Name: "application_name", Oid: oid.T_text},
+	{Name: "client_addr", Oid: oid.T_inet},
+	{Name: "client_hostname", Oid: oid.T_text},
+	{Name: "client_port", Oid: oid.T_int4},
+	{Name: "backend_start", Oid: oid.T_timestamptz},
+	{Name: "xact_start", Oid: oid.T_timestamptz},
+	{Name: "query_start", Oid: oid.T_timestamptz},
+	{Name: "state_change", Oid: oid.T_timestamptz},
+	{Name: "wait_event_type", Oid: oid.T_text},
+	{Name: "wait_event", Oid: oid.T_text},
+	{Name: "state", Oid: oid.T_text},
+	{Name: "backend_xid", Oid: oid.T_xid},
+	{Name: "backend_xmin", Oid: oid.T_xid},
+	{Name: "query_id", Oid: oid.T_int8},
+	{Name: "query", Oid: oid.T_text},
+	{Name: "backend_type", Oid: oid.T_text},
+}
+
+// activityQuery is a select of pg_stat_activity with a column list, conditions combined with AND,
+// an order and a limit
+type activityQuery struct {
+	// columns are the indexes into activityColumns of the selected columns
+	columns []int
+	names   []string
+	where   []activityCondition
+	orderBy []activityOrder
+	// limit is -1 without a limit
+	limit int
+}
+
+type activityCondition struct {
+	column int
+	// operator is one of =, <>, is null and is not null
+	operator string
+	value    []sqlToken
+}
+
+type activityOrder struct {
+	column     int
+	descending bool
+}
+
+// parseBackendCommand parses selects of the backend functions and of pg_stat_activity, ok is false for
+// any other statement. Selects of pg_stat_activity which are too complex to answer are left to redshift.
+func parseBackendCommand(statement string) (command backendCommand, ok bool) {
+	tokens := lexSql(statement)
+	if len(tokens) > 0 && tokens[len(tokens)-1].kind == sqlTokenSemicolon {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) < 2 || !tokens[0].isWord("select") {
+		return backendCommand{}, false
+	}
+	if command, ok := parseBackendFunctionCall(tokens[1:]); ok {
+		return command, true
+	}
+	if activity, ok := parseActivityQuery(tokens[1:]); ok {
+		return backendCommand{kind: backendCommandStatActivity, activity: activity}, true
+	}
+	return backendCommand{}, false
+}
+
+// parseBackendFunctionCall parses the select list of SELECT pg_cancel_backend(10001) AS cancelled
+func parseBackendFunctionCall(tokens []sqlToken) (backendCommand, bool) {
+	call, rest, ok := parseFunctionCall(tokens)
+	if !ok {
+		return backendCommand{}, false
+	}
+	name := call[0].lowerText()
+	kind, ok := backendFunctions[name]
+	if !ok {
+		return backendCommand{}, false
+	}
+	column, ok := parseColumnAlias(rest, name)
+	if !ok {
+		return backendCommand{}, false
+	}
+	arguments := call[2 : len(call)-1]
+	command := backendCommand{kind: kind, column: column}
+	switch kind {
+	case backendCommandPid:
+		return command, len(arguments) == 0
+	case backendCommandTerminate:
+		// the timeout of pg_terminate_backend is not waited for
+		if len(arguments) > 2 && arguments[len(arguments)-2].text == "," {
+			arguments = arguments[:len(arguments)-2]
+		}
+	}
+	if !isPidArgument(arguments) {
+		return backendCommand{}, false
+	}
+	command.argument = arguments
+	return command, true
+}
+
+// parseFunctionCall returns the tokens of a call like pg_catalog.f(a, b) without the catalog and the
+// tokens following it
+func parseFunctionCall(tokens []sqlToken) (call []sqlToken, rest []sqlToken, ok bool) {
+	if len(tokens) >= 2 && tokens[0].isWord("pg_catalog") && tokens[1].text == "." {
+		tokens = tokens[2:]
+	}
+	if len(tokens) < 3 || tokens[0].kind != sqlTokenWord || tokens[1].text != "(" {
+		return nil, nil, false
+	}
+	for i := 2; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			return nil, nil, false
+		case ")":
+			return tokens[:i+1], tokens[i+1:], true
+		}
+	}
+	return nil, nil, false
+}
+
+// isPidArgument reports if the arguments are a single number, placeholder or pg_backend_pid() call
+func isPidArgument(arguments []sqlToken) bool {
+	if len(arguments) == 1 {
+		return arguments[0].kind == sqlTokenNumber || arguments[0].kind == sqlTokenPlaceholder
+	}
+	call, rest, ok := parseFunctionCall(arguments)
+	return ok && len(rest) == 0 && len(call) == 3 && call[0].isWord("pg_backend_pid")
+}
+
+// parseColumnAlias parses an optional [AS] alias which has to be the last tokens
+func parseColumnAlias(tokens []sqlToken, name string) (string, bool) {
+	if len(tokens) > 0 && tokens[0].isWord("as") {
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return "", false
+		}
+	}
+	switch {
+	case len(tokens) == 0:
+		return name, true
+	case len(tokens) == 1 && (tokens[0].kind == sqlTokenWord || tokens[0].kind == sqlTokenQuotedIdentifier):
+		return unquoteSqlIdentifier(tokens[0].text), true
+	}
+	return "", false
+}
+
+// parseActivityQuery parses the tokens following SELECT of
+// SELECT columns FROM [pg_catalog.]pg_stat_activity [alias] [WHERE conditions] [ORDER BY columns] [LIMIT n]
+func parseActivityQuery(tokens []sqlToken) (activityQuery, bool) {
+	query := activityQuery{limit: -1}
+	from := indexOfWord(tokens, "from")
+	if from < 1 || !query.parseColumns(tokens[:from]) {
+		return activityQuery{}, false
+	}
+	tokens = tokens[from+1:]
+	if len(tokens) >= 2 && tokens[0].isWord("pg_catalog") && tokens[1].text == "." {
+		tokens = tokens[2:]
+	}
+	if len(tokens) == 0 || !tokens[0].isWord("pg_stat_activity") {
+		return activityQuery{}, false
+	}
+	tokens = tokens[1:]
+	if len(tokens) > 0 && tokens[0].isWord("as") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && tokens[0].kind == sqlTokenWord && !isActivityClause(tokens[0]) {
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && tokens[0].isWord("where") {
+		end := indexOfClause(tokens[1:]) + 1
+		if !query.parseWhere(tokens[1:end]) {
+			return activityQuery{}, false
+		}
+		tokens = tokens[end:]
+	}
+	if len(tokens) > 1 && tokens[0].isWord("order") && tokens[1].isWord("by") {
+		end := indexOfClause(tokens[2:]) + 2
+		if !query.parseOrderBy(tokens[2:end]) {
+			return activityQuery{}, false
+		}
+		tokens = tokens[end:]
+	}
+	if len(tokens) == 2 && tokens[0].isWord("limit") && tokens[1].kind == sqlTokenNumber {
+		limit, err := strconv.Atoi(tokens[1].text)
+		if err != nil {
+			return activityQuery{}, false
+		}
+		query.limit = limit
+		tokens = tokens[2:]
+	}
+	return query, len(tokens) == 0
+}
+
+func isActivityClause(token sqlToken) bool {
+	return token.isWord("where") || token.isWord("order") || token.isWord("limit")
+}
+
+func indexOfWord(tokens []sqlToken, word string) int {
+	for i, token := range tokens {
+		if token.isWord(word) {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexOfClause returns the index of the next ORDER BY or LIMIT clause, the length of the tokens if there is none
+func indexOfClause(tokens []sqlToken) int {
+	for i, token := range tokens {
+		if token.isWord("order") || token.isWord("limit") {
+			return i
+		}
+	}
+	return len(tokens)
+}
+
+// activityColumn resolves a column optionally qualified by the alias of pg_stat_activity
+func activityColumn(tokens []sqlToken) (column int, rest []sqlToken, ok bool) {
+	if len(tokens) >= 3 && tokens[1].text == "." {
+		tokens = tokens[2:]
+	}
+	if len(tokens) == 0 || (tokens[0].kind != sqlTokenWord && tokens[0].kind != sqlTokenQuotedIdentifier) {
+		return 0, nil, false
+	}
+	name := strings.ToLower(unquoteSqlIdentifier(tokens[0].text))
+	for i, column := range activityColumns {
+		if column.Name == name {
+			return i, tokens[1:], true
+		}
+	}
+	return 0, nil, false
+}
+
+func (query *activityQuery) parseColumns(tokens []sqlToken) bool {
+	for _, item := range splitOnCommas(tokens) {
+		if (len(item) == 1 && item[0].text == "*") || (len(item) == 3 && item[1].text == "." && item[2].text == "*") {
+			for i, column := range activityColumns {
+				query.columns = append(query.columns, i)
+				query.names = append(query.names, column.Name)
+			}
+			continue
+		}
+		column, rest, ok := activityColumn(item)
+		if !ok {
+			return false
+		}
+		name, ok := parseColumnAlias(rest, activityColumns[column].Name)
+		if !ok {
+			return false
+		}
+		query.columns = append(query.columns, column)
+		query.names = append(query.names, name)
+	}
+	return len(query.columns) > 0
+}
+
+func (query *activityQuery) parseWhere(tokens []sqlToken) bool {
+	for len(tokens) > 0 {
+		end := indexOfWord(tokens, "and")
+		if end < 0 {
+			end = len(tokens)
+		}
+		column, rest, ok := activityColumn(tokens[:end])
+		if !ok {
+			return false
+		}
+		condition := activityCondition{column: column}
+		switch {
+		case len(rest) == 2 && rest[0].isWord("is") && rest[1].isWord("null"):
+			condition.operator = "is null"
+		case len(rest) == 3 && rest[0].isWord("is") && rest[1].isWord("not") && rest[2].isWord("null"):
+			condition.operator = "is not null"
+		case len(rest) >= 2 && rest[0].text == "=":
+			condition.operator, condition.value = "=", rest[1:]
+		case len(rest) >= 3 && ((rest[0].text == "<" && rest[1].text == ">") || (rest[0].text == "!" && rest[1].text == "=")):
+			condition.operator, condition.value = "<>", rest[2:]
+		default:
+			return false
+		}
+		if condition.value != nil && !isActivityValue(condition.value) {
+			return false
+		}
+		query.where = append(query.where, condition)
+		tokens = tokens[end:]
+		if len(tokens) > 0 {
+			tokens = tokens[1:]
+		}
+	}
+	return len(query.where) > 0
+}
+
+// isActivityValue reports if the tokens are a value conditions can compare with
+func isActivityValue(tokens []sqlToken) bool {
+	if len(tokens) == 1 {
+		switch tokens[0].kind {
+		case sqlTokenString, sqlTokenNumber, sqlTokenPlaceholder:
+			return true
+		}
+		return tokens[0].isWord("current_user") || tokens[0].isWord("session_user")
+	}
+	call, rest, ok := parseFunctionCall(tokens)
+	return ok && len(rest) == 0 && len(call) == 3 && (call[0].isWord("pg_backend_pid") || call[0].isWord("current_database"))
+}
+
+func (query *activityQuery) parseOrderBy(tokens []sqlToken) bool {
+	for _, item := range splitOnCommas(tokens) {
+		column, rest, ok := activityColumn(item)
+		if !ok {
+			return false
+		}
+		order := activityOrder{column: column}
+		switch {
+		case len(rest) == 0 || (len(rest) == 1 && rest[0].isWord("asc")):
+		case len(rest) == 1 && rest[0].isWord("desc"):
+			order.descending = true
+		default:
+			return false
+		}
+		query.orderBy = append(query.orderBy, order)
+	}
+	return len(query.orderBy) > 0
+}
+
+func splitOnCommas(tokens []sqlToken) [][]sqlToken {
+	var items [][]sqlToken
+	start := 0
+	for i, token := range tokens {
+		if token.text == "," {
+			items = append(items, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, tokens[start:])
+}
+
+// handleBackendCommand answers the backend functions and pg_stat_activity from the sessions of rdapp
+func (handler *redshiftDataApiQueryHandler) handleBackendCommand(rdappCtx RdappContext, command backendCommand, parameters []QueryParameter, writer wire.DataWriter) error {
+	session := rdappCtx.session
+	switch command.kind {
+	case backendCommandPid:
+		return writeSingleValue(rdappCtx, writer, command.column, oid.T_int4, session.pid)
+	case backendCommandCancel, backendCommandTerminate:
+		pid, err := pidArgument(session, command.argument, parameters)
+		if err != nil {
+			return err
+		}
+		target, ok := handler.sessions.byPid(pid)
+		if !ok {
+			rdappCtx.logger.Warn("there is no backend with the pid", zap.Int32("pid", pid))
+			return writeSingleValue(rdappCtx, writer, command.column, oid.T_bool, false)
+		}
+		// the user names of clients are only verified with WithAuth, without it a client can only signal its own backend
+		if target.user != session.user || (!handler.authenticated && target.id != session.id) {
+			err := errors.New("must be a member of the role whose process is being terminated")
+			if command.kind == backendCommandCancel {
+				err = errors.New("must be a member of the role whose query is being canceled")
+			}
+			if !handler.authenticated {
+				err = psqlerr.WithHint(err, "rdapp does not verify user names without passwords, connections can only signal their own backend")
+			}
+			return psqlerr.WithCode(err, codes.InsufficientPrivilege)
+		}
+		signalled := true
+		if command.kind == backendCommandCancel {
+			rdappCtx.logger.Info("cancelling statements of backend", zap.Int32("pid", pid), zap.String("sessionId", target.id))
+			handler.running.cancelSession(target.id)
+		} else {
+			rdappCtx.logger.Info("terminating backend", zap.Int32("pid", pid), zap.String("sessionId", target.id))
+			signalled = handler.connections.terminate(target.id, handler)
+		}
+		return writeSingleValue(rdappCtx, writer, command.column, oid.T_bool, signalled)
+	case backendCommandStatActivity:
+		return handler.writeActivity(rdappCtx, command.activity, parameters, writer)
+	}
+	return nil
+}
+
+func writeSingleValue(rdappCtx RdappContext, writer wire.DataWriter, column string, columnOid oid.Oid, value any) error {
+	err := writer.Define(wire.Columns{
+		{Name: column, Oid: columnOid, Format: rdappCtx.resultFormat(0)},
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Row([]any{value})
+	if err != nil {
+		return err
+	}
+	return writer.Complete("SELECT 1")
+}
+
+// pidArgument evaluates the pid argument of pg_cancel_backend and pg_terminate_backend
+func pidArgument(session *Session, argument []sqlToken, parameters []QueryParameter) (int32, error) {
+	value := activityValue(session, argument, parameters)
+	pid, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, psqlerr.WithCode(fmt.Errorf("invalid pid %q", value), codes.InvalidParameterValue)
+	}
+	return int32(pid), nil
+}
+
+// activityValue returns the text of a value condition compare with
+func activityValue(session *Session, tokens []sqlToken, parameters []QueryParameter) string {
+	if len(tokens) > 1 {
+		call, _, _ := parseFunctionCall(tokens)
+		if call[0].isWord("pg_backend_pid") {
+			return strconv.Itoa(int(session.pid))
+		}
+		return session.database
+	}
+	token := tokens[0]
+	switch token.kind {
+	case sqlTokenString:
+		return unquoteSqlString(token.text)
+	case sqlTokenPlaceholder:
+		index := 0
+		if strings.HasPrefix(token.text, "$") {
+			index, _ = strconv.Atoi(token.text[1:])
+			index--
+		}
+		if index >= 0 && index < len(parameters) {
+			return string(parameters[index].Value)
+		}
+		return ""
+	case sqlTokenWord:
+		return session.user
+	}
+	return token.text
+}
+
+func (handler *redshiftDataApiQueryHandler) writeActivity(rdappCtx RdappContext, query activityQuery, parameters []QueryParameter, writer wire.DataWriter) error {
+	var rows [][]any
+	for _, activity := range handler.sessions.activity() {
+		row := activityRow(rdappCtx.session, activity, handler.authenticated)
+		if query.matches(rdappCtx.session, row, parameters) {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, order := range query.orderBy {
+			comparison := compareActivityValues(rows[i][order.column], rows[j][order.column])
+			if comparison != 0 {
+				return (comparison < 0) != order.descending
+			}
+		}
+		return false
+	})
+	if query.limit >= 0 && len(rows) > query.limit {
+		rows = rows[:query.limit]
+	}
+	columns := wire.Columns{}
+	for i, column := range query.columns {
+		columns = append(columns, wire.Column{Name: query.names[i], Oid: activityColumns[column].Oid, Format: rdappCtx.resultFormat(i)})
+	}
+	err := writer.Define(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make([]any, len(query.columns))
+		for i, column := range query.columns {
+			values[i] = row[column]
+		}
+		err = writer.Row(values)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Complete(fmt.Sprintf("SELECT %d", len(rows)))
+}
+
+// activityRow is the pg_stat_activity row of a session, the query of sessions of other users is hidden as by
+// postgres. User names are only verified when authenticated, without it only the own query of the viewer is shown.
+func activityRow(viewer *Session, activity Session, authenticated bool) []any {
+	row := make([]any, len(activityColumns))
+	set := func(column string, value any) {
+		for i, activityColumn := range activityColumns {
+			if activityColumn.Name == column {
+				row[i] = value
+			}
+		}
+	}
+	set("datname", activity.database)
+	set("pid", activity.pid)
+	set("usename", activity.user)
+	set("application_name", activity.applicationName)
+	if host, port, err := net.SplitHostPort(activity.clientAddress); err == nil && net.ParseIP(host) != nil {
+		set("client_addr", host)
+		if port, err := strconv.Atoi(port); err == nil {
+			set("client_port", int32(port))
+		}
+	}
+	set("backend_start", activity.startedAt)
+	if !activity.queryStart.IsZero() {
+		set("query_start", activity.queryStart)
+	}
+	set("state_change", activity.stateChange)
+	if activity.active {
+		set("xact_start", activity.queryStart)
+		set("state", "active")
+	} else {
+		set("wait_event_type", "Client")
+		set("wait_event", "ClientRead")
+		set("state", "idle")
+	}
+	set("query", activity.query)
+	if activity.user != viewer.user || (!authenticated && activity.id != viewer.id) {
+		set("query", "<insufficient privilege>")
+	}
+	set("backend_type", "client backend")
+	return row
+}
+
+func (query activityQuery) matches(session *Session, row []any, parameters []QueryParameter) bool {
+	for _, condition := range query.where {
+		value := row[condition.column]
+		switch condition.operator {
+		case "is null":
+			if value != nil {
+				return false
+			}
+		case "is not null":
+			if value == nil {
+				return false
+			}
+		default:
+			if value == nil {
+				return false
+			}
+			equal := activityText(value) == activityValue(session, condition.value, parameters)
+			if equal != (condition.operator == "=") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func activityText(value any) string {
+	if value, ok := value.(time.Time); ok {
+		return value.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// compareActivityValues orders nulls last like postgres does for ascending orders
+func compareActivityValues(a any, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	switch a := a.(type) {
+	case int32:
+		return int(a) - int(b.(int32))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return strings.Compare(activityText(a), activityText(b))
+}
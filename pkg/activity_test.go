@@ -0,0 +1,100 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_parseBackendCommand(t *testing.T) {
+	type args struct {
+		statement string
+	}
+	tests := []struct {
+		name           string
+		args           args
+		wantKind       backendCommandKind
+		wantColumn     string
+		wantOk         bool
+		wantColumnList []string
+	}{
+		{
+			name:       "backend pid",
+			args:       args{statement: "select pg_backend_pid()"},
+			wantKind:   backendCommandPid,
+			wantColumn: "pg_backend_pid",
+			wantOk:     true,
+		},
+		{
+			name:       "cancel backend with alias",
+			args:       args{statement: "SELECT pg_catalog.pg_cancel_backend(10002) AS cancelled;"},
+			wantKind:   backendCommandCancel,
+			wantColumn: "cancelled",
+			wantOk:     true,
+		},
+		{
+			name:       "terminate backend with timeout",
+			args:       args{statement: "select pg_terminate_backend($1, 500)"},
+			wantKind:   backendCommandTerminate,
+			wantColumn: "pg_terminate_backend",
+			wantOk:     true,
+		},
+		{
+			name:           "pg_stat_activity with conditions, order and limit",
+			args:           args{statement: "SELECT sa.pid, sa.usename AS user_name, state FROM pg_catalog.pg_stat_activity sa WHERE sa.pid <> pg_backend_pid() AND state IS NOT NULL ORDER BY pid DESC LIMIT 10"},
+			wantKind:       backendCommandStatActivity,
+			wantOk:         true,
+			wantColumnList: []string{"pid", "user_name", "state"},
+		},
+		{
+			name:   "pg_stat_activity join is left to redshift",
+			args:   args{statement: "select a.pid from pg_stat_activity a join pg_locks l on l.pid = a.pid"},
+			wantOk: false,
+		},
+		{
+			name:   "other functions are not backend commands",
+			args:   args{statement: "select pg_cancel_backend(pid) from stv_sessions"},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseBackendCommand(tt.args.statement)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.wantKind, got.kind)
+			require.Equal(t, tt.wantColumn, got.column)
+			require.Equal(t, tt.wantColumnList, got.activity.names)
+		})
+	}
+}
+
+func Test_activityQuery_matches(t *testing.T) {
+	viewer := &Session{pid: 10001, user: "alice", database: "dev"}
+	command, ok := parseBackendCommand("select * from pg_stat_activity where pid <> pg_backend_pid() and datname = current_database() and usename = $1")
+	require.True(t, ok)
+	parameters := TextQueryParameters([]string{"bob"})
+
+	other := Session{pid: 10002, user: "bob", database: "dev", clientAddress: "10.0.0.7:51234", startedAt: time.Now(), query: "select 1", active: true}
+	row := activityRow(viewer, other, true)
+	require.True(t, command.activity.matches(viewer, row, parameters))
+	require.Equal(t, "10.0.0.7", row[7])
+	require.Equal(t, int32(51234), row[9])
+	require.Equal(t, "active", row[16])
+	require.Equal(t, "<insufficient privilege>", row[20])
+
+	require.False(t, command.activity.matches(viewer, activityRow(viewer, *viewer, true), parameters))
+}
+
+func Test_activityRow_query(t *testing.T) {
+	viewer := &Session{id: "viewer", pid: 10001, user: "alice", query: "select * from pg_stat_activity"}
+	sameUser := Session{id: "same-user", pid: 10002, user: "alice", query: "select 1"}
+	otherUser := Session{id: "other-user", pid: 10003, user: "bob", query: "select 2"}
+	const query = 20
+
+	require.Equal(t, "select * from pg_stat_activity", activityRow(viewer, *viewer, false)[query])
+	require.Equal(t, "<insufficient privilege>", activityRow(viewer, sameUser, false)[query], "user names are not verified without auth")
+	require.Equal(t, "<insufficient privilege>", activityRow(viewer, otherUser, false)[query])
+
+	require.Equal(t, "select 1", activityRow(viewer, sameUser, true)[query])
+	require.Equal(t, "<insufficient privilege>", activityRow(viewer, otherUser, true)[query])
+}
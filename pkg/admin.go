@@ -0,0 +1,241 @@
+package rdapp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessTimeout bounds a single readiness check
+const readinessTimeout = 5 * time.Second
+
+// ConnectionInfo is an open client connection
+type ConnectionInfo struct {
+	// Id is the id of the session of the connection
+	Id string `json:"id"`
+	// Pid is the pseudo backend pid of the connection, as in pg_stat_activity
+	Pid             int32     `json:"pid"`
+	RemoteAddress   string    `json:"remoteAddress"`
+	OpenedAt        time.Time `json:"openedAt"`
+	Tls             bool      `json:"tls"`
+	User            string    `json:"user,omitempty"`
+	Database        string    `json:"database,omitempty"`
+	ApplicationName string    `json:"applicationName,omitempty"`
+}
+
+// ReadinessCheck returns an error while statements cannot be run
+type ReadinessCheck func(ctx context.Context) error
+
+// NewDataApiReadinessCheck verifies that aws credentials can be retrieved and that the data api lists the
+// databases of the target, which needs access to the cluster or workgroup. Anonymous credentials, as used
+// with fake data apis, are not verified.
+func NewDataApiReadinessCheck(credentials aws.CredentialsProvider, client RedshiftDataApiListDatabasesClient, redshiftDataApiConfig RedshiftDataAPIConfig) ReadinessCheck {
+	return func(ctx context.Context) error {
+		if _, anonymous := credentials.(aws.AnonymousCredentials); !anonymous {
+			if credentials == nil {
+				return fmt.Errorf("no aws credentials are configured")
+			}
+			_, err := credentials.Retrieve(ctx)
+			if err != nil {
+				return fmt.Errorf("error while retrieving aws credentials: %w", err)
+			}
+		}
+		_, err := client.ListDatabases(ctx, &redshiftdata.ListDatabasesInput{
+			Database:          redshiftDataApiConfig.Database,
+			ClusterIdentifier: redshiftDataApiConfig.ClusterIdentifier,
+			DbUser:            redshiftDataApiConfig.DbUser,
+			SecretArn:         redshiftDataApiConfig.SecretArn,
+			WorkgroupName:     redshiftDataApiConfig.WorkgroupName,
+			MaxResults:        1,
+		})
+		if err != nil {
+			return fmt.Errorf("error while performing list databases operation: %w", err)
+		}
+		return nil
+	}
+}
+
+type AdminServer interface {
+	Run() error
+	Serve(listener net.Listener) error
+}
+
+type adminServer struct {
+	listenAddress  string
+	token          string
+	proxy          PostgresRedshiftProxy
+	readinessCheck ReadinessCheck
+	logger         *zap.Logger
+}
+
+// NewAdminServer serves the probes of the proxy and lets operators list, cancel and terminate its
+// statements and connections. The probes are open, the other endpoints need the token as bearer token.
+// Without a token the admin server only listens on loopback addresses.
+func NewAdminServer(listenAddress string, token string, proxy PostgresRedshiftProxy, readinessCheck ReadinessCheck, logger *zap.Logger) (AdminServer, error) {
+	if token == "" && !isLoopbackAddress(listenAddress) {
+		return nil, fmt.Errorf("admin endpoints on %s need a token, only loopback addresses are served without one", listenAddress)
+	}
+	return &adminServer{
+		listenAddress:  listenAddress,
+		token:          token,
+		proxy:          proxy,
+		readinessCheck: readinessCheck,
+		logger:         logger,
+	}, nil
+}
+
+// isLoopbackAddress is true for addresses like localhost:8080 or 127.0.0.1:8080, an address without
+// host listens on every interface
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *adminServer) Run() error {
+	listener, err := net.Listen("tcp", server.listenAddress)
+	if err != nil {
+		server.logger.Error("error while listening for admin endpoints",
+			zap.String("adminListenAddress", server.listenAddress),
+			zap.Error(err))
+		return fmt.Errorf("error while listening for admin endpoints on %s: %w", server.listenAddress, err)
+	}
+	return server.Serve(listener)
+}
+
+func (server *adminServer) Serve(listener net.Listener) error {
+	server.logger.Info("serving admin endpoints",
+		zap.String("adminListenAddress", listener.Addr().String()))
+	err := http.Serve(listener, server.handler())
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		server.logger.Error("error while serving admin endpoints",
+			zap.String("adminListenAddress", server.listenAddress),
+			zap.Error(err))
+		return fmt.Errorf("error while serving admin endpoints on %s: %w", server.listenAddress, err)
+	}
+	return nil
+}
+
+func (server *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.live)
+	mux.HandleFunc("/readyz", server.ready)
+	mux.HandleFunc("/connections", server.authorized(server.connections))
+	mux.HandleFunc("/connections/", server.authorized(server.terminateConnection))
+	mux.HandleFunc("/statements", server.authorized(server.statements))
+	mux.HandleFunc("/statements/", server.authorized(server.cancelStatement))
+	return mux
+}
+
+// authorized answers requests without the bearer token of the admin server, every request is authorized
+// when there is no token as the server then only listens on loopback addresses
+func (server *adminServer) authorized(handle http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if server.token != "" && (!ok || subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1) {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "a valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		handle(writer, request)
+	}
+}
+
+func (server *adminServer) live(writer http.ResponseWriter, _ *http.Request) {
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+func (server *adminServer) ready(writer http.ResponseWriter, request *http.Request) {
+	if server.proxy.ShuttingDown() {
+		http.Error(writer, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), readinessTimeout)
+	defer cancel()
+	err := server.readinessCheck(ctx)
+	if err != nil {
+		server.logger.Warn("not ready", zap.Error(err))
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = writer.Write([]byte("ready\n"))
+}
+
+func (server *adminServer) connections(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	server.writeJson(writer, server.proxy.Connections())
+}
+
+func (server *adminServer) statements(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	server.writeJson(writer, server.proxy.Statements())
+}
+
+// terminateConnection handles POST /connections/{id}/terminate
+func (server *adminServer) terminateConnection(writer http.ResponseWriter, request *http.Request) {
+	id, ok := actionTarget(writer, request, "/connections/", "/terminate")
+	if !ok {
+		return
+	}
+	if !server.proxy.TerminateConnection(id) {
+		http.Error(writer, fmt.Sprintf("there is no connection %s", id), http.StatusNotFound)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// cancelStatement handles POST /statements/{id}/cancel
+func (server *adminServer) cancelStatement(writer http.ResponseWriter, request *http.Request) {
+	id, ok := actionTarget(writer, request, "/statements/", "/cancel")
+	if !ok {
+		return
+	}
+	if !server.proxy.CancelStatement(id) {
+		http.Error(writer, fmt.Sprintf("there is no running statement %s", id), http.StatusNotFound)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// actionTarget returns the id of a POST {prefix}{id}{action} request, other requests are answered
+func actionTarget(writer http.ResponseWriter, request *http.Request, prefix string, action string) (string, bool) {
+	id := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, prefix), action)
+	if id == "" || strings.Contains(id, "/") || !strings.HasSuffix(request.URL.Path, action) {
+		http.NotFound(writer, request)
+		return "", false
+	}
+	if request.Method != http.MethodPost {
+		http.Error(writer, "only POST is supported", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	return id, true
+}
+
+func (server *adminServer) writeJson(writer http.ResponseWriter, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		server.logger.Error("error while writing admin response", zap.Error(err))
+	}
+}
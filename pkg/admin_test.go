@@ -0,0 +1,125 @@
+package rdapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_adminServer(t *testing.T) {
+	queryHandler := NewRedshiftDataApiQueryHandler(&activeStatementsExceededService{}, NewPgRedshiftTranslator(), RedshiftDataAPIConfig{}, nil, nil,
+		ReadOnlyPolicy{}, nil, RowLimitPolicy{}, nil, nil, Hooks{}, NewMetrics(), zap.NewNop())
+	proxy := newPostgresRedshiftProxy(nil, queryHandler, proxyOptions{listenAddress: DefaultListenAddress, metrics: NewMetrics(), logger: zap.NewNop()}, newClientConnections(NewBackendPids()))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := (&trackingListener{Listener: listener, proxy: proxy}).Accept()
+	require.NoError(t, err)
+	connectionId := conn.(*trackedConn).id
+
+	rdappCtx := NewRdappContext(context.Background(), zap.NewNop())
+	rdappCtx.correlationId = "correlation"
+	rdappCtx.session = &Session{id: connectionId, user: "analyst"}
+	statementCtx, finished, err := queryHandler.(*redshiftDataApiQueryHandler).running.start(rdappCtx, "select 1")
+	require.NoError(t, err)
+	defer finished()
+	statementCtx.submitted("data-api-id")
+
+	ready := errors.New("credentials expired")
+	_, err = NewAdminServer(":8080", "", proxy, nil, zap.NewNop())
+	require.ErrorContains(t, err, "need a token", "admin endpoints on every interface need a token")
+	server, err := NewAdminServer(":8080", "secret", proxy, func(ctx context.Context) error { return ready }, zap.NewNop())
+	require.NoError(t, err)
+	handler := server.(*adminServer).handler()
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	unauthorized := httptest.NewRecorder()
+	handler.ServeHTTP(unauthorized, httptest.NewRequest(http.MethodPost, "/connections/"+connectionId+"/terminate", nil))
+	require.Equal(t, http.StatusUnauthorized, unauthorized.Code)
+	probe := httptest.NewRecorder()
+	handler.ServeHTTP(probe, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, probe.Code, "probes need no token")
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/healthz").Code)
+	response := serve(http.MethodGet, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, response.Code)
+	require.Contains(t, response.Body.String(), "credentials expired")
+	ready = nil
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/readyz").Code)
+
+	var connections []ConnectionInfo
+	require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/connections").Body.Bytes(), &connections))
+	require.Len(t, connections, 1)
+	require.Equal(t, connectionId, connections[0].Id)
+	require.Equal(t, client.LocalAddr().String(), connections[0].RemoteAddress)
+
+	var statements []ActiveStatement
+	require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/statements").Body.Bytes(), &statements))
+	require.Len(t, statements, 1)
+	require.Equal(t, "correlation", statements[0].Id)
+	require.Equal(t, connectionId, statements[0].SessionId)
+	require.Equal(t, "analyst", statements[0].User)
+	require.Equal(t, []string{"data-api-id"}, statements[0].DataApiIds)
+
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodGet, "/statements/correlation/cancel").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/statements/unknown/cancel").Code)
+	require.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/statements/correlation/cancel").Code)
+	require.Error(t, statementCtx.Err(), "the statement is cancelled")
+
+	require.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/connections/unknown/terminate").Code)
+	require.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/connections/"+connectionId+"/terminate").Code)
+	require.Empty(t, proxy.Connections())
+
+	proxy.mutex.Lock()
+	proxy.closed = true
+	proxy.mutex.Unlock()
+	require.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/readyz").Code, "not ready while shutting down")
+}
+
+func Test_NewDataApiReadinessCheck(t *testing.T) {
+	config := RedshiftDataAPIConfig{Database: aws.String("dev"), WorkgroupName: aws.String("rdapp")}
+	client := &listDatabasesClient{}
+	check := NewDataApiReadinessCheck(aws.AnonymousCredentials{}, client, config)
+	require.NoError(t, check(context.Background()))
+	require.Equal(t, config.WorkgroupName, client.input.WorkgroupName)
+
+	client.err = errors.New("AccessDeniedException")
+	require.ErrorContains(t, check(context.Background()), "AccessDeniedException")
+
+	check = NewDataApiReadinessCheck(nil, &listDatabasesClient{}, config)
+	require.Error(t, check(context.Background()), "no credentials are configured")
+}
+
+type listDatabasesClient struct {
+	input *redshiftdata.ListDatabasesInput
+	err   error
+}
+
+func (client *listDatabasesClient) ListDatabases(_ context.Context, params *redshiftdata.ListDatabasesInput, _ ...func(*redshiftdata.Options)) (*redshiftdata.ListDatabasesOutput, error) {
+	client.input = params
+	return &redshiftdata.ListDatabasesOutput{}, client.err
+}
+
+func Test_isLoopbackAddress(t *testing.T) {
+	require.True(t, isLoopbackAddress("localhost:8080"))
+	require.True(t, isLoopbackAddress("127.0.0.1:8080"))
+	require.True(t, isLoopbackAddress("[::1]:8080"))
+	require.False(t, isLoopbackAddress(":8080"), "listens on every interface")
+	require.False(t, isLoopbackAddress("10.0.0.1:8080"))
+}
@@ -0,0 +1,533 @@
+package rdapp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AuditEventConnectionOpened = "connection_opened"
+	AuditEventConnectionClosed = "connection_closed"
+	AuditEventSessionStarted   = "session_started"
+	AuditEventSessionEnded     = "session_ended"
+	AuditEventStatement        = "statement"
+)
+
+const redactedParameter = "<redacted>"
+
+// AuditIdentity is the identity statements are run as on the aws and redshift side
+type AuditIdentity struct {
+	// AwsPrincipal is the arn of the aws credentials rdapp uses
+	AwsPrincipal string `json:"awsPrincipal,omitempty"`
+	DbUser       string `json:"dbUser,omitempty"`
+	SecretArn    string `json:"secretArn,omitempty"`
+}
+
+// NewAuditIdentity resolves the aws principal of the credentials in use
+func NewAuditIdentity(ctx context.Context, stsClient StsClient, config RedshiftDataAPIConfig) (AuditIdentity, error) {
+	callerIdentity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return AuditIdentity{}, fmt.Errorf("error while resolving aws caller identity: %w", err)
+	}
+	return AuditIdentity{
+		AwsPrincipal: aws.ToString(callerIdentity.Arn),
+		DbUser:       aws.ToString(config.DbUser),
+		SecretArn:    aws.ToString(config.SecretArn),
+	}, nil
+}
+
+// AuditRecord is a single entry of the audit log. Records are chained by hash, each record
+// holds the hash of its predecessor so that removing or altering records can be detected.
+type AuditRecord struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	// ClientAddress is known for connection events only as psql-wire does not expose it to query handlers
+	ClientAddress   string        `json:"clientAddress,omitempty"`
+	SessionId       string        `json:"sessionId,omitempty"`
+	User            string        `json:"user,omitempty"`
+	Identity        AuditIdentity `json:"identity"`
+	Target          string        `json:"target"`
+	CorrelationId   string        `json:"correlationId,omitempty"`
+	Statement       string        `json:"statement,omitempty"`
+	Parameters      []string      `json:"parameters,omitempty"`
+	DataApiQueryId  string        `json:"dataApiQueryId,omitempty"`
+	RedshiftQueryId int64         `json:"redshiftQueryId,omitempty"`
+	Outcome         string        `json:"outcome,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	PreviousHash    string        `json:"previousHash"`
+	Hash            string        `json:"hash"`
+}
+
+// computeHash hashes the record without its own hash
+func (record AuditRecord) computeHash() (string, error) {
+	record.Hash = ""
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("error while encoding audit record: %w", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type AuditSink interface {
+	Write(record AuditRecord) error
+	Close() error
+}
+
+// AuditAnchor is a record the hash chain continues from, the zero anchor is the start of the chain
+type AuditAnchor struct {
+	Sequence uint64 `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+func (anchor AuditAnchor) String() string {
+	return fmt.Sprintf("%d:%s", anchor.Sequence, anchor.Hash)
+}
+
+// ParseAuditAnchor parses an anchor in the sequence:hash form printed by AuditAnchor.String
+func ParseAuditAnchor(value string) (AuditAnchor, error) {
+	sequence, hash, ok := strings.Cut(value, ":")
+	parsedSequence, err := strconv.ParseUint(sequence, 10, 64)
+	if !ok || err != nil || hash == "" {
+		return AuditAnchor{}, fmt.Errorf("invalid audit anchor %q, expected sequence:hash", value)
+	}
+	return AuditAnchor{Sequence: parsedSequence, Hash: hash}, nil
+}
+
+// auditChainResumer is implemented by sinks which can continue the hash chain of a previous run
+type auditChainResumer interface {
+	head() (AuditAnchor, bool, error)
+}
+
+type AuditLog interface {
+	// Record completes the record with the identity, target and hash chain and writes it to every sink
+	Record(record AuditRecord)
+	Close() error
+}
+
+type auditLog struct {
+	mutex            sync.Mutex
+	identity         AuditIdentity
+	target           string
+	redactParameters bool
+	sequence         uint64
+	previousHash     string
+	sinks            []AuditSink
+	logger           *zap.Logger
+}
+
+func NewAuditLog(identity AuditIdentity, target string, redactParameters bool, logger *zap.Logger, sinks ...AuditSink) (AuditLog, error) {
+	log := &auditLog{
+		identity:         identity,
+		target:           target,
+		redactParameters: redactParameters,
+		sinks:            sinks,
+		logger:           logger,
+	}
+	for _, sink := range sinks {
+		resumer, ok := sink.(auditChainResumer)
+		if !ok {
+			continue
+		}
+		head, found, err := resumer.head()
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			log.sequence = head.Sequence
+			log.previousHash = head.Hash
+		}
+		break
+	}
+	return log, nil
+}
+
+func (log *auditLog) Record(record AuditRecord) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	record.Sequence = log.sequence + 1
+	record.Time = time.Now().UTC()
+	if record.Target == "" {
+		record.Identity = log.identity
+		record.Target = log.target
+	}
+	if log.redactParameters {
+		for i := range record.Parameters {
+			record.Parameters[i] = redactedParameter
+		}
+	}
+	record.PreviousHash = log.previousHash
+	hash, err := record.computeHash()
+	if err != nil {
+		log.logger.Error("error while hashing audit record", zap.Error(err))
+		return
+	}
+	record.Hash = hash
+	log.sequence = record.Sequence
+	log.previousHash = hash
+	for _, sink := range log.sinks {
+		err := sink.Write(record)
+		if err != nil {
+			log.logger.Error("error while writing audit record",
+				zap.Uint64("auditSequence", record.Sequence),
+				zap.Error(err))
+		}
+	}
+}
+
+func (log *auditLog) Close() error {
+	var errs []error
+	for _, sink := range log.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type listenerAuditLog struct {
+	AuditLog
+	identity AuditIdentity
+	target   string
+}
+
+// NewListenerAuditLog records to the audit log with the identity and target of a listener, the records of
+// all listeners share the hash chain of the log. Closing it leaves the audit log open.
+func NewListenerAuditLog(log AuditLog, identity AuditIdentity, target string) AuditLog {
+	return &listenerAuditLog{
+		AuditLog: log,
+		identity: identity,
+		target:   target,
+	}
+}
+
+func (log *listenerAuditLog) Record(record AuditRecord) {
+	record.Identity = log.identity
+	record.Target = log.target
+	log.AuditLog.Record(record)
+}
+
+func (log *listenerAuditLog) Close() error {
+	return nil
+}
+
+// VerifyAuditLog checks the hash chain of audit files, given oldest first, and returns the last record
+// verified along with the number of records. The chain has to continue from the anchor, the zero anchor
+// requires it to start with the first record ever written so that removing records from the head is detected.
+func VerifyAuditLog(anchor AuditAnchor, readers ...io.Reader) (AuditAnchor, int, error) {
+	head := anchor
+	count := 0
+	for _, reader := range readers {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			var record AuditRecord
+			err := json.Unmarshal(scanner.Bytes(), &record)
+			if err != nil {
+				return head, count, fmt.Errorf("error while decoding audit record after sequence %d: %w", head.Sequence, err)
+			}
+			hash, err := record.computeHash()
+			if err != nil {
+				return head, count, err
+			}
+			if hash != record.Hash {
+				return head, count, fmt.Errorf("audit record %d has been altered", record.Sequence)
+			}
+			if record.PreviousHash != head.Hash || record.Sequence != head.Sequence+1 {
+				if count == 0 {
+					return head, count, fmt.Errorf("audit records between %d and %d are missing, pass the files rotated before or an anchor", head.Sequence, record.Sequence)
+				}
+				return head, count, fmt.Errorf("audit records between %d and %d are missing or reordered", head.Sequence, record.Sequence)
+			}
+			head = AuditAnchor{Sequence: record.Sequence, Hash: record.Hash}
+			count++
+		}
+		err := scanner.Err()
+		if err != nil {
+			return head, count, fmt.Errorf("error while reading audit log: %w", err)
+		}
+	}
+	return head, count, nil
+}
+
+// fileAuditSink writes records as json lines to a file rotated by size. The last record written is kept
+// in the head file next to it so that the chain continues across rotations and restarts and removing
+// records from the tail is detected.
+type fileAuditSink struct {
+	path   string
+	writer *lumberjack.Logger
+}
+
+// AuditHeadPath is the path of the head file of an audit file
+func AuditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// ReadAuditHead reads the head file of an audit file, found is false when there is none
+func ReadAuditHead(path string) (head AuditAnchor, found bool, err error) {
+	content, err := os.ReadFile(AuditHeadPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return AuditAnchor{}, false, nil
+	}
+	if err != nil {
+		return AuditAnchor{}, false, fmt.Errorf("error while reading audit head: %w", err)
+	}
+	err = json.Unmarshal(content, &head)
+	if err != nil {
+		return AuditAnchor{}, false, fmt.Errorf("error while decoding audit head of %s: %w", path, err)
+	}
+	return head, true, nil
+}
+
+func NewFileAuditSink(path string, maxSizeMegabytes int, maxBackups int) AuditSink {
+	return &fileAuditSink{
+		path: path,
+		writer: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMegabytes,
+			MaxBackups: maxBackups,
+		},
+	}
+}
+
+func (sink *fileAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error while encoding audit record: %w", err)
+	}
+	_, err = sink.writer.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("error while writing audit record to %s: %w", sink.path, err)
+	}
+	return sink.writeHead(AuditAnchor{Sequence: record.Sequence, Hash: record.Hash})
+}
+
+// writeHead replaces the head file atomically so that a crash leaves the previous head
+func (sink *fileAuditSink) writeHead(head AuditAnchor) error {
+	content, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("error while encoding audit head: %w", err)
+	}
+	temporaryPath := AuditHeadPath(sink.path) + ".tmp"
+	err = os.WriteFile(temporaryPath, content, 0o600)
+	if err != nil {
+		return fmt.Errorf("error while writing audit head: %w", err)
+	}
+	err = os.Rename(temporaryPath, AuditHeadPath(sink.path))
+	if err != nil {
+		return fmt.Errorf("error while writing audit head: %w", err)
+	}
+	return nil
+}
+
+func (sink *fileAuditSink) Close() error {
+	return sink.writer.Close()
+}
+
+// head returns the last record written, audit files written before head files were kept are resumed
+// from their last record
+func (sink *fileAuditSink) head() (AuditAnchor, bool, error) {
+	head, found, err := ReadAuditHead(sink.path)
+	if err != nil || found {
+		return head, found, err
+	}
+	last, found, err := sink.lastRecord()
+	return AuditAnchor{Sequence: last.Sequence, Hash: last.Hash}, found, err
+}
+
+// lastRecord reads the last record of the current audit file
+func (sink *fileAuditSink) lastRecord() (AuditRecord, bool, error) {
+	file, err := os.Open(sink.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return AuditRecord{}, false, nil
+	}
+	if err != nil {
+		return AuditRecord{}, false, fmt.Errorf("error while opening audit file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return AuditRecord{}, false, fmt.Errorf("error while reading audit file: %w", err)
+	}
+	const tailSize = 1024 * 1024
+	offset := info.Size() - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(tail, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return AuditRecord{}, false, fmt.Errorf("error while reading audit file: %w", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(tail), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return AuditRecord{}, false, nil
+	}
+	var record AuditRecord
+	err = json.Unmarshal(last, &record)
+	if err != nil {
+		return AuditRecord{}, false, fmt.Errorf("error while decoding last audit record of %s: %w", sink.path, err)
+	}
+	return record, true, nil
+}
+
+// webhookAuditSink posts every record as json to a webhook. Records are delivered in order from a
+// background goroutine so that slow webhooks do not hold up queries, records are dropped while the
+// buffer is full. The webhook can detect dropped records by the gaps in the sequence.
+type webhookAuditSink struct {
+	url     string
+	client  *http.Client
+	records chan AuditRecord
+	done    chan struct{}
+	dropped atomic.Uint64
+	logger  *zap.Logger
+}
+
+const webhookAuditAttempts = 3
+
+func NewWebhookAuditSink(url string, logger *zap.Logger) AuditSink {
+	sink := &webhookAuditSink{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		records: make(chan AuditRecord, 1024),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go sink.deliver()
+	return sink
+}
+
+// Write never blocks as it is called while the audit log is locked
+func (sink *webhookAuditSink) Write(record AuditRecord) error {
+	select {
+	case sink.records <- record:
+		return nil
+	default:
+		return fmt.Errorf("error while queueing audit record for webhook: buffer is full, %d records dropped so far", sink.dropped.Add(1))
+	}
+}
+
+// Close delivers the buffered records before returning
+func (sink *webhookAuditSink) Close() error {
+	close(sink.records)
+	<-sink.done
+	return nil
+}
+
+func (sink *webhookAuditSink) deliver() {
+	defer close(sink.done)
+	for record := range sink.records {
+		var err error
+		for attempt := 1; attempt <= webhookAuditAttempts; attempt++ {
+			err = sink.post(record)
+			if err == nil {
+				break
+			}
+			if attempt < webhookAuditAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			sink.logger.Error("error while forwarding audit record to webhook",
+				zap.Uint64("auditSequence", record.Sequence),
+				zap.Error(err))
+		}
+	}
+}
+
+func (sink *webhookAuditSink) post(record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error while encoding audit record: %w", err)
+	}
+	response, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error while posting audit record: %w", err)
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("error while posting audit record: unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// auditSession records the start or end of a client session when auditing is enabled
+func (handler *redshiftDataApiQueryHandler) auditSession(event string, session *Session) {
+	if handler.auditLog == nil {
+		return
+	}
+	handler.auditLog.Record(AuditRecord{
+		Event:     event,
+		SessionId: session.id,
+		User:      session.user,
+	})
+}
+
+// auditStatement records a statement received from a client, including the ones answered by rdapp itself
+func (handler *redshiftDataApiQueryHandler) auditStatement(rdappCtx RdappContext, statement string, parameters []QueryParameter, result *QueryResult, err error) {
+	if handler.auditLog == nil {
+		return
+	}
+	record := AuditRecord{
+		Event:         AuditEventStatement,
+		CorrelationId: rdappCtx.correlationId,
+		Statement:     statement,
+		Parameters:    auditParameters(parameters),
+		Outcome:       HistoryStatusSuccess,
+	}
+	if rdappCtx.session != nil {
+		record.SessionId = rdappCtx.session.id
+		record.User = rdappCtx.session.user
+	}
+	if result != nil {
+		record.DataApiQueryId = result.QueryId
+		record.RedshiftQueryId = result.RedshiftQueryId
+	}
+	if err != nil {
+		record.Outcome = HistoryStatusError
+		record.Error = err.Error()
+		var statementError *StatementError
+		if errors.As(err, &statementError) {
+			record.DataApiQueryId = statementError.QueryId
+			record.RedshiftQueryId = statementError.RedshiftQueryId
+		}
+	}
+	handler.auditLog.Record(record)
+}
+
+// auditParameters renders the parameters as text, values which cannot be decoded are rendered in hex
+func auditParameters(parameters []QueryParameter) []string {
+	var values []string
+	for _, parameter := range parameters {
+		if parameter.Value == nil {
+			values = append(values, "NULL")
+			continue
+		}
+		value, err := parameter.textValue()
+		if err != nil {
+			value = hex.EncodeToString(parameter.Value)
+		}
+		values = append(values, value)
+	}
+	return values
+}
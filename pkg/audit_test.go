@@ -0,0 +1,127 @@
+package rdapp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_VerifyAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	writeAuditRecords := func(statements ...string) {
+		auditLog, err := NewAuditLog(AuditIdentity{DbUser: "rdapp"}, "workgroup/analytics/dev", true, zap.NewNop(), NewFileAuditSink(path, 1, 1))
+		require.NoError(t, err)
+		for _, statement := range statements {
+			auditLog.Record(AuditRecord{Event: AuditEventStatement, Statement: statement, Parameters: []string{"secret"}})
+		}
+		require.NoError(t, auditLog.Close())
+	}
+	// the second run continues the chain of the first
+	writeAuditRecords("select 1", "select 2")
+	writeAuditRecords("select 3")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 3)
+	require.NotContains(t, string(content), "secret")
+	head, found, err := ReadAuditHead(path)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, anchorOf(lines[2]), head)
+	// the head carries the chain over a rotation of the file
+	require.NoError(t, os.Rename(path, path+".1"))
+	writeAuditRecords("select 4")
+	rotated, err := os.ReadFile(path)
+	require.NoError(t, err)
+	_, count, err := VerifyAuditLog(AuditAnchor{}, strings.NewReader(string(content)), strings.NewReader(string(rotated)))
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+	type args struct {
+		content string
+		anchor  AuditAnchor
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantCount int
+		wantErr   string
+	}{
+		{
+			name:      "intact",
+			args:      args{content: string(content)},
+			wantCount: 3,
+		},
+		{
+			name:      "removed head",
+			args:      args{content: lines[1] + lines[2]},
+			wantCount: 0,
+			wantErr:   "audit records between 0 and 2 are missing, pass the files rotated before or an anchor",
+		},
+		{
+			name:      "rotated away records before the anchor",
+			args:      args{content: lines[1] + lines[2], anchor: anchorOf(lines[0])},
+			wantCount: 2,
+		},
+		{
+			name:      "altered record",
+			args:      args{content: lines[0] + strings.Replace(lines[1], "select 2", "select 4", 1) + lines[2]},
+			wantCount: 1,
+			wantErr:   "audit record 2 has been altered",
+		},
+		{
+			name:      "removed record",
+			args:      args{content: lines[0] + lines[2]},
+			wantCount: 1,
+			wantErr:   "audit records between 1 and 3 are missing or reordered",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, count, err := VerifyAuditLog(tt.args.anchor, strings.NewReader(tt.args.content))
+			require.Equal(t, tt.wantCount, count)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_NewListenerAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewAuditLog(AuditIdentity{}, "", false, zap.NewNop(), NewFileAuditSink(path, 1, 1))
+	require.NoError(t, err)
+	prod := NewListenerAuditLog(auditLog, AuditIdentity{SecretArn: "prod-secret"}, "workgroup/prod/analytics")
+	dev := NewListenerAuditLog(auditLog, AuditIdentity{DbUser: "dev"}, "cluster/dev/dev")
+	prod.Record(AuditRecord{Event: AuditEventStatement, Statement: "select 1"})
+	dev.Record(AuditRecord{Event: AuditEventStatement, Statement: "select 2"})
+	require.NoError(t, prod.Close())
+	require.NoError(t, auditLog.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2, "closing a listener audit log leaves the audit log open")
+	require.Contains(t, lines[0], `"target":"workgroup/prod/analytics"`)
+	require.Contains(t, lines[1], `"target":"cluster/dev/dev"`)
+	_, count, err := VerifyAuditLog(AuditAnchor{}, strings.NewReader(string(content)))
+	require.NoError(t, err, "the listeners share the hash chain")
+	require.Equal(t, 2, count)
+}
+
+func anchorOf(line string) AuditAnchor {
+	var record AuditRecord
+	_ = json.Unmarshal([]byte(line), &record)
+	return AuditAnchor{Sequence: record.Sequence, Hash: record.Hash}
+}
+
+func Test_webhookAuditSink_Write(t *testing.T) {
+	sink := &webhookAuditSink{records: make(chan AuditRecord, 1)}
+	require.NoError(t, sink.Write(AuditRecord{Sequence: 1}))
+	require.EqualError(t, sink.Write(AuditRecord{Sequence: 2}), "error while queueing audit record for webhook: buffer is full, 1 records dropped so far", "a full buffer does not block")
+}
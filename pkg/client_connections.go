@@ -0,0 +1,117 @@
+package rdapp
+
+import (
+	"errors"
+	"sync"
+)
+
+// clientConnections are the open client connections of a proxy keyed by the id of their session. The proxy
+// tracks them while its query handler reaches them for notices, the extended protocol and pg_terminate_backend.
+// A nil clientConnections has no connections.
+type clientConnections struct {
+	// mutex guards the map as well as the negotiated state of the connections
+	mutex sync.Mutex
+	conns map[string]*trackedConn
+	pids  *BackendPids
+}
+
+func newClientConnections(pids *BackendPids) *clientConnections {
+	return &clientConnections{
+		conns: map[string]*trackedConn{},
+		pids:  pids,
+	}
+}
+
+// add tracks the connection and hands it the next backend pid
+func (connections *clientConnections) add(conn *trackedConn) {
+	conn.pid = connections.pids.next()
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	connections.conns[conn.id] = conn
+}
+
+func (connections *clientConnections) remove(id string) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	delete(connections.conns, id)
+}
+
+func (connections *clientConnections) get(id string) (*trackedConn, bool) {
+	if connections == nil {
+		return nil, false
+	}
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	conn, ok := connections.conns[id]
+	return conn, ok
+}
+
+func (connections *clientConnections) all() []*trackedConn {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	conns := make([]*trackedConn, 0, len(connections.conns))
+	for _, conn := range connections.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// terminate cancels the statements of the session of the connection and closes it, false if there is none
+func (connections *clientConnections) terminate(id string, queryHandler RedshiftDataApiQueryHandler) bool {
+	conn, ok := connections.get(id)
+	if !ok {
+		return false
+	}
+	for _, statement := range queryHandler.Statements() {
+		if statement.SessionId == id {
+			queryHandler.CancelStatement(statement.Id)
+		}
+	}
+	_ = conn.Close()
+	return true
+}
+
+// extendedProtocolOf returns the extended protocol state of the connection, nil if there is none
+func (connections *clientConnections) extendedProtocolOf(id string) *extendedProtocol {
+	if connections == nil {
+		return nil
+	}
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	conn, ok := connections.conns[id]
+	if !ok {
+		return nil
+	}
+	return conn.extended
+}
+
+// sendNotice writes the notice to the client of the connection as psql-wire v0.5 cannot send notices.
+// psql-wire writes every message with a single Write on the connection, the notice is written under
+// the same write lock so it arrives between two messages.
+func (connections *clientConnections) sendNotice(id string, notice notice) error {
+	conn, ok := connections.get(id)
+	if !ok {
+		return errors.New("connection not found")
+	}
+	_, err := conn.Write(notice.encode())
+	return err
+}
+
+// BackendPids hands out the pseudo backend pids of client connections, the proxies sharing it never hand
+// out the same pid
+type BackendPids struct {
+	mutex sync.Mutex
+	// last is the pid handed out last
+	last int32
+}
+
+func NewBackendPids() *BackendPids {
+	return &BackendPids{last: firstBackendPid - 1}
+}
+
+func (pids *BackendPids) next() int32 {
+	pids.mutex.Lock()
+	defer pids.mutex.Unlock()
+	pids.last++
+	return pids.last
+}
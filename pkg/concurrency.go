@@ -0,0 +1,252 @@
+package rdapp
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	activeStatementsRetryInitialBackoff = 250 * time.Millisecond
+	activeStatementsRetryMaxBackoff     = 5 * time.Second
+)
+
+// ConcurrencyLimits caps the statements running at once via the data api, statements beyond the
+// limits wait in a queue in the order they arrived
+type ConcurrencyLimits struct {
+	// MaxStatements caps the statements of all users, 0 does not cap
+	MaxStatements int
+	// MaxStatementsPerUser caps the statements of each postgres user, 0 does not cap
+	MaxStatementsPerUser int
+	// Users overrides MaxStatementsPerUser per postgres user
+	Users map[string]int
+	// QueueTimeout is how long a statement waits for its turn, 0 waits forever
+	QueueTimeout time.Duration
+	// RetryTimeout is how long a statement is retried while the data api has too many active
+	// statements, 0 retries forever
+	RetryTimeout time.Duration
+}
+
+func (limits ConcurrencyLimits) maxStatementsOf(user string) int {
+	if maxStatements, ok := limits.Users[user]; ok {
+		return maxStatements
+	}
+	return limits.MaxStatementsPerUser
+}
+
+// perUser reports if the limits differ between users, which needs WithAuth as clients choose their user name otherwise
+func (limits ConcurrencyLimits) perUser() bool {
+	return limits.MaxStatementsPerUser > 0 || len(limits.Users) > 0
+}
+
+// ConcurrencyLimiter queues the statements beyond the concurrency limits, proxies sharing a limiter
+// share its limits
+type ConcurrencyLimiter struct {
+	limits         ConcurrencyLimits
+	mutex          sync.Mutex
+	running        int
+	runningPerUser map[string]int
+	// queue holds the waiting statements in arrival order
+	queue   *list.List
+	metrics *Metrics
+}
+
+type queuedStatement struct {
+	user    string
+	started chan struct{}
+}
+
+func NewConcurrencyLimiter(limits ConcurrencyLimits, metrics *Metrics) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limits:         limits,
+		runningPerUser: map[string]int{},
+		queue:          list.New(),
+		metrics:        metrics,
+	}
+}
+
+// acquire waits until the statement of the user may run, the returned function has to be called
+// once the statement finished
+func (limiter *ConcurrencyLimiter) acquire(ctx RdappContext, user string) (func(), error) {
+	release := func() {
+		limiter.release(user)
+	}
+	limiter.mutex.Lock()
+	// every queued statement which may run has been started already, so a new statement which may
+	// run does not overtake any of them
+	if limiter.admits(user) {
+		limiter.start(user)
+		limiter.mutex.Unlock()
+		return release, nil
+	}
+	statement := &queuedStatement{user: user, started: make(chan struct{})}
+	element := limiter.queue.PushBack(statement)
+	position := limiter.queue.Len()
+	limiter.metrics.queuedStatements.Inc()
+	limiter.mutex.Unlock()
+	ctx.logger.Info("queued statement until concurrent statements finish",
+		zap.String("user", user),
+		zap.Int("queuePosition", position))
+	ctx.notify(notice{
+		severity: "NOTICE",
+		code:     sqlStateSuccessfulCompletion,
+		message:  fmt.Sprintf("waiting for concurrent statements to finish, %d in the queue", position),
+	})
+	var timeout <-chan time.Time
+	if limiter.limits.QueueTimeout > 0 {
+		timer := time.NewTimer(limiter.limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-statement.started:
+	case <-timeout:
+		err = psqlerr.WithCode(fmt.Errorf("timed out after %s waiting for concurrent statements to finish", limiter.limits.QueueTimeout), codes.ConfigurationLimitExceeded)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		return release, nil
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	select {
+	case <-statement.started:
+		// started while giving up
+		return release, nil
+	default:
+	}
+	limiter.queue.Remove(element)
+	limiter.metrics.queuedStatements.Dec()
+	ctx.logger.Warn("gave up waiting for concurrent statements to finish", zap.Error(err))
+	return nil, err
+}
+
+func (limiter *ConcurrencyLimiter) release(user string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.running--
+	limiter.runningPerUser[user]--
+	if limiter.runningPerUser[user] == 0 {
+		delete(limiter.runningPerUser, user)
+	}
+	// start the queued statements which may run now, a user at their limit does not hold up others
+	for element := limiter.queue.Front(); element != nil; {
+		next := element.Next()
+		statement := element.Value.(*queuedStatement)
+		if limiter.admits(statement.user) {
+			limiter.queue.Remove(element)
+			limiter.metrics.queuedStatements.Dec()
+			limiter.start(statement.user)
+			close(statement.started)
+		}
+		element = next
+	}
+}
+
+func (limiter *ConcurrencyLimiter) admits(user string) bool {
+	if limiter.limits.MaxStatements > 0 && limiter.running >= limiter.limits.MaxStatements {
+		return false
+	}
+	maxStatements := limiter.limits.maxStatementsOf(user)
+	return maxStatements <= 0 || limiter.runningPerUser[user] < maxStatements
+}
+
+func (limiter *ConcurrencyLimiter) start(user string) {
+	limiter.running++
+	limiter.runningPerUser[user]++
+}
+
+// limitedRedshiftDataAPIService runs statements within the concurrency limits and retries them
+// while the data api has too many active statements
+type limitedRedshiftDataAPIService struct {
+	service RedshiftDataAPIService
+	limiter *ConcurrencyLimiter
+	metrics *Metrics
+}
+
+func newLimitedRedshiftDataAPIService(service RedshiftDataAPIService, limiter *ConcurrencyLimiter, metrics *Metrics) RedshiftDataAPIService {
+	return &limitedRedshiftDataAPIService{
+		service: service,
+		limiter: limiter,
+		metrics: metrics,
+	}
+}
+
+func (limited *limitedRedshiftDataAPIService) ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*QueryResult, error) {
+	var result *QueryResult
+	err := limited.run(ctx, func() (err error) {
+		result, err = limited.service.ExecuteQuery(ctx, query, parameters)
+		return err
+	})
+	return result, err
+}
+
+func (limited *limitedRedshiftDataAPIService) ExecuteBatch(ctx RdappContext, queries []string) ([]QueryResult, error) {
+	var results []QueryResult
+	err := limited.run(ctx, func() (err error) {
+		results, err = limited.service.ExecuteBatch(ctx, queries)
+		return err
+	})
+	return results, err
+}
+
+func (limited *limitedRedshiftDataAPIService) run(ctx RdappContext, execute func() error) error {
+	var user string
+	if ctx.session != nil {
+		user = ctx.session.user
+	}
+	release, err := limited.limiter.acquire(ctx, user)
+	if err != nil {
+		return err
+	}
+	defer release()
+	var deadline time.Time
+	if limited.limiter.limits.RetryTimeout > 0 {
+		deadline = time.Now().Add(limited.limiter.limits.RetryTimeout)
+	}
+	backoff := activeStatementsRetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = execute()
+		if !isActiveStatementsExceeded(err) || (!deadline.IsZero() && time.Now().Add(backoff).After(deadline)) {
+			return err
+		}
+		limited.metrics.activeStatementsRetries.Inc()
+		ctx.logger.Warn("retrying statement as the data api has too many active statements",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff))
+		err = sleep(ctx, backoff)
+		if err != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > activeStatementsRetryMaxBackoff {
+			backoff = activeStatementsRetryMaxBackoff
+		}
+	}
+}
+
+func isActiveStatementsExceeded(err error) bool {
+	var exceeded *types.ActiveStatementsExceededException
+	return errors.As(err, &exceeded)
+}
+
+// sleep waits for the duration unless the context is done first
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
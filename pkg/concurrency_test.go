@@ -0,0 +1,77 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func Test_concurrencyLimiter_acquire(t *testing.T) {
+	ctx := NewRdappContext(context.Background(), zap.NewNop())
+	limiter := NewConcurrencyLimiter(ConcurrencyLimits{
+		MaxStatements:        2,
+		MaxStatementsPerUser: 1,
+		QueueTimeout:         50 * time.Millisecond,
+	}, NewMetrics())
+
+	var notices []string
+	ctx.sendNotice = func(notice notice) error {
+		notices = append(notices, notice.message)
+		return nil
+	}
+
+	releaseEtl, err := limiter.acquire(ctx, "etl")
+	require.NoError(t, err)
+	_, err = limiter.acquire(ctx, "etl")
+	require.Error(t, err, "etl is at its limit")
+	require.Equal(t, []string{"waiting for concurrent statements to finish, 1 in the queue"}, notices)
+
+	releaseAnalyst, err := limiter.acquire(ctx, "analyst")
+	require.NoError(t, err)
+	started := make(chan error)
+	go func() {
+		_, err := limiter.acquire(ctx, "intern")
+		started <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	releaseEtl()
+	require.NoError(t, <-started, "intern starts once etl finished")
+	releaseAnalyst()
+	require.Equal(t, 1, limiter.running)
+}
+
+func Test_limitedRedshiftDataAPIService_ExecuteQuery(t *testing.T) {
+	ctx := NewRdappContext(context.Background(), zap.NewNop())
+	service := &activeStatementsExceededService{failures: 1}
+	limited := newLimitedRedshiftDataAPIService(service, NewConcurrencyLimiter(ConcurrencyLimits{RetryTimeout: time.Minute}, NewMetrics()), NewMetrics())
+
+	result, err := limited.ExecuteQuery(ctx, "select 1", nil)
+	require.NoError(t, err)
+	require.Equal(t, "query", result.QueryId)
+	require.Equal(t, 2, service.calls)
+
+	limited = newLimitedRedshiftDataAPIService(&activeStatementsExceededService{failures: 10}, NewConcurrencyLimiter(ConcurrencyLimits{RetryTimeout: time.Millisecond}, NewMetrics()), NewMetrics())
+	_, err = limited.ExecuteQuery(ctx, "select 1", nil)
+	require.True(t, isActiveStatementsExceeded(err))
+}
+
+// activeStatementsExceededService fails the given number of calls as the data api does when it has too many active statements
+type activeStatementsExceededService struct {
+	failures int
+	calls    int
+}
+
+func (service *activeStatementsExceededService) ExecuteQuery(_ RdappContext, _ string, _ []types.SqlParameter) (*QueryResult, error) {
+	service.calls++
+	if service.calls <= service.failures {
+		return nil, &types.ActiveStatementsExceededException{}
+	}
+	return &QueryResult{QueryId: "query"}, nil
+}
+
+func (service *activeStatementsExceededService) ExecuteBatch(_ RdappContext, _ []string) ([]QueryResult, error) {
+	return nil, nil
+}
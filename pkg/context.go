@@ -2,10 +2,89 @@ package rdapp
 
 import (
 	"context"
+	"fmt"
+	"github.com/google/uuid"
+	wire "github.com/jeroenrinzema/psql-wire"
 	"go.uber.org/zap"
 )
 
 type RdappContext struct {
 	context.Context
-	logger *zap.Logger
+	logger        *zap.Logger
+	session       *Session
+	correlationId string
+	// maxRows caps the rows fetched for a statement, 0 does not cap
+	maxRows int64
+	// columnMasks holds the masking rule per column of the result set being written, nil when nothing is masked
+	columnMasks []*MaskingRule
+	// running keeps the query of the context, nil outside of queries
+	running *runningStatements
+	// resultFormats are the result format codes of the Bind message the query runs for, nil for text
+	resultFormats []wire.FormatCode
+	// sendNotice writes a notice to the client, nil outside of client connections
+	sendNotice func(notice notice) error
+}
+
+// resultFormat returns the format the ith column of a result set is sent in
+func (ctx RdappContext) resultFormat(i int) wire.FormatCode {
+	return resultFormat(ctx.resultFormats, i)
+}
+
+// resultFormat returns the format of the ith column following the semantics of the Bind message, no
+// format codes means text, a single format code applies to every column and otherwise there is one
+// format code per column
+func resultFormat(resultFormats []wire.FormatCode, i int) wire.FormatCode {
+	switch {
+	case len(resultFormats) == 1:
+		return resultFormats[0]
+	case i < len(resultFormats):
+		return resultFormats[i]
+	}
+	return wire.TextFormat
+}
+
+// columnMask returns the masking rule of the ith column, nil if it is not masked
+func (ctx RdappContext) columnMask(i int) *MaskingRule {
+	if i < len(ctx.columnMasks) {
+		return ctx.columnMasks[i]
+	}
+	return nil
+}
+
+// submitted notes the data api id of a statement submitted for the query of the context
+func (ctx RdappContext) submitted(dataApiId string) {
+	if ctx.running != nil {
+		ctx.running.submitted(ctx.correlationId, dataApiId)
+	}
+}
+
+// forwardedStatements returns the set statements replayed ahead of statements sent to redshift
+func (ctx RdappContext) forwardedStatements() []string {
+	if ctx.session == nil {
+		return nil
+	}
+	return ctx.session.forwardedPrefix()
+}
+
+// NewRdappContext constructs a context for using the services outside a client connection
+func NewRdappContext(ctx context.Context, logger *zap.Logger) RdappContext {
+	return RdappContext{
+		Context: ctx,
+		logger:  logger,
+	}
+}
+
+// WithForwardedStatements returns a copy of the context replaying the set statements ahead of the
+// statements it runs, like a client session would
+func (ctx RdappContext) WithForwardedStatements(statements []string) RdappContext {
+	session := newSession(uuid.NewString(), wire.Parameters{})
+	for i, statement := range statements {
+		name := fmt.Sprintf("statement %03d", i)
+		if command, ok := parseSessionCommand(statement); ok && command.parameter != "" {
+			name = command.parameter
+		}
+		session.forward(name, statement)
+	}
+	ctx.session = session
+	return ctx
 }
@@ -0,0 +1,276 @@
+package rdapp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+	"sync"
+)
+
+// maxPendingExecutions bounds the executions kept for the query handler
+const maxPendingExecutions = 64
+
+// maxMessageSize is the default message buffer size of psql-wire, it rejects larger messages so they
+// are not followed
+const maxMessageSize = 1 << 24
+
+// extendedProtocol follows the Parse, Bind, Execute and Close messages of a connection. psql-wire hands
+// the bound parameters to the query handler as strings, their declared types, formats and NULLs as well
+// as the result formats are taken from here.
+type extendedProtocol struct {
+	mutex      sync.Mutex
+	statements map[string]parsedStatement
+	portals    map[string]boundStatement
+	// executions are the portals executed and not yet picked up by the query handler, oldest first
+	executions []execution
+	// header and body of the message being read, remaining is the length of the body still to be read
+	// and following denotes that the body is kept
+	header    []byte
+	body      []byte
+	remaining int
+	following bool
+}
+
+type parsedStatement struct {
+	query         string
+	parameterOids []oid.Oid
+}
+
+// boundStatement is a statement with the parameters and result formats of a Bind message
+type boundStatement struct {
+	query      string
+	parameters []QueryParameter
+	// resultFormats follow the semantics of the Bind message, see resultFormat
+	resultFormats []wire.FormatCode
+}
+
+// execution is an Execute message of the portal with the statement bound to it
+type execution struct {
+	portal string
+	bound  boundStatement
+}
+
+func newExtendedProtocol() *extendedProtocol {
+	return &extendedProtocol{
+		statements: map[string]parsedStatement{},
+		portals:    map[string]boundStatement{},
+	}
+}
+
+// observe follows the messages in the data read from the client, messages may span several reads
+func (protocol *extendedProtocol) observe(data []byte) {
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	for len(data) > 0 {
+		if protocol.remaining == 0 {
+			n := 5 - len(protocol.header)
+			if n > len(data) {
+				n = len(data)
+			}
+			protocol.header = append(protocol.header, data[:n]...)
+			data = data[n:]
+			if len(protocol.header) < 5 {
+				return
+			}
+			protocol.remaining = int(binary.BigEndian.Uint32(protocol.header[1:])) - 4
+			protocol.following = isFollowedMessage(protocol.header[0]) && protocol.remaining <= maxMessageSize
+			// the body grows as it arrives, the length is sent by the client before it authenticated
+			protocol.body = protocol.body[:0]
+			if protocol.remaining <= 0 {
+				protocol.remaining = 0
+				protocol.handle(protocol.header[0], nil)
+				protocol.header = protocol.header[:0]
+			}
+			continue
+		}
+		n := protocol.remaining
+		if n > len(data) {
+			n = len(data)
+		}
+		if protocol.following {
+			protocol.body = append(protocol.body, data[:n]...)
+		}
+		protocol.remaining -= n
+		data = data[n:]
+		if protocol.remaining == 0 {
+			if protocol.following {
+				protocol.handle(protocol.header[0], protocol.body)
+			}
+			protocol.header = protocol.header[:0]
+			// a large body is not kept for the next message
+			if cap(protocol.body) > 1<<16 {
+				protocol.body = nil
+			}
+		}
+	}
+}
+
+func isFollowedMessage(messageType byte) bool {
+	switch messageType {
+	case 'P', 'B', 'E', 'C':
+		return true
+	}
+	return false
+}
+
+// handle follows a single message, malformed messages are ignored as psql-wire rejects them
+func (protocol *extendedProtocol) handle(messageType byte, body []byte) {
+	reader := &messageReader{body: body}
+	switch messageType {
+	case 'P':
+		name := reader.string()
+		statement := parsedStatement{query: reader.string()}
+		count := reader.int16()
+		for i := 0; i < count; i++ {
+			statement.parameterOids = append(statement.parameterOids, oid.Oid(reader.int32()))
+		}
+		if reader.err == nil {
+			protocol.statements[name] = statement
+		}
+	case 'B':
+		portal := reader.string()
+		bound, err := protocol.bind(reader)
+		if err != nil {
+			delete(protocol.portals, portal)
+			return
+		}
+		protocol.portals[portal] = bound
+	case 'E':
+		portal := reader.string()
+		bound, ok := protocol.portals[portal]
+		if !ok || reader.err != nil {
+			return
+		}
+		protocol.executions = append(protocol.executions, execution{portal: portal, bound: bound})
+		if len(protocol.executions) > maxPendingExecutions {
+			protocol.executions = protocol.executions[1:]
+		}
+	case 'C':
+		kind, name := reader.byte(), reader.string()
+		switch kind {
+		case 'S':
+			delete(protocol.statements, name)
+		case 'P':
+			delete(protocol.portals, name)
+		}
+	}
+}
+
+func (protocol *extendedProtocol) bind(reader *messageReader) (boundStatement, error) {
+	statement, ok := protocol.statements[reader.string()]
+	if !ok {
+		return boundStatement{}, errors.New("unknown statement")
+	}
+	bound := boundStatement{query: statement.query}
+	var formats []wire.FormatCode
+	count := reader.int16()
+	for i := 0; i < count; i++ {
+		formats = append(formats, wire.FormatCode(reader.int16()))
+	}
+	count = reader.int16()
+	for i := 0; i < count; i++ {
+		parameter := QueryParameter{Format: wire.TextFormat}
+		switch {
+		case len(formats) == 1:
+			parameter.Format = formats[0]
+		case i < len(formats):
+			parameter.Format = formats[i]
+		}
+		if i < len(statement.parameterOids) {
+			parameter.Oid = statement.parameterOids[i]
+		}
+		if length := reader.int32(); length >= 0 {
+			parameter.Value = reader.bytes(int(length))
+		}
+		bound.parameters = append(bound.parameters, parameter)
+	}
+	count = reader.int16()
+	for i := 0; i < count; i++ {
+		bound.resultFormats = append(bound.resultFormats, wire.FormatCode(reader.int16()))
+	}
+	return bound, reader.err
+}
+
+// take returns the statement bound to the portal of the oldest execution, psql-wire calls the query handler
+// for the Execute messages in order. The query and number of parameters psql-wire calls the query handler
+// with must match the portal, otherwise the executions are out of step and all of them are dropped rather
+// than guessing which one the call belongs to.
+func (protocol *extendedProtocol) take(query string, noOfParameters int) (boundStatement, bool) {
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	if len(protocol.executions) == 0 {
+		return boundStatement{}, false
+	}
+	oldest := protocol.executions[0]
+	if oldest.bound.query != query || len(oldest.bound.parameters) != noOfParameters {
+		protocol.executions = nil
+		return boundStatement{}, false
+	}
+	protocol.executions = protocol.executions[1:]
+	return oldest.bound, true
+}
+
+// hasStatement reports if the statement was prepared via the extended protocol
+func (protocol *extendedProtocol) hasStatement(name string) bool {
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	_, ok := protocol.statements[name]
+	return ok
+}
+
+// messageReader reads the fields of a message body, err is set once the body is exhausted
+type messageReader struct {
+	body []byte
+	err  error
+}
+
+var errShortMessage = errors.New("message is shorter than its fields")
+
+func (reader *messageReader) bytes(n int) []byte {
+	if reader.err != nil || n > len(reader.body) {
+		reader.err = errShortMessage
+		return nil
+	}
+	value := reader.body[:n:n]
+	reader.body = reader.body[n:]
+	return value
+}
+
+func (reader *messageReader) byte() byte {
+	value := reader.bytes(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (reader *messageReader) int16() int {
+	value := reader.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return int(int16(binary.BigEndian.Uint16(value)))
+}
+
+func (reader *messageReader) int32() int32 {
+	value := reader.bytes(4)
+	if value == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(value))
+}
+
+func (reader *messageReader) string() string {
+	if reader.err != nil {
+		return ""
+	}
+	value, rest, ok := bytes.Cut(reader.body, []byte{0})
+	if !ok {
+		reader.err = errShortMessage
+		return ""
+	}
+	reader.body = rest
+	return string(value)
+}
@@ -0,0 +1,96 @@
+package rdapp
+
+import (
+	"encoding/binary"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func frontendMessage(messageType byte, fields ...any) []byte {
+	var body []byte
+	for _, field := range fields {
+		switch field := field.(type) {
+		case string:
+			body = append(append(body, field...), 0)
+		case int16:
+			body = binary.BigEndian.AppendUint16(body, uint16(field))
+		case int32:
+			body = binary.BigEndian.AppendUint32(body, uint32(field))
+		case []byte:
+			body = append(body, field...)
+		}
+	}
+	message := []byte{messageType}
+	message = binary.BigEndian.AppendUint32(message, uint32(len(body)+4))
+	return append(message, body...)
+}
+
+func Test_extendedProtocol(t *testing.T) {
+	query := "select $1, $2"
+	var stream []byte
+	stream = append(stream, frontendMessage('P', "", query, int16(2), int32(oid.T_text), int32(oid.T_int4))...)
+	stream = append(stream, frontendMessage('B', "", "", int16(1), int16(wire.BinaryFormat),
+		int16(2), int32(-1), int32(4), []byte{0, 0, 0, 42}, int16(1), int16(wire.BinaryFormat))...)
+	stream = append(stream, frontendMessage('D', []byte{'P'}, "")...)
+	stream = append(stream, frontendMessage('E', "", int32(0))...)
+	stream = append(stream, frontendMessage('S')...)
+	protocol := newExtendedProtocol()
+	for len(stream) > 0 {
+		n := 3
+		if n > len(stream) {
+			n = len(stream)
+		}
+		protocol.observe(stream[:n])
+		stream = stream[n:]
+	}
+
+	bound, ok := protocol.take(query, 2)
+	require.True(t, ok)
+	require.Equal(t, []QueryParameter{
+		{Oid: oid.T_text, Format: wire.BinaryFormat},
+		{Value: []byte{0, 0, 0, 42}, Oid: oid.T_int4, Format: wire.BinaryFormat},
+	}, bound.parameters)
+	require.Equal(t, []wire.FormatCode{wire.BinaryFormat}, bound.resultFormats)
+	_, ok = protocol.take(query, 2)
+	require.False(t, ok, "an execution is handed out once")
+
+	require.True(t, protocol.hasStatement(""))
+	protocol.observe(frontendMessage('C', []byte{'S'}, ""))
+	require.False(t, protocol.hasStatement(""))
+}
+
+func Test_extendedProtocol_take(t *testing.T) {
+	protocol := newExtendedProtocol()
+	protocol.observe(frontendMessage('P', "first", "select $1", int16(1), int32(oid.T_int4)))
+	protocol.observe(frontendMessage('P', "second", "select $1", int16(1), int32(oid.T_text)))
+	protocol.observe(frontendMessage('B', "a", "first", int16(0), int16(1), int32(1), []byte("1"), int16(0)))
+	protocol.observe(frontendMessage('B', "b", "second", int16(0), int16(1), int32(1), []byte("x"), int16(0)))
+	protocol.observe(frontendMessage('E', "b", int32(0)))
+	protocol.observe(frontendMessage('E', "a", int32(0)))
+
+	bound, ok := protocol.take("select $1", 1)
+	require.True(t, ok)
+	require.Equal(t, oid.T_text, bound.parameters[0].Oid, "the portal executed first is taken first")
+	bound, ok = protocol.take("select $1", 1)
+	require.True(t, ok)
+	require.Equal(t, oid.T_int4, bound.parameters[0].Oid)
+
+	protocol.observe(frontendMessage('E', "a", int32(0)))
+	_, ok = protocol.take("select 2", 0)
+	require.False(t, ok, "a call out of step with the executions")
+	_, ok = protocol.take("select $1", 1)
+	require.False(t, ok, "executions out of step are dropped")
+}
+
+func Test_extendedProtocol_observe_hugeMessage(t *testing.T) {
+	protocol := newExtendedProtocol()
+	header := []byte{'P'}
+	header = binary.BigEndian.AppendUint32(header, 0xFFFFFFF0)
+	protocol.observe(header)
+	protocol.observe(make([]byte, 1024))
+
+	require.Zero(t, cap(protocol.body), "the body of a message larger than psql-wire accepts is not kept")
+	require.Equal(t, 0xFFFFFFF0-4-1024, protocol.remaining)
+}
@@ -0,0 +1,300 @@
+package rdapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryStatusSuccess = "success"
+	HistoryStatusError   = "error"
+)
+
+// HistoryTarget identifies the redshift database a statement ran against
+type HistoryTarget struct {
+	Database          string `json:"database,omitempty"`
+	ClusterIdentifier string `json:"clusterIdentifier,omitempty"`
+	DbUser            string `json:"dbUser,omitempty"`
+	SecretArn         string `json:"secretArn,omitempty"`
+	WorkgroupName     string `json:"workgroupName,omitempty"`
+}
+
+func NewHistoryTarget(config RedshiftDataAPIConfig) HistoryTarget {
+	return HistoryTarget{
+		Database:          aws.ToString(config.Database),
+		ClusterIdentifier: aws.ToString(config.ClusterIdentifier),
+		DbUser:            aws.ToString(config.DbUser),
+		SecretArn:         aws.ToString(config.SecretArn),
+		WorkgroupName:     aws.ToString(config.WorkgroupName),
+	}
+}
+
+// String renders the target as workgroup/<name>/<database> or cluster/<identifier>/<database>
+func (target HistoryTarget) String() string {
+	if target.WorkgroupName != "" {
+		return fmt.Sprintf("workgroup/%s/%s", target.WorkgroupName, target.Database)
+	}
+	return fmt.Sprintf("cluster/%s/%s", target.ClusterIdentifier, target.Database)
+}
+
+// RedshiftDataAPIConfig returns the config to run statements against the target again
+func (target HistoryTarget) RedshiftDataAPIConfig() RedshiftDataAPIConfig {
+	optional := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return aws.String(value)
+	}
+	return RedshiftDataAPIConfig{
+		Database:          optional(target.Database),
+		ClusterIdentifier: optional(target.ClusterIdentifier),
+		DbUser:            optional(target.DbUser),
+		SecretArn:         optional(target.SecretArn),
+		WorkgroupName:     optional(target.WorkgroupName),
+	}
+}
+
+// HistoryEntry is a statement run on redshift on behalf of a client
+type HistoryEntry struct {
+	Id            string        `json:"id"`
+	Time          time.Time     `json:"time"`
+	CorrelationId string        `json:"correlationId"`
+	User          string        `json:"user,omitempty"`
+	Target        HistoryTarget `json:"target"`
+	Statement     string        `json:"statement"`
+	// Query is the statement as sent to the data api along with its named Parameters and the set statements
+	// of the session, like search_path, replayed ahead of it
+	Query             string            `json:"query,omitempty"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+	SessionStatements []string          `json:"sessionStatements,omitempty"`
+	DataApiQueryId    string            `json:"dataApiQueryId,omitempty"`
+	RedshiftQueryId   int64             `json:"redshiftQueryId,omitempty"`
+	Status            string            `json:"status"`
+	Error             string            `json:"error,omitempty"`
+	Duration          time.Duration     `json:"duration"`
+	Rows              int64             `json:"rows"`
+}
+
+// SqlParameters returns the recorded parameters in the form of the data api
+func (entry HistoryEntry) SqlParameters() []types.SqlParameter {
+	var names []string
+	for name := range entry.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parameters []types.SqlParameter
+	for _, name := range names {
+		parameters = append(parameters, types.SqlParameter{
+			Name:  aws.String(name),
+			Value: aws.String(entry.Parameters[name]),
+		})
+	}
+	return parameters
+}
+
+// ShortId is the id abbreviated for listings, history ids are uuids but entries may be written by hand
+func (entry HistoryEntry) ShortId() string {
+	if len(entry.Id) > 8 {
+		return entry.Id[:8]
+	}
+	return entry.Id
+}
+
+// HistoryFilter selects history entries, zero values match every entry
+type HistoryFilter struct {
+	Status string
+	// Target matches entries whose target contains it
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// Contains matches entries whose statement contains it ignoring case
+	Contains string
+	// Limit keeps the latest entries only
+	Limit int
+}
+
+func (filter HistoryFilter) matches(entry HistoryEntry) bool {
+	switch {
+	case filter.Status != "" && entry.Status != filter.Status:
+		return false
+	case filter.Target != "" && !strings.Contains(entry.Target.String(), filter.Target):
+		return false
+	case !filter.Since.IsZero() && entry.Time.Before(filter.Since):
+		return false
+	case !filter.Until.IsZero() && entry.Time.After(filter.Until):
+		return false
+	case filter.Contains != "" && !strings.Contains(strings.ToLower(entry.Statement), strings.ToLower(filter.Contains)):
+		return false
+	}
+	return true
+}
+
+type HistoryStore interface {
+	Record(entry HistoryEntry) error
+	// Search returns the matching entries oldest first
+	Search(filter HistoryFilter) ([]HistoryEntry, error)
+	// Get returns the entry with the given id or unique id prefix
+	Get(id string) (HistoryEntry, error)
+}
+
+// jsonlHistoryStore keeps the history as one json document per line
+type jsonlHistoryStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewJsonlHistoryStore(path string) HistoryStore {
+	return &jsonlHistoryStore{
+		path: path,
+	}
+}
+
+func (store *jsonlHistoryStore) Record(entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error while encoding history entry: %w", err)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	err = os.MkdirAll(filepath.Dir(store.path), 0o700)
+	if err != nil {
+		return fmt.Errorf("error while creating history directory: %w", err)
+	}
+	file, err := os.OpenFile(store.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error while opening history file: %w", err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("error while writing history entry: %w", err)
+	}
+	return nil
+}
+
+func (store *jsonlHistoryStore) Search(filter HistoryFilter) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := store.scan(func(entry HistoryEntry) bool {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+func (store *jsonlHistoryStore) Get(id string) (HistoryEntry, error) {
+	var found []HistoryEntry
+	err := store.scan(func(entry HistoryEntry) bool {
+		if strings.HasPrefix(entry.Id, id) {
+			found = append(found, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	switch {
+	case len(found) == 0:
+		return HistoryEntry{}, fmt.Errorf("history entry %s is not found", id)
+	case len(found) > 1:
+		return HistoryEntry{}, fmt.Errorf("history entry id %s is ambiguous, it matches %d entries", id, len(found))
+	}
+	return found[0], nil
+}
+
+// scan calls visit for every entry until it returns false, a missing history file has no entries
+func (store *jsonlHistoryStore) scan(visit func(entry HistoryEntry) bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file, err := os.Open(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while opening history file: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var entry HistoryEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("error while decoding history entry on line %d: %w", lineNo, err)
+		}
+		if !visit(entry) {
+			return nil
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("error while reading history file: %w", err)
+	}
+	return nil
+}
+
+// recordHistory records a statement run on redshift when a history store is configured,
+// failing to record does not fail the statement
+func (handler *redshiftDataApiQueryHandler) recordHistory(rdappCtx RdappContext, statement string, redshiftQuery string, redshiftQueryParams []types.SqlParameter, startedAt time.Time, result *QueryResult, err error) {
+	if handler.historyStore == nil {
+		return
+	}
+	entry := HistoryEntry{
+		Id:                uuid.NewString(),
+		Time:              startedAt,
+		CorrelationId:     rdappCtx.correlationId,
+		Target:            handler.historyTarget,
+		Statement:         statement,
+		Query:             redshiftQuery,
+		SessionStatements: rdappCtx.forwardedStatements(),
+		Status:            HistoryStatusSuccess,
+		Duration:          time.Since(startedAt),
+	}
+	for _, parameter := range redshiftQueryParams {
+		if entry.Parameters == nil {
+			entry.Parameters = map[string]string{}
+		}
+		entry.Parameters[aws.ToString(parameter.Name)] = aws.ToString(parameter.Value)
+	}
+	if rdappCtx.session != nil {
+		entry.User = rdappCtx.session.user
+	}
+	if result != nil {
+		entry.DataApiQueryId = result.QueryId
+		entry.RedshiftQueryId = result.RedshiftQueryId
+		entry.Rows = result.ResultRows
+	}
+	if err != nil {
+		entry.Status = HistoryStatusError
+		entry.Error = err.Error()
+		var statementError *StatementError
+		if errors.As(err, &statementError) {
+			entry.DataApiQueryId = statementError.QueryId
+			entry.RedshiftQueryId = statementError.RedshiftQueryId
+		}
+	}
+	recordErr := handler.historyStore.Record(entry)
+	if recordErr != nil {
+		rdappCtx.logger.Error("error while recording statement history", zap.Error(recordErr))
+	}
+}
@@ -0,0 +1,104 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_jsonlHistoryStore_Search(t *testing.T) {
+	startTime := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	entries := []HistoryEntry{
+		{Id: "a1", Time: startTime, Target: HistoryTarget{WorkgroupName: "analytics", Database: "dev"}, Statement: "select * from employee", Status: HistoryStatusSuccess, Rows: 3},
+		{Id: "b2", Time: startTime.Add(time.Hour), Target: HistoryTarget{ClusterIdentifier: "etl", Database: "prod"}, Statement: "insert into audit values (1)", Status: HistoryStatusError, Error: "permission denied"},
+		{Id: "c3", Time: startTime.Add(2 * time.Hour), Target: HistoryTarget{WorkgroupName: "analytics", Database: "dev"}, Statement: "SELECT count(*) FROM Employee", Status: HistoryStatusSuccess, Rows: 1},
+	}
+	store := NewJsonlHistoryStore(filepath.Join(t.TempDir(), "rdapp", "history.jsonl"))
+	for _, entry := range entries {
+		require.NoError(t, store.Record(entry))
+	}
+	type args struct {
+		filter HistoryFilter
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantIds []string
+	}{
+		{
+			name:    "no filter",
+			args:    args{filter: HistoryFilter{}},
+			wantIds: []string{"a1", "b2", "c3"},
+		},
+		{
+			name:    "by status",
+			args:    args{filter: HistoryFilter{Status: HistoryStatusError}},
+			wantIds: []string{"b2"},
+		},
+		{
+			name:    "by target",
+			args:    args{filter: HistoryFilter{Target: "workgroup/analytics"}},
+			wantIds: []string{"a1", "c3"},
+		},
+		{
+			name:    "by time range",
+			args:    args{filter: HistoryFilter{Since: startTime.Add(30 * time.Minute), Until: startTime.Add(90 * time.Minute)}},
+			wantIds: []string{"b2"},
+		},
+		{
+			name:    "by statement text ignoring case",
+			args:    args{filter: HistoryFilter{Contains: "from employee"}},
+			wantIds: []string{"a1", "c3"},
+		},
+		{
+			name:    "limit keeps the latest",
+			args:    args{filter: HistoryFilter{Limit: 2}},
+			wantIds: []string{"b2", "c3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Search(tt.args.filter)
+			require.NoError(t, err)
+			var gotIds []string
+			for _, entry := range got {
+				gotIds = append(gotIds, entry.Id)
+			}
+			require.Equal(t, tt.wantIds, gotIds)
+		})
+	}
+}
+
+func Test_jsonlHistoryStore_Get(t *testing.T) {
+	store := NewJsonlHistoryStore(filepath.Join(t.TempDir(), "history.jsonl"))
+	require.NoError(t, store.Record(HistoryEntry{Id: "4f1c2a", Statement: "select 1"}))
+	require.NoError(t, store.Record(HistoryEntry{Id: "4f9e07", Statement: "select 2"}))
+
+	got, err := store.Get("4f1")
+	require.NoError(t, err)
+	require.Equal(t, "select 1", got.Statement)
+
+	_, err = store.Get("4f")
+	require.ErrorContains(t, err, "ambiguous")
+
+	_, err = store.Get("ff")
+	require.ErrorContains(t, err, "not found")
+}
+
+func Test_HistoryEntry_rerun(t *testing.T) {
+	entry := HistoryEntry{Id: "4f1c", Parameters: map[string]string{"2": "b", "1": "a"}}
+
+	require.Equal(t, "4f1c", entry.ShortId(), "short ids are not cut")
+	require.Equal(t, []types.SqlParameter{
+		{Name: aws.String("1"), Value: aws.String("a")},
+		{Name: aws.String("2"), Value: aws.String("b")},
+	}, entry.SqlParameters())
+
+	ctx := NewRdappContext(context.Background(), zap.NewNop()).WithForwardedStatements([]string{"set search_path to pii", "set datestyle to 'ISO'"})
+	require.Equal(t, []string{"set datestyle to 'ISO'", "set search_path to pii"}, ctx.forwardedStatements())
+}
@@ -0,0 +1,51 @@
+package rdapp
+
+import (
+	"context"
+	"net"
+)
+
+// Hooks let programs embedding rdapp observe connections and statements, nil hooks are skipped
+type Hooks struct {
+	ConnectionOpened func(remoteAddress net.Addr)
+	ConnectionClosed func(remoteAddress net.Addr)
+	// BeforeStatement is called before a statement is run, returning an error rejects the statement
+	// with the error
+	BeforeStatement func(ctx context.Context, statement StatementInfo) error
+	// AfterStatement is called with the outcome of every statement, result is nil for failed statements
+	AfterStatement func(ctx context.Context, statement StatementInfo, result *QueryResult, err error)
+}
+
+// StatementInfo describes the statement passed to hooks
+type StatementInfo struct {
+	SessionId     string
+	User          string
+	CorrelationId string
+	Statement     string
+}
+
+func newStatementInfo(rdappCtx RdappContext, statement string) StatementInfo {
+	info := StatementInfo{
+		CorrelationId: rdappCtx.correlationId,
+		Statement:     statement,
+	}
+	if rdappCtx.session != nil {
+		info.SessionId = rdappCtx.session.id
+		info.User = rdappCtx.session.user
+	}
+	return info
+}
+
+func (handler *redshiftDataApiQueryHandler) beforeStatement(rdappCtx RdappContext, statement string) error {
+	if handler.hooks.BeforeStatement == nil {
+		return nil
+	}
+	return handler.hooks.BeforeStatement(rdappCtx, newStatementInfo(rdappCtx, statement))
+}
+
+func (handler *redshiftDataApiQueryHandler) afterStatement(rdappCtx RdappContext, statement string, result *QueryResult, err error) {
+	if handler.hooks.AfterStatement == nil {
+		return
+	}
+	handler.hooks.AfterStatement(rdappCtx, newStatementInfo(rdappCtx, statement), result, err)
+}
@@ -1,16 +1,339 @@
 package rdapp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/pkg/buffer"
+	"github.com/jeroenrinzema/psql-wire/pkg/types"
 	"go.uber.org/zap"
+	"net"
+	"os"
 )
 
+const DefaultListenAddress = ":25432"
+
+// ProxyOption configures the proxy constructed by NewProxy
+type ProxyOption func(options *proxyOptions)
+
+type proxyOptions struct {
+	listenAddress          string
+	unixSocketPath         string
+	unixSocketMode         os.FileMode
+	tlsConfig              *tls.Config
+	authenticate           func(ctx context.Context, username, password string) (bool, error)
+	awsConfig              *aws.Config
+	redshiftDataApiClient  RedshiftDataApiClient
+	redshiftDataAPIService RedshiftDataAPIService
+	redshiftDataApiConfig  RedshiftDataAPIConfig
+	pgRedshiftTranslator   PgRedshiftTranslator
+	recorder               *Recorder
+	historyStore           HistoryStore
+	auditLog               AuditLog
+	readOnlyPolicy         ReadOnlyPolicy
+	policy                 *Policy
+	rowLimitPolicy         RowLimitPolicy
+	masking                *Masking
+	resultCache            ResultCache
+	concurrencyLimits      ConcurrencyLimits
+	concurrencyLimiter     *ConcurrencyLimiter
+	backendPids            *BackendPids
+	hooks                  Hooks
+	metrics                *Metrics
+	logger                 *zap.Logger
+}
+
+// WithListenAddress sets the address Run listens on, it defaults to :25432. An empty address only
+// listens on the unix socket.
+func WithListenAddress(listenAddress string) ProxyOption {
+	return func(options *proxyOptions) {
+		options.listenAddress = listenAddress
+	}
+}
+
+// WithUnixSocket lets Run listen on the unix socket too, restricted to the file mode. A directory like
+// /tmp is given like to psql -h, the socket is then named .s.PGSQL.<port> after the listen address.
+func WithUnixSocket(path string, mode os.FileMode) ProxyOption {
+	return func(options *proxyOptions) {
+		options.unixSocketPath = path
+		options.unixSocketMode = mode
+	}
+}
+
+// WithTLS lets clients which ask for it connect via tls with the config
+func WithTLS(tlsConfig *tls.Config) ProxyOption {
+	return func(options *proxyOptions) {
+		options.tlsConfig = tlsConfig
+	}
+}
+
+// WithAuth asks clients for a clear text password, connections are accepted if authenticate returns true
+func WithAuth(authenticate func(ctx context.Context, username, password string) (bool, error)) ProxyOption {
+	return func(options *proxyOptions) {
+		options.authenticate = authenticate
+	}
+}
+
+// WithAWSConfig constructs the data api client from the aws config
+func WithAWSConfig(cfg aws.Config) ProxyOption {
+	return func(options *proxyOptions) {
+		options.awsConfig = &cfg
+	}
+}
+
+// WithDataAPIClient runs statements with the data api client
+func WithDataAPIClient(client RedshiftDataApiClient) ProxyOption {
+	return func(options *proxyOptions) {
+		options.redshiftDataApiClient = client
+	}
+}
+
+// WithDataAPIService runs statements with the service instead of a data api client, e.g. one of
+// NewPostgresRedshiftDataAPIService
+func WithDataAPIService(service RedshiftDataAPIService) ProxyOption {
+	return func(options *proxyOptions) {
+		options.redshiftDataAPIService = service
+	}
+}
+
+// WithRedshiftDataAPIConfig sets the cluster or workgroup and database statements are run against
+func WithRedshiftDataAPIConfig(redshiftDataApiConfig RedshiftDataAPIConfig) ProxyOption {
+	return func(options *proxyOptions) {
+		options.redshiftDataApiConfig = redshiftDataApiConfig
+	}
+}
+
+// WithTranslator replaces the translation of postgres statements into redshift statements
+func WithTranslator(translator PgRedshiftTranslator) ProxyOption {
+	return func(options *proxyOptions) {
+		options.pgRedshiftTranslator = translator
+	}
+}
+
+// WithRecorder records the calls of the data api client
+func WithRecorder(recorder *Recorder) ProxyOption {
+	return func(options *proxyOptions) {
+		options.recorder = recorder
+	}
+}
+
+func WithHistoryStore(historyStore HistoryStore) ProxyOption {
+	return func(options *proxyOptions) {
+		options.historyStore = historyStore
+	}
+}
+
+func WithAuditLog(auditLog AuditLog) ProxyOption {
+	return func(options *proxyOptions) {
+		options.auditLog = auditLog
+	}
+}
+
+// WithReadOnlyPolicy rejects statements modifying data or schema, per user settings need WithAuth
+func WithReadOnlyPolicy(readOnlyPolicy ReadOnlyPolicy) ProxyOption {
+	return func(options *proxyOptions) {
+		options.readOnlyPolicy = readOnlyPolicy
+	}
+}
+
+func WithPolicy(policy *Policy) ProxyOption {
+	return func(options *proxyOptions) {
+		options.policy = policy
+	}
+}
+
+func WithRowLimitPolicy(rowLimitPolicy RowLimitPolicy) ProxyOption {
+	return func(options *proxyOptions) {
+		options.rowLimitPolicy = rowLimitPolicy
+	}
+}
+
+func WithMasking(masking *Masking) ProxyOption {
+	return func(options *proxyOptions) {
+		options.masking = masking
+	}
+}
+
+func WithResultCache(resultCache ResultCache) ProxyOption {
+	return func(options *proxyOptions) {
+		options.resultCache = resultCache
+	}
+}
+
+// WithConcurrencyLimits caps the statements running at once via the proxy, per user limits need WithAuth
+func WithConcurrencyLimits(concurrencyLimits ConcurrencyLimits) ProxyOption {
+	return func(options *proxyOptions) {
+		options.concurrencyLimits = concurrencyLimits
+	}
+}
+
+// WithConcurrencyLimiter caps the statements running at once via the proxies sharing the limiter,
+// it replaces WithConcurrencyLimits
+func WithConcurrencyLimiter(concurrencyLimiter *ConcurrencyLimiter) ProxyOption {
+	return func(options *proxyOptions) {
+		options.concurrencyLimiter = concurrencyLimiter
+	}
+}
+
+// WithBackendPids hands out the pseudo backend pids of the connections from pids, proxies run as a group
+// share them so that a pid belongs to one connection of the group
+func WithBackendPids(pids *BackendPids) ProxyOption {
+	return func(options *proxyOptions) {
+		options.backendPids = pids
+	}
+}
+
+func WithHooks(hooks Hooks) ProxyOption {
+	return func(options *proxyOptions) {
+		options.hooks = hooks
+	}
+}
+
+// WithMetrics collects the metrics of the proxy into metrics, by default they are collected but not served
+func WithMetrics(metrics *Metrics) ProxyOption {
+	return func(options *proxyOptions) {
+		options.metrics = metrics
+	}
+}
+
+// WithLogger logs with the logger, by default nothing is logged
+func WithLogger(logger *zap.Logger) ProxyOption {
+	return func(options *proxyOptions) {
+		options.logger = logger
+	}
+}
+
+// NewProxy constructs a proxy which is started with Run or Serve. One of WithAWSConfig,
+// WithDataAPIClient or WithDataAPIService is required.
+func NewProxy(options ...ProxyOption) (PostgresRedshiftProxy, error) {
+	proxyOptions := proxyOptions{
+		listenAddress: DefaultListenAddress,
+		logger:        zap.NewNop(),
+	}
+	for _, option := range options {
+		option(&proxyOptions)
+	}
+	if len(proxyOptions.readOnlyPolicy.Users) > 0 && proxyOptions.authenticate == nil {
+		return nil, errors.New("read only settings per user need WithAuth, clients could connect as any user otherwise")
+	}
+	if proxyOptions.metrics == nil {
+		proxyOptions.metrics = NewMetrics()
+	}
+	if proxyOptions.concurrencyLimiter == nil {
+		proxyOptions.concurrencyLimiter = NewConcurrencyLimiter(proxyOptions.concurrencyLimits, proxyOptions.metrics)
+	}
+	if proxyOptions.backendPids == nil {
+		proxyOptions.backendPids = NewBackendPids()
+	}
+	if proxyOptions.concurrencyLimiter.limits.perUser() && proxyOptions.authenticate == nil {
+		return nil, errors.New("concurrency limits per user need WithAuth, clients could connect as any user otherwise")
+	}
+	if proxyOptions.authenticate != nil && proxyOptions.tlsConfig == nil && proxyOptions.listenAddress != "" {
+		proxyOptions.logger.Warn("clients send their passwords in clear text as WithAuth is given without WithTLS",
+			zap.String("listenAddress", proxyOptions.listenAddress))
+	}
+	if proxyOptions.pgRedshiftTranslator == nil {
+		proxyOptions.pgRedshiftTranslator = NewPgRedshiftTranslator()
+	}
+	redshiftDataAPIService, err := proxyOptions.redshiftDataAPIServiceFor()
+	if err != nil {
+		return nil, err
+	}
+	proxyOptions.redshiftDataAPIService = newLimitedRedshiftDataAPIService(redshiftDataAPIService, proxyOptions.concurrencyLimiter, proxyOptions.metrics)
+	connections := newClientConnections(proxyOptions.backendPids)
+	redshiftDataApiQueryHandler := newRedshiftDataApiQueryHandler(proxyOptions, connections)
+	server, err := wire.NewServer(proxyOptions.wireOptions(redshiftDataApiQueryHandler)...)
+	if err != nil {
+		proxyOptions.logger.Error("error while instantiating server", zap.Error(err))
+		return nil, fmt.Errorf("error while instantiating server: %w", err)
+	}
+	return newPostgresRedshiftProxy(server, redshiftDataApiQueryHandler, proxyOptions, connections), nil
+}
+
+// ConstructProxy constructs a proxy listening on the listen address which runs statements with a data api
+// client of the aws config.
+//
+// Deprecated: use NewProxy, errors constructing the proxy are returned by Run and Serve of the proxy.
 func ConstructProxy(cfg aws.Config, redshiftDataApiConfig RedshiftDataAPIConfig, logger *zap.Logger, listenAddress string) PostgresRedshiftProxy {
-	redshiftDataApiClient := redshiftdata.NewFromConfig(cfg)
-	redshiftDataAPIService := NewRedshiftDataAPIService(redshiftDataApiClient, redshiftDataApiConfig)
-	pgRedshiftTranslator := NewPgRedshiftTranslator()
-	redshiftDataApiQueryHandler := NewRedshiftDataApiQueryHandler(redshiftDataAPIService, pgRedshiftTranslator, logger)
-	proxy := NewPostgresRedshiftDataAPIProxy(listenAddress, redshiftDataApiQueryHandler.QueryHandler, logger)
+	proxy, err := NewProxy(
+		WithAWSConfig(cfg),
+		WithRedshiftDataAPIConfig(redshiftDataApiConfig),
+		WithLogger(logger),
+		WithListenAddress(listenAddress))
+	if err != nil {
+		return failedProxy{err: err}
+	}
 	return proxy
 }
+
+// failedProxy is the proxy ConstructProxy returns when it cannot construct one, it serves nothing
+type failedProxy struct {
+	err error
+}
+
+func (proxy failedProxy) Run() error                        { return proxy.err }
+func (proxy failedProxy) Serve(_ net.Listener) error        { return proxy.err }
+func (proxy failedProxy) Shutdown(_ context.Context) error  { return nil }
+func (proxy failedProxy) ShuttingDown() bool                { return false }
+func (proxy failedProxy) Addr() net.Addr                    { return nil }
+func (proxy failedProxy) Connections() []ConnectionInfo     { return nil }
+func (proxy failedProxy) Statements() []ActiveStatement     { return nil }
+func (proxy failedProxy) CancelStatement(_ string) bool     { return false }
+func (proxy failedProxy) TerminateConnection(_ string) bool { return false }
+
+func (options *proxyOptions) redshiftDataAPIServiceFor() (RedshiftDataAPIService, error) {
+	if options.redshiftDataAPIService != nil {
+		return options.redshiftDataAPIService, nil
+	}
+	redshiftDataApiClient := options.redshiftDataApiClient
+	if redshiftDataApiClient == nil {
+		if options.awsConfig == nil {
+			return nil, errors.New("one of WithAWSConfig, WithDataAPIClient or WithDataAPIService is required")
+		}
+		redshiftDataApiClient = redshiftdata.NewFromConfig(*options.awsConfig)
+	}
+	if options.recorder != nil {
+		redshiftDataApiClient = newRecordingRedshiftDataApiClient(redshiftDataApiClient, options.recorder)
+	}
+	redshiftDataApiClient = newInstrumentedRedshiftDataApiClient(redshiftDataApiClient, options.metrics)
+	return NewRedshiftDataAPIService(redshiftDataApiClient, options.redshiftDataApiConfig, options.metrics), nil
+}
+
+func (options *proxyOptions) wireOptions(queryHandler RedshiftDataApiQueryHandler) []wire.OptionFn {
+	wireOptions := []wire.OptionFn{
+		wire.Logger(options.logger),
+		wire.SimpleQuery(queryHandler.QueryHandler),
+		wire.TerminateConn(queryHandler.CloseSession),
+		// tls is negotiated by the listener, see negotiateStartup
+		wire.ClientAuth(tls.NoClientCert),
+	}
+	return append(wireOptions, wire.SessionAuthStrategy(sessionAuthStrategy(queryHandler, options.authenticate)))
+}
+
+// sessionAuthStrategy authenticates a connection when passwords are checked and opens its session,
+// psql-wire hands the returned context to every query of the connection
+func sessionAuthStrategy(queryHandler RedshiftDataApiQueryHandler, authenticate func(ctx context.Context, username, password string) (bool, error)) wire.AuthStrategy {
+	passwordAuth := wire.ClearTextPassword(func(ctx context.Context, username, password string) (context.Context, bool, error) {
+		ok, err := authenticate(ctx, username, password)
+		return ctx, ok, err
+	})
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		var err error
+		if authenticate != nil {
+			ctx, err = passwordAuth(ctx, writer, reader)
+		} else {
+			// AuthenticationOk, which psql-wire sends itself when there is no auth strategy
+			writer.Start(types.ServerAuth)
+			writer.AddInt32(0)
+			err = writer.End()
+		}
+		if err != nil {
+			return ctx, err
+		}
+		return queryHandler.OpenSession(ctx), nil
+	}
+}
@@ -1,45 +1,336 @@
 package rdapp
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	wire "github.com/jeroenrinzema/psql-wire"
 	"go.uber.org/zap"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
+// ErrProxyClosed is returned by Run and Serve once the proxy is shut down
+var ErrProxyClosed = errors.New("rdapp: proxy closed")
+
 type PostgresRedshiftProxy interface {
+	// Run listens on the listen address and the unix socket and serves the connections until the
+	// proxy is shut down
 	Run() error
+	// Serve serves the connections of the listener until the proxy is shut down
+	Serve(listener net.Listener) error
+	// Shutdown stops accepting connections and waits for the running statements to finish before
+	// closing the connections. Statements still running when the context is done are cancelled.
+	Shutdown(ctx context.Context) error
+	// ShuttingDown is true once Shutdown is called, the proxy is no longer ready then
+	ShuttingDown() bool
+	// Addr is the address of the first listener served, nil before that
+	Addr() net.Addr
+	// Connections lists the open client connections
+	Connections() []ConnectionInfo
+	// Statements lists the running queries
+	Statements() []ActiveStatement
+	// CancelStatement cancels the running query with the id, false if there is none
+	CancelStatement(id string) bool
+	// TerminateConnection closes the connection with the id, false if there is none
+	TerminateConnection(id string) bool
 }
 
 type postgresRedshiftProxy struct {
+	server        *wire.Server
+	queryHandler  RedshiftDataApiQueryHandler
 	listenAddress string
-	simpleQueryFn wire.SimpleQueryFn
-	logger        *zap.Logger
+	// unixSocketPath is the unix socket Run listens on besides the listen address, empty for none
+	unixSocketPath string
+	unixSocketMode os.FileMode
+	tlsConfig      *tls.Config
+	auditLog       AuditLog
+	hooks          Hooks
+	metrics        *Metrics
+	logger         *zap.Logger
+	connections    *clientConnections
+	mutex          sync.Mutex
+	listeners      []net.Listener
+	closed         bool
 }
 
-func NewPostgresRedshiftDataAPIProxy(listenAddress string, simpleQueryFn wire.SimpleQueryFn, logger *zap.Logger) PostgresRedshiftProxy {
+// newPostgresRedshiftProxy constructs the proxy of the options, its query handler reaches the client
+// connections via connections
+func newPostgresRedshiftProxy(server *wire.Server, queryHandler RedshiftDataApiQueryHandler, options proxyOptions, connections *clientConnections) *postgresRedshiftProxy {
 	return &postgresRedshiftProxy{
-		listenAddress: listenAddress,
-		simpleQueryFn: simpleQueryFn,
-		logger:        logger,
+		server:         server,
+		queryHandler:   queryHandler,
+		listenAddress:  options.listenAddress,
+		unixSocketPath: options.unixSocketPath,
+		unixSocketMode: options.unixSocketMode,
+		tlsConfig:      options.tlsConfig,
+		auditLog:       options.auditLog,
+		hooks:          options.hooks,
+		metrics:        options.metrics,
+		logger:         options.logger,
+		connections:    connections,
 	}
 }
 
 func (proxy *postgresRedshiftProxy) Run() error {
-	server, err := wire.NewServer(
-		wire.Logger(proxy.logger),
-		wire.SimpleQuery(proxy.simpleQueryFn),
-		wire.ClientAuth(tls.NoClientCert))
+	listeners, err := proxy.listen()
 	if err != nil {
-		proxy.logger.Error("error while instantiating server", zap.Error(err))
-		return fmt.Errorf("error while instantiating server: %w", err)
+		return err
+	}
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			served <- proxy.Serve(listener)
+		}(listener)
+	}
+	err = <-served
+	// the proxy stops serving as a whole when one of its listeners fails
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-served
+	}
+	return err
+}
+
+// listen listens on the listen address and the unix socket, whichever are configured
+func (proxy *postgresRedshiftProxy) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	if proxy.listenAddress != "" {
+		listener, err := net.Listen("tcp", proxy.listenAddress)
+		if err != nil {
+			proxy.logger.Error("error while listening to listen address",
+				zap.String("listenAddress", proxy.listenAddress),
+				zap.Error(err))
+			return nil, fmt.Errorf("error while listening to %s: %w", proxy.listenAddress, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if proxy.unixSocketPath != "" {
+		path := unixSocketPath(proxy.unixSocketPath, proxy.listenAddress)
+		listener, err := listenUnix(path, proxy.unixSocketMode)
+		if err != nil {
+			proxy.logger.Error("error while listening to unix socket",
+				zap.String("unixSocket", path),
+				zap.Error(err))
+			closeListeners()
+			return nil, err
+		}
+		proxy.logger.Info("listening to unix socket", zap.String("unixSocket", path), zap.Stringer("mode", proxy.unixSocketMode))
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("neither a listen address nor a unix socket is configured")
+	}
+	return listeners, nil
+}
+
+func (proxy *postgresRedshiftProxy) Serve(listener net.Listener) error {
+	proxy.mutex.Lock()
+	if proxy.closed {
+		proxy.mutex.Unlock()
+		_ = listener.Close()
+		return ErrProxyClosed
+	}
+	proxy.listeners = append(proxy.listeners, listener)
+	proxy.mutex.Unlock()
+	err := proxy.server.Serve(&trackingListener{Listener: listener, proxy: proxy})
+	if proxy.ShuttingDown() {
+		return ErrProxyClosed
 	}
-	err = server.ListenAndServe(proxy.listenAddress)
 	if err != nil {
-		proxy.logger.Error("error while listening to listen address",
-			zap.String("listenAddress", proxy.listenAddress),
+		proxy.logger.Error("error while serving listener",
+			zap.Stringer("address", listener.Addr()),
 			zap.Error(err))
-		return fmt.Errorf("error while listening to %s: %w", proxy.listenAddress, err)
+		return fmt.Errorf("error while serving %s: %w", listener.Addr(), err)
 	}
 	return nil
 }
+
+func (proxy *postgresRedshiftProxy) Shutdown(ctx context.Context) error {
+	proxy.mutex.Lock()
+	proxy.closed = true
+	listeners := proxy.listeners
+	proxy.mutex.Unlock()
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	proxy.logger.Info("shutting down, waiting for running statements to finish")
+	summary, err := proxy.queryHandler.Drain(ctx)
+	closedConnections := proxy.closeConnections()
+	proxy.logger.Info("shut down",
+		zap.Int("finishedStatements", summary.Finished),
+		zap.Int("cancelledStatements", summary.Cancelled),
+		zap.Int("closedConnections", closedConnections))
+	return err
+}
+
+func (proxy *postgresRedshiftProxy) Addr() net.Addr {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if len(proxy.listeners) == 0 {
+		return nil
+	}
+	return proxy.listeners[0].Addr()
+}
+
+func (proxy *postgresRedshiftProxy) ShuttingDown() bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.closed
+}
+
+func (proxy *postgresRedshiftProxy) closeConnections() int {
+	conns := proxy.connections.all()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return len(conns)
+}
+
+func (proxy *postgresRedshiftProxy) Connections() []ConnectionInfo {
+	proxy.connections.mutex.Lock()
+	defer proxy.connections.mutex.Unlock()
+	connections := make([]ConnectionInfo, 0, len(proxy.connections.conns))
+	for _, conn := range proxy.connections.conns {
+		connections = append(connections, ConnectionInfo{
+			Id:              conn.id,
+			Pid:             conn.pid,
+			RemoteAddress:   conn.raw.RemoteAddr().String(),
+			OpenedAt:        conn.openedAt,
+			Tls:             conn.encrypted,
+			User:            conn.parameters.user,
+			Database:        conn.parameters.database,
+			ApplicationName: conn.parameters.applicationName,
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].OpenedAt.Before(connections[j].OpenedAt)
+	})
+	return connections
+}
+
+func (proxy *postgresRedshiftProxy) Statements() []ActiveStatement {
+	return proxy.queryHandler.Statements()
+}
+
+func (proxy *postgresRedshiftProxy) CancelStatement(id string) bool {
+	return proxy.queryHandler.CancelStatement(id)
+}
+
+func (proxy *postgresRedshiftProxy) TerminateConnection(id string) bool {
+	proxy.logger.Info("terminating connection", zap.String("sessionId", id))
+	return proxy.connections.terminate(id, proxy.queryHandler)
+}
+
+// trackingListener counts the open client connections and audits their opening and closing.
+// The client address is only known here as psql-wire does not hand it to the query handler.
+type trackingListener struct {
+	net.Listener
+	proxy *postgresRedshiftProxy
+}
+
+func (listener *trackingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	proxy := listener.proxy
+	tracked := &trackedConn{
+		Conn:     conn,
+		raw:      conn,
+		proxy:    proxy,
+		id:       uuid.NewString(),
+		openedAt: time.Now(),
+	}
+	proxy.connections.add(tracked)
+	proxy.metrics.activeConnections.Inc()
+	proxy.audit(AuditEventConnectionOpened, conn)
+	if proxy.hooks.ConnectionOpened != nil {
+		proxy.hooks.ConnectionOpened(conn.RemoteAddr())
+	}
+	return tracked, nil
+}
+
+func (proxy *postgresRedshiftProxy) audit(event string, conn net.Conn) {
+	if proxy.auditLog == nil {
+		return
+	}
+	proxy.auditLog.Record(AuditRecord{
+		Event:         event,
+		ClientAddress: conn.RemoteAddr().String(),
+	})
+}
+
+// trackedConn is a client connection, its id is the id of its session. Conn becomes the tls
+// connection once the client asked for tls, raw stays the accepted connection.
+type trackedConn struct {
+	net.Conn
+	raw        net.Conn
+	proxy      *postgresRedshiftProxy
+	id         string
+	pid        int32
+	openedAt   time.Time
+	encrypted  bool
+	parameters startupParameters
+	negotiated bool
+	// pending holds the startup packet until it is read by psql-wire
+	pending []byte
+	// extended follows the extended protocol messages once the startup packet is read, nil before
+	extended *extendedProtocol
+	// writeMutex keeps the messages written by psql-wire and the notices of the proxy whole
+	writeMutex sync.Mutex
+	once       sync.Once
+}
+
+func (conn *trackedConn) Read(p []byte) (int, error) {
+	if !conn.negotiated {
+		conn.negotiated = true
+		err := conn.negotiateStartup(conn.proxy.tlsConfig)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(conn.pending) > 0 {
+		n := copy(p, conn.pending)
+		conn.pending = conn.pending[n:]
+		return n, nil
+	}
+	n, err := conn.Conn.Read(p)
+	if n > 0 && conn.extended != nil {
+		conn.extended.observe(p[:n])
+	}
+	return n, err
+}
+
+// Write writes p to the client as a whole. psql-wire writes each message with a single Write, a notice
+// written concurrently goes before or after the message rather than into it.
+func (conn *trackedConn) Write(p []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	return conn.Conn.Write(p)
+}
+
+func (conn *trackedConn) Close() error {
+	conn.once.Do(func() {
+		proxy := conn.proxy
+		proxy.connections.remove(conn.id)
+		proxy.metrics.activeConnections.Dec()
+		proxy.audit(AuditEventConnectionClosed, conn.raw)
+		if proxy.hooks.ConnectionClosed != nil {
+			proxy.hooks.ConnectionClosed(conn.raw.RemoteAddr())
+		}
+	})
+	return conn.raw.Close()
+}
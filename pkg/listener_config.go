@@ -0,0 +1,179 @@
+package rdapp
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ListenerConfigs are the listeners of a listeners file, each serving its own target
+type ListenerConfigs struct {
+	Listeners []ListenerConfig `yaml:"listeners"`
+}
+
+// ListenerConfig is a listen address or unix socket with the target statements are run against and the
+// auth and policy settings of its connections
+type ListenerConfig struct {
+	Name   string `yaml:"name"`
+	Listen string `yaml:"listen"`
+	// UnixSocket is a socket path or a directory like /tmp, UnixSocketMode its octal file mode
+	UnixSocket        string `yaml:"unixSocket"`
+	UnixSocketMode    string `yaml:"unixSocketMode"`
+	Database          string `yaml:"database"`
+	ClusterIdentifier string `yaml:"clusterIdentifier"`
+	DbUser            string `yaml:"dbUser"`
+	SecretArn         string `yaml:"secretArn"`
+	WorkgroupName     string `yaml:"workgroupName"`
+	// TLSCertFile and TLSKeyFile are the pem encoded certificate and key served to clients connecting via tls
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+	// Passwords of the postgres users who may connect, environment variables like $PROD_PASSWORD are expanded.
+	// Any user may connect without a password when there are none. Listeners with a listen address need
+	// tls for passwords, clients would send them in clear text otherwise.
+	Passwords      map[string]string `yaml:"passwords"`
+	ReadOnly       bool              `yaml:"readOnly"`
+	ReadOnlyUsers  []string          `yaml:"readOnlyUsers"`
+	ReadWriteUsers []string          `yaml:"readWriteUsers"`
+	PolicyFile     string            `yaml:"policyFile"`
+}
+
+// LoadListenerConfigs reads the listeners from a yaml file
+func LoadListenerConfigs(path string) ([]ListenerConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening listeners file: %w", err)
+	}
+	defer file.Close()
+	return ParseListenerConfigs(file)
+}
+
+func ParseListenerConfigs(reader io.Reader) ([]ListenerConfig, error) {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	var configs ListenerConfigs
+	err := decoder.Decode(&configs)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error while parsing listeners: %w", err)
+	}
+	if len(configs.Listeners) == 0 {
+		return nil, errors.New("no listeners are configured")
+	}
+	names := map[string]bool{}
+	for i := range configs.Listeners {
+		err := configs.Listeners[i].validate(i+1, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs.Listeners, nil
+}
+
+func (config *ListenerConfig) validate(position int, names map[string]bool) error {
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("listener %d", position)
+	}
+	if names[config.Name] {
+		return fmt.Errorf("listener %s is configured twice", config.Name)
+	}
+	names[config.Name] = true
+	if config.Listen == "" && config.UnixSocket == "" {
+		return fmt.Errorf("listener %s needs a listen address or a unix socket", config.Name)
+	}
+	_, err := config.unixSocketMode()
+	if err != nil {
+		return err
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("listener %s needs both a tls cert file and a tls key file", config.Name)
+	}
+	if len(config.Passwords) > 0 && config.Listen != "" && config.TLSCertFile == "" {
+		return fmt.Errorf("listener %s has passwords but no tls, clients would send them in clear text", config.Name)
+	}
+	for user, password := range config.Passwords {
+		config.Passwords[user] = os.ExpandEnv(password)
+	}
+	if len(config.Passwords) == 0 && (len(config.ReadOnlyUsers) > 0 || len(config.ReadWriteUsers) > 0) {
+		return fmt.Errorf("listener %s has read only users but no passwords, clients could connect as any user", config.Name)
+	}
+	return nil
+}
+
+// ProxyOptions returns the options of the listener, the shared options like the data api client are
+// added by the caller
+func (config ListenerConfig) ProxyOptions() ([]ProxyOption, error) {
+	options := []ProxyOption{
+		WithListenAddress(config.Listen),
+		WithRedshiftDataAPIConfig(config.RedshiftDataAPIConfig()),
+		WithReadOnlyPolicy(config.ReadOnlyPolicy()),
+	}
+	if config.UnixSocket != "" {
+		mode, err := config.unixSocketMode()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithUnixSocket(config.UnixSocket, mode))
+	}
+	if config.TLSCertFile != "" {
+		tlsConfig, err := LoadTLSConfig(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading tls config of listener %s: %w", config.Name, err)
+		}
+		options = append(options, WithTLS(tlsConfig))
+	}
+	if len(config.Passwords) > 0 {
+		options = append(options, WithAuth(PasswordAuthenticator(config.Passwords)))
+	}
+	if config.PolicyFile != "" {
+		policy, err := LoadPolicy(config.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading policy of listener %s: %w", config.Name, err)
+		}
+		options = append(options, WithPolicy(policy))
+	}
+	return options, nil
+}
+
+func (config ListenerConfig) RedshiftDataAPIConfig() RedshiftDataAPIConfig {
+	return RedshiftDataAPIConfig{
+		Database:          optionalString(config.Database),
+		ClusterIdentifier: optionalString(config.ClusterIdentifier),
+		DbUser:            optionalString(config.DbUser),
+		SecretArn:         optionalString(config.SecretArn),
+		WorkgroupName:     optionalString(config.WorkgroupName),
+	}
+}
+
+func (config ListenerConfig) ReadOnlyPolicy() ReadOnlyPolicy {
+	policy := ReadOnlyPolicy{
+		Default: config.ReadOnly,
+		Users:   map[string]bool{},
+	}
+	for _, user := range config.ReadOnlyUsers {
+		policy.Users[user] = true
+	}
+	for _, user := range config.ReadWriteUsers {
+		policy.Users[user] = false
+	}
+	return policy
+}
+
+func (config ListenerConfig) unixSocketMode() (os.FileMode, error) {
+	if config.UnixSocketMode == "" {
+		return DefaultUnixSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(config.UnixSocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error while parsing unix socket mode of listener %s: %w", config.Name, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
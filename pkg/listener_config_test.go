@@ -0,0 +1,101 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_ParseListenerConfigs(t *testing.T) {
+	t.Setenv("DEV_PASSWORD", "s3cret")
+	configs, err := ParseListenerConfigs(strings.NewReader(`
+listeners:
+  - name: prod
+    listen: ":15432"
+    workgroupName: prod
+    database: analytics
+    readOnly: true
+  - listen: ":15433"
+    unixSocket: /tmp
+    unixSocketMode: "0770"
+    clusterIdentifier: dev
+    database: dev
+    dbUser: developer
+    tlsCertFile: /etc/rdapp/tls.crt
+    tlsKeyFile: /etc/rdapp/tls.key
+    passwords:
+      developer: $DEV_PASSWORD
+`))
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	require.Equal(t, "listener 2", configs[1].Name)
+	require.Equal(t, RedshiftDataAPIConfig{Database: aws.String("analytics"), WorkgroupName: aws.String("prod")}, configs[0].RedshiftDataAPIConfig())
+	require.Equal(t, ReadOnlyPolicy{Default: true, Users: map[string]bool{}}, configs[0].ReadOnlyPolicy())
+	mode, err := configs[1].unixSocketMode()
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0770), mode)
+	authenticate := PasswordAuthenticator(configs[1].Passwords)
+	ok, err := authenticate(context.Background(), "developer", "s3cret")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = authenticate(context.Background(), "analyst", "s3cret")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - name: prod\n    database: analytics\n"))
+	require.ErrorContains(t, err, "needs a listen address or a unix socket")
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - name: a\n    listen: \":1\"\n  - name: a\n    listen: \":2\"\n"))
+	require.ErrorContains(t, err, "configured twice")
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - listen: \":1\"\n    readonly: true\n"))
+	require.Error(t, err, "unknown fields are rejected")
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - listen: \":1\"\n    readOnly: true\n    readWriteUsers: [etl]\n"))
+	require.ErrorContains(t, err, "has read only users but no passwords")
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - listen: \":1\"\n    passwords:\n      etl: secret\n"))
+	require.ErrorContains(t, err, "has passwords but no tls")
+	_, err = ParseListenerConfigs(strings.NewReader("listeners:\n  - unixSocket: /tmp\n    passwords:\n      etl: secret\n"))
+	require.NoError(t, err, "unix sockets need no tls")
+}
+
+func Test_NewProxyGroup(t *testing.T) {
+	var proxies []PostgresRedshiftProxy
+	for _, listenAddress := range []string{"127.0.0.1:0", "127.0.0.1:0"} {
+		proxy, err := NewProxy(WithListenAddress(listenAddress), WithDataAPIService(&activeStatementsExceededService{}))
+		require.NoError(t, err)
+		proxies = append(proxies, proxy)
+	}
+	group := NewProxyGroup(proxies...)
+	require.Empty(t, group.Connections())
+	require.False(t, group.CancelStatement("unknown"))
+	require.False(t, group.TerminateConnection("unknown"))
+	require.NoError(t, group.Shutdown(context.Background()))
+	require.ErrorIs(t, group.Run(), ErrProxyClosed, "every proxy of the group is shut down")
+}
+
+func Test_NewProxyGroup_backendPids(t *testing.T) {
+	backendPids := NewBackendPids()
+	var proxies []PostgresRedshiftProxy
+	for i := 0; i < 2; i++ {
+		proxy, err := NewProxy(WithListenAddress("127.0.0.1:0"), WithDataAPIService(&activeStatementsExceededService{}), WithBackendPids(backendPids))
+		require.NoError(t, err)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		client, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		_, err = (&trackingListener{Listener: listener, proxy: proxy.(*postgresRedshiftProxy)}).Accept()
+		require.NoError(t, err)
+		proxies = append(proxies, proxy)
+	}
+	group := NewProxyGroup(proxies...)
+
+	var pids []int32
+	for _, connection := range group.Connections() {
+		pids = append(pids, connection.Pid)
+	}
+	require.ElementsMatch(t, []int32{firstBackendPid, firstBackendPid + 1}, pids, "the listeners of a group count from one counter")
+}
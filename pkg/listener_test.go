@@ -0,0 +1,84 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_NewProxy(t *testing.T) {
+	_, err := NewProxy(WithListenAddress("127.0.0.1:0"))
+	require.Error(t, err, "a data api client is required")
+
+	_, err = NewProxy(WithDataAPIService(&activeStatementsExceededService{}), WithReadOnlyPolicy(ReadOnlyPolicy{Default: true, Users: map[string]bool{"etl": false}}))
+	require.ErrorContains(t, err, "need WithAuth", "the user names of clients are not trusted")
+
+	proxy, err := NewProxy(WithDataAPIClient(nil), WithDataAPIService(&activeStatementsExceededService{}))
+	require.NoError(t, err)
+	require.Nil(t, proxy.Addr())
+}
+
+func Test_ConstructProxy(t *testing.T) {
+	proxy := ConstructProxy(aws.Config{}, RedshiftDataAPIConfig{}, zap.NewNop(), "127.0.0.1:0")
+	require.IsType(t, &postgresRedshiftProxy{}, proxy)
+	require.Nil(t, proxy.Addr())
+}
+
+func Test_postgresRedshiftProxy_Shutdown(t *testing.T) {
+	var opened, closed atomic.Int32
+	hooks := Hooks{
+		ConnectionOpened: func(net.Addr) { opened.Add(1) },
+		ConnectionClosed: func(net.Addr) { closed.Add(1) },
+	}
+	queryHandler := NewRedshiftDataApiQueryHandler(&activeStatementsExceededService{}, NewPgRedshiftTranslator(), RedshiftDataAPIConfig{}, nil, nil,
+		ReadOnlyPolicy{}, nil, RowLimitPolicy{}, nil, nil, hooks, NewMetrics(), zap.NewNop())
+	running := queryHandler.(*redshiftDataApiQueryHandler).running
+	proxy := newPostgresRedshiftProxy(nil, queryHandler, proxyOptions{listenAddress: DefaultListenAddress, hooks: hooks, metrics: NewMetrics(), logger: zap.NewNop()}, newClientConnections(NewBackendPids()))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy.listeners = append(proxy.listeners, listener)
+	tracking := &trackingListener{Listener: listener, proxy: proxy}
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := tracking.Accept()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), opened.Load())
+
+	rdappCtx := NewRdappContext(context.Background(), zap.NewNop())
+	rdappCtx.correlationId = "quick"
+	_, quickFinished, err := running.start(rdappCtx, "select 1")
+	require.NoError(t, err)
+	rdappCtx.correlationId = "slow"
+	slowCtx, slowFinished, err := running.start(rdappCtx, "select pg_sleep(60)")
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		quickFinished()
+	}()
+	go func() {
+		<-slowCtx.Done()
+		slowFinished()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, proxy.Shutdown(ctx), context.DeadlineExceeded, "the slow statement is still running")
+	require.Equal(t, DrainSummary{Finished: 1, Cancelled: 1}, running.summary)
+	require.Equal(t, int32(1), closed.Load())
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err, "the connection is closed")
+	_, err = tracking.Accept()
+	require.Error(t, err, "the listener is closed")
+	_, _, err = running.start(rdappCtx, "select 1")
+	require.Error(t, err, "no statements are started while shutting down")
+
+	require.NoError(t, proxy.Shutdown(context.Background()))
+	require.ErrorIs(t, proxy.Serve(listener), ErrProxyClosed)
+}
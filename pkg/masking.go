@@ -0,0 +1,236 @@
+package rdapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaskingMethodHash replaces values by their keyed hmac-sha256 hash
+	MaskingMethodHash = "hash"
+	// MaskingMethodPartial replaces all but the last characters by *
+	MaskingMethodPartial = "partial"
+	// MaskingMethodNull replaces values by NULL, the column keeps its type
+	MaskingMethodNull = "nullify"
+	// MaskingMethodTokenize replaces values by a keyed token, equal values get equal tokens
+	MaskingMethodTokenize = "tokenize"
+)
+
+const defaultPartialKeep = 4
+
+// Masking holds the rules masking sensitive columns in results, the first matching rule masks a column
+type Masking struct {
+	// Key is the key hashes and tokens are derived from, it is required by hash and tokenize rules.
+	// Environment variables like $MASKING_KEY are expanded.
+	Key string `yaml:"key"`
+	// TokenKey is the former name of Key
+	//
+	// Deprecated: use Key
+	TokenKey string        `yaml:"tokenKey"`
+	Rules    []MaskingRule `yaml:"rules"`
+}
+
+// MaskingRule masks columns for which all of its conditions hold
+type MaskingRule struct {
+	Name string `yaml:"name"`
+	// Users the rule applies to, empty applies to every user
+	Users []string `yaml:"users"`
+	// ExemptUsers see the values unmasked
+	ExemptUsers []string `yaml:"exemptUsers"`
+	// Columns are glob patterns on the column name
+	Columns []string `yaml:"columns"`
+	// Tables are glob patterns on the table the column is read from as reported by redshift,
+	// qualified patterns like pii.* match the schema too
+	Tables []string `yaml:"tables"`
+	// Types are redshift type names like varchar
+	Types  []string `yaml:"types"`
+	Method string   `yaml:"method"`
+	// Keep is the number of trailing characters partial masking leaves visible, 4 when not given
+	Keep *int `yaml:"keep"`
+	key  []byte
+}
+
+// LoadMasking reads the masking rules from a yaml file
+func LoadMasking(path string) (*Masking, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening masking file: %w", err)
+	}
+	defer file.Close()
+	return ParseMasking(file)
+}
+
+func ParseMasking(reader io.Reader) (*Masking, error) {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	var masking Masking
+	err := decoder.Decode(&masking)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error while parsing masking rules: %w", err)
+	}
+	key := masking.Key
+	if key == "" {
+		key = masking.TokenKey
+	}
+	key = os.ExpandEnv(key)
+	for i := range masking.Rules {
+		err := masking.Rules[i].compile(i+1, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &masking, nil
+}
+
+func (rule *MaskingRule) compile(position int, key string) error {
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("rule %d", position)
+	}
+	switch rule.Method {
+	case MaskingMethodNull:
+	case MaskingMethodPartial:
+		if rule.Keep == nil {
+			keep := defaultPartialKeep
+			rule.Keep = &keep
+		}
+		if *rule.Keep < 0 {
+			return fmt.Errorf("masking rule %q keeps %d characters, expected 0 or more", rule.Name, *rule.Keep)
+		}
+	case MaskingMethodHash, MaskingMethodTokenize:
+		// an unkeyed hash of a value with few candidates like a phone number is reverted by hashing the candidates
+		if key == "" {
+			return fmt.Errorf("masking rule %q uses method %s but no key is given", rule.Name, rule.Method)
+		}
+		rule.key = []byte(key)
+	default:
+		return fmt.Errorf("masking rule %q has method %q, expected hash, partial, nullify or tokenize", rule.Name, rule.Method)
+	}
+	if len(rule.Columns) == 0 && len(rule.Tables) == 0 && len(rule.Types) == 0 {
+		return fmt.Errorf("masking rule %q needs columns, tables or types to match", rule.Name)
+	}
+	for _, pattern := range append(append([]string{}, rule.Columns...), rule.Tables...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("masking rule %q has invalid glob pattern %q: %w", rule.Name, pattern, err)
+		}
+	}
+	return nil
+}
+
+// masksFor returns the rule masking each column for the user, nil when no column is masked
+func (masking *Masking) masksFor(user string, columnMetadata []types.ColumnMetadata) []*MaskingRule {
+	if masking == nil {
+		return nil
+	}
+	var masks []*MaskingRule
+	for i, column := range columnMetadata {
+		for j := range masking.Rules {
+			rule := &masking.Rules[j]
+			if !rule.appliesTo(user) || !rule.matches(column) {
+				continue
+			}
+			if masks == nil {
+				masks = make([]*MaskingRule, len(columnMetadata))
+			}
+			masks[i] = rule
+			break
+		}
+	}
+	return masks
+}
+
+func (rule *MaskingRule) appliesTo(user string) bool {
+	if containsString(rule.ExemptUsers, user) {
+		return false
+	}
+	return len(rule.Users) == 0 || containsString(rule.Users, user)
+}
+
+func (rule *MaskingRule) matches(column types.ColumnMetadata) bool {
+	name := strings.ToLower(aws.ToString(column.Name))
+	table := strings.ToLower(aws.ToString(column.TableName))
+	if schema := aws.ToString(column.SchemaName); schema != "" && table != "" {
+		table = strings.ToLower(schema) + "." + table
+	}
+	switch {
+	case len(rule.Columns) > 0 && !anyGlobMatches(lowered(rule.Columns), name):
+		return false
+	case len(rule.Tables) > 0 && (table == "" || !anyTableMatches(rule.Tables, table, nil)):
+		return false
+	case len(rule.Types) > 0 && !containsFold(rule.Types, aws.ToString(column.TypeName)):
+		return false
+	}
+	return true
+}
+
+// changesType reports if masked values are sent as text instead of the type of the column
+func (rule *MaskingRule) changesType() bool {
+	return rule.Method != MaskingMethodNull
+}
+
+// apply masks the field, NULL stays NULL
+func (rule *MaskingRule) apply(field types.Field) any {
+	text, isNull := fieldText(field)
+	if isNull || rule.Method == MaskingMethodNull {
+		return nil
+	}
+	switch rule.Method {
+	case MaskingMethodHash:
+		return rule.hmac(text)
+	case MaskingMethodTokenize:
+		return "tok_" + rule.hmac(text)[:16]
+	}
+	characters := []rune(text)
+	visible := len(characters) - *rule.Keep
+	// values no longer than the kept characters are masked completely
+	if visible <= 0 {
+		visible = len(characters)
+	}
+	for i := 0; i < visible; i++ {
+		characters[i] = '*'
+	}
+	return string(characters)
+}
+
+// hmac returns the hex encoded hmac-sha256 of the text keyed with the key of the masking
+func (rule *MaskingRule) hmac(text string) string {
+	mac := hmac.New(sha256.New, rule.key)
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fieldText returns the text representation of a data api field
+func fieldText(field types.Field) (text string, isNull bool) {
+	switch value := field.(type) {
+	case *types.FieldMemberIsNull:
+		return "", true
+	case *types.FieldMemberBlobValue:
+		return hex.EncodeToString(value.Value), false
+	case *types.FieldMemberBooleanValue:
+		return strconv.FormatBool(value.Value), false
+	case *types.FieldMemberDoubleValue:
+		return strconv.FormatFloat(value.Value, 'g', -1, 64), false
+	case *types.FieldMemberLongValue:
+		return strconv.FormatInt(value.Value, 10), false
+	case *types.FieldMemberStringValue:
+		return value.Value, false
+	}
+	return fmt.Sprintf("%v", field), false
+}
+
+func lowered(values []string) []string {
+	var result []string
+	for _, value := range values {
+		result = append(result, strings.ToLower(value))
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/lib/pq/oid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func Test_Masking_masksFor(t *testing.T) {
+	t.Setenv("MASKING_KEY", "secret")
+	masking, err := ParseMasking(strings.NewReader(`
+key: $MASKING_KEY
+rules:
+  - name: email
+    exemptUsers: [dpo]
+    columns: ["*email*"]
+    method: tokenize
+  - name: phone
+    users: [analyst]
+    tables: ["pii.person"]
+    columns: [phone]
+    method: partial
+  - name: ssn
+    types: [char]
+    tables: [person]
+    method: nullify
+  - name: notes
+    columns: [notes]
+    method: hash
+`))
+	require.NoError(t, err)
+	columnMetadata := []types.ColumnMetadata{
+		{Name: aws.String("id"), TypeName: aws.String("int4"), SchemaName: aws.String("pii"), TableName: aws.String("person")},
+		{Name: aws.String("Work_Email"), TypeName: aws.String("varchar"), SchemaName: aws.String("pii"), TableName: aws.String("person")},
+		{Name: aws.String("phone"), TypeName: aws.String("varchar"), SchemaName: aws.String("pii"), TableName: aws.String("person")},
+		{Name: aws.String("ssn"), TypeName: aws.String("char"), SchemaName: aws.String("pii"), TableName: aws.String("person")},
+		{Name: aws.String("notes"), TypeName: aws.String("int8")},
+	}
+	row := []types.Field{
+		&types.FieldMemberLongValue{Value: 7},
+		&types.FieldMemberStringValue{Value: "jane@example.com"},
+		&types.FieldMemberStringValue{Value: "+49 170 1234567"},
+		&types.FieldMemberStringValue{Value: "123-45-6789"},
+		&types.FieldMemberLongValue{Value: 42},
+	}
+	type args struct {
+		user string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		wantOids []oid.Oid
+		wantRow  []any
+	}{
+		{
+			name:     "analyst",
+			args:     args{user: "analyst"},
+			wantOids: []oid.Oid{oid.T_int4, oid.T_text, oid.T_text, oid.T_varchar, oid.T_text},
+			wantRow:  []any{int64(7), "tok_fb817989d942e7ff", "***********4567", nil, "93c121e7aa437a1e01e3c512c6f0ce3c821a839025dca4408f85616de4aaee70"},
+		},
+		{
+			name:     "exempt user",
+			args:     args{user: "dpo"},
+			wantOids: []oid.Oid{oid.T_int4, oid.T_varchar, oid.T_varchar, oid.T_varchar, oid.T_text},
+			wantRow:  []any{int64(7), "jane@example.com", "+49 170 1234567", nil, "93c121e7aa437a1e01e3c512c6f0ce3c821a839025dca4408f85616de4aaee70"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdappCtx := RdappContext{Context: context.Background(), logger: zap.NewNop()}
+			rdappCtx.columnMasks = masking.masksFor(tt.args.user, columnMetadata)
+			translator := &pgRedshiftTranslator{}
+			columns, err := translator.TranslateColumnMetaDataToPgFormat(rdappCtx, columnMetadata, nil)
+			require.NoError(t, err)
+			var oids []oid.Oid
+			for _, column := range columns {
+				oids = append(oids, column.Oid)
+			}
+			require.Equal(t, tt.wantOids, oids)
+			got, err := translator.TranslateRowToPgFormat(rdappCtx, columns, row)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRow, got)
+		})
+	}
+}
+
+func Test_ParseMasking(t *testing.T) {
+	masking, err := ParseMasking(strings.NewReader("rules:\n  - columns: [pin]\n    method: partial\n    keep: 0\n"))
+	require.NoError(t, err)
+	require.Equal(t, "****", masking.Rules[0].apply(&types.FieldMemberStringValue{Value: "1234"}), "keep 0 masks every character")
+
+	_, err = ParseMasking(strings.NewReader("rules:\n  - columns: [notes]\n    method: hash\n"))
+	require.EqualError(t, err, `masking rule "rule 1" uses method hash but no key is given`)
+}
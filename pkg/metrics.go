@@ -0,0 +1,281 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "rdapp"
+
+const (
+	queryOutcomeSuccess  = "success"
+	queryOutcomeError    = "error"
+	queryOutcomeCanceled = "canceled"
+)
+
+const (
+	statementPhaseSubmit  = "submit"
+	statementPhaseQueue   = "queue"
+	statementPhaseExecute = "execute"
+	statementPhaseFetch   = "fetch"
+)
+
+const (
+	translationColumnType = "column_type"
+	translationRowValue   = "row_value"
+	translationParameter  = "parameter"
+)
+
+// Metrics holds the prometheus collectors of the proxy
+type Metrics struct {
+	registry                *prometheus.Registry
+	activeConnections       prometheus.Gauge
+	queries                 *prometheus.CounterVec
+	statementPhases         *prometheus.HistogramVec
+	rowsReturned            prometheus.Counter
+	bytesReturned           prometheus.Counter
+	dataApiCalls            *prometheus.CounterVec
+	dataApiThrottles        *prometheus.CounterVec
+	translationFailures     *prometheus.CounterVec
+	truncatedResults        prometheus.Counter
+	resultCacheLookups      *prometheus.CounterVec
+	queuedStatements        prometheus.Gauge
+	activeStatementsRetries prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_connections",
+			Help:      "Number of open client connections.",
+		}),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_total",
+			Help:      "Number of queries received from clients by outcome.",
+		}, []string{"outcome"}),
+		statementPhases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "statement_phase_duration_seconds",
+			Help:      "Time spent by statements in the submit, queue, execute and fetch phases of the data api.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"phase"}),
+		rowsReturned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rows_returned_total",
+			Help:      "Number of rows fetched from the data api.",
+		}),
+		bytesReturned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_returned_total",
+			Help:      "Number of bytes of field values fetched from the data api.",
+		}),
+		dataApiCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "data_api_calls_total",
+			Help:      "Number of redshift data api calls by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		dataApiThrottles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "data_api_throttles_total",
+			Help:      "Number of redshift data api call attempts which were throttled, including the attempts retried by the sdk.",
+		}, []string{"operation"}),
+		translationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "translation_failures_total",
+			Help:      "Number of failures translating between postgres and redshift types.",
+		}, []string{"kind"}),
+		truncatedResults: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "truncated_results_total",
+			Help:      "Number of result sets cut off at the max rows of the client.",
+		}),
+		resultCacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "result_cache_lookups_total",
+			Help:      "Number of result cache lookups by outcome, hit or miss.",
+		}, []string{"outcome"}),
+		queuedStatements: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queued_statements",
+			Help:      "Number of statements waiting for concurrent statements to finish.",
+		}),
+		activeStatementsRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_statements_retries_total",
+			Help:      "Number of statements retried as the data api had too many active statements.",
+		}),
+	}
+	metrics.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.activeConnections,
+		metrics.queries,
+		metrics.statementPhases,
+		metrics.rowsReturned,
+		metrics.bytesReturned,
+		metrics.dataApiCalls,
+		metrics.dataApiThrottles,
+		metrics.translationFailures,
+		metrics.truncatedResults,
+		metrics.resultCacheLookups,
+		metrics.queuedStatements,
+		metrics.activeStatementsRetries,
+	)
+	return metrics
+}
+
+// Handler serves the metrics in the prometheus exposition format
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (metrics *Metrics) observeQuery(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		metrics.queries.WithLabelValues(queryOutcomeSuccess).Inc()
+	case ctx.Err() != nil:
+		metrics.queries.WithLabelValues(queryOutcomeCanceled).Inc()
+	default:
+		metrics.queries.WithLabelValues(queryOutcomeError).Inc()
+	}
+}
+
+func (metrics *Metrics) observePhase(phase string, duration time.Duration) {
+	metrics.statementPhases.WithLabelValues(phase).Observe(duration.Seconds())
+}
+
+func (metrics *Metrics) observeRecords(records [][]types.Field) {
+	metrics.rowsReturned.Add(float64(len(records)))
+	var size int
+	for _, record := range records {
+		for _, field := range record {
+			size += fieldSize(field)
+		}
+	}
+	metrics.bytesReturned.Add(float64(size))
+}
+
+func (metrics *Metrics) observeTranslationFailure(kind string) {
+	metrics.translationFailures.WithLabelValues(kind).Inc()
+}
+
+func (metrics *Metrics) observeDataApiCall(operation string, err error) {
+	outcome := queryOutcomeSuccess
+	if err != nil {
+		outcome = queryOutcomeError
+	}
+	metrics.dataApiCalls.WithLabelValues(operation, outcome).Inc()
+}
+
+// countThrottles counts the throttled attempts of an operation, the sdk retries throttled attempts so
+// most of them never surface as the error of the call
+func (metrics *Metrics) countThrottles(operation string) func(*redshiftdata.Options) {
+	return func(options *redshiftdata.Options) {
+		if options.Retryer == nil {
+			return
+		}
+		options.Retryer = &throttleCountingRetryer{
+			Retryer:   options.Retryer,
+			operation: operation,
+			metrics:   metrics,
+		}
+	}
+}
+
+// throttleCountingRetryer is asked about the error of every failed attempt, including the last one
+type throttleCountingRetryer struct {
+	aws.Retryer
+	operation string
+	metrics   *Metrics
+}
+
+func (retryer *throttleCountingRetryer) IsErrorRetryable(err error) bool {
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+		retryer.metrics.dataApiThrottles.WithLabelValues(retryer.operation).Inc()
+	}
+	return retryer.Retryer.IsErrorRetryable(err)
+}
+
+func (retryer *throttleCountingRetryer) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	if retryerV2, ok := retryer.Retryer.(aws.RetryerV2); ok {
+		return retryerV2.GetAttemptToken(ctx)
+	}
+	return retryer.Retryer.GetInitialToken(), nil
+}
+
+// fieldSize approximates the number of bytes of a field as returned by the data api
+func fieldSize(field types.Field) int {
+	switch value := field.(type) {
+	case *types.FieldMemberBlobValue:
+		return len(value.Value)
+	case *types.FieldMemberStringValue:
+		return len(value.Value)
+	case *types.FieldMemberLongValue, *types.FieldMemberDoubleValue:
+		return 8
+	case *types.FieldMemberBooleanValue:
+		return 1
+	}
+	return 0
+}
+
+// instrumentedRedshiftDataApiClient counts the calls made to the data api
+type instrumentedRedshiftDataApiClient struct {
+	client  RedshiftDataApiClient
+	metrics *Metrics
+}
+
+func newInstrumentedRedshiftDataApiClient(client RedshiftDataApiClient, metrics *Metrics) RedshiftDataApiClient {
+	return &instrumentedRedshiftDataApiClient{
+		client:  client,
+		metrics: metrics,
+	}
+}
+
+func (instrumented *instrumentedRedshiftDataApiClient) ExecuteStatement(ctx context.Context, params *redshiftdata.ExecuteStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.ExecuteStatementOutput, error) {
+	output, err := instrumented.client.ExecuteStatement(ctx, params, append(optFns, instrumented.metrics.countThrottles("ExecuteStatement"))...)
+	instrumented.metrics.observeDataApiCall("ExecuteStatement", err)
+	return output, err
+}
+
+func (instrumented *instrumentedRedshiftDataApiClient) BatchExecuteStatement(ctx context.Context, params *redshiftdata.BatchExecuteStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.BatchExecuteStatementOutput, error) {
+	output, err := instrumented.client.BatchExecuteStatement(ctx, params, append(optFns, instrumented.metrics.countThrottles("BatchExecuteStatement"))...)
+	instrumented.metrics.observeDataApiCall("BatchExecuteStatement", err)
+	return output, err
+}
+
+func (instrumented *instrumentedRedshiftDataApiClient) DescribeStatement(ctx context.Context, params *redshiftdata.DescribeStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.DescribeStatementOutput, error) {
+	output, err := instrumented.client.DescribeStatement(ctx, params, append(optFns, instrumented.metrics.countThrottles("DescribeStatement"))...)
+	instrumented.metrics.observeDataApiCall("DescribeStatement", err)
+	return output, err
+}
+
+func (instrumented *instrumentedRedshiftDataApiClient) GetStatementResult(ctx context.Context, params *redshiftdata.GetStatementResultInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.GetStatementResultOutput, error) {
+	output, err := instrumented.client.GetStatementResult(ctx, params, append(optFns, instrumented.metrics.countThrottles("GetStatementResult"))...)
+	instrumented.metrics.observeDataApiCall("GetStatementResult", err)
+	return output, err
+}
+
+func (instrumented *instrumentedRedshiftDataApiClient) CancelStatement(ctx context.Context, params *redshiftdata.CancelStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.CancelStatementOutput, error) {
+	output, err := instrumented.client.CancelStatement(ctx, params, append(optFns, instrumented.metrics.countThrottles("CancelStatement"))...)
+	instrumented.metrics.observeDataApiCall("CancelStatement", err)
+	return output, err
+}
+
+func (metrics *Metrics) observeResultCache(hit bool) {
+	outcome := "miss"
+	if hit {
+		outcome = "hit"
+	}
+	metrics.resultCacheLookups.WithLabelValues(outcome).Inc()
+}
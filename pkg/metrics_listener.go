@@ -0,0 +1,54 @@
+package rdapp
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+)
+
+type MetricsServer interface {
+	Run() error
+	// Serve serves the metrics on a listener bound by the caller, so that bind failures fail the startup
+	Serve(listener net.Listener) error
+}
+
+type metricsServer struct {
+	listenAddress string
+	metrics       *Metrics
+	logger        *zap.Logger
+}
+
+func NewMetricsServer(listenAddress string, metrics *Metrics, logger *zap.Logger) MetricsServer {
+	return &metricsServer{
+		listenAddress: listenAddress,
+		metrics:       metrics,
+		logger:        logger,
+	}
+}
+
+func (server *metricsServer) Run() error {
+	listener, err := net.Listen("tcp", server.listenAddress)
+	if err != nil {
+		server.logger.Error("error while listening for metrics",
+			zap.String("metricsListenAddress", server.listenAddress),
+			zap.Error(err))
+		return fmt.Errorf("error while listening for metrics on %s: %w", server.listenAddress, err)
+	}
+	return server.Serve(listener)
+}
+
+func (server *metricsServer) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.metrics.Handler())
+	server.logger.Info("serving metrics",
+		zap.String("metricsListenAddress", listener.Addr().String()))
+	err := http.Serve(listener, mux)
+	if err != nil {
+		server.logger.Error("error while serving metrics",
+			zap.String("metricsListenAddress", server.listenAddress),
+			zap.Error(err))
+		return fmt.Errorf("error while serving metrics on %s: %w", server.listenAddress, err)
+	}
+	return nil
+}
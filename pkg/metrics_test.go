@@ -0,0 +1,51 @@
+package rdapp
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_Metrics_observeDataApiCall(t *testing.T) {
+	type args struct {
+		err error
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantOutcome string
+	}{
+		{
+			name:        "successful call",
+			args:        args{err: nil},
+			wantOutcome: queryOutcomeSuccess,
+		},
+		{
+			name:        "failed call",
+			args:        args{err: errors.New("validation failed")},
+			wantOutcome: queryOutcomeError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			metrics.observeDataApiCall("ExecuteStatement", tt.args.err)
+			require.Equal(t, float64(1), testutil.ToFloat64(metrics.dataApiCalls.WithLabelValues("ExecuteStatement", tt.wantOutcome)))
+		})
+	}
+}
+
+func Test_Metrics_countThrottles(t *testing.T) {
+	metrics := NewMetrics()
+	options := redshiftdata.Options{Retryer: retry.NewStandard()}
+	metrics.countThrottles("DescribeStatement")(&options)
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	require.True(t, options.Retryer.IsErrorRetryable(throttled))
+	require.True(t, options.Retryer.IsErrorRetryable(throttled))
+	require.False(t, options.Retryer.IsErrorRetryable(errors.New("validation failed")))
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.dataApiThrottles.WithLabelValues("DescribeStatement")), "every throttled attempt is counted")
+}
@@ -0,0 +1,50 @@
+package rdapp
+
+import (
+	"encoding/binary"
+	"errors"
+	"go.uber.org/zap"
+)
+
+// the sql states of notices, sqlStateWarning warns the client while sqlStateSuccessfulCompletion informs it
+const (
+	sqlStateSuccessfulCompletion = "00000"
+	sqlStateWarning              = "01000"
+)
+
+// notice is a NoticeResponse message sent to the client while a query runs
+type notice struct {
+	// severity is one of WARNING, NOTICE or INFO
+	severity string
+	code     string
+	message  string
+}
+
+// encode returns the NoticeResponse message of the notice
+func (notice notice) encode() []byte {
+	var fields []byte
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{{'S', notice.severity}, {'V', notice.severity}, {'C', notice.code}, {'M', notice.message}} {
+		fields = append(append(append(fields, field.kind), field.value...), 0)
+	}
+	fields = append(fields, 0)
+	message := make([]byte, 5, 5+len(fields))
+	message[0] = 'N'
+	binary.BigEndian.PutUint32(message[1:], uint32(4+len(fields)))
+	return append(message, fields...)
+}
+
+// notify sends the notice to the client of the context, notices which cannot be sent are logged
+func (ctx RdappContext) notify(notice notice) {
+	err := errors.New("the context belongs to no client connection")
+	if ctx.sendNotice != nil {
+		err = ctx.sendNotice(notice)
+	}
+	if err != nil {
+		ctx.logger.Warn("error while sending notice",
+			zap.String("notice", notice.message),
+			zap.Error(err))
+	}
+}
@@ -0,0 +1,71 @@
+package rdapp
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func Test_notice_encode(t *testing.T) {
+	got := notice{severity: "WARNING", code: sqlStateWarning, message: "truncated"}.encode()
+	require.Equal(t, "N\x00\x00\x00\x29SWARNING\x00VWARNING\x00C01000\x00Mtruncated\x00\x00", string(got))
+}
+
+// byteWiseConn writes a byte at a time like a connection accepting short writes
+type byteWiseConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written []byte
+}
+
+func (conn *byteWiseConn) Write(p []byte) (int, error) {
+	for _, b := range p {
+		conn.mutex.Lock()
+		conn.written = append(conn.written, b)
+		conn.mutex.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func Test_clientConnections_sendNotice(t *testing.T) {
+	queryHandler := NewRedshiftDataApiQueryHandler(&activeStatementsExceededService{}, NewPgRedshiftTranslator(), RedshiftDataAPIConfig{}, nil, nil,
+		ReadOnlyPolicy{}, nil, RowLimitPolicy{}, nil, nil, Hooks{}, NewMetrics(), zap.NewNop())
+	proxy := newPostgresRedshiftProxy(nil, queryHandler, proxyOptions{listenAddress: DefaultListenAddress, metrics: NewMetrics(), logger: zap.NewNop()}, newClientConnections(NewBackendPids()))
+	written := &byteWiseConn{}
+	conn := &trackedConn{Conn: written, proxy: proxy, id: "connection"}
+	proxy.connections.add(conn)
+	dataRow := []byte{'D', 0, 0, 0, 10, 0, 1, 0, 0, 0, 0}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, err := conn.Write(dataRow)
+			require.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			require.NoError(t, proxy.connections.sendNotice(conn.id, notice{severity: "NOTICE", code: sqlStateSuccessfulCompletion, message: "waiting"}))
+		}
+	}()
+	wg.Wait()
+
+	counts := map[byte]int{}
+	stream := written.written
+	for len(stream) > 0 {
+		require.GreaterOrEqual(t, len(stream), 5)
+		length := int(binary.BigEndian.Uint32(stream[1:5]))
+		require.Contains(t, []byte{'D', 'N'}, stream[0], "messages are not interleaved")
+		counts[stream[0]]++
+		stream = stream[1+length:]
+	}
+	require.Equal(t, map[byte]int{'D': 50, 'N': 50}, counts)
+}
@@ -0,0 +1,30 @@
+package rdapp
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net/url"
+	"strings"
+)
+
+// newOtlpHttpExporter exports spans to the otlp/http collector at endpoint, a url like http://localhost:4318
+func newOtlpHttpExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("error while parsing otlp endpoint %q, expected a url like http://localhost:4318", endpoint)
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpointUrl.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(endpointUrl.Path, "/") + "/v1/traces"),
+	}
+	if endpointUrl.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("error while constructing otlp trace exporter: %w", err)
+	}
+	return exporter, nil
+}
@@ -0,0 +1,76 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_otlpHttpExporter_ExportSpans(t *testing.T) {
+	var received coltracepb.ExportTraceServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, proto.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+	startTime := time.Unix(1700000000, 0)
+	spans := tracetest.SpanStubs{
+		{
+			Name: "DescribeStatement",
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: trace.TraceID{0x01},
+				SpanID:  trace.SpanID{0x02},
+			}),
+			Parent: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: trace.TraceID{0x01},
+				SpanID:  trace.SpanID{0x03},
+			}),
+			SpanKind:  trace.SpanKindClient,
+			StartTime: startTime,
+			EndTime:   startTime.Add(time.Second),
+			Attributes: []attribute.KeyValue{
+				dataApiQueryIdAttribute.String("d9b6c0c9"),
+				redshiftQueryIdAttribute.Int64(42),
+			},
+			Status: sdktrace.Status{Code: otelcodes.Error, Description: "query failed"},
+		},
+	}.Snapshots()
+
+	exporter, err := newOtlpHttpExporter(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer exporter.Shutdown(context.Background())
+
+	err = exporter.ExportSpans(context.Background(), spans)
+
+	require.NoError(t, err)
+	span := received.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	require.Equal(t, "DescribeStatement", span.Name)
+	require.Equal(t, []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, span.TraceId)
+	require.Equal(t, []byte{0x02, 0, 0, 0, 0, 0, 0, 0}, span.SpanId)
+	require.Equal(t, []byte{0x03, 0, 0, 0, 0, 0, 0, 0}, span.ParentSpanId)
+	require.Equal(t, uint64(1700000001000000000), span.EndTimeUnixNano)
+	require.Equal(t, "rdapp.redshift.query_id", span.Attributes[1].Key)
+	require.Equal(t, int64(42), span.Attributes[1].Value.GetIntValue())
+	require.Equal(t, tracepb.Status_STATUS_CODE_ERROR, span.Status.Code)
+	require.Equal(t, "query failed", span.Status.Message)
+}
+
+func Test_newOtlpHttpExporter_invalidEndpoint(t *testing.T) {
+	_, err := newOtlpHttpExporter(context.Background(), "localhost:4318")
+	require.ErrorContains(t, err, "expected a url like http://localhost:4318")
+}
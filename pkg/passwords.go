@@ -0,0 +1,44 @@
+package rdapp
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+)
+
+// LoadPasswords reads a yaml file mapping postgres users to their passwords, environment variables
+// like $PROD_PASSWORD are expanded
+func LoadPasswords(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening passwords file: %w", err)
+	}
+	defer file.Close()
+	return ParsePasswords(file)
+}
+
+func ParsePasswords(reader io.Reader) (map[string]string, error) {
+	passwords := map[string]string{}
+	err := yaml.NewDecoder(reader).Decode(&passwords)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error while parsing passwords: %w", err)
+	}
+	for user, password := range passwords {
+		passwords[user] = os.ExpandEnv(password)
+	}
+	return passwords, nil
+}
+
+// PasswordAuthenticator accepts the users with their password, to be passed to WithAuth
+func PasswordAuthenticator(passwords map[string]string) func(ctx context.Context, username, password string) (bool, error) {
+	return func(_ context.Context, username, password string) (bool, error) {
+		expected, ok := passwords[username]
+		if !ok {
+			return false, nil
+		}
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1, nil
+	}
+}
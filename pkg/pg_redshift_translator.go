@@ -12,10 +12,10 @@ import (
 )
 
 type PgRedshiftTranslator interface {
-	TranslateToRedshiftQuery(pgQuery string) string
-	TranslateToRedshiftQueryParams(pgParams []string) []types.SqlParameter
-	TranslateColumnMetaDataToPgFormat(rdappCtx RdappContext, columnMetadata []types.ColumnMetadata) (wire.Columns, error)
-	TranslateRowToPgFormat(rdappCtx RdappContext, redshiftRow []types.Field) ([]any, error)
+	TranslateToRedshiftQuery(pgQuery string, pgParams []QueryParameter) string
+	TranslateToRedshiftQueryParams(pgParams []QueryParameter) ([]types.SqlParameter, error)
+	TranslateColumnMetaDataToPgFormat(rdappCtx RdappContext, columnMetadata []types.ColumnMetadata, resultFormats []wire.FormatCode) (wire.Columns, error)
+	TranslateRowToPgFormat(rdappCtx RdappContext, columns wire.Columns, redshiftRow []types.Field) ([]any, error)
 }
 
 type pgRedshiftTranslator struct {
@@ -25,60 +25,103 @@ func NewPgRedshiftTranslator() PgRedshiftTranslator {
 	return &pgRedshiftTranslator{}
 }
 
-func (translator *pgRedshiftTranslator) TranslateToRedshiftQuery(query string) string {
-	newQuery := strings.ReplaceAll(query, "$", ":")
-	for i := 1; strings.Contains(newQuery, "?"); i++ {
-		newQuery = strings.Replace(newQuery, "?", fmt.Sprintf(":%d", i), 1)
+// TranslateToRedshiftQuery rewrites $n and ? placeholders into the :n named parameters of the data api.
+// NULL parameters are inlined and parameters of a known type are cast unless the query casts them already.
+func (translator *pgRedshiftTranslator) TranslateToRedshiftQuery(query string, pgParams []QueryParameter) string {
+	var newQuery strings.Builder
+	tokens := lexSql(query)
+	position := 0
+	questionMarkIndex := 0
+	for i, token := range tokens {
+		if token.kind != sqlTokenPlaceholder {
+			continue
+		}
+		index := 0
+		if token.text == "?" {
+			questionMarkIndex++
+			index = questionMarkIndex
+		} else {
+			index, _ = strconv.Atoi(token.text[1:])
+		}
+		name := strconv.Itoa(index)
+		replacement := ":" + name
+		if index >= 1 && index <= len(pgParams) {
+			castFollows := i+1 < len(tokens) && tokens[i+1].text == "::"
+			replacement = pgParams[index-1].redshiftPlaceholder(name, castFollows)
+		}
+		newQuery.WriteString(query[position:token.start])
+		newQuery.WriteString(replacement)
+		position = token.end
 	}
-	return newQuery
+	newQuery.WriteString(query[position:])
+	return newQuery.String()
 }
 
-func (translator *pgRedshiftTranslator) TranslateToRedshiftQueryParams(pgParams []string) []types.SqlParameter {
+// TranslateToRedshiftQueryParams converts the parameters into data api parameters named by their position,
+// NULL parameters are skipped as they are inlined into the query
+func (translator *pgRedshiftTranslator) TranslateToRedshiftQueryParams(pgParams []QueryParameter) ([]types.SqlParameter, error) {
 	var sqlParameters []types.SqlParameter
 	for i, parameter := range pgParams {
+		if parameter.Value == nil {
+			continue
+		}
+		value, err := parameter.redshiftValue()
+		if err != nil {
+			return nil, fmt.Errorf("error while translating parameter $%d: %w", i+1, err)
+		}
 		sqlParameters = append(sqlParameters, types.SqlParameter{
 			Name:  aws.String(strconv.Itoa(i + 1)),
-			Value: aws.String(parameter),
+			Value: aws.String(value),
 		})
 	}
-	return sqlParameters
+	return sqlParameters, nil
 }
 
-func (translator *pgRedshiftTranslator) TranslateRowToPgFormat(rdappCtx RdappContext, redshiftRow []types.Field) ([]any, error) {
+// TranslateRowToPgFormat converts the fields of a row into values psql-wire can encode for the given columns
+func (translator *pgRedshiftTranslator) TranslateRowToPgFormat(rdappCtx RdappContext, columns wire.Columns, redshiftRow []types.Field) ([]any, error) {
 	var row []any
-	for _, recordCol := range redshiftRow {
-		switch t := recordCol.(type) {
-		case *types.FieldMemberIsNull:
-			row = append(row, nil)
-		case *types.FieldMemberBlobValue:
-			row = append(row, t.Value)
-		case *types.FieldMemberBooleanValue:
-			row = append(row, t.Value)
-		case *types.FieldMemberDoubleValue:
-			row = append(row, t.Value)
-		case *types.FieldMemberLongValue:
-			row = append(row, t.Value)
-		case *types.FieldMemberStringValue:
-			row = append(row, t.Value)
-		default:
-			rdappCtx.logger.Error("unknown row column format", zap.Any("recordColType", t))
-			return nil, fmt.Errorf("unknown row column format %v", t)
+	for i, recordCol := range redshiftRow {
+		var columnOid oid.Oid
+		if i < len(columns) {
+			columnOid = columns[i].Oid
+		}
+		if mask := rdappCtx.columnMask(i); mask != nil {
+			row = append(row, mask.apply(recordCol))
+			continue
 		}
+		value, err := pgValueForColumn(columnOid, recordCol)
+		if err != nil {
+			rdappCtx.logger.Error("error while translating row column",
+				zap.Any("recordCol", recordCol),
+				zap.Uint32("columnOid", uint32(columnOid)),
+				zap.Error(err))
+			return nil, fmt.Errorf("error while translating row column: %w", err)
+		}
+		row = append(row, value)
 	}
 	return row, nil
 }
 
-func (translator *pgRedshiftTranslator) TranslateColumnMetaDataToPgFormat(rdappCtx RdappContext, columnMetadata []types.ColumnMetadata) (wire.Columns, error) {
+// TranslateColumnMetaDataToPgFormat converts the column metadata into a row description, resultFormats
+// are the result format codes of the Bind message
+func (translator *pgRedshiftTranslator) TranslateColumnMetaDataToPgFormat(rdappCtx RdappContext, columnMetadata []types.ColumnMetadata, resultFormats []wire.FormatCode) (wire.Columns, error) {
 	var wireColumns wire.Columns
-	for _, column := range columnMetadata {
+	for i, column := range columnMetadata {
 		postgresType, err := translator.convertRedshiftResultTypeToPostgresType(*column.TypeName, rdappCtx.logger)
 		if err != nil {
 			return nil, err
 		}
+		width := int16(column.Length)
+		// masked values are text whatever the type of the column
+		if mask := rdappCtx.columnMask(i); mask != nil && mask.changesType() {
+			postgresType = oid.T_text
+			width = -1
+		}
 		wireColumns = append(wireColumns, wire.Column{
-			Name:  *column.Name,
-			Oid:   postgresType,
-			Width: int16(column.Length),
+			Name:   *column.Name,
+			Oid:    postgresType,
+			Width:  width,
+			Format: resultFormat(resultFormats, i),
 		})
 	}
 	return wireColumns, nil
@@ -92,6 +135,10 @@ const (
 	RedshiftTypeBpchar      = "bpchar"
 	RedshiftTypeTimestamp   = "timestamp"
 	RedshiftTypeTimestamptz = "timestamptz"
+	RedshiftTypeDate        = "date"
+	RedshiftTypeTime        = "time"
+	RedshiftTypeTimetz      = "timetz"
+	RedshiftTypeVarbyte     = "varbyte"
 	RedshiftTypeFloat4      = "float4"
 	RedshiftTypeFloat8      = "float8"
 	RedshiftTypeInt2        = "int2"
@@ -116,6 +163,12 @@ func (translator *pgRedshiftTranslator) convertRedshiftResultTypeToPostgresType(
 		// Timestamp types
 		RedshiftTypeTimestamp:   oid.T_timestamp,
 		RedshiftTypeTimestamptz: oid.T_timestamptz,
+		RedshiftTypeDate:        oid.T_date,
+		RedshiftTypeTime:        oid.T_time,
+		// timetz has no pgtype codec, it is passed on as text
+		RedshiftTypeTimetz: oid.T_varchar,
+		// Binary types
+		RedshiftTypeVarbyte: oid.T_bytea,
 		// Numeric types
 		RedshiftTypeFloat4:  oid.T_float4,
 		RedshiftTypeFloat8:  oid.T_float8,
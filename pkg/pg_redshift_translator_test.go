@@ -3,13 +3,16 @@ package rdapp
 import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
 
 func Test_pgRedshiftTranslator_TranslateToRedshiftQuery(t *testing.T) {
 	type args struct {
-		query string
+		query    string
+		pgParams []QueryParameter
 	}
 	tests := []struct {
 		name string
@@ -26,11 +29,29 @@ func Test_pgRedshiftTranslator_TranslateToRedshiftQuery(t *testing.T) {
 			args: args{query: "select * from person where name = $1 and age > $2"},
 			want: "select * from person where name = :1 and age > :2",
 		},
+		{
+			name: "placeholders within literals are left alone",
+			args: args{query: "select '$1', 'what?' from person where name = $1"},
+			want: "select '$1', 'what?' from person where name = :1",
+		},
+		{
+			name: "typed parameters are cast and null is inlined",
+			args: args{
+				query: "select * from person where id = $1 and age > $2::int and name = $3 and photo = $4",
+				pgParams: []QueryParameter{
+					{Value: []byte("1"), Oid: oid.T_int8},
+					{Value: []byte("20"), Oid: oid.T_int4},
+					{Value: nil, Oid: oid.T_varchar},
+					{Value: []byte{0xca, 0xfe}, Oid: oid.T_bytea, Format: wire.BinaryFormat},
+				},
+			},
+			want: "select * from person where id = :1::int8 and age > :2::int and name = NULL and photo = from_hex(:4)",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			translator := &pgRedshiftTranslator{}
-			got := translator.TranslateToRedshiftQuery(tt.args.query)
+			got := translator.TranslateToRedshiftQuery(tt.args.query, tt.args.pgParams)
 			require.Equal(t, tt.want, got)
 		})
 	}
@@ -38,7 +59,7 @@ func Test_pgRedshiftTranslator_TranslateToRedshiftQuery(t *testing.T) {
 
 func Test_pgRedshiftTranslator_TranslateToRedshiftQueryParams(t *testing.T) {
 	type args struct {
-		pgParams []string
+		pgParams []QueryParameter
 	}
 	tests := []struct {
 		name string
@@ -48,18 +69,35 @@ func Test_pgRedshiftTranslator_TranslateToRedshiftQueryParams(t *testing.T) {
 		{
 			name: "translate args to sql position params",
 			args: args{
-				pgParams: []string{"name", "20"},
+				pgParams: TextQueryParameters([]string{"name", "20"}),
 			},
 			want: []types.SqlParameter{
 				{Name: aws.String("1"), Value: aws.String("name")},
 				{Name: aws.String("2"), Value: aws.String("20")},
 			},
 		},
+		{
+			name: "null parameters are skipped and binary parameters decoded",
+			args: args{
+				pgParams: []QueryParameter{
+					{Value: nil},
+					{Value: []byte{0, 0, 0, 42}, Oid: oid.T_int4, Format: wire.BinaryFormat},
+					{Value: []byte{0xca, 0xfe}, Oid: oid.T_bytea, Format: wire.BinaryFormat},
+					{Value: []byte(`\xcafe`), Oid: oid.T_bytea},
+				},
+			},
+			want: []types.SqlParameter{
+				{Name: aws.String("2"), Value: aws.String("42")},
+				{Name: aws.String("3"), Value: aws.String("cafe")},
+				{Name: aws.String("4"), Value: aws.String("cafe")},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			translator := &pgRedshiftTranslator{}
-			got := translator.TranslateToRedshiftQueryParams(tt.args.pgParams)
+			got, err := translator.TranslateToRedshiftQueryParams(tt.args.pgParams)
+			require.NoError(t, err)
 			require.Equal(t, tt.want, got)
 		})
 	}
@@ -0,0 +1,98 @@
+package rdapp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/jackc/pgtype"
+	"github.com/lib/pq/oid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redshift renders time zones as +hh, +hh:mm or +hh:mm:ss
+var timestamptzLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+	time.RFC3339Nano,
+}
+
+const (
+	timestampLayout = "2006-01-02 15:04:05.999999999"
+	dateLayout      = "2006-01-02"
+	timeLayout      = "15:04:05.999999999"
+)
+
+// pgValueForColumn converts a data api field into the go value psql-wire encodes for the column type.
+// The values are chosen so that pgtype can encode them in both the text and the binary format,
+// for example numeric values which the data api returns as strings are validated as numerics
+// and timestamps are parsed into time.Time.
+func pgValueForColumn(columnOid oid.Oid, field types.Field) (any, error) {
+	switch value := field.(type) {
+	case *types.FieldMemberIsNull:
+		return nil, nil
+	case *types.FieldMemberBlobValue:
+		return value.Value, nil
+	case *types.FieldMemberBooleanValue:
+		return value.Value, nil
+	case *types.FieldMemberDoubleValue:
+		return value.Value, nil
+	case *types.FieldMemberLongValue:
+		return value.Value, nil
+	case *types.FieldMemberStringValue:
+		return pgValueFromString(columnOid, value.Value)
+	}
+	return nil, fmt.Errorf("unknown row column format %v", field)
+}
+
+func pgValueFromString(columnOid oid.Oid, value string) (any, error) {
+	switch columnOid {
+	case oid.T_numeric:
+		numeric := pgtype.Numeric{}
+		err := numeric.DecodeText(nil, []byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid numeric value %q: %w", value, err)
+		}
+		return value, nil
+	case oid.T_int2, oid.T_int4, oid.T_int8:
+		return strconv.ParseInt(value, 10, 64)
+	case oid.T_float4, oid.T_float8:
+		return strconv.ParseFloat(value, 64)
+	case oid.T_bool:
+		return strconv.ParseBool(value)
+	case oid.T_timestamp:
+		return parseTime(timestampLayout, value)
+	case oid.T_timestamptz:
+		for _, layout := range timestamptzLayouts {
+			if parsed, err := time.Parse(layout, value); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid timestamptz value %q", value)
+	case oid.T_date:
+		return parseTime(dateLayout, value)
+	case oid.T_time:
+		parsed, err := parseTime(timeLayout, value)
+		if err != nil {
+			return nil, err
+		}
+		return time.Date(2000, 1, 1, parsed.Hour(), parsed.Minute(), parsed.Second(), parsed.Nanosecond(), time.UTC), nil
+	case oid.T_bytea:
+		decoded, err := hex.DecodeString(strings.TrimPrefix(value, `\x`))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytea value: %w", err)
+		}
+		return decoded, nil
+	}
+	return value, nil
+}
+
+func parseTime(layout string, value string) (time.Time, error) {
+	parsed, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time value %q: %w", value, err)
+	}
+	return parsed, nil
+}
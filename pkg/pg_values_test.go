@@ -0,0 +1,142 @@
+package rdapp
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/jackc/pgtype"
+	pgxtype "github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func Test_pgRedshiftTranslator_TranslateRowToPgFormat_roundTrip(t *testing.T) {
+	type args struct {
+		redshiftType string
+		field        types.Field
+	}
+	tests := []struct {
+		name string
+		args args
+		// scan decodes the encoded value using pgx and returns it for comparison
+		scan func(t *testing.T, pgxTypes *pgxtype.Map, columnOid uint32, format int16, src []byte) any
+		want any
+	}{
+		{
+			name: "int4",
+			args: args{redshiftType: "int4", field: &types.FieldMemberLongValue{Value: 42}},
+			scan: scanInto[int32],
+			want: int32(42),
+		},
+		{
+			name: "int8",
+			args: args{redshiftType: "int8", field: &types.FieldMemberLongValue{Value: 1 << 40}},
+			scan: scanInto[int64],
+			want: int64(1 << 40),
+		},
+		{
+			name: "float8",
+			args: args{redshiftType: "float8", field: &types.FieldMemberDoubleValue{Value: 1.5}},
+			scan: scanInto[float64],
+			want: 1.5,
+		},
+		{
+			name: "bool",
+			args: args{redshiftType: "bool", field: &types.FieldMemberBooleanValue{Value: true}},
+			scan: scanInto[bool],
+			want: true,
+		},
+		{
+			name: "numeric received as string",
+			args: args{redshiftType: "numeric", field: &types.FieldMemberStringValue{Value: "12345.6789"}},
+			scan: scanInto[float64],
+			want: 12345.6789,
+		},
+		{
+			name: "timestamp",
+			args: args{redshiftType: "timestamp", field: &types.FieldMemberStringValue{Value: "2023-05-04 10:11:12.123456"}},
+			scan: scanInto[time.Time],
+			want: time.Date(2023, 5, 4, 10, 11, 12, 123456000, time.UTC),
+		},
+		{
+			name: "timestamptz",
+			args: args{redshiftType: "timestamptz", field: &types.FieldMemberStringValue{Value: "2023-05-04 10:11:12+05:30"}},
+			scan: func(t *testing.T, pgxTypes *pgxtype.Map, columnOid uint32, format int16, src []byte) any {
+				return scanInto[time.Time](t, pgxTypes, columnOid, format, src).(time.Time).UTC()
+			},
+			want: time.Date(2023, 5, 4, 4, 41, 12, 0, time.UTC),
+		},
+		{
+			name: "date",
+			args: args{redshiftType: "date", field: &types.FieldMemberStringValue{Value: "2023-05-04"}},
+			scan: scanInto[time.Time],
+			want: time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "time",
+			args: args{redshiftType: "time", field: &types.FieldMemberStringValue{Value: "10:11:12.5"}},
+			scan: func(t *testing.T, pgxTypes *pgxtype.Map, columnOid uint32, format int16, src []byte) any {
+				return scanInto[pgxtype.Time](t, pgxTypes, columnOid, format, src).(pgxtype.Time).Microseconds
+			},
+			want: int64((10*3600+11*60+12)*1000000 + 500000),
+		},
+		{
+			name: "varbyte",
+			args: args{redshiftType: "varbyte", field: &types.FieldMemberStringValue{Value: "cafe"}},
+			scan: scanInto[[]byte],
+			want: []byte{0xca, 0xfe},
+		},
+		{
+			name: "varchar",
+			args: args{redshiftType: "varchar", field: &types.FieldMemberStringValue{Value: "john doe"}},
+			scan: scanInto[string],
+			want: "john doe",
+		},
+	}
+	rdappCtx := RdappContext{Context: context.Background(), logger: zap.NewNop()}
+	for _, tt := range tests {
+		for _, format := range []wire.FormatCode{wire.TextFormat, wire.BinaryFormat} {
+			t.Run(fmt.Sprintf("%s format %d", tt.name, format), func(t *testing.T) {
+				translator := &pgRedshiftTranslator{}
+				columns, err := translator.TranslateColumnMetaDataToPgFormat(rdappCtx, []types.ColumnMetadata{
+					{Name: aws.String("col"), TypeName: aws.String(tt.args.redshiftType)},
+				}, []wire.FormatCode{format})
+				require.NoError(t, err)
+				row, err := translator.TranslateRowToPgFormat(rdappCtx, columns, []types.Field{tt.args.field})
+				require.NoError(t, err)
+				encoded := encodeLikePsqlWire(t, columns[0], row[0])
+				got := tt.scan(t, pgxtype.NewMap(), uint32(columns[0].Oid), int16(format), encoded)
+				require.Equal(t, tt.want, got)
+			})
+		}
+	}
+}
+
+// encodeLikePsqlWire encodes a value the way psql-wire does when writing a data row, it sets the value on
+// the jackc/pgtype data type of the column oid and encodes it in the format of the column
+func encodeLikePsqlWire(t *testing.T, column wire.Column, value any) []byte {
+	connInfo := pgtype.NewConnInfo()
+	dataType, ok := connInfo.DataTypeForOID(uint32(column.Oid))
+	require.True(t, ok)
+	typed := pgtype.NewValue(dataType.Value)
+	require.NoError(t, typed.Set(value))
+	var encoded []byte
+	var err error
+	if column.Format == wire.BinaryFormat {
+		encoded, err = typed.(pgtype.BinaryEncoder).EncodeBinary(connInfo, nil)
+	} else {
+		encoded, err = typed.(pgtype.TextEncoder).EncodeText(connInfo, nil)
+	}
+	require.NoError(t, err)
+	return encoded
+}
+
+func scanInto[T any](t *testing.T, pgxTypes *pgxtype.Map, columnOid uint32, format int16, src []byte) any {
+	var value T
+	require.NoError(t, pgxTypes.Scan(columnOid, format, src, &value))
+	return value
+}
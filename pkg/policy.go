@@ -0,0 +1,463 @@
+package rdapp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	PolicyActionAllow = "allow"
+	PolicyActionDeny  = "deny"
+)
+
+// Policy is an ordered list of rules, the first rule matching a statement decides
+// whether it is allowed. Statements matching no rule are allowed.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches statements for which all of its conditions hold, empty conditions match every statement
+type PolicyRule struct {
+	Name   string `yaml:"name"`
+	Action string `yaml:"action"`
+	// Message is sent to the client when the rule denies a statement
+	Message string   `yaml:"message"`
+	Users   []string `yaml:"users"`
+	// Targets are glob patterns like workgroup/analytics/*
+	Targets []string `yaml:"targets"`
+	// StatementTypes are leading keywords like select or insert, the main statement counts for WITH
+	StatementTypes []string `yaml:"statementTypes"`
+	// Tables are glob patterns, qualified patterns like pii.* match table references qualified
+	// explicitly or by the search path while unqualified patterns match the table name of any reference
+	Tables []string `yaml:"tables"`
+	// Pattern is a regular expression matched against the statement text
+	Pattern string `yaml:"pattern"`
+	// SelectStar matches statements selecting all columns using *
+	SelectStar bool `yaml:"selectStar"`
+	// WithoutLimit matches statements whose outermost query has no LIMIT, TOP or FETCH FIRST
+	WithoutLimit bool `yaml:"withoutLimit"`
+	pattern      *regexp.Regexp
+}
+
+// DefaultSearchPath is the search_path of redshift sessions which did not set one
+var DefaultSearchPath = []string{"$user", "public"}
+
+// PolicyRequest is a statement to be checked against the policy
+type PolicyRequest struct {
+	User      string
+	Target    string
+	Statement string
+	// SearchPath are the lower cased schemas unqualified table names are resolved against. An unqualified
+	// name matches qualified patterns of any schema when the search path is empty or contains $user.
+	SearchPath []string
+}
+
+// LoadPolicy reads a policy from a yaml file
+func LoadPolicy(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening policy file: %w", err)
+	}
+	defer file.Close()
+	return ParsePolicy(file)
+}
+
+func ParsePolicy(reader io.Reader) (*Policy, error) {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	var policy Policy
+	err := decoder.Decode(&policy)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error while parsing policy: %w", err)
+	}
+	for i := range policy.Rules {
+		err := policy.Rules[i].compile(i + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &policy, nil
+}
+
+func (rule *PolicyRule) compile(position int) error {
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("rule %d", position)
+	}
+	if rule.Action != PolicyActionAllow && rule.Action != PolicyActionDeny {
+		return fmt.Errorf("policy rule %q has action %q, expected allow or deny", rule.Name, rule.Action)
+	}
+	for _, pattern := range append(append([]string{}, rule.Targets...), rule.Tables...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("policy rule %q has invalid glob pattern %q: %w", rule.Name, pattern, err)
+		}
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("policy rule %q has invalid pattern: %w", rule.Name, err)
+		}
+		rule.pattern = pattern
+	}
+	return nil
+}
+
+// Evaluate returns the first rule matching the request, nil if no rule matches
+func (policy *Policy) Evaluate(request PolicyRequest) *PolicyRule {
+	if policy == nil {
+		return nil
+	}
+	facts := analyzeStatement(request.Statement)
+	for i := range policy.Rules {
+		if policy.Rules[i].matches(request, facts) {
+			return &policy.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *PolicyRule) matches(request PolicyRequest, facts statementFacts) bool {
+	switch {
+	case len(rule.Users) > 0 && !containsString(rule.Users, request.User):
+		return false
+	case len(rule.Targets) > 0 && !anyGlobMatches(rule.Targets, request.Target):
+		return false
+	case len(rule.StatementTypes) > 0 && !containsFold(rule.StatementTypes, facts.statementType):
+		return false
+	case len(rule.Tables) > 0 && !rule.referencesTables(facts.tables, request.SearchPath):
+		return false
+	case rule.pattern != nil && !rule.pattern.MatchString(request.Statement):
+		return false
+	case rule.SelectStar && !facts.selectStar:
+		return false
+	case rule.WithoutLimit && facts.hasLimit:
+		return false
+	}
+	return true
+}
+
+func (rule *PolicyRule) referencesTables(tables []string, searchPath []string) bool {
+	for _, table := range tables {
+		if anyTableMatches(rule.Tables, table, searchPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyTableMatches matches a lower cased and possibly qualified table name against glob patterns.
+// Unqualified patterns match the table name only. Qualified patterns match the schema and table name,
+// an unqualified name is qualified with each schema of the search path. When the schema cannot be
+// told, as the search path is empty or contains $user, it matches the patterns of any schema.
+func anyTableMatches(patterns []string, table string, searchPath []string) bool {
+	parts := strings.Split(table, ".")
+	name := parts[len(parts)-1]
+	var qualifiedNames []string
+	anySchema := false
+	if len(parts) > 1 {
+		// the database of database.schema.table is not matched
+		qualifiedNames = append(qualifiedNames, strings.Join(parts[len(parts)-2:], "."))
+	} else {
+		anySchema = len(searchPath) == 0
+		for _, schema := range searchPath {
+			anySchema = anySchema || schema == "$user"
+			qualifiedNames = append(qualifiedNames, schema+"."+name)
+		}
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		separator := strings.LastIndex(pattern, ".")
+		if separator < 0 || anySchema {
+			if matched, _ := path.Match(pattern[separator+1:], name); matched {
+				return true
+			}
+			continue
+		}
+		for _, qualifiedName := range qualifiedNames {
+			if matched, _ := path.Match(pattern, qualifiedName); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denyMessage is the error sent to the client when the rule denies a statement
+func (rule *PolicyRule) denyMessage() string {
+	if rule.Message == "" {
+		return fmt.Sprintf("statement denied by policy rule %q", rule.Name)
+	}
+	return fmt.Sprintf("statement denied by policy rule %q: %s", rule.Name, rule.Message)
+}
+
+// statementFacts are the properties of a statement policy rules match on
+type statementFacts struct {
+	statementType string
+	tables        []string
+	selectStar    bool
+	hasLimit      bool
+}
+
+// tableReferencingKeywords are keywords which may be followed by a table name
+var tableReferencingKeywords = map[string]bool{
+	"copy":     true,
+	"from":     true,
+	"into":     true,
+	"join":     true,
+	"table":    true,
+	"truncate": true,
+	"update":   true,
+}
+
+// tableReferenceModifiers may precede the table name after a table referencing keyword
+var tableReferenceModifiers = map[string]bool{
+	"exists":  true,
+	"if":      true,
+	"lateral": true,
+	"not":     true,
+	"only":    true,
+	"table":   true,
+}
+
+// clauseKeywords are never table names, they end a table reference
+var clauseKeywords = map[string]bool{
+	"cross": true, "except": true, "fetch": true, "for": true, "full": true, "group": true,
+	"having": true, "inner": true, "intersect": true, "join": true, "left": true, "limit": true,
+	"natural": true, "offset": true, "on": true, "order": true, "returning": true, "right": true,
+	"select": true, "set": true, "union": true, "using": true, "values": true, "where": true,
+	"window": true,
+}
+
+func analyzeStatement(statement string) statementFacts {
+	tokens := lexSql(statement)
+	facts := statementFacts{tables: referencedTables(tokens)}
+	main := tokens
+	for len(main) > 0 && main[0].kind == sqlTokenOperator && main[0].text == "(" {
+		main = main[1:]
+	}
+	if len(main) > 0 && main[0].isWord("with") {
+		if _, withMain, ok := splitWith(main[1:]); ok {
+			main = withMain
+		}
+	}
+	for len(main) > 0 && main[0].kind == sqlTokenOperator && main[0].text == "(" {
+		main = main[1:]
+	}
+	if len(main) > 0 && main[0].kind == sqlTokenWord {
+		facts.statementType = main[0].lowerText()
+	}
+	facts.hasLimit = hasLimit(main)
+	for i, token := range tokens {
+		if token.kind != sqlTokenOperator || token.text != "*" || i == 0 {
+			continue
+		}
+		previous := tokens[i-1]
+		if previous.isWord("select") || previous.isWord("distinct") || previous.isWord("all") || previous.text == "," || previous.text == "." {
+			facts.selectStar = true
+		}
+	}
+	return facts
+}
+
+// fromClauseEndKeywords end the FROM clause of a query, the joins within it do not
+var fromClauseEndKeywords = map[string]bool{
+	"except": true, "fetch": true, "for": true, "group": true, "having": true, "intersect": true,
+	"limit": true, "offset": true, "order": true, "returning": true, "select": true, "set": true,
+	"union": true, "values": true, "where": true, "window": true,
+}
+
+// referencedTables returns the lower cased and possibly qualified names of the tables the statement refers to.
+// Tables referred to from within string literals, like the query of an UNLOAD, are not found.
+func referencedTables(tokens []sqlToken) []string {
+	var tables []string
+	seen := map[string]bool{}
+	// fromClauses marks the parenthesis depths at which a FROM clause is read, a comma there is followed
+	// by the next table reference whatever came before it, like a subquery, a function call or a join
+	fromClauses := map[int]bool{}
+	depth := 0
+	for i, token := range tokens {
+		keyword := token.lowerText()
+		var name string
+		switch {
+		case token.kind == sqlTokenOperator && token.text == "(":
+			depth++
+			continue
+		case token.kind == sqlTokenOperator && token.text == ")":
+			delete(fromClauses, depth)
+			depth--
+			continue
+		case token.kind == sqlTokenOperator && token.text == ",":
+			if !fromClauses[depth] {
+				continue
+			}
+			name = tableReference(tokens, i+1, "from")
+		case token.kind != sqlTokenWord:
+			continue
+		case tableReferencingKeywords[keyword]:
+			if keyword == "update" && i > 0 && tokens[i-1].isWord("for") {
+				continue
+			}
+			if keyword == "from" {
+				fromClauses[depth] = true
+			}
+			name = tableReference(tokens, i+1, keyword)
+		case fromClauseEndKeywords[keyword]:
+			delete(fromClauses, depth)
+			continue
+		default:
+			continue
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
+
+// tableReference returns the name of the table referenced at position after the keyword, empty if there is
+// none like for a subquery or a function call
+func tableReference(tokens []sqlToken, position int, keyword string) string {
+	for position < len(tokens) && tokens[position].kind == sqlTokenWord && tableReferenceModifiers[tokens[position].lowerText()] {
+		position++
+	}
+	name, next := qualifiedName(tokens, position)
+	// a name followed by a parenthesis after FROM or JOIN is a function call
+	if (keyword == "from" || keyword == "join") && next < len(tokens) && tokens[next].text == "(" {
+		return ""
+	}
+	return name
+}
+
+// qualifiedName reads a possibly qualified and quoted name starting at position
+func qualifiedName(tokens []sqlToken, position int) (string, int) {
+	var parts []string
+	for position < len(tokens) {
+		token := tokens[position]
+		switch {
+		case token.kind == sqlTokenWord && !clauseKeywords[token.lowerText()]:
+			parts = append(parts, token.lowerText())
+		case token.kind == sqlTokenQuotedIdentifier:
+			// redshift folds quoted identifiers to lower case unless enable_case_sensitive_identifier is set
+			parts = append(parts, strings.ToLower(unquoteSqlIdentifier(token.text)))
+		default:
+			return strings.Join(parts, "."), position
+		}
+		position++
+		if position >= len(tokens) || tokens[position].text != "." {
+			break
+		}
+		position++
+	}
+	return strings.Join(parts, "."), position
+}
+
+// hasLimit reports if the outermost query limits its rows by LIMIT, TOP or FETCH FIRST
+func hasLimit(tokens []sqlToken) bool {
+	depth := 0
+	for i, token := range tokens {
+		if token.kind == sqlTokenOperator {
+			switch token.text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		switch {
+		case token.isWord("limit"):
+			return true
+		case token.isWord("top") && i > 0 && (tokens[i-1].isWord("select") || tokens[i-1].isWord("distinct")):
+			return true
+		case token.isWord("fetch") && i+1 < len(tokens) && (tokens[i+1].isWord("first") || tokens[i+1].isWord("next")):
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyGlobMatches(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy rejects statements denied by the policy
+func (handler *redshiftDataApiQueryHandler) checkPolicy(rdappCtx RdappContext, statement string) error {
+	request := PolicyRequest{
+		Target:     handler.historyTarget.String(),
+		Statement:  statement,
+		SearchPath: handler.searchPath(rdappCtx.session),
+	}
+	if rdappCtx.session != nil {
+		request.User = rdappCtx.session.user
+	}
+	rule := handler.policy.Evaluate(request)
+	if rule == nil || rule.Action != PolicyActionDeny {
+		return nil
+	}
+	rdappCtx.logger.Warn("rejected statement by policy",
+		zap.String("policyRule", rule.Name),
+		zap.String("user", request.User),
+		zap.String("statement", statement))
+	return psqlerr.WithCode(errors.New(rule.denyMessage()), codes.InsufficientPrivilege)
+}
+
+// searchPath returns the search path of the session with $user resolved to the db user of the target
+// when it is known
+func (handler *redshiftDataApiQueryHandler) searchPath(session *Session) []string {
+	searchPath := DefaultSearchPath
+	if session != nil && session.searchPath() != nil {
+		searchPath = session.searchPath()
+	}
+	resolved := make([]string, 0, len(searchPath))
+	for _, schema := range searchPath {
+		if schema == "$user" && handler.historyTarget.DbUser != "" {
+			schema = strings.ToLower(handler.historyTarget.DbUser)
+		}
+		resolved = append(resolved, schema)
+	}
+	return resolved
+}
+
+// authorizeStatement applies the read only mode and the policy to a statement
+func (handler *redshiftDataApiQueryHandler) authorizeStatement(rdappCtx RdappContext, statement string) error {
+	err := handler.checkReadOnly(rdappCtx, statement)
+	if err != nil {
+		return err
+	}
+	return handler.checkPolicy(rdappCtx, statement)
+}
@@ -0,0 +1,199 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func Test_Policy_Evaluate(t *testing.T) {
+	policy, err := ParsePolicy(strings.NewReader(`
+rules:
+  - name: etl
+    action: allow
+    users: [etl]
+  - name: no-select-star-on-events
+    action: deny
+    message: select the columns you need
+    selectStar: true
+    tables: [events]
+  - name: pii
+    action: deny
+    users: [analyst]
+    tables: ["pii.*"]
+  - name: dev-only-ddl
+    action: deny
+    targets: ["workgroup/prod/*"]
+    statementTypes: [create, drop, alter]
+  - name: require-limit
+    action: deny
+    statementTypes: [select]
+    withoutLimit: true
+    pattern: (?i)from
+`))
+	require.NoError(t, err)
+	type args struct {
+		request PolicyRequest
+	}
+	tests := []struct {
+		name     string
+		args     args
+		wantRule string
+	}{
+		{
+			name:     "allowed user skips the remaining rules",
+			args:     args{request: PolicyRequest{User: "etl", Target: "workgroup/prod/dev", Statement: "select * from events"}},
+			wantRule: "etl",
+		},
+		{
+			name:     "select star on a qualified table",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select e.* from analytics.events e limit 10"}},
+			wantRule: "no-select-star-on-events",
+		},
+		{
+			name:     "count star is not a select star",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select count(*) from events limit 1"}},
+			wantRule: "",
+		},
+		{
+			name:     "pii schema joined",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select p.name from orders o join pii.person p on p.id = o.person_id limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "quoted names are folded to lower case",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: `select p.name from orders o join "PII".person p on p.id = o.person_id limit 5`}},
+			wantRule: "pii",
+		},
+		{
+			name:     "database qualified name",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select name from dev.pii.person limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "unqualified name resolved by the search path",
+			args:     args{request: PolicyRequest{User: "analyst", SearchPath: []string{"analytics", "pii"}, Statement: "select name from person limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "unqualified name with an unknown schema",
+			args:     args{request: PolicyRequest{User: "analyst", SearchPath: []string{"$user", "public"}, Statement: "select name from person limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema in a from list",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select p.name from orders o, pii.person as p where p.id = o.person_id limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema in a from list after a subquery",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select * from (select 1) a, pii.secret limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema in a from list after a function call",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select * from generate_series(1, 2) g(n), pii.secret limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema in a from list after a lateral subquery",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select * from orders o, lateral (select 1 from items i where i.order_id = o.id) l, pii.secret limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema in a from list after a join",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select * from orders o join items i on i.order_id = o.id, pii.secret limit 5"}},
+			wantRule: "pii",
+		},
+		{
+			name:     "pii schema for other users",
+			args:     args{request: PolicyRequest{User: "auditor", Statement: "select name from pii.person limit 5"}},
+			wantRule: "",
+		},
+		{
+			name:     "ddl on prod",
+			args:     args{request: PolicyRequest{User: "analyst", Target: "workgroup/prod/dev", Statement: "create table if not exists t (id int)"}},
+			wantRule: "dev-only-ddl",
+		},
+		{
+			name:     "missing limit",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "with recent as (select * from orders limit 5) select id from recent"}},
+			wantRule: "require-limit",
+		},
+		{
+			name:     "top counts as limit",
+			args:     args{request: PolicyRequest{User: "analyst", Statement: "select top 10 id from orders"}},
+			wantRule: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.args.request.SearchPath == nil {
+				tt.args.request.SearchPath = []string{"public"}
+			}
+			rule := policy.Evaluate(tt.args.request)
+			if tt.wantRule == "" {
+				require.Nil(t, rule)
+				return
+			}
+			require.NotNil(t, rule)
+			require.Equal(t, tt.wantRule, rule.Name)
+		})
+	}
+}
+
+func Test_referencedTables(t *testing.T) {
+	tests := []struct {
+		name      string
+		statement string
+		want      []string
+	}{
+		{name: "from list", statement: "select * from orders o, pii.person as p", want: []string{"orders", "pii.person"}},
+		{name: "after a subquery", statement: "select * from (select 1) a, pii.secret", want: []string{"pii.secret"}},
+		{name: "after a function call", statement: "select * from generate_series(1, 2) g(n), pii.secret", want: []string{"pii.secret"}},
+		{name: "after a lateral subquery", statement: "select * from orders o, lateral (select * from items i where i.order_id = o.id) l, pii.secret",
+			want: []string{"orders", "items", "pii.secret"}},
+		{name: "after a join", statement: "select * from orders o join items i on i.order_id = o.id, pii.secret", want: []string{"orders", "items", "pii.secret"}},
+		{name: "select list commas", statement: "select (select max(id) from orders), substring(name from 1 for 2), total from person where id in (1, 2)",
+			want: []string{"orders", "person"}},
+		{name: "update from list", statement: "update person set age = 1 from orders, pii.secret where person.id = orders.id", want: []string{"person", "orders", "pii.secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, referencedTables(lexSql(tt.statement)))
+		})
+	}
+}
+
+func Test_ParsePolicy(t *testing.T) {
+	type args struct {
+		policy string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr string
+	}{
+		{
+			name:    "unknown action",
+			args:    args{policy: "rules:\n  - name: r\n    action: reject\n"},
+			wantErr: `policy rule "r" has action "reject", expected allow or deny`,
+		},
+		{
+			name:    "unknown field",
+			args:    args{policy: "rules:\n  - action: deny\n    table: [x]\n"},
+			wantErr: "error while parsing policy: yaml: unmarshal errors:\n  line 3: field table not found in type rdapp.PolicyRule",
+		},
+		{
+			name:    "invalid pattern",
+			args:    args{policy: "rules:\n  - action: deny\n    pattern: \"(\"\n"},
+			wantErr: "policy rule \"rule 1\" has invalid pattern: error parsing regexp: missing closing ): `(`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy(strings.NewReader(tt.args.policy))
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
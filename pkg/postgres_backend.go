@@ -0,0 +1,345 @@
+package rdapp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// postgresTypeNames maps postgres types to the redshift type the data api reports, other types are reported as varchar
+var postgresTypeNames = map[string]string{
+	"bool":        RedshiftTypeBool,
+	"bpchar":      RedshiftTypeBpchar,
+	"bytea":       RedshiftTypeVarbyte,
+	"date":        RedshiftTypeDate,
+	"float4":      RedshiftTypeFloat4,
+	"float8":      RedshiftTypeFloat8,
+	"int2":        RedshiftTypeInt2,
+	"int4":        RedshiftTypeInt4,
+	"int8":        RedshiftTypeInt8,
+	"json":        RedshiftTypeSuper,
+	"jsonb":       RedshiftTypeSuper,
+	"name":        RedshiftTypeName,
+	"numeric":     RedshiftTypeNumeric,
+	"oid":         RedshiftTypeOid,
+	"text":        RedshiftTypeVarchar,
+	"time":        RedshiftTypeTime,
+	"timestamp":   RedshiftTypeTimestamp,
+	"timestamptz": RedshiftTypeTimestamptz,
+	"timetz":      RedshiftTypeTimetz,
+	"varchar":     RedshiftTypeVarchar,
+}
+
+type postgresRedshiftDataAPIService struct {
+	db              *sql.DB
+	redshiftQueryId atomic.Int64
+	// tables holds the schema and name of tables by oid
+	tables  sync.Map
+	metrics *Metrics
+	logger  *zap.Logger
+}
+
+type postgresTable struct {
+	schemaName string
+	tableName  string
+}
+
+// NewPostgresRedshiftDataAPIService runs statements against postgres instead of redshift for local
+// development. Results and failures take the shape the data api gives them.
+func NewPostgresRedshiftDataAPIService(db *sql.DB, metrics *Metrics, logger *zap.Logger) RedshiftDataAPIService {
+	return &postgresRedshiftDataAPIService{
+		db:      db,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+func (service *postgresRedshiftDataAPIService) ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*QueryResult, error) {
+	queryResult := &QueryResult{
+		QueryId:         uuid.NewString(),
+		RedshiftQueryId: service.redshiftQueryId.Add(1),
+	}
+	loggerWithContext := ctx.logger.With(zap.String("redshiftDataApiQueryId", queryResult.QueryId))
+	loggerWithContext.Info("executing query against postgres",
+		zap.String("query", query),
+		zap.Any("parameters", parameters))
+	postgresQuery, arguments, err := bindNamedParameters(query, parameters)
+	if err != nil {
+		return nil, &StatementError{QueryId: queryResult.QueryId, Err: err}
+	}
+	startedAt := time.Now()
+	err = service.withConn(ctx, func(conn *pgx.Conn) error {
+		for _, statement := range ctx.forwardedStatements() {
+			_, err := conn.Exec(ctx, statement, pgx.QueryExecModeSimpleProtocol)
+			if err != nil {
+				return err
+			}
+		}
+		// the simple protocol runs the query without preparing it like the data api does, the arguments are
+		// quoted by pgx. Cancelling the query stops reading rows beyond the max rows.
+		queryCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		rows, err := conn.Query(queryCtx, postgresQuery, append([]any{pgx.QueryExecModeSimpleProtocol}, arguments...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		queryResult.HasResultSet = len(rows.FieldDescriptions()) > 0
+		if queryResult.HasResultSet {
+			queryResult.ColumnMetadata, err = service.columnMetadata(ctx, conn.TypeMap(), rows.FieldDescriptions())
+			if err != nil {
+				return err
+			}
+		}
+		for rows.Next() {
+			if ctx.maxRows > 0 && int64(len(queryResult.Records)) >= ctx.maxRows {
+				queryResult.Truncated = true
+				break
+			}
+			record, err := service.record(rows.FieldDescriptions(), rows.RawValues())
+			if err != nil {
+				return err
+			}
+			queryResult.Records = append(queryResult.Records, record)
+		}
+		if queryResult.Truncated {
+			// the cancelled query closes the connection, the pool replaces it instead of reusing it
+			cancel()
+			rows.Close()
+			queryResult.ResultRows = int64(len(queryResult.Records))
+			return nil
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		queryResult.ResultRows = resultRows(rows.CommandTag())
+		return nil
+	})
+	if err != nil {
+		return nil, service.statementError(queryResult, err, loggerWithContext)
+	}
+	service.metrics.observePhase(statementPhaseExecute, time.Since(startedAt))
+	service.metrics.observeRecords(queryResult.Records)
+	loggerWithContext.Info("query finished execution",
+		zap.Int64("resultRows", queryResult.ResultRows),
+		zap.Bool("hasResultSet", queryResult.HasResultSet))
+	reportTruncation(ctx, queryResult, service.metrics, loggerWithContext)
+	return queryResult, nil
+}
+
+func (service *postgresRedshiftDataAPIService) ExecuteBatch(ctx RdappContext, queries []string) ([]QueryResult, error) {
+	queryId := uuid.NewString()
+	loggerWithContext := ctx.logger.With(zap.String("redshiftDataApiQueryId", queryId))
+	loggerWithContext.Info("executing batch of queries against postgres",
+		zap.Strings("queries", queries))
+	var queryResults []QueryResult
+	err := service.withConn(ctx, func(conn *pgx.Conn) error {
+		// the data api runs a batch in a single transaction
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			for _, query := range queries {
+				rows, err := tx.Query(ctx, query, pgx.QueryExecModeSimpleProtocol)
+				if err != nil {
+					return err
+				}
+				rows.Close()
+				if rows.Err() != nil {
+					return rows.Err()
+				}
+				queryResults = append(queryResults, QueryResult{
+					HasResultSet:    len(rows.FieldDescriptions()) > 0,
+					ResultRows:      resultRows(rows.CommandTag()),
+					QueryId:         queryId,
+					RedshiftQueryId: service.redshiftQueryId.Add(1),
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, service.statementError(&QueryResult{QueryId: queryId}, err, loggerWithContext)
+	}
+	loggerWithContext.Info("batch finished execution",
+		zap.Int("noOfSubStatements", len(queryResults)))
+	return queryResults, nil
+}
+
+// withConn runs the function with a connection of the pool, the forwarded session parameters of the
+// context are reset afterwards as the connection is shared by every session
+func (service *postgresRedshiftDataAPIService) withConn(ctx RdappContext, run func(conn *pgx.Conn) error) error {
+	conn, err := service.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error while connecting to postgres: %w", err)
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+		if len(ctx.forwardedStatements()) > 0 {
+			defer func() {
+				if pgxConn.IsClosed() {
+					return
+				}
+				_, err := pgxConn.Exec(context.Background(), "reset all", pgx.QueryExecModeSimpleProtocol)
+				if err != nil {
+					ctx.logger.Error("error while resetting session parameters", zap.Error(err))
+				}
+			}()
+		}
+		return run(pgxConn)
+	})
+}
+
+// statementError renders failures reported by postgres the way redshift reports them via the data api
+func (service *postgresRedshiftDataAPIService) statementError(queryResult *QueryResult, err error, loggerWithContext *zap.Logger) error {
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) {
+		loggerWithContext.Error("query execution failed or aborted", zap.Error(err))
+		err = fmt.Errorf("query execution failed or aborted: %w",
+			psqlerr.WithCode(fmt.Errorf("ERROR: %s", pgError.Message), codes.Code(pgError.Code)))
+	} else {
+		loggerWithContext.Error("error while executing query against postgres", zap.Error(err))
+	}
+	return &StatementError{QueryId: queryResult.QueryId, RedshiftQueryId: queryResult.RedshiftQueryId, Err: err}
+}
+
+func (service *postgresRedshiftDataAPIService) columnMetadata(ctx context.Context, typeMap *pgtype.Map, fields []pgconn.FieldDescription) ([]types.ColumnMetadata, error) {
+	var columnMetadata []types.ColumnMetadata
+	for _, field := range fields {
+		typeName := RedshiftTypeVarchar
+		if dataType, ok := typeMap.TypeForOID(field.DataTypeOID); ok {
+			if redshiftTypeName, ok := postgresTypeNames[dataType.Name]; ok {
+				typeName = redshiftTypeName
+			}
+		}
+		column := types.ColumnMetadata{
+			Name:     aws.String(field.Name),
+			Label:    aws.String(field.Name),
+			TypeName: aws.String(typeName),
+			Nullable: 1,
+		}
+		switch typeName {
+		case RedshiftTypeVarchar, RedshiftTypeBpchar:
+			if field.TypeModifier > 4 {
+				column.Length = field.TypeModifier - 4
+			}
+		case RedshiftTypeNumeric:
+			if field.TypeModifier > 4 {
+				column.Precision = (field.TypeModifier - 4) >> 16
+				column.Scale = (field.TypeModifier - 4) & 0xffff
+			}
+		}
+		if field.TableOID != 0 {
+			table, err := service.table(ctx, field.TableOID)
+			if err != nil {
+				return nil, err
+			}
+			column.SchemaName = aws.String(table.schemaName)
+			column.TableName = aws.String(table.tableName)
+		}
+		columnMetadata = append(columnMetadata, column)
+	}
+	return columnMetadata, nil
+}
+
+// table looks the table up on another connection of the pool as the connection of the query is busy reading its rows
+func (service *postgresRedshiftDataAPIService) table(ctx context.Context, tableOid uint32) (postgresTable, error) {
+	if table, ok := service.tables.Load(tableOid); ok {
+		return table.(postgresTable), nil
+	}
+	var table postgresTable
+	err := service.db.QueryRowContext(ctx, "select n.nspname, c.relname from pg_class c join pg_namespace n on n.oid = c.relnamespace where c.oid = $1", tableOid).
+		Scan(&table.schemaName, &table.tableName)
+	if err != nil {
+		return postgresTable{}, fmt.Errorf("error while looking up table of column: %w", err)
+	}
+	service.tables.Store(tableOid, table)
+	return table, nil
+}
+
+// record converts the text encoded values of a row into the fields the data api returns for them
+func (service *postgresRedshiftDataAPIService) record(fields []pgconn.FieldDescription, values [][]byte) ([]types.Field, error) {
+	var record []types.Field
+	for i, value := range values {
+		if value == nil {
+			record = append(record, &types.FieldMemberIsNull{Value: true})
+			continue
+		}
+		text := string(value)
+		switch oid.Oid(fields[i].DataTypeOID) {
+		case oid.T_int2, oid.T_int4, oid.T_int8, oid.T_oid:
+			long, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading integer value %q: %w", text, err)
+			}
+			record = append(record, &types.FieldMemberLongValue{Value: long})
+		case oid.T_float4, oid.T_float8:
+			double, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading float value %q: %w", text, err)
+			}
+			record = append(record, &types.FieldMemberDoubleValue{Value: double})
+		case oid.T_bool:
+			record = append(record, &types.FieldMemberBooleanValue{Value: text == "t"})
+		case oid.T_bytea:
+			record = append(record, &types.FieldMemberStringValue{Value: strings.TrimPrefix(text, `\x`)})
+		default:
+			record = append(record, &types.FieldMemberStringValue{Value: text})
+		}
+	}
+	return record, nil
+}
+
+// resultRows is the number of rows returned or affected, -1 for statements without a row count
+func resultRows(commandTag pgconn.CommandTag) int64 {
+	if commandTag.Insert() || commandTag.Update() || commandTag.Delete() || commandTag.Select() ||
+		strings.HasPrefix(commandTag.String(), "COPY") || strings.HasPrefix(commandTag.String(), "FETCH") || strings.HasPrefix(commandTag.String(), "MOVE") {
+		return commandTag.RowsAffected()
+	}
+	return -1
+}
+
+// bindNamedParameters rewrites the :name parameters of the data api into the $n parameters of postgres
+func bindNamedParameters(query string, parameters []types.SqlParameter) (string, []any, error) {
+	positions := map[string]int{}
+	var arguments []any
+	for _, parameter := range parameters {
+		positions[aws.ToString(parameter.Name)] = len(arguments) + 1
+		arguments = append(arguments, aws.ToString(parameter.Value))
+	}
+	var rewritten strings.Builder
+	tokens := lexSql(query)
+	position := 0
+	for i := 0; i+1 < len(tokens); i++ {
+		colon, name := tokens[i], tokens[i+1]
+		if colon.text != ":" || name.start != colon.end || (name.kind != sqlTokenWord && name.kind != sqlTokenNumber) {
+			continue
+		}
+		index, ok := positions[name.text]
+		if !ok {
+			return "", nil, fmt.Errorf("ERROR: parameter %q is not given", name.text)
+		}
+		rewritten.WriteString(query[position:colon.start])
+		rewritten.WriteString("$" + strconv.Itoa(index))
+		position = name.end
+		i++
+	}
+	rewritten.WriteString(query[position:])
+	return rewritten.String(), arguments, nil
+}
@@ -0,0 +1,74 @@
+package rdapp
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func Test_bindNamedParameters(t *testing.T) {
+	type args struct {
+		query      string
+		parameters []types.SqlParameter
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantQuery     string
+		wantArguments []any
+		wantErr       string
+	}{
+		{
+			name:      "named and numbered parameters",
+			args:      args{query: "select * from person where id > :1 and name = :name", parameters: []types.SqlParameter{{Name: aws.String("1"), Value: aws.String("7")}, {Name: aws.String("name"), Value: aws.String("ann")}}},
+			wantQuery: "select * from person where id > $1 and name = $2", wantArguments: []any{"7", "ann"},
+		},
+		{
+			name:      "casts, strings and comments are kept",
+			args:      args{query: "select ':1', 1::int /* :1 */, :1", parameters: []types.SqlParameter{{Name: aws.String("1"), Value: aws.String("7")}}},
+			wantQuery: "select ':1', 1::int /* :1 */, $1", wantArguments: []any{"7"},
+		},
+		{
+			name:    "parameter not given",
+			args:    args{query: "select :name"},
+			wantErr: `ERROR: parameter "name" is not given`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, arguments, err := bindNamedParameters(tt.args.query, tt.args.parameters)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantQuery, query)
+			require.Equal(t, tt.wantArguments, arguments)
+		})
+	}
+}
+
+func Test_resultRows(t *testing.T) {
+	require.Equal(t, int64(3), resultRows(pgconn.NewCommandTag("SELECT 3")))
+	require.Equal(t, int64(2), resultRows(pgconn.NewCommandTag("INSERT 0 2")))
+	require.Equal(t, int64(-1), resultRows(pgconn.NewCommandTag("CREATE TABLE")))
+}
+
+func Test_postgresRedshiftDataAPIService_statementError(t *testing.T) {
+	service := &postgresRedshiftDataAPIService{}
+	queryResult := &QueryResult{QueryId: "query-id", RedshiftQueryId: 7}
+
+	err := service.statementError(queryResult, &pgconn.PgError{Code: "42P01", Message: `relation "missing" does not exist`}, zap.NewNop())
+
+	var statementError *StatementError
+	require.ErrorAs(t, err, &statementError)
+	require.Equal(t, "query-id", statementError.QueryId)
+	require.Equal(t, int64(7), statementError.RedshiftQueryId)
+	require.EqualError(t, err, `query execution failed or aborted: ERROR: relation "missing" does not exist`)
+	require.Equal(t, codes.Code("42P01"), psqlerr.GetCode(err))
+}
@@ -0,0 +1,260 @@
+package rdapp
+
+import (
+	"fmt"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+// preparedStatement is a statement registered via the sql level PREPARE command
+type preparedStatement struct {
+	name           string
+	parameterTypes []string
+	statement      string
+}
+
+type preparedStatementCommandKind int
+
+const (
+	preparedStatementPrepare preparedStatementCommandKind = iota
+	preparedStatementExecute
+	preparedStatementDeallocate
+)
+
+// preparedStatementCommand is a parsed PREPARE, EXECUTE or DEALLOCATE statement
+type preparedStatementCommand struct {
+	kind preparedStatementCommandKind
+	name string
+	// parameterTypes are the declared parameter types of PREPARE
+	parameterTypes []string
+	// statement is the statement being prepared
+	statement string
+	// arguments are the argument expressions of EXECUTE
+	arguments []string
+	// all denotes DEALLOCATE ALL
+	all bool
+}
+
+// parsePreparedStatementCommand parses PREPARE, EXECUTE and DEALLOCATE statements, ok is false for any other statement
+func parsePreparedStatementCommand(statement string) (command preparedStatementCommand, ok bool) {
+	tokens := lexSql(statement)
+	if len(tokens) < 2 {
+		return preparedStatementCommand{}, false
+	}
+	switch {
+	case tokens[0].isWord("prepare"):
+		// PREPARE TRANSACTION is two phase commit, not a prepared statement
+		if tokens[1].isWord("transaction") {
+			return preparedStatementCommand{}, false
+		}
+		command = preparedStatementCommand{kind: preparedStatementPrepare, name: preparedStatementName(tokens[1])}
+		rest := tokens[2:]
+		if len(rest) > 0 && rest[0].text == "(" {
+			var groups [][]sqlToken
+			groups, rest = splitParenthesized(rest)
+			for _, group := range groups {
+				command.parameterTypes = append(command.parameterTypes, tokensText(statement, group))
+			}
+		}
+		if len(rest) < 2 || !rest[0].isWord("as") {
+			return preparedStatementCommand{}, false
+		}
+		command.statement = strings.TrimSpace(statement[rest[1].start:])
+		return command, true
+	case tokens[0].isWord("execute"):
+		command = preparedStatementCommand{kind: preparedStatementExecute, name: preparedStatementName(tokens[1])}
+		rest := tokens[2:]
+		if len(rest) > 0 && rest[0].text == "(" {
+			var groups [][]sqlToken
+			groups, rest = splitParenthesized(rest)
+			for _, group := range groups {
+				command.arguments = append(command.arguments, tokensText(statement, group))
+			}
+		}
+		if len(rest) > 0 {
+			return preparedStatementCommand{}, false
+		}
+		return command, true
+	case tokens[0].isWord("deallocate"):
+		rest := tokens[1:]
+		if len(rest) > 1 && rest[0].isWord("prepare") {
+			rest = rest[1:]
+		}
+		if len(rest) != 1 {
+			return preparedStatementCommand{}, false
+		}
+		command = preparedStatementCommand{kind: preparedStatementDeallocate, name: preparedStatementName(rest[0])}
+		command.all = rest[0].isWord("all")
+		return command, true
+	}
+	return preparedStatementCommand{}, false
+}
+
+// splitParenthesized splits a parenthesized comma separated list into its elements,
+// tokens are expected to start with the opening parenthesis
+func splitParenthesized(tokens []sqlToken) (groups [][]sqlToken, rest []sqlToken) {
+	depth := 0
+	var group []sqlToken
+	for i, token := range tokens {
+		switch {
+		case token.text == "(" && token.kind == sqlTokenOperator:
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case token.text == ")" && token.kind == sqlTokenOperator:
+			depth--
+			if depth == 0 {
+				if len(group) > 0 {
+					groups = append(groups, group)
+				}
+				return groups, tokens[i+1:]
+			}
+		case token.text == "," && token.kind == sqlTokenOperator && depth == 1:
+			groups = append(groups, group)
+			group = nil
+			continue
+		}
+		group = append(group, token)
+	}
+	return groups, nil
+}
+
+// tokensText returns the source text spanned by the tokens
+func tokensText(sql string, tokens []sqlToken) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	return sql[tokens[0].start:tokens[len(tokens)-1].end]
+}
+
+func preparedStatementName(token sqlToken) string {
+	if token.kind == sqlTokenQuotedIdentifier {
+		return unquoteSqlIdentifier(token.text)
+	}
+	return token.lowerText()
+}
+
+// bindArguments binds the argument expressions of EXECUTE to the prepared statement. When every
+// argument is a literal they are passed as parameters typed by the declared parameter types,
+// otherwise the expressions are substituted for the placeholders casting them to the declared types.
+func (statement preparedStatement) bindArguments(arguments []string) (string, []QueryParameter, error) {
+	if parameters, ok := statement.literalParameters(arguments); ok {
+		return statement.statement, parameters, nil
+	}
+	var builder strings.Builder
+	position := 0
+	for _, token := range lexSql(statement.statement) {
+		if token.kind != sqlTokenPlaceholder || !strings.HasPrefix(token.text, "$") {
+			continue
+		}
+		index, err := strconv.Atoi(token.text[1:])
+		if err != nil || index < 1 || index > len(arguments) {
+			return "", nil, psqlerr.WithCode(fmt.Errorf("there is no parameter %s", token.text), codes.UndefinedParameter)
+		}
+		argument := "(" + arguments[index-1] + ")"
+		if index <= len(statement.parameterTypes) {
+			argument += "::" + statement.parameterTypes[index-1]
+		}
+		builder.WriteString(statement.statement[position:token.start])
+		builder.WriteString(argument)
+		position = token.end
+	}
+	builder.WriteString(statement.statement[position:])
+	return builder.String(), nil, nil
+}
+
+// literalParameters converts the arguments into parameters, ok is false if any argument is not a literal
+func (statement preparedStatement) literalParameters(arguments []string) (parameters []QueryParameter, ok bool) {
+	for i, argument := range arguments {
+		tokens := lexSql(argument)
+		if len(tokens) == 2 && tokens[0].text == "-" && tokens[1].kind == sqlTokenNumber {
+			tokens = []sqlToken{{kind: sqlTokenNumber, text: argument}}
+		}
+		if len(tokens) != 1 {
+			return nil, false
+		}
+		parameter := QueryParameter{Format: wire.TextFormat}
+		if i < len(statement.parameterTypes) {
+			parameterOid, known := oidForTypeName(statement.parameterTypes[i])
+			if !known {
+				return nil, false
+			}
+			parameter.Oid = parameterOid
+		}
+		switch {
+		case tokens[0].isWord("null"):
+		case tokens[0].isWord("true"), tokens[0].isWord("false"):
+			parameter.Value = []byte(tokens[0].lowerText())
+		case tokens[0].kind == sqlTokenNumber:
+			parameter.Value = []byte(tokens[0].text)
+		case tokens[0].kind == sqlTokenString:
+			parameter.Value = []byte(unquoteSqlString(tokens[0].text))
+		default:
+			return nil, false
+		}
+		parameters = append(parameters, parameter)
+	}
+	return parameters, true
+}
+
+// handlePreparedStatementCommand handles the sql level PREPARE, EXECUTE and DEALLOCATE commands
+// against the prepared statements of the session
+func (handler *redshiftDataApiQueryHandler) handlePreparedStatementCommand(rdappCtx RdappContext, command preparedStatementCommand, writer wire.DataWriter) error {
+	session := rdappCtx.session
+	switch command.kind {
+	case preparedStatementPrepare:
+		if _, exists := session.preparedStatements[command.name]; exists {
+			return psqlerr.WithCode(fmt.Errorf("prepared statement \"%s\" already exists", command.name), codes.DuplicatePreparedStatement)
+		}
+		session.preparedStatements[command.name] = preparedStatement{
+			name:           command.name,
+			parameterTypes: command.parameterTypes,
+			statement:      command.statement,
+		}
+		rdappCtx.logger.Info("registered prepared statement",
+			zap.String("preparedStatementName", command.name))
+		return writer.Complete("PREPARE")
+	case preparedStatementExecute:
+		prepared, exists := session.preparedStatements[command.name]
+		if !exists {
+			return psqlerr.WithCode(fmt.Errorf("prepared statement \"%s\" does not exist", command.name), codes.InvalidSQLStatementName)
+		}
+		if len(command.arguments) != len(prepared.parameterTypes) && len(prepared.parameterTypes) > 0 {
+			return psqlerr.WithCode(fmt.Errorf("wrong number of parameters for prepared statement \"%s\": expected %d but got %d",
+				command.name, len(prepared.parameterTypes), len(command.arguments)), codes.Syntax)
+		}
+		statement, parameters, err := prepared.bindArguments(command.arguments)
+		if err != nil {
+			return err
+		}
+		return handler.executeStatement(rdappCtx, statement, writer, parameters)
+	case preparedStatementDeallocate:
+		switch {
+		case command.all:
+			session.preparedStatements = map[string]preparedStatement{}
+		default:
+			// drivers deallocate statements prepared via the extended protocol by name as well
+			_, exists := session.preparedStatements[command.name]
+			if !exists && !handler.preparedViaExtendedProtocol(session, command.name) {
+				return psqlerr.WithCode(fmt.Errorf("prepared statement \"%s\" does not exist", command.name), codes.InvalidSQLStatementName)
+			}
+			delete(session.preparedStatements, command.name)
+		}
+		rdappCtx.logger.Info("deallocated prepared statement",
+			zap.String("preparedStatementName", command.name),
+			zap.Bool("all", command.all))
+		return writer.Complete("DEALLOCATE")
+	}
+	return nil
+}
+
+// preparedViaExtendedProtocol reports if the statement was prepared by a Parse message of the connection
+func (handler *redshiftDataApiQueryHandler) preparedViaExtendedProtocol(session *Session, name string) bool {
+	protocol := handler.connections.extendedProtocolOf(session.id)
+	return protocol != nil && protocol.hasStatement(name)
+}
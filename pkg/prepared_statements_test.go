@@ -0,0 +1,96 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func Test_parsePreparedStatementCommand(t *testing.T) {
+	type args struct {
+		statement string
+	}
+	tests := []struct {
+		name   string
+		args   args
+		want   preparedStatementCommand
+		wantOk bool
+	}{
+		{
+			name: "prepare with parameter types",
+			args: args{statement: "PREPARE find_person (int, varchar(20)) AS select * from person where id = $1 and name = $2"},
+			want: preparedStatementCommand{
+				kind:           preparedStatementPrepare,
+				name:           "find_person",
+				parameterTypes: []string{"int", "varchar(20)"},
+				statement:      "select * from person where id = $1 and name = $2",
+			},
+			wantOk: true,
+		},
+		{
+			name:   "execute with arguments",
+			args:   args{statement: "execute find_person(1, 'o''brien')"},
+			want:   preparedStatementCommand{kind: preparedStatementExecute, name: "find_person", arguments: []string{"1", "'o''brien'"}},
+			wantOk: true,
+		},
+		{
+			name:   "deallocate prepare",
+			args:   args{statement: `deallocate prepare "stmtcache_1"`},
+			want:   preparedStatementCommand{kind: preparedStatementDeallocate, name: "stmtcache_1"},
+			wantOk: true,
+		},
+		{
+			name:   "deallocate all",
+			args:   args{statement: "DEALLOCATE ALL"},
+			want:   preparedStatementCommand{kind: preparedStatementDeallocate, name: "all", all: true},
+			wantOk: true,
+		},
+		{
+			name:   "select mentioning deallocate is not a command",
+			args:   args{statement: "select 'deallocate' as deallocate"},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePreparedStatementCommand(tt.args.statement)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_preparedStatement_bindArguments(t *testing.T) {
+	statement := preparedStatement{
+		name:           "find_person",
+		parameterTypes: []string{"int", "text"},
+		statement:      "select '$1', * from person where id = $1 and name = $2",
+	}
+	got, parameters, err := statement.bindArguments([]string{"1", "NULL"})
+	require.NoError(t, err)
+	require.Equal(t, statement.statement, got)
+	require.Equal(t, []QueryParameter{
+		{Value: []byte("1"), Oid: oid.T_int4},
+		{Value: nil, Oid: oid.T_text},
+	}, parameters)
+
+	got, parameters, err = statement.bindArguments([]string{"1 + 1", "upper('john')"})
+	require.NoError(t, err)
+	require.Nil(t, parameters)
+	require.Equal(t, "select '$1', * from person where id = (1 + 1)::int and name = (upper('john'))::text", got)
+
+	_, _, err = statement.bindArguments([]string{"1 + 1"})
+	require.Error(t, err)
+}
+
+func Test_handlePreparedStatementCommand_deallocateUnknown(t *testing.T) {
+	handler := &redshiftDataApiQueryHandler{}
+	rdappCtx := RdappContext{Context: context.Background(), logger: zap.NewNop(), session: newSession("id", nil)}
+	err := handler.handlePreparedStatementCommand(rdappCtx, preparedStatementCommand{kind: preparedStatementDeallocate, name: "missing"}, nil)
+	require.ErrorContains(t, err, `prepared statement "missing" does not exist`)
+	require.Equal(t, codes.InvalidSQLStatementName, psqlerr.GetCode(err))
+}
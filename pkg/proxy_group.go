@@ -0,0 +1,124 @@
+package rdapp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+)
+
+type proxyGroup struct {
+	proxies []PostgresRedshiftProxy
+}
+
+// NewProxyGroup runs several proxies, e.g. ones listening on distinct addresses for distinct targets, as one.
+// Serve serves the listener with the first proxy, the others only serve with Run.
+func NewProxyGroup(proxies ...PostgresRedshiftProxy) PostgresRedshiftProxy {
+	return &proxyGroup{
+		proxies: proxies,
+	}
+}
+
+func (group *proxyGroup) Run() error {
+	if len(group.proxies) == 0 {
+		return errors.New("the proxy group has no proxies")
+	}
+	served := make(chan error, len(group.proxies))
+	for _, proxy := range group.proxies {
+		go func(proxy PostgresRedshiftProxy) {
+			served <- proxy.Run()
+		}(proxy)
+	}
+	err := <-served
+	if !errors.Is(err, ErrProxyClosed) {
+		// the group stops as a whole when one of its proxies fails
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = group.Shutdown(ctx)
+	}
+	for i := 1; i < len(group.proxies); i++ {
+		<-served
+	}
+	return err
+}
+
+func (group *proxyGroup) Serve(listener net.Listener) error {
+	if len(group.proxies) == 0 {
+		_ = listener.Close()
+		return errors.New("the proxy group has no proxies")
+	}
+	return group.proxies[0].Serve(listener)
+}
+
+func (group *proxyGroup) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(group.proxies))
+	var wg sync.WaitGroup
+	for i, proxy := range group.proxies {
+		wg.Add(1)
+		go func(i int, proxy PostgresRedshiftProxy) {
+			defer wg.Done()
+			errs[i] = proxy.Shutdown(ctx)
+		}(i, proxy)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (group *proxyGroup) ShuttingDown() bool {
+	for _, proxy := range group.proxies {
+		if proxy.ShuttingDown() {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *proxyGroup) Addr() net.Addr {
+	for _, proxy := range group.proxies {
+		if addr := proxy.Addr(); addr != nil {
+			return addr
+		}
+	}
+	return nil
+}
+
+func (group *proxyGroup) Connections() []ConnectionInfo {
+	connections := []ConnectionInfo{}
+	for _, proxy := range group.proxies {
+		connections = append(connections, proxy.Connections()...)
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		return connections[i].OpenedAt.Before(connections[j].OpenedAt)
+	})
+	return connections
+}
+
+func (group *proxyGroup) Statements() []ActiveStatement {
+	statements := []ActiveStatement{}
+	for _, proxy := range group.proxies {
+		statements = append(statements, proxy.Statements()...)
+	}
+	sort.SliceStable(statements, func(i, j int) bool {
+		return statements[i].StartedAt.Before(statements[j].StartedAt)
+	})
+	return statements
+}
+
+func (group *proxyGroup) CancelStatement(id string) bool {
+	for _, proxy := range group.proxies {
+		if proxy.CancelStatement(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *proxyGroup) TerminateConnection(id string) bool {
+	for _, proxy := range group.proxies {
+		if proxy.TerminateConnection(id) {
+			return true
+		}
+	}
+	return false
+}
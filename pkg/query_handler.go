@@ -3,73 +3,393 @@ package rdapp
 import (
 	"context"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
 	"github.com/google/uuid"
 	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"time"
 )
 
 type RedshiftDataApiQueryHandler interface {
 	QueryHandler(ctx context.Context, query string, writer wire.DataWriter, parameters []string) error
+	// OpenSession creates the session of an authenticated connection, the returned context is the one
+	// of the connection
+	OpenSession(ctx context.Context) context.Context
+	// CloseSession releases the session state of the connection the context belongs to
+	CloseSession(ctx context.Context) error
+	// Drain refuses new queries and waits for the running ones to finish, the ones still running
+	// when the context is done are cancelled
+	Drain(ctx context.Context) (DrainSummary, error)
+	// Statements lists the running queries
+	Statements() []ActiveStatement
+	// CancelStatement cancels the running query with the correlation id, false if there is none
+	CancelStatement(id string) bool
 }
 
 type redshiftDataApiQueryHandler struct {
 	redshiftDataAPIService RedshiftDataAPIService
 	pgRedshiftTranslator   PgRedshiftTranslator
+	sessions               *sessionRegistry
+	running                *runningStatements
+	historyStore           HistoryStore
+	historyTarget          HistoryTarget
+	auditLog               AuditLog
+	readOnlyPolicy         ReadOnlyPolicy
+	policy                 *Policy
+	rowLimitPolicy         RowLimitPolicy
+	masking                *Masking
+	resultCache            ResultCache
+	hooks                  Hooks
+	metrics                *Metrics
 	logger                 *zap.Logger
+	// authenticated is true when clients are authenticated by WithAuth, their user names are trusted then
+	authenticated bool
+	// connections are the client connections of the sessions, nil when the handler runs without a proxy
+	connections *clientConnections
 }
 
-func NewRedshiftDataApiQueryHandler(redshiftDataAPIService RedshiftDataAPIService, pgRedshiftTranslator PgRedshiftTranslator, logger *zap.Logger) RedshiftDataApiQueryHandler {
-	return &redshiftDataApiQueryHandler{
+func NewRedshiftDataApiQueryHandler(redshiftDataAPIService RedshiftDataAPIService, pgRedshiftTranslator PgRedshiftTranslator, redshiftDataAPIConfig RedshiftDataAPIConfig, historyStore HistoryStore, auditLog AuditLog, readOnlyPolicy ReadOnlyPolicy, policy *Policy, rowLimitPolicy RowLimitPolicy, masking *Masking, resultCache ResultCache, hooks Hooks, metrics *Metrics, logger *zap.Logger) RedshiftDataApiQueryHandler {
+	return newRedshiftDataApiQueryHandler(proxyOptions{
 		redshiftDataAPIService: redshiftDataAPIService,
 		pgRedshiftTranslator:   pgRedshiftTranslator,
+		redshiftDataApiConfig:  redshiftDataAPIConfig,
+		historyStore:           historyStore,
+		auditLog:               auditLog,
+		readOnlyPolicy:         readOnlyPolicy,
+		policy:                 policy,
+		rowLimitPolicy:         rowLimitPolicy,
+		masking:                masking,
+		resultCache:            resultCache,
+		hooks:                  hooks,
+		metrics:                metrics,
 		logger:                 logger,
+	}, nil)
+}
+
+// newRedshiftDataApiQueryHandler constructs the query handler of the options, it runs statements with the
+// data api service of the options and reaches the client connections of its sessions via connections
+func newRedshiftDataApiQueryHandler(options proxyOptions, connections *clientConnections) *redshiftDataApiQueryHandler {
+	return &redshiftDataApiQueryHandler{
+		redshiftDataAPIService: options.redshiftDataAPIService,
+		pgRedshiftTranslator:   options.pgRedshiftTranslator,
+		sessions:               newSessionRegistry(),
+		running:                newRunningStatements(),
+		historyStore:           options.historyStore,
+		historyTarget:          NewHistoryTarget(options.redshiftDataApiConfig),
+		auditLog:               options.auditLog,
+		readOnlyPolicy:         options.readOnlyPolicy,
+		policy:                 options.policy,
+		rowLimitPolicy:         options.rowLimitPolicy,
+		masking:                options.masking,
+		resultCache:            options.resultCache,
+		hooks:                  options.hooks,
+		metrics:                options.metrics,
+		logger:                 options.logger,
+		authenticated:          options.authenticate != nil,
+		connections:            connections,
 	}
 }
 
-func (handler *redshiftDataApiQueryHandler) QueryHandler(ctx context.Context, query string, writer wire.DataWriter, parameters []string) error {
+func (handler *redshiftDataApiQueryHandler) QueryHandler(ctx context.Context, query string, writer wire.DataWriter, parameters []string) (err error) {
+	correlationId := uuid.NewString()
+	spanCtx, span := tracer.Start(ctx, "query", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(correlationIdAttribute.String(correlationId), semconv.DBSystemRedshift))
+	defer func() {
+		endSpan(span, err)
+		handler.metrics.observeQuery(ctx, err)
+	}()
+	session := handler.sessions.sessionFor(ctx)
 	rdappCtx := RdappContext{
-		Context: ctx,
+		Context: spanCtx,
 		logger: handler.logger.With(
-			zap.String("rdappCorrelationId", uuid.NewString()),
+			zap.String("rdappCorrelationId", correlationId),
 		),
+		session:       session,
+		correlationId: correlationId,
+		maxRows:       handler.rowLimitPolicy.maxRowsFor(session.user),
+	}
+	if handler.connections != nil {
+		rdappCtx.sendNotice = func(notice notice) error {
+			return handler.connections.sendNotice(session.id, notice)
+		}
+	}
+	// the execution is taken before anything can fail so the next call is matched with its own
+	queryParameters := TextQueryParameters(parameters)
+	if bound, ok := handler.boundStatement(session, query, parameters); ok {
+		queryParameters = bound.parameters
+		rdappCtx.resultFormats = bound.resultFormats
 	}
+	rdappCtx, finished, err := handler.running.start(rdappCtx, query)
+	if err != nil {
+		return err
+	}
+	defer finished()
+	handler.sessions.queryStarted(session, query)
+	defer handler.sessions.queryFinished(session)
+	defer func() {
+		if err != nil && rdappCtx.Err() != nil && ctx.Err() == nil {
+			err = psqlerr.WithCode(fmt.Errorf("canceling statement: %w", err), codes.QueryCanceled)
+		}
+	}()
 	loggerWithContext := rdappCtx.logger
 	loggerWithContext.Info("received query",
 		zap.String("query", query),
 		zap.Any("parameters", parameters))
-	redshiftQuery := handler.pgRedshiftTranslator.TranslateToRedshiftQuery(query)
-	redshiftQueryParams := handler.pgRedshiftTranslator.TranslateToRedshiftQueryParams(parameters)
-	result, err := handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, redshiftQueryParams)
+	statements := SplitStatements(query)
+	if len(statements) == 0 {
+		return writer.Empty()
+	}
+	if len(statements) > 1 && len(parameters) > 0 {
+		return psqlerr.WithCode(fmt.Errorf("cannot insert multiple commands into a prepared statement"), codes.Syntax)
+	}
+	if len(statements) > 1 && !anyMayReturnRows(statements) && !anyHandledLocally(statements) {
+		return handler.executeBatch(rdappCtx, statements, writer)
+	}
+	for _, statement := range statements {
+		err = handler.executeStatement(rdappCtx, statement, writer, queryParameters)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handler *redshiftDataApiQueryHandler) executeStatement(rdappCtx RdappContext, statement string, writer wire.DataWriter, parameters []QueryParameter) (err error) {
+	spanCtx, span := tracer.Start(rdappCtx, "statement", trace.WithAttributes(semconv.DBStatementKey.String(statement)))
+	var result *QueryResult
+	defer func() {
+		endSpan(span, err)
+		handler.auditStatement(rdappCtx, statement, parameters, result, err)
+		handler.afterStatement(rdappCtx, statement, result, err)
+	}()
+	rdappCtx.Context = spanCtx
+	loggerWithContext := rdappCtx.logger
+	err = handler.authorizeStatement(rdappCtx, statement)
+	if err != nil {
+		return err
+	}
+	err = handler.beforeStatement(rdappCtx, statement)
+	if err != nil {
+		return err
+	}
+	if command, ok := parseSessionCommand(statement); ok {
+		handled, err := handler.handleSessionCommand(rdappCtx, statement, command, writer)
+		if handled || err != nil {
+			return err
+		}
+	}
+	if command, ok := parsePreparedStatementCommand(statement); ok {
+		return handler.handlePreparedStatementCommand(rdappCtx, command, writer)
+	}
+	if command, ok := parseBackendCommand(statement); ok {
+		return handler.handleBackendCommand(rdappCtx, command, parameters, writer)
+	}
+	redshiftQuery, redshiftQueryParams, err := handler.translateStatement(rdappCtx, statement, parameters)
 	if err != nil {
 		return err
 	}
-	if result != nil {
-		pgColumnMetaData, err := handler.pgRedshiftTranslator.TranslateColumnMetaDataToPgFormat(rdappCtx, result.ColumnMetadata)
+	startedAt := time.Now()
+	result, err = handler.executeQuery(rdappCtx, statement, redshiftQuery, redshiftQueryParams)
+	handler.recordHistory(rdappCtx, statement, redshiftQuery, redshiftQueryParams, startedAt, result, err)
+	if err != nil {
+		return err
+	}
+	if result.HasResultSet {
+		err = handler.writeResultSet(rdappCtx, result, writer)
 		if err != nil {
 			return err
 		}
-		err = writer.Define(pgColumnMetaData)
+		loggerWithContext.Info("completed writing result into the wire")
+	}
+	if result.Truncated {
+		rdappCtx.notify(notice{
+			severity: "WARNING",
+			code:     sqlStateWarning,
+			message:  fmt.Sprintf("result truncated to its first %d rows by the max rows of the user", rdappCtx.maxRows),
+		})
+	}
+	return writer.Complete(commandTag(statement, result.HasResultSet, result.ResultRows))
+}
+
+// translateStatement translates the statement and its parameters into a data api query
+func (handler *redshiftDataApiQueryHandler) translateStatement(rdappCtx RdappContext, statement string, parameters []QueryParameter) (redshiftQuery string, redshiftQueryParams []types.SqlParameter, err error) {
+	_, span := tracer.Start(rdappCtx, "translate")
+	defer func() {
+		endSpan(span, err)
+	}()
+	if handler.rowLimitPolicy.InjectLimit && rdappCtx.maxRows > 0 {
+		statement = withRowLimit(statement, rdappCtx.maxRows)
+	}
+	redshiftQuery = handler.pgRedshiftTranslator.TranslateToRedshiftQuery(statement, parameters)
+	redshiftQueryParams, err = handler.pgRedshiftTranslator.TranslateToRedshiftQueryParams(parameters)
+	if err != nil {
+		rdappCtx.logger.Error("error while translating query parameters", zap.Error(err))
+		handler.metrics.observeTranslationFailure(translationParameter)
+		return "", nil, psqlerr.WithCode(err, codes.InvalidParameterValue)
+	}
+	return redshiftQuery, redshiftQueryParams, nil
+}
+
+// writeResultSet translates the result set and writes it to the wire
+func (handler *redshiftDataApiQueryHandler) writeResultSet(rdappCtx RdappContext, result *QueryResult, writer wire.DataWriter) (err error) {
+	spanCtx, span := tracer.Start(rdappCtx, "write result", trace.WithAttributes(rowsAttribute.Int(len(result.Records))))
+	defer func() {
+		endSpan(span, err)
+	}()
+	rdappCtx.Context = spanCtx
+	rdappCtx.columnMasks = handler.masking.masksFor(rdappCtx.session.user, result.ColumnMetadata)
+	loggerWithContext := rdappCtx.logger
+	pgColumnMetaData, err := handler.pgRedshiftTranslator.TranslateColumnMetaDataToPgFormat(rdappCtx, result.ColumnMetadata, rdappCtx.resultFormats)
+	if err != nil {
+		handler.metrics.observeTranslationFailure(translationColumnType)
+		return err
+	}
+	err = writer.Define(pgColumnMetaData)
+	if err != nil {
+		loggerWithContext.Error("error while writing column definition in result set",
+			zap.Error(err),
+			zap.Any("columnMetadata", result.ColumnMetadata))
+		return err
+	}
+	for _, redshiftRow := range result.Records {
+		row, err := handler.pgRedshiftTranslator.TranslateRowToPgFormat(rdappCtx, pgColumnMetaData, redshiftRow)
 		if err != nil {
-			loggerWithContext.Error("error while writing column definition in result set",
+			handler.metrics.observeTranslationFailure(translationRowValue)
+			return err
+		}
+		err = writer.Row(row)
+		if err != nil {
+			loggerWithContext.Error("error while writing row in redshiftFields set",
 				zap.Error(err),
+				zap.Any("recordRow", redshiftRow),
 				zap.Any("columnMetadata", result.ColumnMetadata))
+			return fmt.Errorf("error while writing row in redshiftFields set: %w", err)
+		}
+	}
+	return nil
+}
+
+// executeBatch runs statements which do not produce result sets in a single round trip
+func (handler *redshiftDataApiQueryHandler) executeBatch(rdappCtx RdappContext, statements []string, writer wire.DataWriter) (err error) {
+	spanCtx, span := tracer.Start(rdappCtx, "batch", trace.WithAttributes(batchStatementCountAttribute.Int(len(statements))))
+	defer func() {
+		endSpan(span, err)
+	}()
+	rdappCtx.Context = spanCtx
+	for _, statement := range statements {
+		err = handler.authorizeStatement(rdappCtx, statement)
+		if err == nil {
+			err = handler.beforeStatement(rdappCtx, statement)
+		}
+		if err != nil {
+			handler.auditStatement(rdappCtx, statement, nil, nil, err)
+			handler.afterStatement(rdappCtx, statement, nil, err)
 			return err
 		}
-		for _, redshiftRow := range result.Records {
-			row, err := handler.pgRedshiftTranslator.TranslateRowToPgFormat(rdappCtx, redshiftRow)
-			if err != nil {
-				return err
-			}
-			err = writer.Row(row)
-			if err != nil {
-				rdappCtx.logger.Error("error while writing row in redshiftFields set",
-					zap.Error(err),
-					zap.Any("recordRow", redshiftRow),
-					zap.Any("columnMetadata", result.ColumnMetadata))
-				return fmt.Errorf("error while writing row in redshiftFields set: %w", err)
-			}
+	}
+	redshiftQueries := rdappCtx.session.forwardedPrefix()
+	noOfPrefixQueries := len(redshiftQueries)
+	for _, statement := range statements {
+		redshiftQueries = append(redshiftQueries, handler.pgRedshiftTranslator.TranslateToRedshiftQuery(statement, nil))
+	}
+	if handler.resultCache != nil && !allReadOnly(statements) {
+		defer handler.resultCache.Invalidate()
+	}
+	startedAt := time.Now()
+	results, err := handler.redshiftDataAPIService.ExecuteBatch(rdappCtx, redshiftQueries)
+	if len(results) >= noOfPrefixQueries {
+		results = results[noOfPrefixQueries:]
+	}
+	for i, statement := range statements {
+		var result *QueryResult
+		if i < len(results) {
+			result = &results[i]
+		}
+		handler.recordHistory(rdappCtx, statement, redshiftQueries[noOfPrefixQueries+i], nil, startedAt, result, err)
+		handler.auditStatement(rdappCtx, statement, nil, result, err)
+		handler.afterStatement(rdappCtx, statement, result, err)
+	}
+	if err != nil {
+		return err
+	}
+	for i, statement := range statements {
+		resultRows := int64(-1)
+		if i < len(results) {
+			resultRows = results[i].ResultRows
+		}
+		err = writer.Complete(commandTag(statement, false, resultRows))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boundStatement returns the statement bound via the extended protocol the query handler is called for,
+// false for simple queries and when the connection is not known
+func (handler *redshiftDataApiQueryHandler) boundStatement(session *Session, query string, parameters []string) (boundStatement, bool) {
+	protocol := handler.connections.extendedProtocolOf(session.id)
+	if protocol == nil {
+		return boundStatement{}, false
+	}
+	return protocol.take(query, len(parameters))
+}
+
+func (handler *redshiftDataApiQueryHandler) OpenSession(ctx context.Context) context.Context {
+	ctx, session := handler.sessions.open(ctx)
+	handler.auditSession(AuditEventSessionStarted, session)
+	return ctx
+}
+
+func (handler *redshiftDataApiQueryHandler) CloseSession(ctx context.Context) error {
+	session := handler.sessions.close(ctx)
+	if session != nil {
+		handler.auditSession(AuditEventSessionEnded, session)
+	}
+	return nil
+}
+
+func (handler *redshiftDataApiQueryHandler) Drain(ctx context.Context) (DrainSummary, error) {
+	return handler.running.drain(ctx)
+}
+
+func (handler *redshiftDataApiQueryHandler) Statements() []ActiveStatement {
+	return handler.running.list()
+}
+
+func (handler *redshiftDataApiQueryHandler) CancelStatement(id string) bool {
+	cancelled := handler.running.cancel(id)
+	if cancelled {
+		handler.logger.Info("cancelling statement", zap.String("rdappCorrelationId", id))
+	}
+	return cancelled
+}
+
+// anyHandledLocally reports if any of the statements is answered by rdapp itself
+func anyHandledLocally(statements []string) bool {
+	for _, statement := range statements {
+		if _, ok := parseSessionCommand(statement); ok {
+			return true
+		}
+		if _, ok := parsePreparedStatementCommand(statement); ok {
+			return true
+		}
+		if _, ok := parseBackendCommand(statement); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMayReturnRows(statements []string) bool {
+	for _, statement := range statements {
+		if mayReturnRows(statement) {
+			return true
 		}
-		loggerWithContext.Info("completed writing result into the wire")
 	}
-	return writer.Complete("OK")
+	return false
 }
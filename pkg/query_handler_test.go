@@ -0,0 +1,115 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+// recordingDataAPIService records the queries and batches it is asked to execute
+type recordingDataAPIService struct {
+	queries []string
+	batches [][]string
+}
+
+func (service *recordingDataAPIService) ExecuteQuery(_ RdappContext, query string, _ []types.SqlParameter) (*QueryResult, error) {
+	service.queries = append(service.queries, query)
+	return &QueryResult{
+		HasResultSet:   true,
+		ResultRows:     1,
+		ColumnMetadata: []types.ColumnMetadata{{Name: aws.String("value"), TypeName: aws.String(RedshiftTypeInt4)}},
+		Records:        [][]types.Field{{&types.FieldMemberLongValue{Value: int64(len(service.queries))}}},
+		QueryId:        "query",
+	}, nil
+}
+
+func (service *recordingDataAPIService) ExecuteBatch(_ RdappContext, queries []string) ([]QueryResult, error) {
+	service.batches = append(service.batches, queries)
+	var results []QueryResult
+	for i := range queries {
+		results = append(results, QueryResult{ResultRows: int64(i + 1)})
+	}
+	return results, nil
+}
+
+// recordingDataWriter records what the query handler writes to the wire
+type recordingDataWriter struct {
+	columns   []wire.Columns
+	rows      [][]any
+	completed []string
+}
+
+func (writer *recordingDataWriter) Define(columns wire.Columns) error {
+	writer.columns = append(writer.columns, columns)
+	return nil
+}
+
+func (writer *recordingDataWriter) Row(row []any) error {
+	writer.rows = append(writer.rows, row)
+	return nil
+}
+
+func (writer *recordingDataWriter) Empty() error {
+	return nil
+}
+
+func (writer *recordingDataWriter) Complete(description string) error {
+	writer.completed = append(writer.completed, description)
+	return nil
+}
+
+func (writer *recordingDataWriter) Written() uint64 {
+	return uint64(len(writer.rows))
+}
+
+func Test_redshiftDataApiQueryHandler_QueryHandler_multipleStatements(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		wantQueries   []string
+		wantBatches   [][]string
+		wantRows      [][]any
+		wantCompleted []string
+	}{
+		{
+			name:          "statements without result sets run as one batch",
+			query:         "insert into person values (1); update person set age = 2",
+			wantBatches:   [][]string{{"insert into person values (1)", "update person set age = 2"}},
+			wantCompleted: []string{"INSERT 0 1", "UPDATE 2"},
+		},
+		{
+			name:          "statements with result sets run one by one",
+			query:         "select 1; select 2;",
+			wantQueries:   []string{"select 1", "select 2"},
+			wantRows:      [][]any{{int64(1)}, {int64(2)}},
+			wantCompleted: []string{"SELECT 1", "SELECT 1"},
+		},
+		{
+			name:          "session commands are handled between the statements",
+			query:         "set search_path to sales; select 1",
+			wantQueries:   []string{"set search_path to sales", "select 1"},
+			wantRows:      [][]any{{int64(2)}},
+			wantCompleted: []string{"SET", "SELECT 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &recordingDataAPIService{}
+			queryHandler := NewRedshiftDataApiQueryHandler(service, NewPgRedshiftTranslator(), RedshiftDataAPIConfig{}, nil, nil,
+				ReadOnlyPolicy{}, nil, RowLimitPolicy{}, nil, nil, Hooks{}, NewMetrics(), zap.NewNop())
+			writer := &recordingDataWriter{}
+
+			err := queryHandler.QueryHandler(context.Background(), tt.query, writer, nil)
+
+			require.NoError(t, err)
+			require.Equal(t, tt.wantQueries, service.queries)
+			require.Equal(t, tt.wantBatches, service.batches)
+			require.Equal(t, tt.wantRows, writer.rows)
+			require.Equal(t, tt.wantCompleted, writer.completed)
+		})
+	}
+}
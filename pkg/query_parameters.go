@@ -0,0 +1,167 @@
+package rdapp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/jackc/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+	"strings"
+)
+
+// QueryParameter is a parameter bound to a statement
+type QueryParameter struct {
+	// Value is the encoded parameter value, nil denotes NULL
+	Value []byte
+	// Oid is the declared type of the parameter, 0 when the client left it unspecified
+	Oid oid.Oid
+	// Format is the format Value is encoded in
+	Format wire.FormatCode
+}
+
+// TextQueryParameters converts parameters received as strings into text format parameters of unspecified type
+func TextQueryParameters(parameters []string) []QueryParameter {
+	var queryParameters []QueryParameter
+	for _, parameter := range parameters {
+		queryParameters = append(queryParameters, QueryParameter{
+			Value:  []byte(parameter),
+			Format: wire.TextFormat,
+		})
+	}
+	return queryParameters
+}
+
+// parameterTypeAliases maps sql type names to the names known to pgtype
+var parameterTypeAliases = map[string]string{
+	"int":                         "int4",
+	"integer":                     "int4",
+	"smallint":                    "int2",
+	"bigint":                      "int8",
+	"real":                        "float4",
+	"float":                       "float8",
+	"double precision":            "float8",
+	"decimal":                     "numeric",
+	"boolean":                     "bool",
+	"character varying":           "varchar",
+	"character":                   "bpchar",
+	"char":                        "bpchar",
+	"nchar":                       "bpchar",
+	"nvarchar":                    "varchar",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+	"time without time zone":      "time",
+	"varbyte":                     "bytea",
+	"varbinary":                   "bytea",
+}
+
+var parameterTypeInfo = pgtype.NewConnInfo()
+
+// oidForTypeName resolves a declared sql type like "varchar(20)" or "integer" to its oid
+func oidForTypeName(typeName string) (oid.Oid, bool) {
+	typeName = strings.ToLower(strings.TrimSpace(typeName))
+	if index := strings.IndexByte(typeName, '('); index >= 0 {
+		typeName = strings.TrimSpace(typeName[:index])
+	}
+	typeName = strings.Join(strings.Fields(typeName), " ")
+	if alias, ok := parameterTypeAliases[typeName]; ok {
+		typeName = alias
+	}
+	dataType, ok := parameterTypeInfo.DataTypeForName(typeName)
+	if !ok {
+		return 0, false
+	}
+	return oid.Oid(dataType.OID), true
+}
+
+// parameterCasts are the redshift casts applied to parameters of a known type,
+// character types are left alone as the data api sends every value as a string
+var parameterCasts = map[oid.Oid]string{
+	oid.T_bool:        "bool",
+	oid.T_int2:        "int2",
+	oid.T_int4:        "int4",
+	oid.T_int8:        "int8",
+	oid.T_float4:      "float4",
+	oid.T_float8:      "float8",
+	oid.T_numeric:     "numeric",
+	oid.T_date:        "date",
+	oid.T_time:        "time",
+	oid.T_timestamp:   "timestamp",
+	oid.T_timestamptz: "timestamptz",
+}
+
+// textValue returns the text representation of the parameter, binary encoded values are decoded using the parameter oid
+func (parameter QueryParameter) textValue() (string, error) {
+	if parameter.Format != wire.BinaryFormat {
+		return string(parameter.Value), nil
+	}
+	switch parameter.Oid {
+	case oid.T_text, oid.T_varchar, oid.T_bpchar, oid.T_name, oid.T_unknown:
+		return string(parameter.Value), nil
+	}
+	dataType, ok := parameterTypeInfo.DataTypeForOID(uint32(parameter.Oid))
+	if !ok {
+		return "", fmt.Errorf("unsupported binary parameter type oid=%d", parameter.Oid)
+	}
+	value := pgtype.NewValue(dataType.Value)
+	decoder, ok := value.(pgtype.BinaryDecoder)
+	if !ok {
+		return "", fmt.Errorf("binary format is not supported for parameter type %s", dataType.Name)
+	}
+	err := decoder.DecodeBinary(parameterTypeInfo, parameter.Value)
+	if err != nil {
+		return "", fmt.Errorf("error while decoding binary parameter of type %s: %w", dataType.Name, err)
+	}
+	encoder, ok := value.(pgtype.TextEncoder)
+	if !ok {
+		return "", fmt.Errorf("text format is not supported for parameter type %s", dataType.Name)
+	}
+	text, err := encoder.EncodeText(parameterTypeInfo, nil)
+	if err != nil {
+		return "", fmt.Errorf("error while encoding parameter of type %s as text: %w", dataType.Name, err)
+	}
+	return string(text), nil
+}
+
+// redshiftValue returns the value sent to the data api. bytea values are sent hex encoded
+// and decoded on the redshift side, see redshiftPlaceholder
+func (parameter QueryParameter) redshiftValue() (string, error) {
+	if parameter.Oid == oid.T_bytea {
+		value := parameter.Value
+		if parameter.Format != wire.BinaryFormat {
+			decoded, err := decodeByteaText(string(value))
+			if err != nil {
+				return "", err
+			}
+			value = decoded
+		}
+		return hex.EncodeToString(value), nil
+	}
+	return parameter.textValue()
+}
+
+// redshiftPlaceholder returns the redshift expression replacing the postgres placeholder
+func (parameter QueryParameter) redshiftPlaceholder(name string, castFollows bool) string {
+	if parameter.Value == nil {
+		if cast, ok := parameterCasts[parameter.Oid]; ok && !castFollows {
+			return "NULL::" + cast
+		}
+		return "NULL"
+	}
+	if parameter.Oid == oid.T_bytea {
+		return fmt.Sprintf("from_hex(:%s)", name)
+	}
+	if cast, ok := parameterCasts[parameter.Oid]; ok && !castFollows {
+		return fmt.Sprintf(":%s::%s", name, cast)
+	}
+	return ":" + name
+}
+
+// decodeByteaText decodes the hex (\x...) and escape text formats of bytea
+func decodeByteaText(value string) ([]byte, error) {
+	bytea := &pgtype.Bytea{}
+	err := bytea.DecodeText(parameterTypeInfo, []byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding bytea parameter: %w", err)
+	}
+	return bytea.Bytes, nil
+}
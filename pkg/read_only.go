@@ -0,0 +1,217 @@
+package rdapp
+
+import (
+	"fmt"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"go.uber.org/zap"
+	"path"
+	"strings"
+)
+
+// ReadOnlyPolicy decides which users may only run statements that modify neither data nor schema
+type ReadOnlyPolicy struct {
+	// Default applies to users and targets without an override
+	Default bool
+	// Targets overrides the default per target, keyed by glob patterns like workgroup/prod/*
+	Targets map[string]bool
+	// Users overrides the default and the targets per postgres user, it needs WithAuth as clients
+	// choose their user name otherwise
+	Users map[string]bool
+}
+
+func (policy ReadOnlyPolicy) appliesTo(user string, target string) bool {
+	if readOnly, ok := policy.Users[user]; ok {
+		return readOnly
+	}
+	readOnly := policy.Default
+	for pattern, targetReadOnly := range policy.Targets {
+		if matched, _ := path.Match(pattern, target); matched {
+			// a read only pattern wins over a read write one also matching the target
+			readOnly = targetReadOnly
+			if readOnly {
+				break
+			}
+		}
+	}
+	return readOnly
+}
+
+// modifyingCommands are leading keywords of statements which modify data or schema and may appear
+// within parentheses of another statement, e.g. in a subquery
+var modifyingCommands = map[string]bool{
+	"alter":    true,
+	"call":     true,
+	"copy":     true,
+	"create":   true,
+	"delete":   true,
+	"drop":     true,
+	"grant":    true,
+	"insert":   true,
+	"merge":    true,
+	"refresh":  true,
+	"revoke":   true,
+	"truncate": true,
+	"unload":   true,
+	"update":   true,
+	"vacuum":   true,
+}
+
+// readOnlyCommands are leading keywords of statements which modify neither data nor schema.
+// Statements starting with any other keyword are rejected in read only mode. PREPARE is allowed
+// like in postgres, the prepared statement is checked when it is executed.
+var readOnlyCommands = map[string]bool{
+	"abort":      true,
+	"begin":      true,
+	"close":      true,
+	"commit":     true,
+	"deallocate": true,
+	"declare":    true,
+	"discard":    true,
+	"end":        true,
+	"execute":    true,
+	"explain":    true,
+	"fetch":      true,
+	"move":       true,
+	"prepare":    true,
+	"release":    true,
+	"reset":      true,
+	"rollback":   true,
+	"savepoint":  true,
+	"select":     true,
+	"set":        true,
+	"show":       true,
+	"start":      true,
+	"table":      true,
+	"values":     true,
+	"with":       true,
+}
+
+// isReadOnly reports if the statements modify neither data nor schema. It is a heuristic over the tokens
+// of the statements rather than a parse tree: leading keywords, INTO, common table expressions and
+// modifying statements within parentheses are checked. Every statement of a multi statement string is
+// checked, statements which cannot be classified are treated as modifying. Functions with side effects
+// called from a SELECT are not detected.
+func isReadOnly(statement string) bool {
+	for _, statement := range SplitStatements(statement) {
+		if !readOnlyTokens(lexSql(statement)) {
+			return false
+		}
+	}
+	return true
+}
+
+func allReadOnly(statements []string) bool {
+	for _, statement := range statements {
+		if !isReadOnly(statement) {
+			return false
+		}
+	}
+	return true
+}
+
+func readOnlyTokens(tokens []sqlToken) bool {
+	for len(tokens) > 0 && tokens[0].kind == sqlTokenOperator && tokens[0].text == "(" {
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return true
+	}
+	keyword := tokens[0].lowerText()
+	if tokens[0].kind != sqlTokenWord || !readOnlyCommands[keyword] {
+		return false
+	}
+	switch keyword {
+	case "select", "table", "values":
+		// SELECT INTO creates a table, INTO cannot appear elsewhere in a query
+		for i, token := range tokens {
+			if token.isWord("into") || modifiesWithinParentheses(tokens, i) {
+				return false
+			}
+		}
+	case "with":
+		return readOnlyWith(tokens[1:])
+	case "explain":
+		return readOnlyExplain(tokens[1:])
+	case "declare":
+		// DECLARE name [options] CURSOR [WITH HOLD] FOR query
+		for i, token := range tokens {
+			if token.isWord("for") {
+				return readOnlyTokens(tokens[i+1:])
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// modifiesWithinParentheses reports if the token at position opens a parenthesis around a modifying statement
+func modifiesWithinParentheses(tokens []sqlToken, position int) bool {
+	if tokens[position].kind != sqlTokenOperator || tokens[position].text != "(" {
+		return false
+	}
+	next := position + 1
+	for next < len(tokens) && tokens[next].kind == sqlTokenOperator && tokens[next].text == "(" {
+		next++
+	}
+	return next < len(tokens) && tokens[next].kind == sqlTokenWord && modifyingCommands[tokens[next].lowerText()]
+}
+
+// readOnlyWith checks the bodies of the common table expressions and the main statement
+func readOnlyWith(tokens []sqlToken) bool {
+	bodies, main, ok := splitWith(tokens)
+	if !ok {
+		return false
+	}
+	for _, body := range bodies {
+		if !readOnlyTokens(body) {
+			return false
+		}
+	}
+	return readOnlyTokens(main)
+}
+
+// readOnlyExplain checks the explained statement when it is run due to ANALYZE
+func readOnlyExplain(tokens []sqlToken) bool {
+	analyze := false
+	if len(tokens) > 0 && tokens[0].text == "(" {
+		closing := closingParenthesis(tokens, 0)
+		if closing < 0 {
+			return false
+		}
+		for _, token := range tokens[1:closing] {
+			analyze = analyze || token.isWord("analyze")
+		}
+		tokens = tokens[closing+1:]
+	}
+	for len(tokens) > 0 && (tokens[0].isWord("analyze") || tokens[0].isWord("analyse") || tokens[0].isWord("verbose")) {
+		analyze = analyze || !tokens[0].isWord("verbose")
+		tokens = tokens[1:]
+	}
+	return !analyze || readOnlyTokens(tokens)
+}
+
+// checkReadOnly rejects statements modifying data or schema when the session user is read only
+func (handler *redshiftDataApiQueryHandler) checkReadOnly(rdappCtx RdappContext, statement string) error {
+	if rdappCtx.session == nil || !handler.readOnlyPolicy.appliesTo(rdappCtx.session.user, handler.historyTarget.String()) || isReadOnly(statement) {
+		return nil
+	}
+	rdappCtx.logger.Warn("rejected statement in read only mode",
+		zap.String("user", rdappCtx.session.user),
+		zap.String("statement", statement))
+	return psqlerr.WithCode(fmt.Errorf("cannot execute %s in a read-only transaction", commandName(statement)), codes.ReadOnlySQLTransaction)
+}
+
+// commandName is the command tag without row counts, for example INSERT or CREATE TABLE
+func commandName(statement string) string {
+	var words []string
+	for _, word := range strings.Fields(commandTag(statement, false, 0)) {
+		if word != "0" {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return "statement"
+	}
+	return strings.Join(words, " ")
+}
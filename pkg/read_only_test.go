@@ -0,0 +1,62 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_isReadOnly(t *testing.T) {
+	type args struct {
+		statement string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{name: "select", args: args{statement: "select * from person where note = 'insert into x'"}, want: true},
+		{name: "parenthesized union", args: args{statement: "(select 1) union (select 2)"}, want: true},
+		{name: "select into creates a table", args: args{statement: "select * into person_copy from person"}, want: false},
+		{name: "with selecting", args: args{statement: "with recent(id) as (select id from person), old as materialized (select 1) select * from recent"}, want: true},
+		{name: "with modifying in a common table expression", args: args{statement: "with gone as (delete from person returning *) select * from gone"}, want: false},
+		{name: "with modifying in the main statement", args: args{statement: "with src as (select 1 as id) insert into person select id from src"}, want: false},
+		{name: "explain", args: args{statement: "explain verbose delete from person"}, want: true},
+		{name: "explain analyze runs the statement", args: args{statement: "explain (analyze, format json) delete from person"}, want: false},
+		{name: "cursor over a query", args: args{statement: "declare c cursor with hold for select * from person"}, want: true},
+		{name: "session commands", args: args{statement: "set search_path to analytics"}, want: true},
+		{name: "prepare is checked on execute", args: args{statement: "prepare p as insert into person values ($1)"}, want: true},
+		{name: "keyword within comment", args: args{statement: "/* select */ insert into person values (1)"}, want: false},
+		{name: "dml", args: args{statement: "UPDATE person SET name = 'x'"}, want: false},
+		{name: "copy", args: args{statement: "copy person from 's3://bucket/person'"}, want: false},
+		{name: "unload", args: args{statement: "unload ('select * from person') to 's3://bucket/person'"}, want: false},
+		{name: "ddl", args: args{statement: "create or replace view v as select 1"}, want: false},
+		{name: "grant", args: args{statement: "grant select on person to analyst"}, want: false},
+		{name: "procedure call", args: args{statement: "call refresh_person()"}, want: false},
+		{name: "modifying statement after a select", args: args{statement: "select 1; delete from person"}, want: false},
+		{name: "selects only", args: args{statement: "select 1; select 2;"}, want: true},
+		{name: "modifying subquery", args: args{statement: "select * from ((delete from person returning id)) gone"}, want: false},
+		{name: "function arguments", args: args{statement: "select count(id), coalesce(update_time, now()) from person"}, want: true},
+		{name: "writable common table expression updating", args: args{statement: "WITH moved AS (UPDATE person SET team = 2 RETURNING id) SELECT count(*) FROM moved"}, want: false},
+		{name: "writable common table expression after a selecting one", args: args{statement: "with a as (select 1), b as (insert into person select * from a returning *) select * from b"}, want: false},
+		{name: "writable common table expression nested in a subquery", args: args{statement: "select * from (with gone as (delete from person returning *) select * from gone) g"}, want: false},
+		{name: "select into a temporary table", args: args{statement: "select id into temp table person_ids from person"}, want: false},
+		{name: "select into after a common table expression", args: args{statement: "with recent as (select id from person) select * into recent_copy from recent"}, want: false},
+		{name: "into within a string literal", args: args{statement: "select 'into' as word from person"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, isReadOnly(tt.args.statement))
+		})
+	}
+}
+
+func Test_ReadOnlyPolicy_appliesTo(t *testing.T) {
+	policy := ReadOnlyPolicy{
+		Targets: map[string]bool{"workgroup/prod/*": true, "workgroup/*": false},
+		Users:   map[string]bool{"etl": false, "analyst": true},
+	}
+	require.True(t, policy.appliesTo("developer", "workgroup/prod/analytics"), "read only target wins")
+	require.False(t, policy.appliesTo("developer", "workgroup/dev/analytics"))
+	require.False(t, policy.appliesTo("etl", "workgroup/prod/analytics"), "users override targets")
+	require.True(t, policy.appliesTo("analyst", "cluster/dev/dev"))
+}
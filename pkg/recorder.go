@@ -0,0 +1,461 @@
+package rdapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/aws/smithy-go"
+	"github.com/kishaningithub/rdapp/fakedataapi"
+	"go.uber.org/zap"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// RecordScrub is what the recorder removes from the statements and results it records
+type RecordScrub string
+
+const (
+	RecordScrubNone RecordScrub = "none"
+	// RecordScrubSecrets replaces passwords, credentials and roles in statements
+	RecordScrubSecrets RecordScrub = "secrets"
+	// RecordScrubValues additionally replaces parameter values and result values keeping their type, nulls
+	// and shape, the statements keep their literals so that they still match on replay
+	RecordScrubValues RecordScrub = "values"
+)
+
+// secretKeywords precede string literals holding secrets like password 'x' or iam_role 'arn:...'
+var secretKeywords = map[string]bool{
+	"password":              true,
+	"credentials":           true,
+	"iam_role":              true,
+	"access_key_id":         true,
+	"secret_access_key":     true,
+	"session_token":         true,
+	"master_symmetric_key":  true,
+	"encrypted_secret_key":  true,
+	"kms_key_id":            true,
+	"aws_access_key_id":     true,
+	"aws_secret_access_key": true,
+}
+
+// Recorder writes the statements run via the data api and their outcome as fixtures of the fake data
+// api, serving them with --replay-file or rdapp fake-data-api reproduces the session without the cluster.
+// The fixtures are written on Close.
+type Recorder struct {
+	path   string
+	scrub  RecordScrub
+	mutex  sync.Mutex
+	logger *zap.Logger
+	// statements which are running or whose first result page is awaited by data api id, the sub
+	// statements of a batch have ids like <id>:2
+	statements map[string]*recordedStatement
+	// pages are the statements whose result is being fetched by the next token of the result
+	pages    map[string]*recordedStatement
+	fixtures []fakedataapi.Fixture
+}
+
+type recordedStatement struct {
+	fixture fakedataapi.Fixture
+	// sqls of a batch, nil for single statements
+	sqls []string
+	// finished statements only await their result
+	finished bool
+	// index of the fixture once the first page of its result is recorded
+	index int
+}
+
+// NewRecorder constructs a recorder writing to the file at path, an existing file is replaced
+func NewRecorder(path string, scrub RecordScrub, logger *zap.Logger) (*Recorder, error) {
+	switch scrub {
+	case RecordScrubNone, RecordScrubSecrets, RecordScrubValues:
+	default:
+		return nil, fmt.Errorf("record scrub %q is not one of none, secrets or values", scrub)
+	}
+	recorder := &Recorder{
+		path:       path,
+		scrub:      scrub,
+		logger:     logger,
+		statements: map[string]*recordedStatement{},
+		pages:      map[string]*recordedStatement{},
+	}
+	err := fakedataapi.WriteFixtures(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (recorder *Recorder) submitted(id *string, sql string, parameters []types.SqlParameter, sqls []string, err error) {
+	if len(sqls) > 0 {
+		sql = sqls[0]
+	}
+	fixture := fakedataapi.Fixture{
+		Pattern:    recorder.pattern(sql),
+		Parameters: recorder.parameters(parameters),
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if err != nil {
+		var apiError smithy.APIError
+		if errors.As(err, &apiError) {
+			fixture.Fault = apiError.ErrorCode()
+			recorder.record(fixture)
+		}
+		return
+	}
+	recorder.statements[aws.ToString(id)] = &recordedStatement{fixture: fixture, sqls: sqls}
+}
+
+func (recorder *Recorder) described(output *redshiftdata.DescribeStatementOutput) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	id := aws.ToString(output.Id)
+	statement, ok := recorder.statements[id]
+	if !ok {
+		return
+	}
+	switch output.Status {
+	case types.StatusStringFinished, types.StatusStringFailed, types.StatusStringAborted:
+	default:
+		statuses := statement.fixture.Statuses
+		if len(statuses) == 0 || statuses[len(statuses)-1] != output.Status {
+			statement.fixture.Statuses = append(statuses, output.Status)
+		}
+		return
+	}
+	delete(recorder.statements, id)
+	if statement.sqls != nil {
+		recorder.recordBatch(statement, output.SubStatements)
+		return
+	}
+	switch {
+	case output.Status != types.StatusStringFinished:
+		statement.fixture.Error = aws.ToString(output.Error)
+	case aws.ToBool(output.HasResultSet):
+		// recorded once the first page of the result is fetched
+		statement.finished = true
+		recorder.statements[id] = statement
+		return
+	default:
+		statement.fixture.RowsAffected = output.ResultRows
+	}
+	recorder.record(statement.fixture)
+}
+
+// recordBatch records the sub statements of a batch, sub statements aborted after a failure did not run.
+// The result of the last sub statement is fetched by its id when the batch replays forwarded statements.
+func (recorder *Recorder) recordBatch(statement *recordedStatement, subStatements []types.SubStatementData) {
+	for i, subStatement := range subStatements {
+		index := subStatementIndex(aws.ToString(subStatement.Id), i)
+		if subStatement.Status == types.StatementStatusStringAborted || index >= len(statement.sqls) {
+			continue
+		}
+		fixture := fakedataapi.Fixture{
+			Pattern:      recorder.pattern(statement.sqls[index]),
+			RowsAffected: subStatement.ResultRows,
+			Error:        aws.ToString(subStatement.Error),
+		}
+		if i == len(subStatements)-1 && subStatement.Status == types.StatementStatusStringFinished && aws.ToBool(subStatement.HasResultSet) {
+			fixture.RowsAffected = 0
+			recorder.statements[aws.ToString(subStatement.Id)] = &recordedStatement{fixture: fixture, finished: true}
+			continue
+		}
+		recorder.record(fixture)
+	}
+}
+
+// subStatementIndex is the index of the sql of the sub statement from its id like <id>:2, the position
+// of the sub statement is used for ids without a number
+func subStatementIndex(id string, position int) int {
+	separator := strings.LastIndex(id, ":")
+	if separator < 0 {
+		return position
+	}
+	number, err := strconv.Atoi(id[separator+1:])
+	if err != nil || number < 1 {
+		return position
+	}
+	return number - 1
+}
+
+func (recorder *Recorder) fetched(input *redshiftdata.GetStatementResultInput, output *redshiftdata.GetStatementResultOutput) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	var statement *recordedStatement
+	if nextToken := aws.ToString(input.NextToken); nextToken != "" {
+		statement = recorder.pages[nextToken]
+		delete(recorder.pages, nextToken)
+	} else {
+		id := aws.ToString(input.Id)
+		statement = recorder.statements[id]
+		delete(recorder.statements, id)
+		if statement != nil {
+			// recorded with the first page as the client may stop fetching at its max rows
+			statement.fixture.Columns = recorder.columns(output.ColumnMetadata)
+			statement.index = len(recorder.fixtures)
+			recorder.record(statement.fixture)
+		}
+	}
+	if statement == nil {
+		return
+	}
+	fixture := &recorder.fixtures[statement.index]
+	for _, record := range output.Records {
+		fixture.Rows = append(fixture.Rows, recorder.row(record, output.ColumnMetadata))
+	}
+	if nextToken := aws.ToString(output.NextToken); nextToken != "" {
+		recorder.pages[nextToken] = statement
+	}
+}
+
+func (recorder *Recorder) record(fixture fakedataapi.Fixture) {
+	recorder.fixtures = append(recorder.fixtures, fixture)
+}
+
+// Close writes the recorded fixtures, finished statements whose result was not fetched are recorded without rows
+func (recorder *Recorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	for id, statement := range recorder.statements {
+		if statement.finished {
+			recorder.record(statement.fixture)
+		}
+		delete(recorder.statements, id)
+	}
+	recorder.pages = map[string]*recordedStatement{}
+	err := fakedataapi.WriteFixtures(recorder.path, compactFixtures(recorder.fixtures))
+	if err != nil {
+		return fmt.Errorf("error while writing recording: %w", err)
+	}
+	return nil
+}
+
+// compactFixtures drops fixtures repeating the previous fixture of the statement. Earlier fixtures of the
+// statement answer as often as they were recorded, the last one answers every time.
+func compactFixtures(fixtures []fakedataapi.Fixture) []fakedataapi.Fixture {
+	var compacted []fakedataapi.Fixture
+	// repeats counts how often the fixture was recorded in a row for the same statement
+	var repeats []int
+	for _, fixture := range fixtures {
+		repeated := false
+		for i := len(compacted) - 1; i >= 0; i-- {
+			previous := compacted[i]
+			if previous.Pattern != fixture.Pattern || !reflect.DeepEqual(previous.Parameters, fixture.Parameters) {
+				continue
+			}
+			// the statuses seen depend on the timing of the polls
+			previous.Statuses = fixture.Statuses
+			if reflect.DeepEqual(previous, fixture) {
+				repeats[i]++
+				repeated = true
+				break
+			}
+			compacted[i].Times = repeats[i]
+			break
+		}
+		if !repeated {
+			compacted = append(compacted, fixture)
+			repeats = append(repeats, 1)
+		}
+	}
+	return compacted
+}
+
+func (recorder *Recorder) pattern(sql string) string {
+	return "^" + regexp.QuoteMeta(recorder.scrubSql(sql)) + "$"
+}
+
+func (recorder *Recorder) parameters(parameters []types.SqlParameter) map[string]string {
+	if len(parameters) == 0 {
+		return nil
+	}
+	values := map[string]string{}
+	for _, parameter := range parameters {
+		value := aws.ToString(parameter.Value)
+		if recorder.scrub == RecordScrubValues {
+			value = scrubText(value)
+		}
+		values[aws.ToString(parameter.Name)] = value
+	}
+	return values
+}
+
+// scrubSql replaces the string literals holding secrets
+func (recorder *Recorder) scrubSql(sql string) string {
+	if recorder.scrub == RecordScrubNone {
+		return sql
+	}
+	var scrubbed strings.Builder
+	position := 0
+	tokens := lexSql(sql)
+	for i, token := range tokens {
+		if token.kind != sqlTokenString {
+			continue
+		}
+		if i == 0 || !secretKeywords[tokens[i-1].lowerText()] {
+			continue
+		}
+		scrubbed.WriteString(sql[position:token.start])
+		scrubbed.WriteString("'***'")
+		position = token.end
+	}
+	scrubbed.WriteString(sql[position:])
+	return scrubbed.String()
+}
+
+func (recorder *Recorder) columns(columnMetadata []types.ColumnMetadata) []fakedataapi.FixtureColumn {
+	columns := []fakedataapi.FixtureColumn{}
+	for _, column := range columnMetadata {
+		nullable := column.Nullable
+		label := aws.ToString(column.Label)
+		if label == aws.ToString(column.Name) {
+			label = ""
+		}
+		columns = append(columns, fakedataapi.FixtureColumn{
+			Name:            aws.ToString(column.Name),
+			Label:           label,
+			TypeName:        aws.ToString(column.TypeName),
+			SchemaName:      aws.ToString(column.SchemaName),
+			TableName:       aws.ToString(column.TableName),
+			ColumnDefault:   aws.ToString(column.ColumnDefault),
+			Length:          column.Length,
+			Precision:       column.Precision,
+			Scale:           column.Scale,
+			IsCaseSensitive: column.IsCaseSensitive,
+			IsCurrency:      column.IsCurrency,
+			IsSigned:        column.IsSigned,
+			Nullable:        &nullable,
+		})
+	}
+	return columns
+}
+
+func (recorder *Recorder) row(record []types.Field, columnMetadata []types.ColumnMetadata) []any {
+	var row []any
+	for i, field := range record {
+		var value any
+		switch field := field.(type) {
+		case *types.FieldMemberBooleanValue:
+			value = field.Value
+		case *types.FieldMemberLongValue:
+			value = field.Value
+		case *types.FieldMemberDoubleValue:
+			value = field.Value
+		case *types.FieldMemberStringValue:
+			value = field.Value
+		case *types.FieldMemberBlobValue:
+			value = field.Value
+		}
+		if recorder.scrub == RecordScrubValues && value != nil {
+			var typeName string
+			if i < len(columnMetadata) {
+				typeName = aws.ToString(columnMetadata[i].TypeName)
+			}
+			value = scrubValue(value, typeName)
+		}
+		row = append(row, value)
+	}
+	return row
+}
+
+// scrubValue replaces the value with one of the same type which still parses as the type of the column
+func scrubValue(value any, typeName string) any {
+	switch value := value.(type) {
+	case int64:
+		return int64(0)
+	case float64:
+		return float64(0)
+	case []byte:
+		return make([]byte, len(value))
+	case string:
+		switch typeName {
+		case RedshiftTypeDate:
+			return "2000-01-01"
+		case RedshiftTypeTimestamp:
+			return "2000-01-01 00:00:00"
+		case RedshiftTypeTimestamptz:
+			return "2000-01-01 00:00:00+00"
+		case RedshiftTypeTime:
+			return "00:00:00"
+		case RedshiftTypeTimetz:
+			return "00:00:00+00"
+		case RedshiftTypeSuper:
+			return "null"
+		}
+		return scrubText(value)
+	}
+	return value
+}
+
+// scrubText replaces letters with x and digits with 0 keeping the length and punctuation of the text
+func scrubText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r):
+			return 'x'
+		case unicode.IsDigit(r):
+			return '0'
+		}
+		return r
+	}, text)
+}
+
+// recordingRedshiftDataApiClient passes the calls made to the data api to the recorder
+type recordingRedshiftDataApiClient struct {
+	client   RedshiftDataApiClient
+	recorder *Recorder
+}
+
+func newRecordingRedshiftDataApiClient(client RedshiftDataApiClient, recorder *Recorder) RedshiftDataApiClient {
+	return &recordingRedshiftDataApiClient{
+		client:   client,
+		recorder: recorder,
+	}
+}
+
+func (recording *recordingRedshiftDataApiClient) ExecuteStatement(ctx context.Context, params *redshiftdata.ExecuteStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.ExecuteStatementOutput, error) {
+	output, err := recording.client.ExecuteStatement(ctx, params, optFns...)
+	var id *string
+	if err == nil {
+		id = output.Id
+	}
+	recording.recorder.submitted(id, aws.ToString(params.Sql), params.Parameters, nil, err)
+	return output, err
+}
+
+func (recording *recordingRedshiftDataApiClient) BatchExecuteStatement(ctx context.Context, params *redshiftdata.BatchExecuteStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.BatchExecuteStatementOutput, error) {
+	output, err := recording.client.BatchExecuteStatement(ctx, params, optFns...)
+	var id *string
+	if err == nil {
+		id = output.Id
+	}
+	recording.recorder.submitted(id, "", nil, params.Sqls, err)
+	return output, err
+}
+
+func (recording *recordingRedshiftDataApiClient) DescribeStatement(ctx context.Context, params *redshiftdata.DescribeStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.DescribeStatementOutput, error) {
+	output, err := recording.client.DescribeStatement(ctx, params, optFns...)
+	if err == nil {
+		recording.recorder.described(output)
+	}
+	return output, err
+}
+
+func (recording *recordingRedshiftDataApiClient) GetStatementResult(ctx context.Context, params *redshiftdata.GetStatementResultInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.GetStatementResultOutput, error) {
+	output, err := recording.client.GetStatementResult(ctx, params, optFns...)
+	if err == nil {
+		recording.recorder.fetched(params, output)
+	}
+	return output, err
+}
+
+func (recording *recordingRedshiftDataApiClient) CancelStatement(ctx context.Context, params *redshiftdata.CancelStatementInput, optFns ...func(*redshiftdata.Options)) (*redshiftdata.CancelStatementOutput, error) {
+	return recording.client.CancelStatement(ctx, params, optFns...)
+}
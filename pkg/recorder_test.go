@@ -0,0 +1,117 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/kishaningithub/rdapp/fakedataapi"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Recorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.yaml")
+	recorder, err := NewRecorder(path, RecordScrubSecrets, zap.NewNop())
+	require.NoError(t, err)
+	columns := []types.ColumnMetadata{
+		{Name: aws.String("id"), TypeName: aws.String(RedshiftTypeInt4), Nullable: 0},
+		{Name: aws.String("score"), TypeName: aws.String(RedshiftTypeFloat8), Nullable: 1},
+		{Name: aws.String("seen"), TypeName: aws.String(RedshiftTypeTimestamp), Nullable: 1},
+	}
+	selectPerson := func(id string, records ...[]types.Field) {
+		recorder.submitted(aws.String(id), "select * from person where id > :1", []types.SqlParameter{{Name: aws.String("1"), Value: aws.String("0")}}, nil, nil)
+		recorder.described(&redshiftdata.DescribeStatementOutput{Id: aws.String(id), Status: types.StatusStringStarted})
+		recorder.described(&redshiftdata.DescribeStatementOutput{Id: aws.String(id), Status: types.StatusStringFinished, HasResultSet: aws.Bool(true)})
+		recorder.fetched(&redshiftdata.GetStatementResultInput{Id: aws.String(id)}, &redshiftdata.GetStatementResultOutput{ColumnMetadata: columns, Records: records})
+	}
+	row := []types.Field{&types.FieldMemberLongValue{Value: 1}, &types.FieldMemberDoubleValue{Value: 1}, &types.FieldMemberStringValue{Value: "2023-01-02 10:00:00"}}
+	selectPerson("1", row)
+	selectPerson("2", row)
+	selectPerson("3", row, []types.Field{&types.FieldMemberLongValue{Value: 2}, &types.FieldMemberIsNull{Value: true}, &types.FieldMemberIsNull{Value: true}})
+	recorder.submitted(aws.String("4"), "alter user etl password 'hunter2'", nil, nil, nil)
+	recorder.described(&redshiftdata.DescribeStatementOutput{Id: aws.String("4"), Status: types.StatusStringFailed, Error: aws.String("ERROR: permission denied")})
+	recorder.submitted(nil, "insert into person values (1)", nil, nil, &types.ActiveStatementsExceededException{})
+	require.NoError(t, recorder.Close())
+
+	fixtures, err := fakedataapi.LoadFixtures(path)
+	require.NoError(t, err)
+	require.Len(t, fixtures, 4)
+	engine, err := fakedataapi.NewFixtureEngine(fixtures)
+	require.NoError(t, err)
+	parameters := []types.SqlParameter{{Name: aws.String("1"), Value: aws.String("0")}}
+	replay := func() *fakedataapi.Result {
+		result, err := engine.Execute(context.Background(), "select * from person where id > :1", parameters)
+		require.NoError(t, err)
+		return result
+	}
+	result := replay()
+	require.Equal(t, []types.StatusString{types.StatusStringStarted}, result.Statuses)
+	require.Equal(t, int32(0), result.ColumnMetadata[0].Nullable)
+	require.Equal(t, [][]types.Field{row}, result.Records)
+	require.Len(t, replay().Records, 1, "recorded twice")
+	require.Len(t, replay().Records, 2)
+	require.Len(t, replay().Records, 2, "the last fixture answers every time")
+
+	_, err = engine.Execute(context.Background(), "alter user etl password '***'", nil)
+	require.EqualError(t, err, "ERROR: permission denied")
+	_, err = engine.Execute(context.Background(), "insert into person values (1)", nil)
+	require.ErrorAs(t, err, new(*fakedataapi.APIError))
+}
+
+func Test_Recorder_pages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.yaml")
+	recorder, err := NewRecorder(path, RecordScrubValues, zap.NewNop())
+	require.NoError(t, err)
+	columns := []types.ColumnMetadata{{Name: aws.String("name"), TypeName: aws.String(RedshiftTypeVarchar)}}
+	page := func(name string) [][]types.Field {
+		return [][]types.Field{{&types.FieldMemberStringValue{Value: name}}}
+	}
+	recorder.submitted(aws.String("1"), "select name from person", nil, nil, nil)
+	recorder.described(&redshiftdata.DescribeStatementOutput{Id: aws.String("1"), Status: types.StatusStringFinished, HasResultSet: aws.Bool(true)})
+	recorder.fetched(&redshiftdata.GetStatementResultInput{Id: aws.String("1")},
+		&redshiftdata.GetStatementResultOutput{ColumnMetadata: columns, Records: page("Ann"), NextToken: aws.String("2")})
+	recorder.fetched(&redshiftdata.GetStatementResultInput{Id: aws.String("1"), NextToken: aws.String("2")},
+		&redshiftdata.GetStatementResultOutput{ColumnMetadata: columns, Records: page("Bob"), NextToken: aws.String("3")})
+	recorder.submitted(aws.String("2"), "", nil, []string{"set search_path to 'sales'", "select name from person where name = 'Ann'"}, nil)
+	recorder.described(&redshiftdata.DescribeStatementOutput{Id: aws.String("2"), Status: types.StatusStringFinished, SubStatements: []types.SubStatementData{
+		{Id: aws.String("2:1"), Status: types.StatementStatusStringFinished},
+		{Id: aws.String("2:2"), Status: types.StatementStatusStringFinished, HasResultSet: aws.Bool(true)},
+	}})
+	recorder.fetched(&redshiftdata.GetStatementResultInput{Id: aws.String("2:2")},
+		&redshiftdata.GetStatementResultOutput{ColumnMetadata: columns, Records: page("Ann")})
+	require.NoError(t, recorder.Close())
+
+	fixtures, err := fakedataapi.LoadFixtures(path)
+	require.NoError(t, err)
+	require.Len(t, fixtures, 3)
+	require.Equal(t, "^select name from person$", fixtures[0].Pattern)
+	require.Equal(t, [][]any{{"xxx"}, {"xxx"}}, fixtures[0].Rows, "recorded with the pages fetched")
+	require.Equal(t, "^set search_path to 'sales'$", fixtures[1].Pattern)
+	require.Equal(t, "^select name from person where name = 'Ann'$", fixtures[2].Pattern)
+	require.Equal(t, [][]any{{"xxx"}}, fixtures[2].Rows)
+}
+
+func Test_Recorder_scrubSql(t *testing.T) {
+	type args struct {
+		scrub RecordScrub
+		sql   string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{name: "none", args: args{scrub: RecordScrubNone, sql: "create user etl password 'Secret1'"}, want: "create user etl password 'Secret1'"},
+		{name: "secrets", args: args{scrub: RecordScrubSecrets, sql: "copy person from 's3://bucket/person' iam_role 'arn:aws:iam::1:role/r' where name = 'ann'"}, want: "copy person from 's3://bucket/person' iam_role '***' where name = 'ann'"},
+		{name: "values", args: args{scrub: RecordScrubValues, sql: "select * from person where name = 'Ann 42' and id = 7 and note = $$x$$"}, want: "select * from person where name = 'Ann 42' and id = 7 and note = $$x$$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &Recorder{scrub: tt.args.scrub}
+			require.Equal(t, tt.want, recorder.scrubSql(tt.args.sql))
+		})
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"strings"
+	"time"
 )
 
+// cancelStatementTimeout bounds cancelling a statement whose client is gone
+const cancelStatementTimeout = 10 * time.Second
+
 type RedshiftDataAPIConfig struct {
 	// The name of the database. This parameter is required when authenticating using
 	// either Secrets Manager or temporary credentials.
@@ -35,60 +40,243 @@ type RedshiftDataAPIConfig struct {
 	WorkgroupName *string
 }
 
+// QueryResult is the outcome of a single statement executed via the redshift data api
+type QueryResult struct {
+	// HasResultSet denotes if the statement produced a result set
+	HasResultSet bool
+	// ResultRows is the number of rows returned or affected by the statement, -1 when not applicable
+	ResultRows     int64
+	ColumnMetadata []types.ColumnMetadata
+	Records        [][]types.Field
+	// QueryId is the data api id of the statement
+	QueryId string
+	// RedshiftQueryId is the query id assigned by redshift
+	RedshiftQueryId int64
+	// Truncated denotes that the result set had more rows than the max rows of the context,
+	// only the first max rows are fetched and ResultRows is reduced accordingly
+	Truncated bool
+}
+
+// StatementError is returned for statements which failed after being submitted to the data api
+type StatementError struct {
+	QueryId         string
+	RedshiftQueryId int64
+	Err             error
+}
+
+func (err *StatementError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *StatementError) Unwrap() error {
+	return err.Err
+}
+
 type RedshiftDataAPIService interface {
-	ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*redshiftdata.GetStatementResultOutput, error)
+	ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*QueryResult, error)
+	// ExecuteBatch runs the given statements in a single transaction via batch execute statement,
+	// the statements should not produce result sets as they are not fetched
+	ExecuteBatch(ctx RdappContext, queries []string) ([]QueryResult, error)
 }
 
 type redshiftDataAPIService struct {
 	redshiftDataAPIConfig RedshiftDataAPIConfig
 	redshiftDataApiClient RedshiftDataApiClient
+	metrics               *Metrics
 }
 
-func NewRedshiftDataAPIService(redshiftDataApiClient RedshiftDataApiClient, redshiftDataAPIConfig RedshiftDataAPIConfig) RedshiftDataAPIService {
+func NewRedshiftDataAPIService(redshiftDataApiClient RedshiftDataApiClient, redshiftDataAPIConfig RedshiftDataAPIConfig, metrics *Metrics) RedshiftDataAPIService {
 	return &redshiftDataAPIService{
 		redshiftDataAPIConfig: redshiftDataAPIConfig,
 		redshiftDataApiClient: redshiftDataApiClient,
+		metrics:               metrics,
 	}
 }
 
-func (service *redshiftDataAPIService) ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*redshiftdata.GetStatementResultOutput, error) {
+func (service *redshiftDataAPIService) ExecuteQuery(ctx RdappContext, query string, parameters []types.SqlParameter) (*QueryResult, error) {
 	loggerWithContext := ctx.logger
-	if strings.Contains(query, "deallocate") {
-		return nil, nil
+	submittedAt := time.Now()
+	// every data api statement runs in a session of its own, the forwarded session parameters are replayed
+	// in a batch ahead of the query. Batches take no parameters so they are inlined into the query.
+	forwardedStatements := ctx.forwardedStatements()
+	var queryId string
+	var err error
+	if len(forwardedStatements) == 0 {
+		queryId, err = service.executeStatement(ctx, query, parameters, loggerWithContext)
+	} else {
+		query, err = inlineNamedParameters(query, parameters)
+		if err != nil {
+			loggerWithContext.Error("error while inlining query parameters", zap.Error(err))
+			return nil, fmt.Errorf("error while inlining query parameters: %w", err)
+		}
+		loggerWithContext.Info("executing query after the forwarded session parameters",
+			zap.String("query", query),
+			zap.Strings("forwardedStatements", forwardedStatements))
+		queryId, err = service.batchExecuteStatement(ctx, append(forwardedStatements, query), loggerWithContext)
 	}
-	queryId, err := service.executeStatement(ctx, query, parameters, loggerWithContext)
 	if err != nil {
 		return nil, err
 	}
+	service.metrics.observePhase(statementPhaseSubmit, time.Since(submittedAt))
+	ctx.submitted(queryId)
+	trace.SpanFromContext(ctx).SetAttributes(dataApiQueryIdAttribute.String(queryId))
 	loggerWithContext = loggerWithContext.With(zap.String("redshiftDataApiQueryId", queryId))
 	loggerWithContext.Info("submitted query to redshift data api")
 	describeStatementOutput, err := service.waitForQueryToFinish(ctx, queryId, loggerWithContext)
 	if err != nil {
+		service.cancelAbandonedStatement(ctx, queryId, loggerWithContext)
 		return nil, err
 	}
-	loggerWithContext = loggerWithContext.With(zap.Int64("redshiftQueryId", describeStatementOutput.RedshiftQueryId))
+	queryResult := &QueryResult{
+		HasResultSet:    aws.ToBool(describeStatementOutput.HasResultSet),
+		ResultRows:      describeStatementOutput.ResultRows,
+		QueryId:         queryId,
+		RedshiftQueryId: describeStatementOutput.RedshiftQueryId,
+	}
+	// the result of a replayed query is the one of the last sub statement of its batch
+	resultId := queryId
+	if subStatements := describeStatementOutput.SubStatements; len(forwardedStatements) > 0 && len(subStatements) > 0 {
+		lastSubStatement := subStatements[len(subStatements)-1]
+		resultId = aws.ToString(lastSubStatement.Id)
+		queryResult.HasResultSet = aws.ToBool(lastSubStatement.HasResultSet)
+		queryResult.ResultRows = lastSubStatement.ResultRows
+		queryResult.RedshiftQueryId = lastSubStatement.RedshiftQueryId
+	}
+	trace.SpanFromContext(ctx).SetAttributes(redshiftQueryIdAttribute.Int64(queryResult.RedshiftQueryId))
+	loggerWithContext = loggerWithContext.With(zap.Int64("redshiftQueryId", queryResult.RedshiftQueryId))
 	loggerWithContext.Info("query finished execution",
-		zap.Int64("resultRows", describeStatementOutput.ResultRows),
-		zap.Bool("hasResultSet", *describeStatementOutput.HasResultSet),
+		zap.Int64("resultRows", queryResult.ResultRows),
+		zap.Bool("hasResultSet", queryResult.HasResultSet),
 	)
-	if *describeStatementOutput.HasResultSet {
-		result, err := service.redshiftDataApiClient.GetStatementResult(ctx, &redshiftdata.GetStatementResultInput{
-			Id: aws.String(queryId),
-		})
-		if err != nil {
-			loggerWithContext.Error("error while getting statement result",
-				zap.Error(err),
-			)
-			return nil, fmt.Errorf("error while getting statement result: %w", err)
+	if queryResult.HasResultSet {
+		fetchStartedAt := time.Now()
+		var nextToken *string
+		for page := 1; ; page++ {
+			result, err := service.getStatementResultPage(ctx, resultId, nextToken, page, loggerWithContext)
+			if err != nil {
+				return nil, &StatementError{QueryId: queryId, RedshiftQueryId: queryResult.RedshiftQueryId, Err: err}
+			}
+			service.metrics.observeRecords(result.Records)
+			if len(queryResult.ColumnMetadata) == 0 {
+				queryResult.ColumnMetadata = result.ColumnMetadata
+			}
+			queryResult.Records = append(queryResult.Records, result.Records...)
+			if ctx.maxRows > 0 && queryResult.ResultRows > ctx.maxRows && int64(len(queryResult.Records)) >= ctx.maxRows {
+				queryResult.Records = queryResult.Records[:ctx.maxRows]
+				queryResult.Truncated = true
+				break
+			}
+			if result.NextToken == nil || *result.NextToken == "" {
+				break
+			}
+			nextToken = result.NextToken
 		}
+		service.metrics.observePhase(statementPhaseFetch, time.Since(fetchStartedAt))
 		loggerWithContext.Info("received get statement result from redshift",
-			zap.Int64("noOfRowsReturned", result.TotalNumRows))
-		return result, nil
+			zap.Int("noOfRowsReturned", len(queryResult.Records)))
+	}
+	reportTruncation(ctx, queryResult, service.metrics, loggerWithContext)
+	return queryResult, nil
+}
+
+// reportTruncation reduces the result rows of a truncated result to the max rows of the context, the
+// client is warned by the query handler
+func reportTruncation(ctx RdappContext, queryResult *QueryResult, metrics *Metrics, loggerWithContext *zap.Logger) {
+	if !queryResult.Truncated {
+		return
+	}
+	metrics.truncatedResults.Inc()
+	loggerWithContext.Warn("stopped fetching the result at the max rows of the client",
+		zap.Int64("maxRows", ctx.maxRows),
+		zap.Int64("resultRows", queryResult.ResultRows))
+	queryResult.ResultRows = ctx.maxRows
+}
+
+// getStatementResultPage fetches a single page of the result, nextToken is nil for the first page
+func (service *redshiftDataAPIService) getStatementResultPage(ctx context.Context, queryId string, nextToken *string, page int, loggerWithContext *zap.Logger) (result *redshiftdata.GetStatementResultOutput, err error) {
+	ctx, span := tracer.Start(ctx, "GetStatementResult", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(dataApiQueryIdAttribute.String(queryId), resultPageAttribute.Int(page)))
+	defer func() {
+		endSpan(span, err)
+	}()
+	result, err = service.redshiftDataApiClient.GetStatementResult(ctx, &redshiftdata.GetStatementResultInput{
+		Id:        aws.String(queryId),
+		NextToken: nextToken,
+	})
+	if err != nil {
+		loggerWithContext.Error("error while getting statement result",
+			zap.Int("page", page),
+			zap.Error(err),
+		)
+		return nil, fmt.Errorf("error while getting statement result: %w", err)
+	}
+	span.SetAttributes(rowsAttribute.Int(len(result.Records)))
+	return result, nil
+}
+
+func (service *redshiftDataAPIService) ExecuteBatch(ctx RdappContext, queries []string) ([]QueryResult, error) {
+	loggerWithContext := ctx.logger
+	loggerWithContext.Info("executing batch of queries",
+		zap.Strings("queries", queries))
+	submittedAt := time.Now()
+	queryId, err := service.batchExecuteStatement(ctx, queries, loggerWithContext)
+	if err != nil {
+		return nil, err
+	}
+	service.metrics.observePhase(statementPhaseSubmit, time.Since(submittedAt))
+	ctx.submitted(queryId)
+	trace.SpanFromContext(ctx).SetAttributes(dataApiQueryIdAttribute.String(queryId))
+	loggerWithContext = loggerWithContext.With(zap.String("redshiftDataApiQueryId", queryId))
+	loggerWithContext.Info("submitted batch to redshift data api")
+	describeStatementOutput, err := service.waitForQueryToFinish(ctx, queryId, loggerWithContext)
+	if err != nil {
+		service.cancelAbandonedStatement(ctx, queryId, loggerWithContext)
+		return nil, err
+	}
+	var queryResults []QueryResult
+	for _, subStatement := range describeStatementOutput.SubStatements {
+		queryResults = append(queryResults, QueryResult{
+			HasResultSet:    subStatement.HasResultSet != nil && *subStatement.HasResultSet,
+			ResultRows:      subStatement.ResultRows,
+			QueryId:         queryId,
+			RedshiftQueryId: subStatement.RedshiftQueryId,
+		})
+	}
+	loggerWithContext.Info("batch finished execution",
+		zap.Int("noOfSubStatements", len(queryResults)))
+	return queryResults, nil
+}
+
+func (service *redshiftDataAPIService) batchExecuteStatement(ctx context.Context, queries []string, loggerWithContext *zap.Logger) (queryId string, err error) {
+	ctx, span := tracer.Start(ctx, "BatchExecuteStatement", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(batchStatementCountAttribute.Int(len(queries))))
+	defer func() {
+		endSpan(span, err)
+	}()
+	output, err := service.redshiftDataApiClient.BatchExecuteStatement(ctx, &redshiftdata.BatchExecuteStatementInput{
+		Database:          service.redshiftDataAPIConfig.Database,
+		Sqls:              queries,
+		ClusterIdentifier: service.redshiftDataAPIConfig.ClusterIdentifier,
+		DbUser:            service.redshiftDataAPIConfig.DbUser,
+		SecretArn:         service.redshiftDataAPIConfig.SecretArn,
+		StatementName:     aws.String("execute_rdapp_batch"),
+		WithEvent:         aws.Bool(true),
+		WorkgroupName:     service.redshiftDataAPIConfig.WorkgroupName,
+	})
+	if err != nil {
+		loggerWithContext.Error("error while performing batch execute statement operation",
+			zap.Error(err))
+		return "", fmt.Errorf("error while performing batch execute statement operation: %w", err)
 	}
-	return nil, nil
+	span.SetAttributes(dataApiQueryIdAttribute.String(*output.Id))
+	return *output.Id, nil
 }
 
-func (service *redshiftDataAPIService) executeStatement(ctx context.Context, query string, parameters []types.SqlParameter, loggerWithContext *zap.Logger) (string, error) {
+func (service *redshiftDataAPIService) executeStatement(ctx context.Context, query string, parameters []types.SqlParameter, loggerWithContext *zap.Logger) (queryId string, err error) {
+	ctx, span := tracer.Start(ctx, "ExecuteStatement", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		endSpan(span, err)
+	}()
 	loggerWithContext.Info("executing query",
 		zap.String("query", query),
 		zap.Any("parameters", parameters))
@@ -108,22 +296,39 @@ func (service *redshiftDataAPIService) executeStatement(ctx context.Context, que
 			zap.Error(err))
 		return "", fmt.Errorf("error while performing execute statement operation: %w", err)
 	}
-	queryId := *output.Id
-	return queryId, nil
+	span.SetAttributes(dataApiQueryIdAttribute.String(*output.Id))
+	return *output.Id, nil
 }
 
-func (service *redshiftDataAPIService) waitForQueryToFinish(ctx context.Context, queryId string, loggerWithContext *zap.Logger) (*redshiftdata.DescribeStatementOutput, error) {
+// waitForQueryToFinish polls the statement until it completes, the time until the statement is
+// first seen running is accounted as queueing and the remainder as execution. The wait is traced as a
+// single span with the number of polls, tracing every poll would flood the trace of long statements.
+func (service *redshiftDataAPIService) waitForQueryToFinish(ctx context.Context, queryId string, loggerWithContext *zap.Logger) (_ *redshiftdata.DescribeStatementOutput, err error) {
+	ctx, span := tracer.Start(ctx, "wait for statement", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(dataApiQueryIdAttribute.String(queryId)))
+	polls := 0
+	var lastStatus *redshiftdata.DescribeStatementOutput
+	defer func() {
+		span.SetAttributes(pollsAttribute.Int(polls))
+		if lastStatus != nil {
+			span.SetAttributes(
+				dataApiQueryStatusAttribute.String(string(lastStatus.Status)),
+				redshiftQueryIdAttribute.Int64(lastStatus.RedshiftQueryId))
+		}
+		endSpan(span, err)
+	}()
+	waitStartedAt := time.Now()
+	var runningSince time.Time
 	for {
-		result, err := service.redshiftDataApiClient.DescribeStatement(ctx, &redshiftdata.DescribeStatementInput{
-			Id: aws.String(queryId),
-		})
+		polls++
+		result, err := service.describeStatement(ctx, queryId, loggerWithContext)
 		if err != nil {
-			loggerWithContext.Error("error while performing describe statement operation",
-				zap.Error(err))
-			return nil, fmt.Errorf("error while performing describe statement operation: %w", err)
+			return nil, &StatementError{QueryId: queryId, Err: err}
 		}
+		lastStatus = result
 		switch result.Status {
 		case types.StatusStringFinished:
+			service.observeWaitPhases(waitStartedAt, runningSince, time.Duration(result.Duration))
 			return result, nil
 		case types.StatusStringAborted, types.StatusStringFailed:
 			err := fmt.Errorf(*result.Error)
@@ -131,10 +336,102 @@ func (service *redshiftDataAPIService) waitForQueryToFinish(ctx context.Context,
 				zap.String("redshiftDataApiQueryId", queryId),
 				zap.Error(err),
 				zap.Int64("redshiftQueryId", result.RedshiftQueryId))
-			return nil, fmt.Errorf("query execution failed or aborted: %w", err)
+			return nil, &StatementError{
+				QueryId:         queryId,
+				RedshiftQueryId: result.RedshiftQueryId,
+				Err:             fmt.Errorf("query execution failed or aborted: %w", err),
+			}
+		case types.StatusStringStarted:
+			if runningSince.IsZero() {
+				runningSince = time.Now()
+			}
+			loggerWithContext.Debug("received query status",
+				zap.String("queryStatus", string(result.Status)))
 		default:
 			loggerWithContext.Debug("received query status",
 				zap.String("queryStatus", string(result.Status)))
 		}
 	}
 }
+
+// cancelAbandonedStatement cancels the statement on the data api when its context was cancelled while
+// waiting for it, e.g. because the proxy is shutting down, as it would keep running otherwise
+func (service *redshiftDataAPIService) cancelAbandonedStatement(ctx context.Context, queryId string, loggerWithContext *zap.Logger) {
+	if ctx.Err() == nil {
+		return
+	}
+	cancelCtx, cancel := context.WithTimeout(context.Background(), cancelStatementTimeout)
+	defer cancel()
+	_, err := service.redshiftDataApiClient.CancelStatement(cancelCtx, &redshiftdata.CancelStatementInput{
+		Id: aws.String(queryId),
+	})
+	if err != nil {
+		loggerWithContext.Error("error while performing cancel statement operation",
+			zap.Error(err))
+		return
+	}
+	loggerWithContext.Info("cancelled abandoned statement on redshift data api")
+}
+
+// describeStatement performs a single poll of the statement status
+func (service *redshiftDataAPIService) describeStatement(ctx context.Context, queryId string, loggerWithContext *zap.Logger) (*redshiftdata.DescribeStatementOutput, error) {
+	result, err := service.redshiftDataApiClient.DescribeStatement(ctx, &redshiftdata.DescribeStatementInput{
+		Id: aws.String(queryId),
+	})
+	if err != nil {
+		loggerWithContext.Error("error while performing describe statement operation",
+			zap.Error(err))
+		return nil, fmt.Errorf("error while performing describe statement operation: %w", err)
+	}
+	return result, nil
+}
+
+// observeWaitPhases records the queue and execute phases, when the statement finished before it
+// was seen running the execution time reported by the data api is used to split the wait
+func (service *redshiftDataAPIService) observeWaitPhases(waitStartedAt time.Time, runningSince time.Time, reportedDuration time.Duration) {
+	waited := time.Since(waitStartedAt)
+	queued := waited - reportedDuration
+	if !runningSince.IsZero() {
+		queued = runningSince.Sub(waitStartedAt)
+	}
+	if queued < 0 {
+		queued = 0
+	}
+	service.metrics.observePhase(statementPhaseQueue, queued)
+	service.metrics.observePhase(statementPhaseExecute, waited-queued)
+}
+
+// inlineNamedParameters replaces the :name parameters of the data api with string literals or NULL for
+// parameters without a value, redshift treats backslashes in literals as escapes so they are doubled along with quotes
+func inlineNamedParameters(query string, parameters []types.SqlParameter) (string, error) {
+	if len(parameters) == 0 {
+		return query, nil
+	}
+	values := map[string]*string{}
+	for _, parameter := range parameters {
+		values[aws.ToString(parameter.Name)] = parameter.Value
+	}
+	var inlined strings.Builder
+	tokens := lexSql(query)
+	position := 0
+	for i := 0; i+1 < len(tokens); i++ {
+		colon, name := tokens[i], tokens[i+1]
+		if colon.text != ":" || name.start != colon.end || (name.kind != sqlTokenWord && name.kind != sqlTokenNumber) {
+			continue
+		}
+		value, ok := values[name.text]
+		if !ok {
+			return "", fmt.Errorf("parameter %q is not given", name.text)
+		}
+		inlined.WriteString(query[position:colon.start])
+		if value == nil {
+			inlined.WriteString("NULL")
+		} else {
+			inlined.WriteString("'" + strings.ReplaceAll(strings.ReplaceAll(*value, `\`, `\\`), "'", "''") + "'")
+		}
+		position = name.end
+		i++
+	}
+	inlined.WriteString(query[position:])
+	return inlined.String(), nil
+}
@@ -0,0 +1,548 @@
+package rdapp
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// noCacheHint in a comment of a statement bypasses the result cache
+const noCacheHint = "rdapp:no-cache"
+
+const resultCacheFileSuffix = ".rdapp-result"
+
+// volatileFunctions return a different value on every call or per user, statements calling them are not cached
+var volatileFunctions = map[string]bool{
+	"current_date":      true,
+	"current_time":      true,
+	"current_timestamp": true,
+	"current_user":      true,
+	"current_user_id":   true,
+	"getdate":           true,
+	"localtime":         true,
+	"localtimestamp":    true,
+	"now":               true,
+	"pg_backend_pid":    true,
+	"random":            true,
+	"session_user":      true,
+	"sysdate":           true,
+	"timeofday":         true,
+	"user":              true,
+}
+
+// volatileTablePrefixes are the prefixes of the redshift system tables and views, which show the
+// current state of the cluster
+var volatileTablePrefixes = []string{"stcs_", "stl_", "stv_", "svcs_", "svl_", "svv_", "sys_"}
+
+// ResultCache keeps the results of read only queries so that identical queries are not run again
+type ResultCache interface {
+	// Get returns the cached result, on a miss it returns the generation of the cache to pass to Put
+	Get(key string) (result *QueryResult, generation uint64, ok bool)
+	// Put caches the result unless the cache was invalidated since generation, so that results
+	// of queries racing with a write are not kept
+	Put(key string, result *QueryResult, generation uint64)
+	// Invalidate drops every cached result
+	Invalidate()
+}
+
+type resultCache struct {
+	mutex      sync.Mutex
+	generation uint64
+	ttl        time.Duration
+	memory     *cacheTier
+	disk       *cacheTier
+	directory  string
+	// aead encrypts the files with a key of the process, they cannot be read after it ends
+	aead    cipher.AEAD
+	now     func() time.Time
+	metrics *Metrics
+	logger  *zap.Logger
+}
+
+// NewResultCache constructs a cache keeping results for ttl within maxMemoryBytes. When directory is
+// given results are written there too, bounded by maxDiskBytes. The files are encrypted with a key
+// only held in memory. Results left in the directory by a previous run are removed as writes may have
+// happened since.
+func NewResultCache(ttl time.Duration, maxMemoryBytes int64, directory string, maxDiskBytes int64, metrics *Metrics, logger *zap.Logger) (ResultCache, error) {
+	cache := &resultCache{
+		ttl:       ttl,
+		directory: directory,
+		now:       time.Now,
+		metrics:   metrics,
+		logger:    logger,
+	}
+	cache.memory = newCacheTier(maxMemoryBytes, nil)
+	if directory != "" {
+		err := os.MkdirAll(directory, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("error while creating result cache directory: %w", err)
+		}
+		cache.disk = newCacheTier(maxDiskBytes, cache.removeFile)
+		cache.aead, err = newResultCacheCipher()
+		if err != nil {
+			return nil, err
+		}
+		err = cache.removeFiles()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cache, nil
+}
+
+// Get reads files outside of the lock so that lookups served from memory do not wait for the disk
+func (cache *resultCache) Get(key string) (*QueryResult, uint64, bool) {
+	cache.mutex.Lock()
+	now := cache.now()
+	generation := cache.generation
+	if entry, ok := cache.memory.get(key, now); ok {
+		cache.mutex.Unlock()
+		cache.metrics.observeResultCache(true)
+		return entry.result, generation, true
+	}
+	var diskEntry *cacheEntry
+	if cache.disk != nil {
+		diskEntry, _ = cache.disk.get(key, now)
+	}
+	cache.mutex.Unlock()
+	if diskEntry == nil {
+		cache.metrics.observeResultCache(false)
+		return nil, generation, false
+	}
+	result, err := cache.readFile(key)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if err != nil {
+		cache.logger.Warn("error while reading cached result", zap.Error(err))
+		if generation == cache.generation {
+			cache.disk.remove(key)
+		}
+		cache.metrics.observeResultCache(false)
+		return nil, cache.generation, false
+	}
+	if generation == cache.generation {
+		cache.memory.put(&cacheEntry{key: key, size: diskEntry.size, expiresAt: diskEntry.expiresAt, result: result})
+	}
+	cache.metrics.observeResultCache(true)
+	return result, generation, true
+}
+
+// Put writes the file outside of the lock, only the rename making it visible is done under the lock
+func (cache *resultCache) Put(key string, result *QueryResult, generation uint64) {
+	cache.mutex.Lock()
+	if generation != cache.generation {
+		cache.mutex.Unlock()
+		return
+	}
+	expiresAt := cache.now().Add(cache.ttl)
+	cache.memory.put(&cacheEntry{key: key, size: resultSize(result), expiresAt: expiresAt, result: result})
+	cache.mutex.Unlock()
+	if cache.disk == nil {
+		return
+	}
+	temporary, size, err := cache.writeFile(key, result)
+	if err != nil {
+		cache.logger.Warn("error while writing cached result", zap.Error(err))
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if generation != cache.generation {
+		_ = os.Remove(temporary)
+		return
+	}
+	err = os.Rename(temporary, cache.path(key))
+	if err != nil {
+		_ = os.Remove(temporary)
+		cache.logger.Warn("error while writing cached result", zap.Error(err))
+		return
+	}
+	cache.disk.put(&cacheEntry{key: key, size: size, expiresAt: expiresAt})
+}
+
+func (cache *resultCache) Invalidate() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.generation++
+	cache.memory.clear()
+	if cache.disk != nil {
+		cache.disk.clear()
+	}
+}
+
+func (cache *resultCache) path(key string) string {
+	return filepath.Join(cache.directory, key+resultCacheFileSuffix)
+}
+
+// writeFile writes the encrypted result to a temporary file of the key and returns its path
+func (cache *resultCache) writeFile(key string, result *QueryResult) (string, int64, error) {
+	content, err := json.Marshal(newCachedResult(result))
+	if err != nil {
+		return "", 0, fmt.Errorf("error while encoding result: %w", err)
+	}
+	nonce := make([]byte, cache.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", 0, fmt.Errorf("error while encrypting result: %w", err)
+	}
+	content = cache.aead.Seal(nonce, nonce, content, []byte(key))
+	file, err := os.CreateTemp(cache.directory, key+resultCacheFileSuffix+".tmp*")
+	if err != nil {
+		return "", 0, fmt.Errorf("error while writing result: %w", err)
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", 0, fmt.Errorf("error while writing result: %w", err)
+	}
+	return file.Name(), int64(len(content)), nil
+}
+
+func (cache *resultCache) readFile(key string) (*QueryResult, error) {
+	content, err := os.ReadFile(cache.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading result: %w", err)
+	}
+	nonceSize := cache.aead.NonceSize()
+	if len(content) < nonceSize {
+		return nil, errors.New("error while decrypting result: file is too short")
+	}
+	content, err = cache.aead.Open(nil, content[:nonceSize], content[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("error while decrypting result: %w", err)
+	}
+	var cached cachedResult
+	err = json.Unmarshal(content, &cached)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding result: %w", err)
+	}
+	return cached.queryResult(), nil
+}
+
+func (cache *resultCache) removeFile(entry *cacheEntry) {
+	_ = os.Remove(cache.path(entry.key))
+}
+
+func (cache *resultCache) removeFiles() error {
+	files, err := filepath.Glob(filepath.Join(cache.directory, "*"+resultCacheFileSuffix+"*"))
+	if err != nil {
+		return fmt.Errorf("error while listing result cache directory: %w", err)
+	}
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("error while clearing result cache directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// newResultCacheCipher returns an aes-gcm cipher with a random key
+func newResultCacheCipher() (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("error while generating result cache key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating result cache cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+type cacheEntry struct {
+	key       string
+	size      int64
+	expiresAt time.Time
+	// result is nil for entries on disk
+	result *QueryResult
+}
+
+// cacheTier evicts the least recently used entries once its entries exceed maxBytes
+type cacheTier struct {
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element
+	order    *list.List
+	onRemove func(entry *cacheEntry)
+}
+
+func newCacheTier(maxBytes int64, onRemove func(entry *cacheEntry)) *cacheTier {
+	return &cacheTier{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		onRemove: onRemove,
+	}
+}
+
+func (tier *cacheTier) get(key string, now time.Time) (*cacheEntry, bool) {
+	element, ok := tier.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		tier.remove(key)
+		return nil, false
+	}
+	tier.order.MoveToFront(element)
+	return entry, true
+}
+
+// put adds or replaces the entry, entries larger than the tier are not kept
+func (tier *cacheTier) put(entry *cacheEntry) {
+	tier.unlink(entry.key)
+	if entry.size > tier.maxBytes {
+		if tier.onRemove != nil {
+			tier.onRemove(entry)
+		}
+		return
+	}
+	for tier.bytes+entry.size > tier.maxBytes {
+		tier.remove(tier.order.Back().Value.(*cacheEntry).key)
+	}
+	tier.entries[entry.key] = tier.order.PushFront(entry)
+	tier.bytes += entry.size
+}
+
+func (tier *cacheTier) remove(key string) {
+	entry := tier.unlink(key)
+	if entry != nil && tier.onRemove != nil {
+		tier.onRemove(entry)
+	}
+}
+
+// unlink forgets the entry without notifying onRemove
+func (tier *cacheTier) unlink(key string) *cacheEntry {
+	element, ok := tier.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	tier.order.Remove(element)
+	delete(tier.entries, key)
+	tier.bytes -= entry.size
+	return entry
+}
+
+func (tier *cacheTier) clear() {
+	for key := range tier.entries {
+		tier.remove(key)
+	}
+}
+
+// resultSize estimates the memory held by a result
+func resultSize(result *QueryResult) int64 {
+	size := int64(256 * len(result.ColumnMetadata))
+	for _, record := range result.Records {
+		size += int64(24 * len(record))
+		for _, field := range record {
+			size += int64(fieldSize(field))
+		}
+	}
+	return size
+}
+
+// resultCacheKey identifies a query by its normalized text, parameters, target, the credentials it runs
+// with and row cap
+func resultCacheKey(target HistoryTarget, redshiftQuery string, parameters []types.SqlParameter, maxRows int64) string {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%d", target.String(), target.DbUser, target.SecretArn, normalizeSql(redshiftQuery), maxRows)
+	for _, parameter := range parameters {
+		_, _ = fmt.Fprintf(hash, "\x00%s=%s", aws.ToString(parameter.Name), aws.ToString(parameter.Value))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalizeSql drops comments and whitespace and lower cases keywords and unquoted identifiers
+func normalizeSql(sql string) string {
+	var normalized []string
+	for _, token := range lexSql(sql) {
+		if token.kind == sqlTokenWord {
+			normalized = append(normalized, token.lowerText())
+			continue
+		}
+		normalized = append(normalized, token.text)
+	}
+	return strings.Join(normalized, " ")
+}
+
+// cacheableStatement reports if the result of the statement may be served from the cache
+func cacheableStatement(statement string) bool {
+	if !isReadOnly(statement) || hasCommentHint(statement, noCacheHint) {
+		return false
+	}
+	switch analyzeStatement(statement).statementType {
+	case "select", "values", "table":
+	default:
+		return false
+	}
+	tokens := lexSql(statement)
+	for _, token := range tokens {
+		if token.kind == sqlTokenWord && volatileFunctions[token.lowerText()] {
+			return false
+		}
+	}
+	for _, table := range referencedTables(tokens) {
+		name := table[strings.LastIndex(table, ".")+1:]
+		for _, prefix := range volatileTablePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasCommentHint reports if a comment of the statement contains the hint. Comments are
+// what the lexer skips between tokens apart from whitespace.
+func hasCommentHint(statement string, hint string) bool {
+	position := 0
+	for _, token := range lexSql(statement) {
+		if strings.Contains(statement[position:token.start], hint) {
+			return true
+		}
+		position = token.end
+	}
+	return strings.Contains(statement[position:], hint)
+}
+
+// cachedResult is the on disk form of a query result
+type cachedResult struct {
+	HasResultSet    bool                   `json:"hasResultSet"`
+	ResultRows      int64                  `json:"resultRows"`
+	ColumnMetadata  []types.ColumnMetadata `json:"columnMetadata"`
+	Records         [][]cachedField        `json:"records"`
+	QueryId         string                 `json:"queryId"`
+	RedshiftQueryId int64                  `json:"redshiftQueryId"`
+	Truncated       bool                   `json:"truncated"`
+}
+
+// cachedField holds one of the values a data api field can have
+type cachedField struct {
+	IsNull  bool     `json:"n,omitempty"`
+	Blob    []byte   `json:"b,omitempty"`
+	Boolean *bool    `json:"t,omitempty"`
+	Double  *float64 `json:"d,omitempty"`
+	Long    *int64   `json:"l,omitempty"`
+	String  *string  `json:"s,omitempty"`
+}
+
+func newCachedResult(result *QueryResult) cachedResult {
+	cached := cachedResult{
+		HasResultSet:    result.HasResultSet,
+		ResultRows:      result.ResultRows,
+		ColumnMetadata:  result.ColumnMetadata,
+		QueryId:         result.QueryId,
+		RedshiftQueryId: result.RedshiftQueryId,
+		Truncated:       result.Truncated,
+	}
+	for _, record := range result.Records {
+		var fields []cachedField
+		for _, field := range record {
+			var cachedField cachedField
+			switch value := field.(type) {
+			case *types.FieldMemberIsNull:
+				cachedField.IsNull = true
+			case *types.FieldMemberBlobValue:
+				cachedField.Blob = value.Value
+				if value.Value == nil {
+					cachedField.Blob = []byte{}
+				}
+			case *types.FieldMemberBooleanValue:
+				cachedField.Boolean = aws.Bool(value.Value)
+			case *types.FieldMemberDoubleValue:
+				cachedField.Double = aws.Float64(value.Value)
+			case *types.FieldMemberLongValue:
+				cachedField.Long = aws.Int64(value.Value)
+			case *types.FieldMemberStringValue:
+				cachedField.String = aws.String(value.Value)
+			}
+			fields = append(fields, cachedField)
+		}
+		cached.Records = append(cached.Records, fields)
+	}
+	return cached
+}
+
+func (cached cachedResult) queryResult() *QueryResult {
+	result := &QueryResult{
+		HasResultSet:    cached.HasResultSet,
+		ResultRows:      cached.ResultRows,
+		ColumnMetadata:  cached.ColumnMetadata,
+		QueryId:         cached.QueryId,
+		RedshiftQueryId: cached.RedshiftQueryId,
+		Truncated:       cached.Truncated,
+	}
+	for _, cachedRecord := range cached.Records {
+		var record []types.Field
+		for _, cachedField := range cachedRecord {
+			var field types.Field
+			switch {
+			case cachedField.Boolean != nil:
+				field = &types.FieldMemberBooleanValue{Value: *cachedField.Boolean}
+			case cachedField.Double != nil:
+				field = &types.FieldMemberDoubleValue{Value: *cachedField.Double}
+			case cachedField.Long != nil:
+				field = &types.FieldMemberLongValue{Value: *cachedField.Long}
+			case cachedField.String != nil:
+				field = &types.FieldMemberStringValue{Value: *cachedField.String}
+			case cachedField.Blob != nil:
+				field = &types.FieldMemberBlobValue{Value: cachedField.Blob}
+			default:
+				field = &types.FieldMemberIsNull{Value: true}
+			}
+			record = append(record, field)
+		}
+		result.Records = append(result.Records, record)
+	}
+	return result
+}
+
+// executeQuery serves read only queries from the result cache when one is configured. Statements
+// which are not read only invalidate the cache as they may change any cached result.
+func (handler *redshiftDataApiQueryHandler) executeQuery(rdappCtx RdappContext, statement string, redshiftQuery string, redshiftQueryParams []types.SqlParameter) (*QueryResult, error) {
+	if handler.resultCache == nil {
+		return handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, redshiftQueryParams)
+	}
+	if !isReadOnly(statement) {
+		defer handler.resultCache.Invalidate()
+		return handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, redshiftQueryParams)
+	}
+	if !cacheableStatement(statement) {
+		return handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, redshiftQueryParams)
+	}
+	// the forwarded session parameters like search_path change what the query reads
+	key := resultCacheKey(handler.historyTarget, rdappCtx.session.withForwardedParameters(redshiftQuery), redshiftQueryParams, rdappCtx.maxRows)
+	result, generation, ok := handler.resultCache.Get(key)
+	if ok {
+		rdappCtx.logger.Info("served query from result cache",
+			zap.String("redshiftDataApiQueryId", result.QueryId))
+		return result, nil
+	}
+	result, err := handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, redshiftQueryParams)
+	if err == nil && result.HasResultSet {
+		handler.resultCache.Put(key, result, generation)
+	}
+	return result, err
+}
@@ -0,0 +1,138 @@
+package rdapp
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_cacheableStatement(t *testing.T) {
+	type args struct {
+		statement string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "select",
+			args: args{statement: "select * from person"},
+			want: true,
+		},
+		{
+			name: "no cache hint in a comment",
+			args: args{statement: "select * from person /* rdapp:no-cache */"},
+			want: false,
+		},
+		{
+			name: "no cache hint in a string",
+			args: args{statement: "select 'rdapp:no-cache' from person"},
+			want: true,
+		},
+		{
+			name: "volatile function",
+			args: args{statement: "select getdate()"},
+			want: false,
+		},
+		{
+			name: "user dependent function",
+			args: args{statement: "select current_user"},
+			want: false,
+		},
+		{
+			name: "system view",
+			args: args{statement: "select * from pg_catalog.stv_inflight"},
+			want: false,
+		},
+		{
+			name: "write",
+			args: args{statement: "insert into person values (1)"},
+			want: false,
+		},
+		{
+			name: "session command",
+			args: args{statement: "show search_path"},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, cacheableStatement(tt.args.statement))
+		})
+	}
+}
+
+func Test_resultCache(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := &QueryResult{
+		HasResultSet:   true,
+		ResultRows:     2,
+		ColumnMetadata: []types.ColumnMetadata{{Name: aws.String("name"), TypeName: aws.String("varchar")}},
+		Records: [][]types.Field{
+			{&types.FieldMemberStringValue{Value: "alice"}},
+			{&types.FieldMemberIsNull{Value: true}},
+		},
+		QueryId: "query",
+	}
+	directory := t.TempDir()
+	cache, err := NewResultCache(time.Minute, 1<<20, directory, 1<<20, NewMetrics(), zap.NewNop())
+	require.NoError(t, err)
+	cache.(*resultCache).now = func() time.Time { return now }
+
+	_, generation, ok := cache.Get("key")
+	require.False(t, ok)
+	cache.Put("key", result, generation)
+	got, _, ok := cache.Get("key")
+	require.True(t, ok)
+	require.Equal(t, result, got)
+	content, err := os.ReadFile(filepath.Join(directory, "key"+resultCacheFileSuffix))
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "alice", "results on disk are encrypted")
+
+	cache.(*resultCache).memory.clear()
+	got, _, ok = cache.Get("key")
+	require.True(t, ok, "served from disk")
+	require.Equal(t, result, got)
+
+	now = now.Add(time.Minute)
+	_, _, ok = cache.Get("key")
+	require.False(t, ok, "expired")
+
+	_, generation, _ = cache.Get("key")
+	cache.Invalidate()
+	cache.Put("key", result, generation)
+	_, _, ok = cache.Get("key")
+	require.False(t, ok, "put of a query racing with a write")
+}
+
+func Test_cacheTier_put(t *testing.T) {
+	var removed []string
+	tier := newCacheTier(10, func(entry *cacheEntry) {
+		removed = append(removed, entry.key)
+	})
+	expiresAt := time.Now().Add(time.Hour)
+	tier.put(&cacheEntry{key: "a", size: 4, expiresAt: expiresAt})
+	tier.put(&cacheEntry{key: "b", size: 4, expiresAt: expiresAt})
+	_, ok := tier.get("a", time.Now())
+	require.True(t, ok)
+	tier.put(&cacheEntry{key: "c", size: 4, expiresAt: expiresAt})
+	tier.put(&cacheEntry{key: "c", size: 4, expiresAt: expiresAt})
+	tier.put(&cacheEntry{key: "d", size: 11, expiresAt: expiresAt})
+	require.Equal(t, []string{"b", "d"}, removed)
+	require.Equal(t, int64(8), tier.bytes)
+}
+
+func Test_resultCacheKey(t *testing.T) {
+	target := HistoryTarget{ClusterIdentifier: "prod", Database: "dev", DbUser: "analyst"}
+	other := target
+	other.DbUser = "admin"
+	require.NotEqual(t, resultCacheKey(target, "select 1", nil, 0), resultCacheKey(other, "select 1", nil, 0),
+		"results are not shared between the credentials of a target")
+	require.Equal(t, resultCacheKey(target, "select 1", nil, 0), resultCacheKey(target, "SELECT  1", nil, 0))
+}
@@ -0,0 +1,42 @@
+package rdapp
+
+import (
+	"fmt"
+)
+
+// RowLimitPolicy caps the rows returned to clients so that interactive tools do not pull entire tables
+type RowLimitPolicy struct {
+	// MaxRows applies to users without an override, 0 does not cap
+	MaxRows int64
+	// Users overrides MaxRows per postgres user
+	Users map[string]int64
+	// InjectLimit adds a LIMIT to top level queries without one, so that redshift does not
+	// produce rows which would not be fetched anyway
+	InjectLimit bool
+}
+
+func (policy RowLimitPolicy) maxRowsFor(user string) int64 {
+	if maxRows, ok := policy.Users[user]; ok {
+		return maxRows
+	}
+	return policy.MaxRows
+}
+
+// withRowLimit appends a LIMIT to top level SELECTs which have none. The limit is one more than the
+// max rows so that the data api still reports that the result was truncated. Statements writing their
+// rows like SELECT INTO or CREATE TABLE AS are left alone as the limit would drop rows they write.
+func withRowLimit(statement string, maxRows int64) string {
+	tokens := lexSql(statement)
+	if len(tokens) == 0 {
+		return statement
+	}
+	facts := analyzeStatement(statement)
+	if facts.statementType != "select" || facts.hasLimit || !isReadOnly(statement) {
+		return statement
+	}
+	end := tokens[len(tokens)-1].end
+	if tokens[len(tokens)-1].kind == sqlTokenSemicolon {
+		end = tokens[len(tokens)-1].start
+	}
+	return fmt.Sprintf("%s LIMIT %d%s", statement[:end], maxRows+1, statement[end:])
+}
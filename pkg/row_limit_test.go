@@ -0,0 +1,64 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_withRowLimit(t *testing.T) {
+	type args struct {
+		statement string
+		maxRows   int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "select without limit",
+			args: args{statement: "select * from person order by id", maxRows: 1000},
+			want: "select * from person order by id LIMIT 1001",
+		},
+		{
+			name: "trailing comment and terminator",
+			args: args{statement: "select * from person; -- all of them", maxRows: 10},
+			want: "select * from person LIMIT 11; -- all of them",
+		},
+		{
+			name: "limit only within a subquery",
+			args: args{statement: "with recent as (select * from orders limit 5) select * from recent", maxRows: 10},
+			want: "with recent as (select * from orders limit 5) select * from recent LIMIT 11",
+		},
+		{
+			name: "select into writes every row",
+			args: args{statement: "select * into person_copy from person", maxRows: 10},
+			want: "select * into person_copy from person",
+		},
+		{
+			name: "create table as writes every row",
+			args: args{statement: "create table person_copy as select * from person", maxRows: 10},
+			want: "create table person_copy as select * from person",
+		},
+		{
+			name: "select with limit",
+			args: args{statement: "select * from person limit 5", maxRows: 10},
+			want: "select * from person limit 5",
+		},
+		{
+			name: "select with top",
+			args: args{statement: "select top 5 * from person", maxRows: 10},
+			want: "select top 5 * from person",
+		},
+		{
+			name: "not a select",
+			args: args{statement: "show search_path", maxRows: 10},
+			want: "show search_path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, withRowLimit(tt.args.statement, tt.args.maxRows))
+		})
+	}
+}
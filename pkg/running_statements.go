@@ -0,0 +1,192 @@
+package rdapp
+
+import (
+	"context"
+	"errors"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// drainCancelGracePeriod bounds the wait for cancelled statements to unwind, which includes
+// cancelling them on the data api
+const drainCancelGracePeriod = 10 * time.Second
+
+// DrainSummary tells how the statements running when the proxy was shut down ended
+type DrainSummary struct {
+	// Finished is the number of statements which finished before the deadline
+	Finished int
+	// Cancelled is the number of statements which were cancelled at the deadline
+	Cancelled int
+}
+
+// ActiveStatement is a query being executed
+type ActiveStatement struct {
+	// Id is the correlation id the query is logged with
+	Id        string    `json:"id"`
+	SessionId string    `json:"sessionId"`
+	User      string    `json:"user"`
+	Query     string    `json:"query"`
+	StartedAt time.Time `json:"startedAt"`
+	// DataApiIds are the ids of the statements the query submitted to the data api so far
+	DataApiIds []string `json:"dataApiIds"`
+}
+
+type runningStatement struct {
+	ActiveStatement
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// runningStatements keeps the queries being executed so that they can be waited for or cancelled
+type runningStatements struct {
+	mutex      sync.Mutex
+	statements map[string]*runningStatement
+	draining   bool
+	summary    DrainSummary
+}
+
+func newRunningStatements() *runningStatements {
+	return &runningStatements{
+		statements: map[string]*runningStatement{},
+	}
+}
+
+// start registers a query, the returned context is cancelled when the query is cancelled and
+// finished has to be called once the query is done. New queries are refused while draining.
+func (running *runningStatements) start(rdappCtx RdappContext, query string) (RdappContext, func(), error) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	if running.draining {
+		return rdappCtx, nil, psqlerr.WithCode(errors.New("terminating connection due to administrator command"), codes.AdminShutdown)
+	}
+	ctx, cancel := context.WithCancel(rdappCtx.Context)
+	statement := &runningStatement{
+		ActiveStatement: ActiveStatement{
+			Id:         rdappCtx.correlationId,
+			Query:      query,
+			StartedAt:  time.Now(),
+			DataApiIds: []string{},
+		},
+		cancel: cancel,
+	}
+	if rdappCtx.session != nil {
+		statement.SessionId = rdappCtx.session.id
+		statement.User = rdappCtx.session.user
+	}
+	rdappCtx.Context = ctx
+	rdappCtx.running = running
+	running.statements[statement.Id] = statement
+	finished := func() {
+		running.mutex.Lock()
+		defer running.mutex.Unlock()
+		delete(running.statements, statement.Id)
+		if running.draining && !statement.cancelled {
+			running.summary.Finished++
+		}
+		cancel()
+	}
+	return rdappCtx, finished, nil
+}
+
+// submitted notes the data api id of a statement submitted by the query with the correlation id
+func (running *runningStatements) submitted(correlationId string, dataApiId string) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	if statement, ok := running.statements[correlationId]; ok {
+		statement.DataApiIds = append(statement.DataApiIds, dataApiId)
+	}
+}
+
+// list returns the running queries, oldest first
+func (running *runningStatements) list() []ActiveStatement {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	statements := make([]ActiveStatement, 0, len(running.statements))
+	for _, statement := range running.statements {
+		active := statement.ActiveStatement
+		active.DataApiIds = append([]string{}, statement.DataApiIds...)
+		statements = append(statements, active)
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		return statements[i].StartedAt.Before(statements[j].StartedAt)
+	})
+	return statements
+}
+
+// cancel cancels the query with the correlation id, statements it submitted to the data api are
+// cancelled there as well
+func (running *runningStatements) cancel(correlationId string) bool {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	statement, ok := running.statements[correlationId]
+	if ok {
+		statement.cancel()
+	}
+	return ok
+}
+
+// cancelSession cancels the queries of the session, the number of queries cancelled is returned
+func (running *runningStatements) cancelSession(sessionId string) int {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	cancelled := 0
+	for _, statement := range running.statements {
+		if statement.SessionId == sessionId {
+			statement.cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+func (running *runningStatements) count() int {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	return len(running.statements)
+}
+
+// drain refuses new queries and waits for the running ones to finish, the ones still running when
+// the context is done are cancelled
+func (running *runningStatements) drain(ctx context.Context) (DrainSummary, error) {
+	running.mutex.Lock()
+	running.draining = true
+	running.mutex.Unlock()
+	err := running.waitUntilIdle(ctx)
+	if err != nil {
+		running.cancelAll()
+		graceCtx, cancel := context.WithTimeout(context.Background(), drainCancelGracePeriod)
+		defer cancel()
+		_ = running.waitUntilIdle(graceCtx)
+	}
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	return running.summary, err
+}
+
+func (running *runningStatements) waitUntilIdle(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for running.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (running *runningStatements) cancelAll() {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	for _, statement := range running.statements {
+		if !statement.cancelled {
+			statement.cancelled = true
+			running.summary.Cancelled++
+			statement.cancel()
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package rdapp
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionIdParameter hands the id of a connection from the listener to its session, which makes the
+// session reachable for terminating the connection. The session itself is held by the context of the
+// connection, see sessionRegistry.open.
+const sessionIdParameter wire.ParameterStatus = "rdapp.session_id"
+
+// backendPidParameter and clientAddressParameter hand the pseudo backend pid and the address of the
+// client from the listener to the session in the same way
+const (
+	backendPidParameter    wire.ParameterStatus = "rdapp.backend_pid"
+	clientAddressParameter wire.ParameterStatus = "rdapp.client_address"
+)
+
+// localSessionParameters are answered and applied by rdapp itself as they either
+// have no meaning for redshift or are not supported by it
+var localSessionParameters = map[string]string{
+	"application_name":                    "",
+	"client_encoding":                     "UTF8",
+	"client_min_messages":                 "notice",
+	"datestyle":                           "ISO, MDY",
+	"default_transaction_isolation":       "serializable",
+	"default_transaction_read_only":       "off",
+	"extra_float_digits":                  "1",
+	"idle_in_transaction_session_timeout": "0",
+	"integer_datetimes":                   "on",
+	"intervalstyle":                       "postgres",
+	"lock_timeout":                        "0",
+	"server_encoding":                     "UTF8",
+	"standard_conforming_strings":         "on",
+	"transaction_isolation":               "serializable",
+	"transaction_read_only":               "off",
+}
+
+// forwardedSessionParameters are meaningful to redshift, since every data api statement runs in
+// its own session they are replayed in front of every subsequent statement of the connection
+var forwardedSessionParameters = map[string]bool{
+	"enable_case_sensitive_identifier": true,
+	"enable_result_cache_for_session":  true,
+	"query_group":                      true,
+	"search_path":                      true,
+	"statement_timeout":                true,
+	"timezone":                         true,
+	"wlm_query_slot_count":             true,
+}
+
+// Session holds the state of a single client connection
+type Session struct {
+	id string
+	// user is the user name the client connected with
+	user       string
+	parameters map[string]string
+	// forwardedStatements holds the set statements to be replayed keyed by parameter name
+	forwardedStatements map[string]string
+	preparedStatements  map[string]preparedStatement
+	// pid is the pseudo backend pid of the connection reported to clients, 0 when unknown
+	pid           int32
+	database      string
+	clientAddress string
+	startedAt     time.Time
+	// the activity reported by pg_stat_activity, guarded by the mutex of the session registry
+	applicationName string
+	query           string
+	queryStart      time.Time
+	stateChange     time.Time
+	active          bool
+}
+
+func newSession(id string, clientParameters wire.Parameters) *Session {
+	session := &Session{
+		id:                  id,
+		user:                clientParameters[wire.ParamUsername],
+		parameters:          map[string]string{},
+		forwardedStatements: map[string]string{},
+		preparedStatements:  map[string]preparedStatement{},
+		database:            clientParameters[wire.ParamDatabase],
+		clientAddress:       clientParameters[clientAddressParameter],
+		startedAt:           time.Now(),
+	}
+	if pid, err := strconv.ParseInt(clientParameters[backendPidParameter], 10, 32); err == nil {
+		session.pid = int32(pid)
+	}
+	session.applicationName, _ = session.Parameter("application_name")
+	session.stateChange = session.startedAt
+	for name, value := range clientParameters {
+		name := strings.ToLower(string(name))
+		if _, ok := localSessionParameters[name]; ok {
+			session.parameters[name] = value
+		}
+	}
+	return session
+}
+
+// Parameter returns the value of a locally handled parameter
+func (session *Session) Parameter(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if value, ok := session.parameters[name]; ok {
+		return value, true
+	}
+	value, ok := localSessionParameters[name]
+	return value, ok
+}
+
+func (session *Session) setParameter(name string, value string) {
+	session.parameters[strings.ToLower(name)] = value
+}
+
+func (session *Session) resetParameter(name string) {
+	name = strings.ToLower(name)
+	delete(session.parameters, name)
+	delete(session.forwardedStatements, name)
+}
+
+func (session *Session) resetAll() {
+	session.parameters = map[string]string{}
+	session.forwardedStatements = map[string]string{}
+}
+
+func (session *Session) forward(name string, statement string) {
+	session.forwardedStatements[strings.ToLower(name)] = statement
+}
+
+// forwardedPrefix returns the set statements which have to precede a statement sent to redshift
+func (session *Session) forwardedPrefix() []string {
+	var names []string
+	for name := range session.forwardedStatements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var statements []string
+	for _, name := range names {
+		statements = append(statements, session.forwardedStatements[name])
+	}
+	return statements
+}
+
+// searchPath returns the lower cased schemas of the search_path set by the client, nil when it was not set
+func (session *Session) searchPath() []string {
+	command, ok := parseSessionCommand(session.forwardedStatements["search_path"])
+	if !ok || command.kind != sessionCommandSet {
+		return nil
+	}
+	var schemas []string
+	for _, schema := range strings.Split(command.value, ",") {
+		schema = unquoteSqlIdentifier(unquoteSqlString(strings.TrimSpace(schema)))
+		if schema != "" {
+			schemas = append(schemas, strings.ToLower(schema))
+		}
+	}
+	return schemas
+}
+
+// withForwardedParameters prefixes the query with the forwarded session parameters, the text the
+// query runs as in redshift
+func (session *Session) withForwardedParameters(query string) string {
+	prefix := session.forwardedPrefix()
+	if len(prefix) == 0 {
+		return query
+	}
+	return fmt.Sprintf("%s; %s", strings.Join(prefix, "; "), query)
+}
+
+type sessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: map[string]*Session{},
+	}
+}
+
+// sessionContextKey holds the session in the context psql-wire hands to every query of a connection
+type sessionContextKey struct{}
+
+// open creates the session of a newly authenticated connection and ties it to the context of the connection
+func (registry *sessionRegistry) open(ctx context.Context) (context.Context, *Session) {
+	clientParameters := wire.ClientParameters(ctx)
+	id, ok := clientParameters[sessionIdParameter]
+	if !ok {
+		id = uuid.NewString()
+	}
+	session := newSession(id, clientParameters)
+	registry.mutex.Lock()
+	registry.sessions[id] = session
+	registry.mutex.Unlock()
+	return context.WithValue(ctx, sessionContextKey{}, session), session
+}
+
+// sessionFor returns the session of the connection the context belongs to, a context outside of a
+// connection gets a session of its own
+func (registry *sessionRegistry) sessionFor(ctx context.Context) *Session {
+	if session, ok := ctx.Value(sessionContextKey{}).(*Session); ok {
+		return session
+	}
+	return newSession(uuid.NewString(), wire.ClientParameters(ctx))
+}
+
+// queryStarted notes the query the session is running for pg_stat_activity
+func (registry *sessionRegistry) queryStarted(session *Session, query string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	session.applicationName, _ = session.Parameter("application_name")
+	session.query = query
+	session.queryStart = time.Now()
+	session.stateChange = session.queryStart
+	session.active = true
+}
+
+func (registry *sessionRegistry) queryFinished(session *Session) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	session.applicationName, _ = session.Parameter("application_name")
+	session.stateChange = time.Now()
+	session.active = false
+}
+
+// byPid returns the session with the pseudo backend pid
+func (registry *sessionRegistry) byPid(pid int32) (*Session, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, session := range registry.sessions {
+		if session.pid == pid {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// activity returns a snapshot of the sessions ordered by pid
+func (registry *sessionRegistry) activity() []Session {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	sessions := make([]Session, 0, len(registry.sessions))
+	for _, session := range registry.sessions {
+		sessions = append(sessions, Session{
+			id:              session.id,
+			user:            session.user,
+			pid:             session.pid,
+			database:        session.database,
+			clientAddress:   session.clientAddress,
+			startedAt:       session.startedAt,
+			applicationName: session.applicationName,
+			query:           session.query,
+			queryStart:      session.queryStart,
+			stateChange:     session.stateChange,
+			active:          session.active,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].pid < sessions[j].pid
+	})
+	return sessions
+}
+
+// close forgets the session of the connection the context belongs to and returns it,
+// nil is returned when the context belongs to no connection
+func (registry *sessionRegistry) close(ctx context.Context) *Session {
+	session, ok := ctx.Value(sessionContextKey{}).(*Session)
+	if !ok {
+		return nil
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.sessions, session.id)
+	return session
+}
@@ -0,0 +1,218 @@
+package rdapp
+
+import (
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+)
+
+type sessionCommandKind int
+
+const (
+	sessionCommandSet sessionCommandKind = iota
+	sessionCommandShow
+	sessionCommandReset
+)
+
+// sessionCommand is a parsed SET, SHOW or RESET statement
+type sessionCommand struct {
+	kind      sessionCommandKind
+	parameter string
+	value     string
+	// all denotes SHOW ALL and RESET ALL
+	all bool
+	// transaction denotes SET TRANSACTION and SET SESSION CHARACTERISTICS which only alter transaction modes
+	transaction bool
+}
+
+// parseSessionCommand parses SET, SHOW and RESET statements, ok is false for any other statement
+func parseSessionCommand(statement string) (command sessionCommand, ok bool) {
+	tokens := lexSql(statement)
+	if len(tokens) < 2 {
+		return sessionCommand{}, false
+	}
+	switch {
+	case tokens[0].isWord("set"):
+		return parseSetCommand(statement, tokens[1:])
+	case tokens[0].isWord("show"):
+		name, rest := parseParameterName(tokens[1:])
+		if name == "" || len(rest) > 0 {
+			return sessionCommand{}, false
+		}
+		return sessionCommand{kind: sessionCommandShow, parameter: name, all: name == "all"}, true
+	case tokens[0].isWord("reset"):
+		name, rest := parseParameterName(tokens[1:])
+		if name == "" || len(rest) > 0 {
+			return sessionCommand{}, false
+		}
+		return sessionCommand{kind: sessionCommandReset, parameter: name, all: name == "all"}, true
+	}
+	return sessionCommand{}, false
+}
+
+func parseSetCommand(statement string, tokens []sqlToken) (sessionCommand, bool) {
+	if len(tokens) > 0 && (tokens[0].isWord("session") || tokens[0].isWord("local")) {
+		if len(tokens) > 1 && tokens[0].isWord("session") && tokens[1].isWord("characteristics") {
+			return sessionCommand{kind: sessionCommandSet, transaction: true}, true
+		}
+		if len(tokens) > 1 && tokens[0].isWord("session") && tokens[1].isWord("authorization") {
+			return sessionCommand{}, false
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && tokens[0].isWord("transaction") {
+		return sessionCommand{kind: sessionCommandSet, transaction: true}, true
+	}
+	name, rest := parseParameterName(tokens)
+	if name == "" {
+		return sessionCommand{}, false
+	}
+	switch {
+	case len(rest) > 0 && (rest[0].isWord("to") || rest[0].text == "="):
+		rest = rest[1:]
+	case name != "timezone":
+		// only SET TIME ZONE may omit the TO keyword
+		return sessionCommand{}, false
+	}
+	if len(rest) == 0 {
+		return sessionCommand{}, false
+	}
+	command := sessionCommand{kind: sessionCommandSet, parameter: name}
+	if len(rest) == 1 && rest[0].isWord("default") {
+		command.kind = sessionCommandReset
+		return command, true
+	}
+	command.value = strings.TrimSpace(statement[rest[0].start:rest[len(rest)-1].end])
+	if len(rest) == 1 && rest[0].kind == sqlTokenString {
+		command.value = unquoteSqlString(rest[0].text)
+	}
+	return command, true
+}
+
+// parseParameterName reads a possibly qualified parameter name, the sql standard
+// spellings TIME ZONE and TRANSACTION ISOLATION LEVEL are mapped to their parameter names
+func parseParameterName(tokens []sqlToken) (string, []sqlToken) {
+	switch {
+	case len(tokens) >= 2 && tokens[0].isWord("time") && tokens[1].isWord("zone"):
+		return "timezone", tokens[2:]
+	case len(tokens) >= 3 && tokens[0].isWord("transaction") && tokens[1].isWord("isolation") && tokens[2].isWord("level"):
+		return "transaction_isolation", tokens[3:]
+	case len(tokens) == 0 || (tokens[0].kind != sqlTokenWord && tokens[0].kind != sqlTokenQuotedIdentifier):
+		return "", tokens
+	}
+	name := unquoteSqlIdentifier(tokens[0].text)
+	tokens = tokens[1:]
+	for len(tokens) >= 2 && tokens[0].text == "." {
+		name += "." + unquoteSqlIdentifier(tokens[1].text)
+		tokens = tokens[2:]
+	}
+	return strings.ToLower(name), tokens
+}
+
+// unquoteSqlString removes the quotes of a string literal
+func unquoteSqlString(literal string) string {
+	if strings.HasPrefix(literal, "E'") || strings.HasPrefix(literal, "e'") {
+		literal = literal[1:]
+	}
+	if len(literal) >= 2 && literal[0] == '\'' && literal[len(literal)-1] == '\'' {
+		return strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+	}
+	return literal
+}
+
+// unquoteSqlIdentifier removes the quotes of a quoted identifier
+func unquoteSqlIdentifier(identifier string) string {
+	if len(identifier) >= 2 && identifier[0] == '"' && identifier[len(identifier)-1] == '"' {
+		return strings.ReplaceAll(identifier[1:len(identifier)-1], `""`, `"`)
+	}
+	return identifier
+}
+
+// handleSessionCommand answers SET, SHOW and RESET statements from the session state where possible.
+// handled is false when the statement has to be sent to redshift as is.
+func (handler *redshiftDataApiQueryHandler) handleSessionCommand(rdappCtx RdappContext, statement string, command sessionCommand, writer wire.DataWriter) (handled bool, err error) {
+	session := rdappCtx.session
+	_, isLocal := localSessionParameters[command.parameter]
+	isForwarded := forwardedSessionParameters[command.parameter]
+	switch command.kind {
+	case sessionCommandSet:
+		switch {
+		case command.transaction:
+			// redshift only supports serializable isolation, transaction modes are accepted and ignored
+		case isLocal:
+			session.setParameter(command.parameter, command.value)
+		case isForwarded:
+			// validate the setting against redshift right away so that a bad value
+			// does not surface as a failure of every following statement
+			redshiftQuery := handler.pgRedshiftTranslator.TranslateToRedshiftQuery(statement, nil)
+			_, err := handler.redshiftDataAPIService.ExecuteQuery(rdappCtx, redshiftQuery, nil)
+			if err != nil {
+				return true, err
+			}
+			session.forward(command.parameter, redshiftQuery)
+		default:
+			return false, nil
+		}
+		rdappCtx.logger.Info("applied session parameter",
+			zap.String("parameter", command.parameter),
+			zap.String("value", command.value))
+		return true, writer.Complete("SET")
+	case sessionCommandReset:
+		switch {
+		case command.all:
+			session.resetAll()
+		case isLocal || isForwarded:
+			session.resetParameter(command.parameter)
+		default:
+			return false, nil
+		}
+		return true, writer.Complete("RESET")
+	case sessionCommandShow:
+		if command.all {
+			return true, handler.writeAllSessionParameters(rdappCtx, writer)
+		}
+		if !isLocal {
+			return false, nil
+		}
+		value, _ := session.Parameter(command.parameter)
+		err := writer.Define(wire.Columns{
+			{Name: command.parameter, Oid: oid.T_text, Format: rdappCtx.resultFormat(0)},
+		})
+		if err != nil {
+			return true, err
+		}
+		err = writer.Row([]any{value})
+		if err != nil {
+			return true, err
+		}
+		return true, writer.Complete("SHOW")
+	}
+	return false, nil
+}
+
+func (handler *redshiftDataApiQueryHandler) writeAllSessionParameters(rdappCtx RdappContext, writer wire.DataWriter) error {
+	session := rdappCtx.session
+	var names []string
+	for name := range localSessionParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	err := writer.Define(wire.Columns{
+		{Name: "name", Oid: oid.T_text, Format: rdappCtx.resultFormat(0)},
+		{Name: "setting", Oid: oid.T_text, Format: rdappCtx.resultFormat(1)},
+		{Name: "description", Oid: oid.T_text, Format: rdappCtx.resultFormat(2)},
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, _ := session.Parameter(name)
+		err = writer.Row([]any{name, value, "emulated by rdapp"})
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Complete("SHOW")
+}
@@ -0,0 +1,121 @@
+package rdapp
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_parseSessionCommand(t *testing.T) {
+	type args struct {
+		statement string
+	}
+	tests := []struct {
+		name   string
+		args   args
+		want   sessionCommand
+		wantOk bool
+	}{
+		{
+			name:   "set with equals",
+			args:   args{statement: "SET extra_float_digits = 3"},
+			want:   sessionCommand{kind: sessionCommandSet, parameter: "extra_float_digits", value: "3"},
+			wantOk: true,
+		},
+		{
+			name:   "set session with to and string literal",
+			args:   args{statement: "set session application_name to 'PostgreSQL JDBC Driver'"},
+			want:   sessionCommand{kind: sessionCommandSet, parameter: "application_name", value: "PostgreSQL JDBC Driver"},
+			wantOk: true,
+		},
+		{
+			name:   "set with list value",
+			args:   args{statement: "set search_path to public, \"Sales\""},
+			want:   sessionCommand{kind: sessionCommandSet, parameter: "search_path", value: "public, \"Sales\""},
+			wantOk: true,
+		},
+		{
+			name:   "set time zone",
+			args:   args{statement: "SET TIME ZONE 'UTC'"},
+			want:   sessionCommand{kind: sessionCommandSet, parameter: "timezone", value: "UTC"},
+			wantOk: true,
+		},
+		{
+			name:   "set to default resets",
+			args:   args{statement: "set DateStyle to default"},
+			want:   sessionCommand{kind: sessionCommandReset, parameter: "datestyle"},
+			wantOk: true,
+		},
+		{
+			name:   "set session characteristics",
+			args:   args{statement: "SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL READ COMMITTED"},
+			want:   sessionCommand{kind: sessionCommandSet, transaction: true},
+			wantOk: true,
+		},
+		{
+			name:   "show transaction isolation level",
+			args:   args{statement: "SHOW TRANSACTION ISOLATION LEVEL"},
+			want:   sessionCommand{kind: sessionCommandShow, parameter: "transaction_isolation"},
+			wantOk: true,
+		},
+		{
+			name:   "reset all",
+			args:   args{statement: "reset all"},
+			want:   sessionCommand{kind: sessionCommandReset, parameter: "all", all: true},
+			wantOk: true,
+		},
+		{
+			name:   "not a session command",
+			args:   args{statement: "select 'set a = 1'"},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseSessionCommand(tt.args.statement)
+			require.Equal(t, tt.wantOk, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_Session_withForwardedParameters(t *testing.T) {
+	session := newSession("id", nil)
+	session.forward("search_path", "set search_path to sales")
+	session.forward("query_group", "set query_group to 'etl'")
+	got := session.withForwardedParameters("select 1")
+	require.Equal(t, "set query_group to 'etl'; set search_path to sales; select 1", got)
+	session.resetParameter("query_group")
+	got = session.withForwardedParameters("select 1")
+	require.Equal(t, "set search_path to sales; select 1", got)
+	require.Equal(t, []string{"sales"}, session.searchPath())
+	session.forward("search_path", `set search_path to '$user', "PII"`)
+	require.Equal(t, []string{"$user", "pii"}, session.searchPath())
+}
+
+func Test_sessionRegistry(t *testing.T) {
+	registry := newSessionRegistry()
+	ctx, session := registry.open(context.Background())
+	require.Same(t, session, registry.sessionFor(ctx), "queries of the connection share its session")
+	require.NotSame(t, session, registry.sessionFor(context.Background()))
+	require.Same(t, session, registry.close(ctx))
+	require.Empty(t, registry.activity())
+	require.Nil(t, registry.close(context.Background()))
+}
+
+func Test_inlineNamedParameters(t *testing.T) {
+	got, err := inlineNamedParameters("select :1::int4, from_hex(:2), '::1' where a = :3", []types.SqlParameter{
+		{Name: aws.String("1"), Value: aws.String("5")},
+		{Name: aws.String("2"), Value: aws.String("0aff")},
+		{Name: aws.String("3"), Value: aws.String(`it's \`)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, `select '5'::int4, from_hex('0aff'), '::1' where a = 'it''s \\'`, got)
+	_, err = inlineNamedParameters("select :1, :2", []types.SqlParameter{{Name: aws.String("1"), Value: aws.String("5")}})
+	require.ErrorContains(t, err, `parameter "2" is not given`)
+	got, err = inlineNamedParameters("select :1, :2", []types.SqlParameter{{Name: aws.String("1")}, {Name: aws.String("2"), Value: aws.String("")}})
+	require.NoError(t, err)
+	require.Equal(t, "select NULL, ''", got, "parameters without a value are null")
+}
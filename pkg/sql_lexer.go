@@ -0,0 +1,220 @@
+package rdapp
+
+import (
+	"strings"
+)
+
+type sqlTokenKind int
+
+const (
+	// sqlTokenWord is a keyword or an unquoted identifier
+	sqlTokenWord sqlTokenKind = iota
+	sqlTokenQuotedIdentifier
+	sqlTokenString
+	sqlTokenNumber
+	// sqlTokenPlaceholder is a positional parameter either in $n or ? style
+	sqlTokenPlaceholder
+	sqlTokenOperator
+	sqlTokenSemicolon
+)
+
+type sqlToken struct {
+	kind  sqlTokenKind
+	text  string
+	start int
+	end   int
+}
+
+// isWord reports if the token is the given keyword, the comparison is case-insensitive
+func (token sqlToken) isWord(keyword string) bool {
+	return token.kind == sqlTokenWord && strings.EqualFold(token.text, keyword)
+}
+
+// lowerText returns the token text lower cased, used to compare keywords
+func (token sqlToken) lowerText() string {
+	return strings.ToLower(token.text)
+}
+
+// lexSql breaks the given sql into tokens. Whitespace and comments are skipped
+// while quoted identifiers, string literals (including dollar quoted ones) are
+// kept intact so that semicolons or placeholders within them are not mistaken
+// for statement terminators or parameters.
+func lexSql(sql string) []sqlToken {
+	var tokens []sqlToken
+	for position := 0; position < len(sql); {
+		char := sql[position]
+		start := position
+		switch {
+		case isSqlSpace(char):
+			position++
+			continue
+		case char == '-' && strings.HasPrefix(sql[position:], "--"):
+			position = skipLineComment(sql, position)
+			continue
+		case char == '/' && strings.HasPrefix(sql[position:], "/*"):
+			position = skipBlockComment(sql, position)
+			continue
+		case char == '\'':
+			position = skipQuoted(sql, position, '\'', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenString, text: sql[start:position], start: start, end: position})
+		case (char == 'e' || char == 'E') && position+1 < len(sql) && sql[position+1] == '\'':
+			position = skipQuoted(sql, position+1, '\'', true)
+			tokens = append(tokens, sqlToken{kind: sqlTokenString, text: sql[start:position], start: start, end: position})
+		case char == '"':
+			position = skipQuoted(sql, position, '"', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenQuotedIdentifier, text: sql[start:position], start: start, end: position})
+		case char == '$':
+			if tag, ok := dollarQuoteTag(sql, position); ok {
+				closing := strings.Index(sql[position+len(tag):], tag)
+				if closing < 0 {
+					position = len(sql)
+				} else {
+					position += len(tag) + closing + len(tag)
+				}
+				tokens = append(tokens, sqlToken{kind: sqlTokenString, text: sql[start:position], start: start, end: position})
+				continue
+			}
+			position++
+			for position < len(sql) && isSqlDigit(sql[position]) {
+				position++
+			}
+			kind := sqlTokenPlaceholder
+			if position == start+1 {
+				kind = sqlTokenOperator
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: sql[start:position], start: start, end: position})
+		case char == '?':
+			position++
+			tokens = append(tokens, sqlToken{kind: sqlTokenPlaceholder, text: sql[start:position], start: start, end: position})
+		case char == ';':
+			position++
+			tokens = append(tokens, sqlToken{kind: sqlTokenSemicolon, text: sql[start:position], start: start, end: position})
+		case isSqlDigit(char) || (char == '.' && position+1 < len(sql) && isSqlDigit(sql[position+1])):
+			position++
+			for position < len(sql) && (isSqlDigit(sql[position]) || sql[position] == '.' || sql[position] == 'e' || sql[position] == 'E') {
+				position++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenNumber, text: sql[start:position], start: start, end: position})
+		case isSqlIdentifierStart(char):
+			position++
+			for position < len(sql) && isSqlIdentifierPart(sql[position]) {
+				position++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenWord, text: sql[start:position], start: start, end: position})
+		case char == ':' && strings.HasPrefix(sql[position:], "::"):
+			position += 2
+			tokens = append(tokens, sqlToken{kind: sqlTokenOperator, text: sql[start:position], start: start, end: position})
+		default:
+			position++
+			tokens = append(tokens, sqlToken{kind: sqlTokenOperator, text: sql[start:position], start: start, end: position})
+		}
+	}
+	return tokens
+}
+
+// SplitStatements splits a sql script into its individual statements. Statement
+// terminators within string literals, quoted identifiers and comments are ignored.
+// Segments which contain nothing but whitespace or comments are dropped.
+func SplitStatements(sql string) []string {
+	var statements []string
+	statementStart := 0
+	hasTokens := false
+	appendStatement := func(end int) {
+		if hasTokens {
+			statements = append(statements, strings.TrimSpace(sql[statementStart:end]))
+		}
+	}
+	for _, token := range lexSql(sql) {
+		if token.kind == sqlTokenSemicolon {
+			appendStatement(token.start)
+			statementStart = token.end
+			hasTokens = false
+			continue
+		}
+		hasTokens = true
+	}
+	appendStatement(len(sql))
+	return statements
+}
+
+func skipLineComment(sql string, position int) int {
+	end := strings.IndexByte(sql[position:], '\n')
+	if end < 0 {
+		return len(sql)
+	}
+	return position + end + 1
+}
+
+// skipBlockComment skips a block comment, block comments nest in postgres
+func skipBlockComment(sql string, position int) int {
+	depth := 0
+	for position < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[position:], "/*"):
+			depth++
+			position += 2
+		case strings.HasPrefix(sql[position:], "*/"):
+			depth--
+			position += 2
+			if depth == 0 {
+				return position
+			}
+		default:
+			position++
+		}
+	}
+	return position
+}
+
+// skipQuoted skips a quoted section starting at position, doubled quotes are
+// treated as escaped quotes and backslash escapes are honoured when requested
+func skipQuoted(sql string, position int, quote byte, backslashEscapes bool) int {
+	position++
+	for position < len(sql) {
+		switch {
+		case backslashEscapes && sql[position] == '\\':
+			position += 2
+		case sql[position] == quote && position+1 < len(sql) && sql[position+1] == quote:
+			position += 2
+		case sql[position] == quote:
+			return position + 1
+		default:
+			position++
+		}
+	}
+	return len(sql)
+}
+
+// dollarQuoteTag returns the opening tag of a dollar quoted string like $$ or $body$
+func dollarQuoteTag(sql string, position int) (string, bool) {
+	end := position + 1
+	if end < len(sql) && isSqlDigit(sql[end]) {
+		return "", false
+	}
+	for end < len(sql) && sql[end] != '$' {
+		if !isSqlIdentifierPart(sql[end]) {
+			return "", false
+		}
+		end++
+	}
+	if end >= len(sql) {
+		return "", false
+	}
+	return sql[position : end+1], true
+}
+
+func isSqlSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '\f'
+}
+
+func isSqlDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isSqlIdentifierStart(char byte) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char >= 0x80
+}
+
+func isSqlIdentifierPart(char byte) bool {
+	return isSqlIdentifierStart(char) || isSqlDigit(char) || char == '$'
+}
@@ -0,0 +1,64 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_SplitStatements(t *testing.T) {
+	type args struct {
+		sql string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{
+			name: "single statement without terminator",
+			args: args{sql: "select 1"},
+			want: []string{"select 1"},
+		},
+		{
+			name: "multiple statements",
+			args: args{sql: "set search_path to x; select * from person;"},
+			want: []string{"set search_path to x", "select * from person"},
+		},
+		{
+			name: "semicolon within string literal and quoted identifier",
+			args: args{sql: `select 'a;b', "c;d" from person; select 2`},
+			want: []string{`select 'a;b', "c;d" from person`, "select 2"},
+		},
+		{
+			name: "escaped quotes within string literal",
+			args: args{sql: `select 'it''s;', E'\';' ; select 2`},
+			want: []string{`select 'it''s;', E'\';'`, "select 2"},
+		},
+		{
+			name: "semicolon within comments",
+			args: args{sql: "select 1 -- first; second\n; /* a; /* nested; */ b; */ select 2"},
+			want: []string{"select 1 -- first; second", "/* a; /* nested; */ b; */ select 2"},
+		},
+		{
+			name: "dollar quoted strings",
+			args: args{sql: "select $$a;b$$, $tag$c;d$tag$; select $1"},
+			want: []string{"select $$a;b$$, $tag$c;d$tag$", "select $1"},
+		},
+		{
+			name: "empty statements and comment only segments are dropped",
+			args: args{sql: " ; -- nothing here\n; select 1;;"},
+			want: []string{"select 1"},
+		},
+		{
+			name: "empty query",
+			args: args{sql: "   "},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitStatements(tt.args.sql)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
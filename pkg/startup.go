@@ -0,0 +1,136 @@
+package rdapp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// the codes of the untyped packets a client opens a connection with
+const (
+	protocolVersion3  = 196608
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// maxStartupPacketLength guards against reading garbage as a startup packet, postgres uses the same limit
+const maxStartupPacketLength = 10000
+
+// startupTimeout bounds the negotiation of a connection like authentication_timeout of postgres, clients
+// which open connections without sending anything would hold them forever otherwise
+const startupTimeout = time.Minute
+
+// startupParameters are the client parameters of the startup packet relevant to rdapp
+type startupParameters struct {
+	user            string
+	database        string
+	applicationName string
+}
+
+// negotiateStartup answers the encryption requests of a new connection in place of psql-wire and adds
+// the session id, pseudo backend pid and client address of the connection to the client parameters of
+// its startup packet. psql-wire hands the client parameters to every query, which ties the connection to
+// its session. The startup packet is kept to be read by psql-wire.
+func (conn *trackedConn) negotiateStartup(tlsConfig *tls.Config) error {
+	err := conn.raw.SetDeadline(time.Now().Add(startupTimeout))
+	if err != nil {
+		return err
+	}
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(conn.Conn, header)
+		if err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint32(header))
+		if length < len(header) || length > maxStartupPacketLength {
+			return fmt.Errorf("invalid startup packet length %d", length)
+		}
+		body := make([]byte, length-len(header))
+		_, err = io.ReadFull(conn.Conn, body)
+		if err != nil {
+			return err
+		}
+		switch binary.BigEndian.Uint32(header[4:]) {
+		case sslRequestCode:
+			if tlsConfig == nil || conn.encrypted {
+				_, err = conn.Conn.Write([]byte{'N'})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			_, err = conn.Conn.Write([]byte{'S'})
+			if err != nil {
+				return err
+			}
+			tlsConn := tls.Server(conn.Conn, tlsConfig)
+			err = tlsConn.Handshake()
+			if err != nil {
+				return fmt.Errorf("error while performing tls handshake: %w", err)
+			}
+			conn.Conn = tlsConn
+			conn.proxy.connections.mutex.Lock()
+			conn.encrypted = true
+			conn.proxy.connections.mutex.Unlock()
+		case gssEncRequestCode:
+			_, err = conn.Conn.Write([]byte{'N'})
+			if err != nil {
+				return err
+			}
+		case protocolVersion3:
+			parameters, packet := withConnectionParameters(body, []string{
+				string(sessionIdParameter), conn.id,
+				string(backendPidParameter), strconv.Itoa(int(conn.pid)),
+				string(clientAddressParameter), conn.raw.RemoteAddr().String(),
+			})
+			conn.proxy.connections.mutex.Lock()
+			conn.parameters = parameters
+			conn.extended = newExtendedProtocol()
+			conn.proxy.connections.mutex.Unlock()
+			conn.pending = packet
+			return conn.raw.SetDeadline(time.Time{})
+		default:
+			// cancel requests and unsupported protocol versions are left to psql-wire
+			conn.pending = append(header, body...)
+			return conn.raw.SetDeadline(time.Time{})
+		}
+	}
+}
+
+// withConnectionParameters returns the startup packet of the client parameters with the given parameter
+// name value pairs added, rdapp parameters the client may have sent are dropped
+func withConnectionParameters(body []byte, connectionParameters []string) (startupParameters, []byte) {
+	var parameters startupParameters
+	packet := make([]byte, 8, 8+len(body)+64)
+	binary.BigEndian.PutUint32(packet[4:], protocolVersion3)
+	for {
+		key, rest, ok := bytes.Cut(body, []byte{0})
+		if !ok || len(key) == 0 {
+			break
+		}
+		value, rest, _ := bytes.Cut(rest, []byte{0})
+		body = rest
+		switch {
+		case bytes.HasPrefix(key, []byte("rdapp.")):
+			continue
+		case string(key) == "user":
+			parameters.user = string(value)
+		case string(key) == "database":
+			parameters.database = string(value)
+		case string(key) == "application_name":
+			parameters.applicationName = string(value)
+		}
+		packet = append(append(append(append(packet, key...), 0), value...), 0)
+	}
+	for i := 0; i+1 < len(connectionParameters); i += 2 {
+		packet = append(append(append(append(packet, connectionParameters[i]...), 0), connectionParameters[i+1]...), 0)
+	}
+	packet = append(packet, 0)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)))
+	return parameters, packet
+}
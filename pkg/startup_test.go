@@ -0,0 +1,105 @@
+package rdapp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_withConnectionParameters(t *testing.T) {
+	body := []byte("user\x00analyst\x00database\x00dev\x00rdapp.session_id\x00forged\x00\x00")
+	parameters, packet := withConnectionParameters(body, []string{"rdapp.session_id", "session"})
+	require.Equal(t, startupParameters{user: "analyst", database: "dev"}, parameters)
+	require.Equal(t, uint32(len(packet)), binary.BigEndian.Uint32(packet))
+	require.Equal(t, uint32(protocolVersion3), binary.BigEndian.Uint32(packet[4:]))
+	require.Equal(t, "user\x00analyst\x00database\x00dev\x00rdapp.session_id\x00session\x00\x00", string(packet[8:]))
+}
+
+func Test_trackedConn_negotiateStartup(t *testing.T) {
+	tests := []struct {
+		name      string
+		tlsConfig *tls.Config
+		ssl       bool
+		encrypted bool
+	}{
+		{name: "plain startup"},
+		{name: "ssl declined without tls config", ssl: true},
+		{name: "ssl accepted with tls config", tlsConfig: serverTlsConfig(t), ssl: true, encrypted: true},
+		{name: "plain startup with tls config", tlsConfig: serverTlsConfig(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			proxy := newPostgresRedshiftProxy(nil, nil, proxyOptions{listenAddress: DefaultListenAddress, tlsConfig: tt.tlsConfig, metrics: NewMetrics(), logger: zap.NewNop()}, newClientConnections(NewBackendPids()))
+			conn := &trackedConn{Conn: server, raw: server, proxy: proxy, id: "session", pid: 10001}
+			read := make(chan []byte)
+			go func() {
+				packet := make([]byte, 256)
+				n, _ := io.ReadAtLeast(conn, packet, 8)
+				read <- packet[:n]
+			}()
+
+			var clientConn net.Conn = client
+			if tt.ssl {
+				_, err := client.Write(startupPacket(sslRequestCode, nil))
+				require.NoError(t, err)
+				answer := make([]byte, 1)
+				_, err = io.ReadFull(client, answer)
+				require.NoError(t, err)
+				if tt.encrypted {
+					require.Equal(t, "S", string(answer))
+					tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+					require.NoError(t, tlsClient.Handshake())
+					clientConn = tlsClient
+				} else {
+					require.Equal(t, "N", string(answer))
+				}
+			}
+			_, err := clientConn.Write(startupPacket(protocolVersion3, []byte("user\x00analyst\x00\x00")))
+			require.NoError(t, err)
+
+			select {
+			case packet := <-read:
+				require.Equal(t, "user\x00analyst\x00rdapp.session_id\x00session\x00rdapp.backend_pid\x0010001\x00rdapp.client_address\x00pipe\x00\x00", string(packet[8:]))
+			case <-time.After(5 * time.Second):
+				t.Fatal("startup packet was not read")
+			}
+			require.Equal(t, tt.encrypted, conn.encrypted)
+			require.Equal(t, "analyst", conn.parameters.user)
+		})
+	}
+}
+
+func startupPacket(code uint32, body []byte) []byte {
+	packet := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(packet[4:], code)
+	return append(packet, body...)
+}
+
+func serverTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}},
+	}
+}
@@ -0,0 +1,143 @@
+package rdapp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rowReturningKeywords are leading keywords of statements which may produce a result set
+var rowReturningKeywords = map[string]bool{
+	"select":  true,
+	"with":    true,
+	"values":  true,
+	"table":   true,
+	"show":    true,
+	"explain": true,
+	"fetch":   true,
+}
+
+// objectTagModifiers are words skipped while computing the command tag of ddl statements
+// for example "create or replace view" completes as "CREATE VIEW"
+var objectTagModifiers = map[string]bool{
+	"or":        true,
+	"replace":   true,
+	"temp":      true,
+	"temporary": true,
+	"local":     true,
+	"global":    true,
+	"unique":    true,
+}
+
+// leadingKeyword returns the first keyword of the statement lower cased
+func leadingKeyword(statement string) string {
+	for _, token := range lexSql(statement) {
+		if token.kind == sqlTokenWord {
+			return token.lowerText()
+		}
+		if token.kind != sqlTokenOperator || token.text != "(" {
+			return ""
+		}
+	}
+	return ""
+}
+
+// mayReturnRows reports if the statement could produce a result set
+func mayReturnRows(statement string) bool {
+	return rowReturningKeywords[leadingKeyword(statement)]
+}
+
+// commandTag computes the postgres command completion tag for a statement
+// https://www.postgresql.org/docs/current/protocol-message-formats.html (CommandComplete)
+func commandTag(statement string, hasResultSet bool, resultRows int64) string {
+	if resultRows < 0 {
+		resultRows = 0
+	}
+	var words []string
+	for _, token := range lexSql(statement) {
+		if token.kind == sqlTokenWord {
+			words = append(words, strings.ToUpper(token.text))
+		}
+		if len(words) == 4 {
+			break
+		}
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	switch words[0] {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", resultRows)
+	case "UPDATE", "DELETE", "FETCH", "MOVE", "COPY":
+		return fmt.Sprintf("%s %d", words[0], resultRows)
+	case "CREATE", "DROP", "ALTER":
+		for _, word := range words[1:] {
+			if !objectTagModifiers[strings.ToLower(word)] {
+				return words[0] + " " + word
+			}
+		}
+		return words[0]
+	case "SHOW", "EXPLAIN":
+		return words[0]
+	case "SELECT", "WITH", "VALUES", "TABLE":
+		return fmt.Sprintf("SELECT %d", resultRows)
+	}
+	if hasResultSet {
+		return fmt.Sprintf("SELECT %d", resultRows)
+	}
+	return words[0]
+}
+
+// splitWith splits the tokens following WITH into the bodies of the common table expressions and
+// the main statement. Each expression has the form name [(columns)] AS [[NOT] MATERIALIZED] (body)
+func splitWith(tokens []sqlToken) (bodies [][]sqlToken, main []sqlToken, ok bool) {
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != sqlTokenOperator || tokens[i].text != "(" {
+			continue
+		}
+		closing := closingParenthesis(tokens, i)
+		if closing < 0 {
+			return nil, nil, false
+		}
+		if !followsAs(tokens[:i]) {
+			i = closing
+			continue
+		}
+		bodies = append(bodies, tokens[i+1:closing])
+		if closing+1 < len(tokens) && tokens[closing+1].text == "," {
+			i = closing + 1
+			continue
+		}
+		return bodies, tokens[closing+1:], true
+	}
+	return nil, nil, false
+}
+
+func followsAs(tokens []sqlToken) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i].isWord("not") || tokens[i].isWord("materialized") {
+			continue
+		}
+		return tokens[i].isWord("as")
+	}
+	return false
+}
+
+// closingParenthesis returns the index of the parenthesis closing the one at open, -1 if it is not closed
+func closingParenthesis(tokens []sqlToken, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		if tokens[i].kind != sqlTokenOperator {
+			continue
+		}
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,51 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_commandTag(t *testing.T) {
+	type args struct {
+		statement    string
+		hasResultSet bool
+		resultRows   int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "select",
+			args: args{statement: "select * from person", hasResultSet: true, resultRows: 3},
+			want: "SELECT 3",
+		},
+		{
+			name: "insert",
+			args: args{statement: "insert into person values (1)", resultRows: 1},
+			want: "INSERT 0 1",
+		},
+		{
+			name: "update with comment",
+			args: args{statement: "/* batch */ UPDATE person set age = 1", resultRows: 5},
+			want: "UPDATE 5",
+		},
+		{
+			name: "create or replace view",
+			args: args{statement: "create or replace view v as select 1", resultRows: -1},
+			want: "CREATE VIEW",
+		},
+		{
+			name: "set",
+			args: args{statement: "set search_path to x", resultRows: -1},
+			want: "SET",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := commandTag(tt.args.statement, tt.args.hasResultSet, tt.args.resultRows)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
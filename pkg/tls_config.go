@@ -0,0 +1,18 @@
+package rdapp
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// LoadTLSConfig reads the pem encoded certificate and key clients connecting via tls are served with
+func LoadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading tls certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
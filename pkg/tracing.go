@@ -0,0 +1,67 @@
+package rdapp
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TraceExporterStdout = "stdout"
+	TraceExporterOtlp   = "otlp"
+)
+
+// tracer uses the global tracer provider, spans are dropped unless a provider is installed via otel.SetTracerProvider
+var tracer = otel.Tracer("github.com/kishaningithub/rdapp")
+
+const (
+	correlationIdAttribute       = attribute.Key("rdapp.correlation_id")
+	dataApiQueryIdAttribute      = attribute.Key("rdapp.data_api.query_id")
+	dataApiQueryStatusAttribute  = attribute.Key("rdapp.data_api.query_status")
+	redshiftQueryIdAttribute     = attribute.Key("rdapp.redshift.query_id")
+	rowsAttribute                = attribute.Key("rdapp.rows")
+	resultPageAttribute          = attribute.Key("rdapp.data_api.result_page")
+	pollsAttribute               = attribute.Key("rdapp.data_api.polls")
+	batchStatementCountAttribute = attribute.Key("rdapp.data_api.batch_statements")
+)
+
+// NewTracerProvider constructs a tracer provider exporting spans to stdout or to an otlp/http collector at otlpEndpoint
+func NewTracerProvider(exporterName string, otlpEndpoint string) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch exporterName {
+	case TraceExporterStdout:
+		stdoutExporter, err := stdouttrace.New()
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing stdout trace exporter: %w", err)
+		}
+		exporter = stdoutExporter
+	case TraceExporterOtlp:
+		otlpExporter, err := newOtlpHttpExporter(context.Background(), otlpEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlpExporter
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected %s or %s", exporterName, TraceExporterStdout, TraceExporterOtlp)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("rdapp"))),
+	), nil
+}
+
+// endSpan records the error on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+package rdapp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultUnixSocketMode lets only the user running rdapp connect, the clients use the aws credentials of rdapp
+const DefaultUnixSocketMode os.FileMode = 0700
+
+// unixSocketPath returns the path of the socket. A directory is given like to psql -h, the socket is then
+// named .s.PGSQL.<port> after the port of the listen address like the one of postgres.
+func unixSocketPath(path string, listenAddress string) string {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return path
+	}
+	port := "25432"
+	if _, listenPort, err := net.SplitHostPort(listenAddress); err == nil && listenPort != "" && listenPort != "0" {
+		port = listenPort
+	}
+	return filepath.Join(path, ".s.PGSQL."+port)
+}
+
+// listenUnix listens on the unix socket with the file mode. A socket left over by a process which did not
+// shut down is removed, one which is still served is not. The socket is created in a private directory
+// and moved into place once it has its mode, clients could connect to it with the mode of the umask otherwise.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	err := removeStaleUnixSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	directory, err := os.MkdirTemp(filepath.Dir(path), ".rdapp-")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating private directory for %s: %w", path, err)
+	}
+	defer os.RemoveAll(directory)
+	privatePath := filepath.Join(directory, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: privatePath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("error while listening to %s: %w", path, err)
+	}
+	// the socket is removed at its final path by unixSocketListener
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(privatePath, mode)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("error while changing the mode of %s: %w", path, err)
+	}
+	err = os.Rename(privatePath, path)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("error while moving unix socket to %s: %w", path, err)
+	}
+	return &unixSocketListener{UnixListener: listener, path: path}, nil
+}
+
+// unixSocketListener is a unix socket listener moved to path, the socket is removed on close
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixSocketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: listener.path, Net: "unix"}
+}
+
+func (listener *unixSocketListener) Close() error {
+	err := listener.UnixListener.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(listener.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error while removing unix socket %s: %w", listener.path, err)
+	}
+	return nil
+}
+
+func removeStaleUnixSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while checking %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("error while removing stale unix socket %s: %w", path, err)
+	}
+	return nil
+}
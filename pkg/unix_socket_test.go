@@ -0,0 +1,54 @@
+package rdapp
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_unixSocketPath(t *testing.T) {
+	directory := t.TempDir()
+	require.Equal(t, filepath.Join(directory, ".s.PGSQL.15432"), unixSocketPath(directory, ":15432"))
+	require.Equal(t, filepath.Join(directory, ".s.PGSQL.25432"), unixSocketPath(directory, ""))
+	require.Equal(t, filepath.Join(directory, "rdapp.sock"), unixSocketPath(filepath.Join(directory, "rdapp.sock"), ":15432"))
+}
+
+func Test_listenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".s.PGSQL.25432")
+	listener, err := listenUnix(path, 0600)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.Equal(t, path, listener.Addr().String())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the private directory of the socket is removed")
+
+	_, err = listenUnix(path, 0600)
+	require.ErrorContains(t, err, "in use", "a served socket is not taken over")
+
+	proxy := newPostgresRedshiftProxy(nil, nil, proxyOptions{unixSocketPath: path, unixSocketMode: 0600, metrics: NewMetrics(), logger: zap.NewNop()}, newClientConnections(NewBackendPids()))
+	tracking := &trackingListener{Listener: listener, proxy: proxy}
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := tracking.Accept()
+	require.NoError(t, err)
+	require.Len(t, proxy.Connections(), 1)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, listener.Close())
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	listener, err = listenUnix(path, 0660)
+	require.NoError(t, err, "the socket of a process which is gone is removed")
+	require.NoError(t, listener.Close())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "the socket is removed on close")
+}